@@ -31,11 +31,17 @@ package rpc
 
 import (
 	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
 	"errors"
+	"fmt"
+	"io"
 	"strconv"
+	"strings"
 
 	"github.com/companyzero/zkc/ratchet"
 	"github.com/companyzero/zkc/zkidentity"
+	xdr "github.com/davecgh/go-xdr/xdr2"
 )
 
 type MessageMode uint32
@@ -45,25 +51,41 @@ const (
 	InitialCmdIdentify      = "identify"
 	InitialCmdCreateAccount = "createaccount"
 	InitialCmdSession       = "session"
+	InitialCmdSessionV      = "sessionv"
+	InitialCmdSuccession    = "succession"
+	InitialCmdFederate      = "federate"
 
 	// session phase
 	SessionCmdWelcome   = "welcome"
 	SessionCmdUnwelcome = "unwelcome"
 
 	// tagged server commands
-	TaggedCmdRendezvous          = "rendezvous"
-	TaggedCmdRendezvousReply     = "rendezvousreply"
-	TaggedCmdRendezvousPull      = "rendezvouspull"
-	TaggedCmdRendezvousPullReply = "rendezvouspullreply"
-	TaggedCmdCache               = "cache"
-	TaggedCmdPush                = "push"
-	TaggedCmdAcknowledge         = "ack"
-	TaggedCmdProxy               = "proxy"
-	TaggedCmdProxyReply          = "proxyreply"
-	TaggedCmdPing                = "ping"
-	TaggedCmdPong                = "pong"
-	TaggedCmdIdentityFind        = "identityfind"
-	TaggedCmdIdentityFindReply   = "identityfindreply"
+	TaggedCmdRendezvous            = "rendezvous"
+	TaggedCmdRendezvousReply       = "rendezvousreply"
+	TaggedCmdRendezvousPull        = "rendezvouspull"
+	TaggedCmdRendezvousPullReply   = "rendezvouspullreply"
+	TaggedCmdRendezvousRevoke      = "rendezvousrevoke"
+	TaggedCmdRendezvousRevokeReply = "rendezvousrevokereply"
+	TaggedCmdCache                 = "cache"
+	TaggedCmdPush                  = "push"
+	TaggedCmdAcknowledge           = "ack"
+	TaggedCmdProxy                 = "proxy"
+	TaggedCmdProxyReply            = "proxyreply"
+	TaggedCmdPing                  = "ping"
+	TaggedCmdPong                  = "pong"
+	TaggedCmdIdentityFind          = "identityfind"
+	TaggedCmdIdentityFindReply     = "identityfindreply"
+	TaggedCmdDeviceRegister        = "deviceregister"
+	TaggedCmdDeviceRegisterReply   = "deviceregisterreply"
+	TaggedCmdNotice                = "notice"
+	TaggedCmdDeliveryReceipt       = "deliveryreceipt"
+	TaggedCmdDirectory             = "directory"
+	TaggedCmdDirectoryReply        = "directoryreply"
+
+	// server to server commands, see FederatedCache
+	FederatedCmdCache               = "federatedcache"
+	FederatedCmdRendezvousPull      = "federatedrendezvouspull"
+	FederatedCmdRendezvousPullReply = "federatedrendezvouspullreply"
 
 	// misc
 	MessageModeNormal MessageMode = 0
@@ -71,6 +93,9 @@ const (
 
 	ErrorCodeInvalid      = 0 // invalid error code
 	ErrorCodeUserDisabled = 1 // user disabled
+	ErrorCodeMailboxFull  = 2 // recipient mailbox full
+	ErrorCodeRateLimited  = 3 // command rate limit exceeded
+	ErrorCodeRelayFailed  = 4 // recipient home server unreachable
 )
 
 // CreateAccount is a PRPC that is used to create a new account on the server.
@@ -110,9 +135,32 @@ type Acknowledge struct {
 }
 
 const (
-	ProtocolVersion = 9
+	ProtocolVersion = 10
+
+	// LegacyProtocolVersion is the version of clients that start a
+	// session with InitialCmdSession.  Their sessions receive neither the
+	// properties nor the commands that were added in later versions.
+	LegacyProtocolVersion = 9
 )
 
+// SessionV follows InitialCmdSessionV, which clients send instead of
+// InitialCmdSession to tell the server the highest protocol version they
+// speak.  The server answers with a Welcome of the same version or of
+// LegacyProtocolVersion.
+type SessionV struct {
+	Version int // protocol version of the client
+}
+
+// ShortRead returns true if err is the result of unmarshaling a structure that
+// was sent or stored prior to fields being appended to it.  Such errors must
+// be ignored; the appended fields keep their zero value.
+func ShortRead(err error) bool {
+	var uerr *xdr.UnmarshalError
+	return errors.As(err, &uerr) &&
+		uerr.ErrorCode == xdr.ErrIO &&
+		errors.Is(uerr.Err, io.EOF)
+}
+
 // Unwelcome is written immediately following a key exchange.  This command
 // purpose is to detect if the key exchange completed on the client side.  If
 // the key exchange failed the server will simply disconnect. If the user is
@@ -177,6 +225,23 @@ const (
 	// keeps a directory of identities.
 	PropDirectory        = "directory"
 	PropDirectoryDefault = false
+
+	// Next Certificate is an optional property of protocol version 10.  It
+	// announces the outer certificate the server is going to present once
+	// the operator rotates it, see NextCert.  It is only sent while a
+	// rotation is pending.
+	PropNextCert = "nextcert"
+
+	// Home Server is an optional property of protocol version 10.  It is
+	// the address users on other servers know this server by.  Clients
+	// hand it to the parties they exchange keys with.  It is only sent if
+	// the server federates.
+	PropHomeServer = "homeserver"
+
+	// Devices is an optional property of protocol version 10.  It is set
+	// if the server accepts DeviceRegister.  Clients must not send
+	// DeviceRegister otherwise.
+	PropDevices = "devices"
 )
 
 var (
@@ -218,8 +283,25 @@ var (
 		Value:    "",
 		Required: false,
 	}
+	DefaultPropNextCert = ServerProperty{
+		Key:      PropNextCert,
+		Value:    "",
+		Required: false,
+	}
+	DefaultPropHomeServer = ServerProperty{
+		Key:      PropHomeServer,
+		Value:    "",
+		Required: false,
+	}
+	DefaultPropDevices = ServerProperty{
+		Key:      PropDevices,
+		Value:    strconv.FormatBool(true),
+		Required: false,
+	}
 
-	// All properties must exist in this array.
+	// All properties of LegacyProtocolVersion must exist in this array.
+	// Sessions of later versions receive the properties that were added
+	// for them in addition.
 	SupportedServerProperties = []ServerProperty{
 		// required
 		DefaultPropTagDepth,
@@ -234,6 +316,112 @@ var (
 	}
 )
 
+// NextCert announces the outer certificate the server is going to present
+// after a rotation.  It is signed by the inner server identity so that a
+// client can accept the new certificate without user intervention.
+type NextCert struct {
+	Fingerprint [sha256.Size]byte // SHA256 of the DER encoded certificate
+	Signature   [64]byte          // server signature of Digest
+}
+
+// Digest returns the digest of the announcement that is signed by the server.
+func (n *NextCert) Digest() []byte {
+	d := sha256.New()
+	d.Write([]byte("zkc nextcert"))
+	d.Write(n.Fingerprint[:])
+	return d.Sum(nil)
+}
+
+// String returns the PropNextCert value of the announcement, the hex encoded
+// fingerprint and signature separated by a space.
+func (n *NextCert) String() string {
+	return hex.EncodeToString(n.Fingerprint[:]) + " " +
+		hex.EncodeToString(n.Signature[:])
+}
+
+// ParseNextCert decodes a PropNextCert value.  The signature is not verified.
+func ParseNextCert(s string) (*NextCert, error) {
+	var n NextCert
+	a := strings.Split(s, " ")
+	if len(a) != 2 {
+		return nil, errors.New("invalid next certificate")
+	}
+	fp, err := hex.DecodeString(a[0])
+	if err != nil || len(fp) != len(n.Fingerprint) {
+		return nil, errors.New("invalid next certificate fingerprint")
+	}
+	sig, err := hex.DecodeString(a[1])
+	if err != nil || len(sig) != len(n.Signature) {
+		return nil, errors.New("invalid next certificate signature")
+	}
+	copy(n.Fingerprint[:], fp)
+	copy(n.Signature[:], sig)
+	return &n, nil
+}
+
+// Succession states that a server identity was replaced by a successor.  It
+// is signed by the replaced identity so that clients that pinned it can
+// migrate to the successor without trusting the network.
+type Succession struct {
+	Old       zkidentity.PublicIdentity // replaced identity
+	New       zkidentity.PublicIdentity // successor identity
+	Time      int64                     // unix time of the succession
+	Signature [64]byte                  // signature of Digest by Old
+}
+
+// Digest returns the digest of the succession that is signed by the replaced
+// identity.
+func (s *Succession) Digest() []byte {
+	d := sha256.New()
+	d.Write([]byte("zkc succession"))
+	d.Write(s.Old.Digest[:])
+	d.Write(s.New.Digest[:])
+	binary.Write(d, binary.BigEndian, s.Time)
+	return d.Sum(nil)
+}
+
+// SuccessionRequest is sent after InitialCmdSuccession to ask the server how
+// the identity a client pinned was succeeded.
+type SuccessionRequest struct {
+	Identity [sha256.Size]byte // identity the client pinned
+}
+
+// SuccessionReply contains the successions, oldest first, that lead from the
+// requested identity to the current server identity.  It is empty if the
+// requested identity is current or unknown.
+type SuccessionReply struct {
+	Successions []Succession
+}
+
+// ErrSuccession is returned when a succession chain does not verify.
+var ErrSuccession = errors.New("invalid succession")
+
+// Successor verifies that chain is a sequence of successions, each signed by
+// its predecessor, that starts at pinned.  It returns the last successor.
+func Successor(pinned zkidentity.PublicIdentity, chain []Succession) (*zkidentity.PublicIdentity, error) {
+	current := pinned
+	for k := range chain {
+		s := &chain[k]
+		if s.Old.Identity != current.Identity ||
+			s.Old.SigKey != current.SigKey ||
+			s.Old.Key != current.Key {
+			return nil, fmt.Errorf("%w: link %v does not succeed "+
+				"%v", ErrSuccession, k, current.Fingerprint())
+		}
+		if !current.VerifyMessage(s.Digest(), s.Signature) {
+			return nil, fmt.Errorf("%w: link %v signature",
+				ErrSuccession, k)
+		}
+		if !s.New.Verify() ||
+			sha256.Sum256(s.New.Key[:]) != s.New.Identity {
+			return nil, fmt.Errorf("%w: link %v successor",
+				ErrSuccession, k)
+		}
+		current = s.New
+	}
+	return &current, nil
+}
+
 // CreateAccountReply returns a sanitized error to the client indicating
 // success or failure of the CreateAccountReply command.  Errors is set to ""
 // on success.
@@ -251,9 +439,23 @@ type Push struct {
 
 // Cache is a PRPC that is used to store message on server for later push
 // delivery.  This command must be acknowledged by the remote side.
+// TTL was added after the fact and is therefore at the end of the struct for
+// compatibility reasons.  The server discards the message if it was not
+// delivered within TTL seconds.  A TTL of 0 means the server maximum message
+// age applies.
+// Server was added after TTL for the same reason.  It is the home server of
+// the recipient; the server relays the message to it unless it is this
+// server.  An empty Server means this server.
+// Receipt was added after Server for the same reason.  If it is not 0 the
+// server sends a DeliveryReceipt carrying it once the recipient acknowledged
+// the message.  Messages that are relayed to another server do not produce
+// receipts.
 type Cache struct {
 	To      [32]byte // recipient identity
 	Payload []byte   // encrypted payload
+	TTL     uint64   // seconds until undelivered message expires
+	Server  string   // recipient home server
+	Receipt uint64   // sender chosen receipt identifier, 0 for none
 }
 
 // Proxy is a PRPC that is used to store message on server for later push
@@ -290,6 +492,35 @@ type ProxyCmd struct {
 type Ping struct{}
 type Pong struct{}
 
+// Federated commands flow between servers that relay messages to each other.
+// A server opens a federation link with InitialCmdFederate, reads the public
+// identity of its peer, verifies it against the identity it was configured
+// with and then initiates a key exchange with its own server identity.  The
+// peer only accepts links from servers it was configured with.  Every command
+// on a link is answered before the next one is sent.
+
+// FederatedCache relays a Cache from a user on the sending server.  It is
+// answered with an Acknowledge.
+type FederatedCache struct {
+	From    [32]byte // sender identity
+	To      [32]byte // recipient identity
+	Payload []byte   // encrypted payload
+	TTL     uint64   // seconds until undelivered message expires
+}
+
+// FederatedRendezvousPull relays a RendezvousPull from a user on the sending
+// server.  It is answered with a FederatedRendezvousPullReply.
+type FederatedRendezvousPull struct {
+	From  [32]byte // identity that pulls
+	Token string   // Rendezvous token that identifies blob
+}
+
+// FederatedRendezvousPullReply is the reply to a FederatedRendezvousPull.
+type FederatedRendezvousPullReply struct {
+	Error string // set if an error occurred
+	Blob  []byte // data reply to previous Rendezvous
+}
+
 // client to client commands
 
 // Rendezvous sends a blob to the server. Blob shall be < 4096 and
@@ -306,17 +537,89 @@ type RendezvousReply struct {
 	Error string // If an error occurred Error will be != ""
 }
 
-// RendezvousPull tries to download a previously uploaded blob.
+// RendezvousPull tries to download a previously uploaded blob.  Server was
+// added after the fact and is therefore at the end of the struct for
+// compatibility reasons.  It is the server the blob was uploaded to; an empty
+// Server means this server.
 type RendezvousPull struct {
-	Token string // Rendezvous token that identifies blob
+	Token  string // Rendezvous token that identifies blob
+	Server string // server that holds the blob
 }
 
 // RendezvousPullReply contains a data blob reply to a previous RendezvousPull
-// command that is identified by token.
+// command that is identified by token.  Server is returned unmodified from the
+// RendezvousPull.
 type RendezvousPullReply struct {
-	Error string // set if an error occurred
+	Error  string // set if an error occurred
+	Token  string // Rendezvous token that identifies blob
+	Blob   []byte // data reply to previous Rendezvous
+	Server string // server that held the blob
+}
+
+// RendezvousRevoke removes a previously uploaded blob before it expires.  Only
+// the identity that uploaded the blob may revoke it.
+type RendezvousRevoke struct {
 	Token string // Rendezvous token that identifies blob
-	Blob  []byte // data reply to previous Rendezvous
+}
+
+// RendezvousRevokeReply is a reply packet for a RendezvousRevoke command.
+type RendezvousRevokeReply struct {
+	Token string // Rendezvous token that identifies blob
+	Error string // If an error occurred Error will be != ""
+}
+
+// DeviceRegister identifies the device a session originates from.  Several
+// devices may be online with the same identity and the server pushes messages
+// to all of them.  Clients send DeviceRegister as the first command of a
+// session if the server announces PropDevices.  Until then the session uses an
+// anonymous device that is shared by clients that do not register a device.
+type DeviceRegister struct {
+	Device [16]byte // random, chosen once per device
+}
+
+// DeviceRegisterReply is a reply packet for a DeviceRegister command.
+type DeviceRegisterReply struct {
+	Error string // If an error occurred Error will be != ""
+}
+
+// Notice is an administrator announcement that the server pushes to all
+// users.  Users that are offline receive it when they connect.  The client
+// shall verify Signature with the identity of the server it pinned and
+// acknowledge the notice.
+type Notice struct {
+	Text      string   // announcement
+	Sent      int64    // unix time the administrator sent the notice
+	Signature [64]byte // server signature of Digest
+}
+
+// Digest returns the digest of the notice that is signed by the server.
+func (n *Notice) Digest() []byte {
+	d := sha256.New()
+	d.Write([]byte("zkc notice"))
+	binary.Write(d, binary.BigEndian, n.Sent)
+	d.Write([]byte(n.Text))
+	return d.Sum(nil)
+}
+
+// DeliveryReceipt tells the sender of a Cache that asked for a receipt that
+// the recipient acknowledged the message.  Users that are offline receive it
+// when they connect.  The client shall verify Signature with the identity of
+// the server it pinned and acknowledge the receipt.
+type DeliveryReceipt struct {
+	Receipt   uint64   // identifier the sender chose, see Cache
+	Recipient [32]byte // identity that acknowledged the message
+	Delivered int64    // unix time the recipient acknowledged the message
+	Signature [64]byte // server signature of Digest
+}
+
+// Digest returns the digest of the receipt that is signed by the server.
+func (d *DeliveryReceipt) Digest() []byte {
+	h := sha256.New()
+	h.Write([]byte("zkc delivery receipt"))
+	binary.Write(h, binary.BigEndian, d.Receipt)
+	h.Write(d.Recipient[:])
+	binary.Write(h, binary.BigEndian, d.Delivered)
+	return h.Sum(nil)
 }
 
 // IdentityFind asks the server's directory if the provided bick exists. The
@@ -333,11 +636,37 @@ type IdentityFindReply struct {
 	Identity zkidentity.PublicIdentity // Public Identify if Error not set
 }
 
+// Directory actions, see Directory.
+const (
+	DirectoryStatus = "status" // report the directory status
+	DirectoryList   = "list"   // list the caller in the directory
+	DirectoryUnlist = "unlist" // keep the caller out of the directory
+)
+
+// Directory lets a user query or change whether the server lists its identity
+// in the directory.  The server remembers the choice across sessions.
+type Directory struct {
+	Action string // DirectoryStatus, DirectoryList or DirectoryUnlist
+}
+
+// DirectoryReply returns the directory status of the user after Action was
+// performed.  Hidden is set if the administrator keeps the user out of the
+// directory regardless of the choice of the user.
+type DirectoryReply struct {
+	Action string // Action that was originally sent in
+	Error  string // Set if an error occurred
+	Listed bool   // identity can be found in the directory
+	Hidden bool   // kept out of the directory by the administrator
+}
+
 // IdentityKX contains the long lived public identify and the DH ratchet keys.
-// It is the second step during the IDKX exchange.
+// It is the second step during the IDKX exchange.  Server was added after the
+// fact and is therefore at the end of the struct for compatibility reasons.
+// It is the home server of Identity, empty if its server does not federate.
 type IdentityKX struct {
 	Identity zkidentity.PublicIdentity
 	KX       ratchet.KeyExchange
+	Server   string
 }
 
 // KX contains the DH ratchet keys.  It is the third step during the IDKX
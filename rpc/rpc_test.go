@@ -0,0 +1,110 @@
+// Copyright (c) 2020 Company 0, LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/companyzero/zkc/zkidentity"
+	xdr "github.com/davecgh/go-xdr/xdr2"
+)
+
+func succeed(t *testing.T, old *zkidentity.FullIdentity) (*zkidentity.FullIdentity, Succession) {
+	t.Helper()
+
+	fid, err := zkidentity.New("zkserver", "zkserver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := Succession{
+		Old:  old.Public,
+		New:  fid.Public,
+		Time: 1600000000,
+	}
+	s.Signature = old.SignMessage(s.Digest())
+	return fid, s
+}
+
+func TestSuccessor(t *testing.T) {
+	id1, err := zkidentity.New("zkserver", "zkserver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	id2, s1 := succeed(t, id1)
+	id3, s2 := succeed(t, id2)
+
+	pid, err := Successor(id1.Public, []Succession{s1, s2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pid.Identity != id3.Public.Identity {
+		t.Fatalf("unexpected successor %v", pid.Fingerprint())
+	}
+
+	// the chain has to start at the pinned identity
+	pid, err = Successor(id2.Public, []Succession{s2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pid.Identity != id3.Public.Identity {
+		t.Fatalf("unexpected successor %v", pid.Fingerprint())
+	}
+	_, err = Successor(id2.Public, []Succession{s1, s2})
+	if !errors.Is(err, ErrSuccession) {
+		t.Fatalf("expected ErrSuccession, got %v", err)
+	}
+
+	// successions must be signed by the replaced identity
+	forged := s2
+	forged.Time++
+	_, err = Successor(id1.Public, []Succession{s1, forged})
+	if !errors.Is(err, ErrSuccession) {
+		t.Fatalf("expected ErrSuccession, got %v", err)
+	}
+	forged = s2
+	forged.Signature = id3.SignMessage(forged.Digest())
+	_, err = Successor(id1.Public, []Succession{s1, forged})
+	if !errors.Is(err, ErrSuccession) {
+		t.Fatalf("expected ErrSuccession, got %v", err)
+	}
+
+	// no successions
+	pid, err = Successor(id1.Public, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pid.Identity != id1.Public.Identity {
+		t.Fatalf("unexpected successor %v", pid.Fingerprint())
+	}
+}
+
+func TestShortRead(t *testing.T) {
+	// Cache as sent before TTL, Server and Receipt were appended
+	type cacheOld struct {
+		To      [zkidentity.IdentitySize]byte
+		Payload []byte
+	}
+	var b bytes.Buffer
+	_, err := xdr.Marshal(&b, cacheOld{Payload: []byte("payload")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var c Cache
+	_, err = xdr.Unmarshal(bytes.NewReader(b.Bytes()), &c)
+	if !ShortRead(err) {
+		t.Fatalf("expected short read, got %v", err)
+	}
+	if !bytes.Equal(c.Payload, []byte("payload")) {
+		t.Fatalf("unexpected cache %+v", c)
+	}
+
+	// a structure that ends within a field is corrupt
+	_, err = xdr.Unmarshal(bytes.NewReader(b.Bytes()[:4]), &c)
+	if err == nil || ShortRead(err) {
+		t.Fatalf("expected corrupt structure, got %v", err)
+	}
+}
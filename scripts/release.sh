@@ -39,6 +39,8 @@ for i in $SYS; do
     env GOOS=$OS GOARCH=$ARCH go build github.com/companyzero/zkc/tools/zkexport
     env GOOS=$OS GOARCH=$ARCH go build github.com/companyzero/zkc/tools/zkimport
     env GOOS=$OS GOARCH=$ARCH go build github.com/companyzero/zkc/tools/zkservertoken
+    env GOOS=$OS GOARCH=$ARCH go build github.com/companyzero/zkc/tools/zkserverbackup
+    env GOOS=$OS GOARCH=$ARCH go build github.com/companyzero/zkc/tools/zkserverfsck
     cp $GPATH/src/github.com/companyzero/zkc/zkclient/zkclient.conf .
     cp $GPATH/src/github.com/companyzero/zkc/zkserver/zkserver.conf .
     cd ..
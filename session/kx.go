@@ -65,13 +65,14 @@ func regenerateEphemeral() error {
 	return nil
 }
 
-// zeroEphemeral erases the contents of ephemeralP{ublic,rivate}.
-func zeroEphemeral() {
-	for i := range ephemeralPublic {
-		ephemeralPublic[i] ^= ephemeralPublic[i]
+// zeroEphemeral erases the contents of an ephemeral key pair.
+func zeroEphemeral(pk *[sntrup4591761.PublicKeySize]byte,
+	sk *[sntrup4591761.PrivateKeySize]byte) {
+	for i := range pk {
+		pk[i] ^= pk[i]
 	}
-	for i := range ephemeralPrivate {
-		ephemeralPrivate[i] ^= ephemeralPrivate[i]
+	for i := range sk {
+		sk[i] ^= sk[i]
 	}
 }
 
@@ -243,13 +244,18 @@ func recvEncryptedIdentity(kx *KX, ek *[32]byte) (*[sntrup4591761.PublicKeySize]
 // c1, c2, c3, c4: NTRU Prime ciphertexts corresponding to k1, k2, k3, k4.
 // From the perspective of the initiator, the process unfolds as follows:
 func (kx *KX) Initiate() error {
-	if err := regenerateEphemeral(); err != nil {
+	// The ephemeral keys of Respond are shared by all connections, a
+	// process that initiates and responds, such as a federating server,
+	// must not erase them.
+	ephemeralPublic, ephemeralPrivate, err := sntrup4591761.GenerateKey(
+		rand.Reader)
+	if err != nil {
 		return err
 	}
-	defer zeroEphemeral()
+	defer zeroEphemeral(ephemeralPublic, ephemeralPrivate)
 
-	D(0, "[session.Initiate] ephemeral public:\n%x", ephemeralPublic)
-	D(0, "[session.Initiate] ephemeral private:\n%x", ephemeralPrivate)
+	D(0, "[session.Initiate] ephemeral public:\n%x", *ephemeralPublic)
+	D(0, "[session.Initiate] ephemeral private:\n%x", *ephemeralPrivate)
 	D(0, "[session.Initiate] our public key:\n%x", *kx.OurPublicKey)
 	D(0, "[session.Initiate] their public key:\n%x", *kx.TheirPublicKey)
 
@@ -265,7 +271,7 @@ func (kx *KX) Initiate() error {
 	}
 
 	// Step 3: Receive c2 encrypted with k1, obtain k2.
-	k2, ok := recvCipherAndGetKey(kx, &ephemeralPrivate, k1)
+	k2, ok := recvCipherAndGetKey(kx, ephemeralPrivate, k1)
 	if ok != 1 {
 		return ErrInvalidKx
 	}
@@ -0,0 +1,38 @@
+// Copyright (c) 2020 Company 0, LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package tools
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+
+	"github.com/companyzero/zkc/zkserver/socketapi"
+)
+
+// SocketCommand sends command and its payload to the server listening on
+// socket and decodes the answer into reply.
+func SocketCommand(socket, command string, payload, reply interface{}) error {
+	c, err := net.Dial("unix", socket)
+	if err != nil {
+		return fmt.Errorf("could not connect to zkserver: %v", err)
+	}
+	defer c.Close()
+
+	je := json.NewEncoder(c)
+	err = je.Encode(socketapi.SocketCommandID{
+		Version: socketapi.SCVersion,
+		Command: command,
+	})
+	if err != nil {
+		return err
+	}
+	err = je.Encode(payload)
+	if err != nil {
+		return err
+	}
+
+	return json.NewDecoder(c).Decode(reply)
+}
@@ -0,0 +1,72 @@
+// Copyright (c) 2020 Company 0, LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package tools
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/companyzero/zkc/rpc"
+	"github.com/companyzero/zkc/zkidentity"
+	xdr "github.com/davecgh/go-xdr/xdr2"
+)
+
+// ReadSuccessions reads the server identity successions, oldest first, from
+// filename.  A file that does not exist contains no successions.
+func ReadSuccessions(filename string) ([]rpc.Succession, error) {
+	blob, err := ioutil.ReadFile(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var sr rpc.SuccessionReply
+	_, err = xdr.Unmarshal(bytes.NewReader(blob), &sr)
+	if err != nil {
+		return nil, err
+	}
+	return sr.Successions, nil
+}
+
+// WriteSuccessions atomically replaces the successions in filename.
+func WriteSuccessions(filename string, successions []rpc.Succession) error {
+	var b bytes.Buffer
+	_, err := xdr.Marshal(&b, rpc.SuccessionReply{
+		Successions: successions,
+	})
+	if err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(filename),
+		filepath.Base(filename))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(b.Bytes())
+	if err == nil {
+		err = f.Sync()
+	}
+	if err1 := f.Close(); err == nil {
+		err = err1
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), filename)
+}
+
+// Predecessors returns the identities that were succeeded, oldest first.
+func Predecessors(successions []rpc.Succession) []zkidentity.PublicIdentity {
+	p := make([]zkidentity.PublicIdentity, 0, len(successions))
+	for _, v := range successions {
+		p = append(p, v.Old)
+	}
+	return p
+}
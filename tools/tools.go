@@ -12,16 +12,21 @@ import (
 	"encoding/hex"
 	"fmt"
 	"io"
+	"strconv"
 
 	"github.com/companyzero/zkc/zkidentity"
 )
 
 const (
-	ZKSIdentityFilename = "zkserver.id"
-	ZKSCertFilename     = "zkserver.crt"
-	ZKSKeyFilename      = "zkserver.key"
-	ZKSHome             = "home"
-	ZKCServerFilename   = "myserver/myserver.ini"
+	ZKSIdentityFilename     = "zkserver.id"
+	ZKSNextIdentityFilename = "zkserver.id.next"
+	ZKSSuccessionFilename   = "zkserver.succession"
+	ZKSCertFilename         = "zkserver.crt"
+	ZKSKeyFilename          = "zkserver.key"
+	ZKSNextCertFilename     = "zkserver.crt.next"
+	ZKSNextKeyFilename      = "zkserver.key.next"
+	ZKSHome                 = "home"
+	ZKCServerFilename       = "myserver/myserver.ini"
 )
 
 type ServerRecord struct {
@@ -52,6 +57,24 @@ func RandomUint64() (uint64, error) {
 	return randomUint64(rand.Reader)
 }
 
+// NewToken returns a random account creation token of 16 decimal digits.
+func NewToken() (string, error) {
+	for {
+		x, err := RandomUint64()
+		if err != nil {
+			return "", err
+		}
+		if x < 10000000000000000 {
+			continue
+		}
+		xs := strconv.FormatUint(x%10000000000000000, 10)
+		if len(xs) != 16 {
+			continue
+		}
+		return xs, nil
+	}
+}
+
 // ValidateIdentity verfies that a string contains a valid identity and returns
 // its []byte representation.
 func ValidateIdentity(id string) ([]byte, error) {
@@ -53,12 +53,18 @@ func fetchServerIPandPort(root string) string {
 	}
 	serverConf := path.Join(root, "zkserver.conf")
 	s := settings.New()
-	s.Listen = ""
+	s.Listen = nil
 	err = s.Load(serverConf)
 	if err != nil {
 		return ""
 	}
-	return s.Listen
+	// UNIX sockets and proxied listeners are not reachable by clients
+	for _, l := range s.Listen {
+		if l.Network == "tcp" && !l.Proxy {
+			return l.Address
+		}
+	}
+	return ""
 }
 
 func fetchServerDirectory(root string) (bool, error) {
@@ -21,6 +21,7 @@ import (
 	"github.com/companyzero/zkc/inidb"
 	"github.com/companyzero/zkc/tools"
 	"github.com/companyzero/zkc/zkserver/account"
+	"github.com/companyzero/zkc/zkserver/storage"
 	"github.com/davecgh/go-spew/spew"
 	xdr "github.com/davecgh/go-xdr/xdr2"
 	"github.com/vaughan0/go-ini"
@@ -106,7 +107,11 @@ func importClientRecord(root string, force bool, cr tools.ClientRecord) error {
 	if err != nil {
 		return err
 	}
-	a, err := account.New(home)
+	store, err := storage.NewFilesystem(home, dir)
+	if err != nil {
+		return err
+	}
+	a, err := account.New(store)
 	if err != nil {
 		return err
 	}
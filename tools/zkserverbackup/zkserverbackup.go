@@ -0,0 +1,413 @@
+// Copyright (c) 2020 Company 0, LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/user"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/companyzero/zkc/tools"
+	"github.com/companyzero/zkc/zkidentity"
+	"github.com/companyzero/zkc/zkserver/backup"
+	"github.com/companyzero/zkc/zkserver/settings"
+	"github.com/companyzero/zkc/zkserver/socketapi"
+)
+
+var socket string
+
+// passphrase reads the backup passphrase from stdin.  The passphrase is
+// prompted for, twice if confirm is set, when stdin is a terminal.
+func passphrase(confirm bool) (string, error) {
+	interactive := false
+	if fi, err := os.Stdin.Stat(); err == nil {
+		interactive = fi.Mode()&os.ModeCharDevice != 0
+	}
+
+	r := bufio.NewReader(os.Stdin)
+	read := func(prompt string) (string, error) {
+		if interactive {
+			fmt.Fprintf(os.Stderr, "%v: ", prompt)
+		}
+		line, err := r.ReadString('\n')
+		if err != nil && !(errors.Is(err, io.EOF) && line != "") {
+			return "", fmt.Errorf("could not read passphrase: %v",
+				err)
+		}
+		return strings.TrimRight(line, "\r\n"), nil
+	}
+
+	p, err := read("Passphrase")
+	if err != nil {
+		return "", err
+	}
+	if p == "" {
+		return "", fmt.Errorf("must provide passphrase")
+	}
+	if confirm && interactive {
+		again, err := read("Confirm passphrase")
+		if err != nil {
+			return "", err
+		}
+		if again != p {
+			return "", fmt.Errorf("passphrases do not match")
+		}
+	}
+	return p, nil
+}
+
+// backupCmd asks the running server to write a backup.
+func backupCmd(filename string) error {
+	filename, err := filepath.Abs(filename)
+	if err != nil {
+		return err
+	}
+	p, err := passphrase(true)
+	if err != nil {
+		return err
+	}
+
+	var br socketapi.SocketCommandBackupReply
+	err = tools.SocketCommand(socket, socketapi.SCBackup,
+		socketapi.SocketCommandBackup{
+			Filename:   filename,
+			Passphrase: p,
+		}, &br)
+	if err != nil {
+		return err
+	}
+	if br.Error != "" {
+		return fmt.Errorf("Server error: %v", br.Error)
+	}
+
+	fmt.Printf("OK, wrote %v bytes to %v\n", br.Size, filename)
+	fmt.Printf("Server identity: %v\n", br.Fingerprint)
+
+	return nil
+}
+
+// archiveName returns the path of an archive entry relative to its directory
+// and whether it belongs to the root or users directory.
+func archiveName(name string) (string, bool, error) {
+	var isRoot bool
+	switch {
+	case strings.HasPrefix(name, "root/"):
+		isRoot = true
+		name = strings.TrimPrefix(name, "root/")
+	case strings.HasPrefix(name, "users/"):
+		name = strings.TrimPrefix(name, "users/")
+	default:
+		return "", false, fmt.Errorf("invalid archive entry: %v", name)
+	}
+	name = path.Clean(name)
+	if path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+		return "", false, fmt.Errorf("invalid archive entry: %v", name)
+	}
+	return name, isRoot, nil
+}
+
+// extract reads a backup and writes it below root and users.  Nothing is
+// written if either is empty.  It returns the manifest once the backup has
+// been verified.
+func extract(filename, p, root, users string, expected func(backup.Manifest) error) (*backup.Manifest, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r, err := backup.NewReader(bufio.NewReader(f), []byte(p))
+	if err != nil {
+		return nil, err
+	}
+	m := r.Manifest()
+
+	// fail early, the manifest is authenticated at the end
+	err = expected(m)
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		th, err := r.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		if root == "" {
+			continue
+		}
+
+		name, isRoot, err := archiveName(th.Name)
+		if err != nil {
+			return nil, err
+		}
+		target := filepath.Join(users, filepath.FromSlash(name))
+		if isRoot {
+			target = filepath.Join(root, filepath.FromSlash(name))
+		}
+
+		switch th.Typeflag {
+		case tar.TypeReg:
+			err = os.MkdirAll(filepath.Dir(target), 0700)
+			if err != nil {
+				return nil, err
+			}
+			out, err := os.OpenFile(target,
+				os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+			if err != nil {
+				return nil, err
+			}
+			_, err = io.Copy(out, r)
+			if err == nil {
+				err = out.Sync()
+			}
+			out.Close()
+			if err != nil {
+				return nil, err
+			}
+		case tar.TypeDir:
+			err = os.MkdirAll(target, 0700)
+			if err != nil {
+				return nil, err
+			}
+		default:
+			return nil, fmt.Errorf("invalid archive entry type: %v",
+				th.Name)
+		}
+		os.Chtimes(target, th.ModTime, th.ModTime)
+	}
+
+	return &m, nil
+}
+
+// expectIdentity returns a function that checks that a backup was taken of
+// the server with identity root/zkserver.id or, if there is none, of the
+// server with fingerprint.
+func expectIdentity(root, fingerprint string) (func(backup.Manifest) error, error) {
+	id, err := ioutil.ReadFile(filepath.Join(root,
+		tools.ZKSIdentityFilename))
+	if err == nil {
+		fid, err := zkidentity.UnmarshalFullIdentity(id)
+		if err != nil {
+			return nil, fmt.Errorf("could not read server "+
+				"identity: %v", err)
+		}
+		if fingerprint != "" && fingerprint != fid.Public.Fingerprint() {
+			return nil, fmt.Errorf("server identity %v does not "+
+				"match %v", fid.Public.Fingerprint(), fingerprint)
+		}
+		fingerprint = fid.Public.Fingerprint()
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	} else if fingerprint == "" {
+		return nil, fmt.Errorf("no server identity in %v, provide "+
+			"the fingerprint of the server with -fingerprint", root)
+	}
+
+	return func(m backup.Manifest) error {
+		if m.Identity.Fingerprint() != fingerprint {
+			return fmt.Errorf("backup of server %v, expected %v",
+				m.Identity.Fingerprint(), fingerprint)
+		}
+		return nil
+	}, nil
+}
+
+// verifyCmd reads a backup without restoring it.
+func verifyCmd(filename, fingerprint string) error {
+	p, err := passphrase(false)
+	if err != nil {
+		return err
+	}
+	m, err := extract(filename, p, "", "", func(m backup.Manifest) error {
+		if fingerprint != "" && m.Identity.Fingerprint() != fingerprint {
+			return fmt.Errorf("backup of server %v, expected %v",
+				m.Identity.Fingerprint(), fingerprint)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("OK, backup of server %v taken %v\n",
+		m.Identity.Fingerprint(),
+		time.Unix(m.Created, 0).Format(time.RFC3339))
+
+	return nil
+}
+
+// restoreCmd replaces the root and users directories with the contents of a
+// backup.  The backup is extracted next to them and verified against the
+// server identity before anything is replaced.  The replaced directories are
+// kept.
+func restoreCmd(s *settings.Settings, filename, fingerprint string) error {
+	c, err := net.Dial("unix", socket)
+	if err == nil {
+		c.Close()
+		return fmt.Errorf("zkserver is running, stop it before " +
+			"restoring a backup")
+	}
+
+	root := filepath.Clean(s.Root)
+	users := filepath.Clean(s.Users)
+	expected, err := expectIdentity(root, fingerprint)
+	if err != nil {
+		return err
+	}
+	p, err := passphrase(false)
+	if err != nil {
+		return err
+	}
+
+	// users is extracted below root if that is where it lives
+	err = os.MkdirAll(filepath.Dir(root), 0700)
+	if err != nil {
+		return err
+	}
+	newRoot, err := ioutil.TempDir(filepath.Dir(root),
+		filepath.Base(root)+".restore")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(newRoot)
+	rel, err := filepath.Rel(root, users)
+	if err != nil {
+		return err
+	}
+	separate := rel == ".." || strings.HasPrefix(rel, ".."+string(os.PathSeparator))
+	newUsers := filepath.Join(newRoot, rel)
+	if separate {
+		err = os.MkdirAll(filepath.Dir(users), 0700)
+		if err != nil {
+			return err
+		}
+		newUsers, err = ioutil.TempDir(filepath.Dir(users),
+			filepath.Base(users)+".restore")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(newUsers)
+	}
+
+	m, err := extract(filename, p, newRoot, newUsers, expected)
+	if err != nil {
+		return err
+	}
+
+	// the restored identity must be the one that signed the backup
+	id, err := ioutil.ReadFile(filepath.Join(newRoot,
+		tools.ZKSIdentityFilename))
+	if err != nil {
+		return fmt.Errorf("backup has no server identity: %v", err)
+	}
+	fid, err := zkidentity.UnmarshalFullIdentity(id)
+	if err != nil {
+		return fmt.Errorf("could not read server identity: %v", err)
+	}
+	if fid.Public.Identity != m.Identity.Identity {
+		return fmt.Errorf("backup signed by %v contains identity %v",
+			m.Identity.Fingerprint(), fid.Public.Fingerprint())
+	}
+
+	// verified, replace the current state
+	suffix := ".replaced-" + time.Now().Format("20060102150405")
+	for _, v := range []struct {
+		dir, restored string
+	}{
+		{root, newRoot},
+		{users, newUsers},
+	} {
+		if v.dir == users && !separate {
+			continue
+		}
+		if _, err := os.Stat(v.dir); err == nil {
+			err = os.Rename(v.dir, v.dir+suffix)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("Moved %v to %v\n", v.dir, v.dir+suffix)
+		}
+		err = os.Rename(v.restored, v.dir)
+		if err != nil {
+			return err
+		}
+	}
+
+	fmt.Printf("OK, restored backup of server %v taken %v\n",
+		m.Identity.Fingerprint(),
+		time.Unix(m.Created, 0).Format(time.RFC3339))
+
+	return nil
+}
+
+func _main() error {
+	// setup default paths
+	usr, err := user.Current()
+	if err != nil {
+		return fmt.Errorf("user.Current: %v", err)
+	}
+
+	// config file
+	filename := flag.String("cfg", path.Join(usr.HomeDir, ".zkserver",
+		"zkserver.conf"), "config file")
+	fingerprint := flag.String("fingerprint", "", "fingerprint of the "+
+		"server identity the backup must belong to")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: zkserverbackup [flags] "+
+			"[backup|verify|restore] <filename>\n"+
+			"The passphrase is read from stdin.\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	// load settings
+	s := settings.New()
+	err = s.Load(*filename)
+	if err != nil {
+		return fmt.Errorf("could not read config file: %v", err)
+	}
+	socket = filepath.Join(s.Root, socketapi.SocketFilename)
+
+	a := flag.Args()
+	if len(a) != 2 {
+		flag.Usage()
+		return fmt.Errorf("must provide command and filename")
+	}
+	switch a[0] {
+	case "backup":
+		return backupCmd(a[1])
+	case "verify":
+		return verifyCmd(a[1], *fingerprint)
+	case "restore":
+		return restoreCmd(s, a[1], *fingerprint)
+	default:
+		return fmt.Errorf("invalid command: %v", a[0])
+	}
+}
+
+func main() {
+	runtime.GOMAXPROCS(runtime.NumCPU())
+
+	err := _main()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+}
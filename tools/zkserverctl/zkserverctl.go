@@ -2,8 +2,10 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"net"
 	"os"
 	"os/user"
@@ -11,7 +13,13 @@ import (
 	"path/filepath"
 	"runtime"
 	"strings"
+	"text/tabwriter"
+	"time"
 
+	"github.com/companyzero/zkc/rpc"
+	"github.com/companyzero/zkc/tools"
+	"github.com/companyzero/zkc/zkidentity"
+	"github.com/companyzero/zkc/zkserver/audit"
 	"github.com/companyzero/zkc/zkserver/settings"
 	"github.com/companyzero/zkc/zkserver/socketapi"
 	"github.com/companyzero/zkc/zkutil"
@@ -139,6 +147,400 @@ func userEnable(a []string) error {
 	return nil
 }
 
+func sessionList(a []string) error {
+	if len(a) != 1 {
+		return fmt.Errorf("sessionlist")
+	}
+
+	var slr socketapi.SocketCommandSessionListReply
+	err := tools.SocketCommand(socket, socketapi.SCSessionList,
+		socketapi.SocketCommandSessionList{}, &slr)
+	if err != nil {
+		return err
+	}
+	if slr.Error != "" {
+		return fmt.Errorf("Server error: %v", slr.Error)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 1, ' ', 0)
+	fmt.Fprintf(w, "Identity\tDevice\tNick\tAddress\tConnected\t"+
+		"Tags\tNotifications\n")
+	for _, v := range slr.Sessions {
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t%v\t%v\n",
+			v.Identity, v.Device, v.Nick, v.RemoteAddress,
+			time.Unix(v.Connected, 0).Format(time.RFC3339),
+			v.Tags, v.Notifications)
+	}
+	return w.Flush()
+}
+
+func sessionKick(a []string) error {
+	if len(a) != 2 && len(a) != 3 {
+		return fmt.Errorf("sessionkick <identity> [device]")
+	}
+
+	sk := socketapi.SocketCommandSessionKick{
+		Identity: strings.TrimSpace(a[1]),
+	}
+	if len(a) == 3 {
+		sk.Device = strings.TrimSpace(a[2])
+	}
+	var skr socketapi.SocketCommandSessionKickReply
+	err := tools.SocketCommand(socket, socketapi.SCSessionKick, sk, &skr)
+	if err != nil {
+		return err
+	}
+	if skr.Error != "" {
+		return fmt.Errorf("Server error: %v", skr.Error)
+	}
+
+	fmt.Printf("OK\n")
+
+	return nil
+}
+
+func userPurge(a []string) error {
+	if len(a) != 2 {
+		return fmt.Errorf("userpurge <identity>")
+	}
+
+	var upr socketapi.SocketCommandUserPurgeReply
+	err := tools.SocketCommand(socket, socketapi.SCUserPurge,
+		socketapi.SocketCommandUserPurge{
+			Identity: strings.TrimSpace(a[1]),
+		}, &upr)
+	if err != nil {
+		return err
+	}
+	if upr.Error != "" {
+		return fmt.Errorf("Server error: %v", upr.Error)
+	}
+
+	fmt.Printf("OK\n")
+
+	return nil
+}
+
+func userNick(a []string) error {
+	if len(a) != 2 && len(a) != 3 {
+		return fmt.Errorf("usernick <identity> [nick]")
+	}
+
+	un := socketapi.SocketCommandUserNick{
+		Identity: strings.TrimSpace(a[1]),
+	}
+	if len(a) == 3 {
+		un.Nick = strings.TrimSpace(a[2])
+	}
+	var unr socketapi.SocketCommandUserNickReply
+	err := tools.SocketCommand(socket, socketapi.SCUserNick, un, &unr)
+	if err != nil {
+		return err
+	}
+	if unr.Error != "" {
+		return fmt.Errorf("Server error: %v", unr.Error)
+	}
+
+	fmt.Printf("OK\n")
+
+	return nil
+}
+
+func directoryList(a []string) error {
+	if len(a) != 2 {
+		return fmt.Errorf("directorylist <identity>")
+	}
+
+	var dlr socketapi.SocketCommandDirectoryListReply
+	err := tools.SocketCommand(socket, socketapi.SCDirectoryList,
+		socketapi.SocketCommandDirectoryList{
+			Identity: strings.TrimSpace(a[1]),
+		}, &dlr)
+	if err != nil {
+		return err
+	}
+	if dlr.Error != "" {
+		return fmt.Errorf("Server error: %v", dlr.Error)
+	}
+
+	fmt.Printf("OK\n")
+
+	return nil
+}
+
+func directoryUnlist(a []string) error {
+	if len(a) != 2 {
+		return fmt.Errorf("directoryunlist <identity>")
+	}
+
+	var dur socketapi.SocketCommandDirectoryUnlistReply
+	err := tools.SocketCommand(socket, socketapi.SCDirectoryUnlist,
+		socketapi.SocketCommandDirectoryUnlist{
+			Identity: strings.TrimSpace(a[1]),
+		}, &dur)
+	if err != nil {
+		return err
+	}
+	if dur.Error != "" {
+		return fmt.Errorf("Server error: %v", dur.Error)
+	}
+
+	fmt.Printf("OK\n")
+
+	return nil
+}
+
+func notice(a []string) error {
+	n := socketapi.SocketCommandNotice{}
+	if len(a) > 1 && a[1] == "-motd" {
+		n.MOTD = true
+		a = a[1:]
+	}
+	if len(a) < 2 {
+		return fmt.Errorf("notice [-motd] <text>")
+	}
+	n.Text = strings.Join(a[1:], " ")
+
+	var nr socketapi.SocketCommandNoticeReply
+	err := tools.SocketCommand(socket, socketapi.SCNotice, n, &nr)
+	if err != nil {
+		return err
+	}
+	if nr.Error != "" {
+		return fmt.Errorf("Server error: %v", nr.Error)
+	}
+
+	fmt.Printf("OK, sent to %v users\n", nr.Recipients)
+
+	return nil
+}
+
+func reload(a []string) error {
+	if len(a) != 1 {
+		return fmt.Errorf("reload")
+	}
+
+	var rr socketapi.SocketCommandReloadReply
+	err := tools.SocketCommand(socket, socketapi.SCReload,
+		socketapi.SocketCommandReload{}, &rr)
+	if err != nil {
+		return err
+	}
+	if rr.Error != "" {
+		return fmt.Errorf("Server error: %v", rr.Error)
+	}
+
+	fmt.Printf("OK, applied: %v\n", strings.Join(rr.Applied, " "))
+	if len(rr.Ignored) != 0 {
+		fmt.Printf("Ignored, restart required: %v\n",
+			strings.Join(rr.Ignored, " "))
+	}
+
+	return nil
+}
+
+func certStage(a []string) error {
+	if len(a) != 1 {
+		return fmt.Errorf("certstage")
+	}
+
+	var csr socketapi.SocketCommandCertStageReply
+	err := tools.SocketCommand(socket, socketapi.SCCertStage,
+		socketapi.SocketCommandCertStage{}, &csr)
+	if err != nil {
+		return err
+	}
+	if csr.Error != "" {
+		return fmt.Errorf("Server error: %v", csr.Error)
+	}
+
+	fmt.Printf("OK, staged outer fingerprint: %v\n", csr.Fingerprint)
+
+	return nil
+}
+
+func certRotate(a []string) error {
+	if len(a) != 1 {
+		return fmt.Errorf("certrotate")
+	}
+
+	var crr socketapi.SocketCommandCertRotateReply
+	err := tools.SocketCommand(socket, socketapi.SCCertRotate,
+		socketapi.SocketCommandCertRotate{}, &crr)
+	if err != nil {
+		return err
+	}
+	if crr.Error != "" {
+		return fmt.Errorf("Server error: %v", crr.Error)
+	}
+
+	fmt.Printf("OK, new outer fingerprint: %v\n", crr.Fingerprint)
+
+	return nil
+}
+
+// auditVerify checks the audit log chain offline, the server does not have to
+// be running.
+func auditVerify(a []string, s *settings.Settings) error {
+	if len(a) != 1 {
+		return fmt.Errorf("auditverify")
+	}
+
+	blob, err := ioutil.ReadFile(filepath.Join(s.Root,
+		tools.ZKSIdentityFilename))
+	if err != nil {
+		return err
+	}
+	id, err := zkidentity.UnmarshalFullIdentity(blob)
+	if err != nil {
+		return err
+	}
+
+	successions, err := tools.ReadSuccessions(filepath.Join(s.Root,
+		tools.ZKSSuccessionFilename))
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(s.AuditLog)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	last, err := audit.Verify(f, id.Public,
+		tools.Predecessors(successions)...)
+	if errors.Is(err, audit.ErrTorn) {
+		// zkserver removes it when it opens the log
+		fmt.Printf("%v\n", err)
+	} else if err != nil {
+		return err
+	}
+	if last == nil {
+		fmt.Printf("OK, audit log is empty\n")
+		return nil
+	}
+
+	fmt.Printf("OK, %v entries, last entry %v\n", last.Seq,
+		time.Unix(last.Time, 0).Format(time.RFC3339))
+
+	return nil
+}
+
+// identityRotate replaces the server identity with a new one and records a
+// succession signed by the old identity.  Clients that pinned the old
+// identity obtain the succession from the server and migrate to the new
+// identity.  The server must not be running.  An interrupted rotation is
+// completed when the command is run again.
+func identityRotate(a []string, s *settings.Settings) error {
+	if len(a) != 1 {
+		return fmt.Errorf("identityrotate")
+	}
+
+	if c, err := net.Dial("unix", socket); err == nil {
+		c.Close()
+		return fmt.Errorf("server is running")
+	}
+
+	idFile := filepath.Join(s.Root, tools.ZKSIdentityFilename)
+	nextFile := filepath.Join(s.Root, tools.ZKSNextIdentityFilename)
+	successionFile := filepath.Join(s.Root, tools.ZKSSuccessionFilename)
+
+	blob, err := ioutil.ReadFile(idFile)
+	if err != nil {
+		return err
+	}
+	old, err := zkidentity.UnmarshalFullIdentity(blob)
+	if err != nil {
+		return err
+	}
+	successions, err := tools.ReadSuccessions(successionFile)
+	if err != nil {
+		return err
+	}
+
+	// the successor is generated once
+	blob, err = ioutil.ReadFile(nextFile)
+	if os.IsNotExist(err) {
+		fid, err := zkidentity.New("zkserver", "zkserver")
+		if err != nil {
+			return err
+		}
+		blob, err = fid.Marshal()
+		if err != nil {
+			return err
+		}
+		err = ioutil.WriteFile(nextFile, blob, 0600)
+		if err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+	id, err := zkidentity.UnmarshalFullIdentity(blob)
+	if err != nil {
+		return err
+	}
+	if n := len(successions); n != 0 &&
+		successions[n-1].New.Identity == id.Public.Identity {
+		// succession was recorded, it is signed again below
+		successions = successions[:n-1]
+	}
+	predecessors := tools.Predecessors(successions)
+
+	// the old identity hands the audit log over to the successor
+	l, err := audit.Open(s.AuditLog, old, predecessors...)
+	if err == nil {
+		if l.Torn() != 0 {
+			fmt.Printf("Removed incomplete last entry from " +
+				"audit log\n")
+		}
+		err = l.Append(audit.KindSuccession, "identityrotate",
+			id.Public.Fingerprint(), "")
+		if err1 := l.Close(); err == nil {
+			err = err1
+		}
+		if err != nil {
+			return fmt.Errorf("could not update audit log: %v", err)
+		}
+	} else {
+		f, err := os.Open(s.AuditLog)
+		if err != nil {
+			return err
+		}
+		_, err = audit.Verify(f, id.Public,
+			append(predecessors, old.Public)...)
+		f.Close()
+		if err != nil && !errors.Is(err, audit.ErrTorn) {
+			return fmt.Errorf("could not verify audit log: %v", err)
+		}
+	}
+
+	// the old identity signs the succession
+	succession := rpc.Succession{
+		Old:  old.Public,
+		New:  id.Public,
+		Time: time.Now().Unix(),
+	}
+	succession.Signature = old.SignMessage(succession.Digest())
+	err = tools.WriteSuccessions(successionFile,
+		append(successions, succession))
+	if err != nil {
+		return fmt.Errorf("could not save succession: %v", err)
+	}
+
+	err = os.Rename(nextFile, idFile)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("OK, replaced identity %v\n", old.Public.Fingerprint())
+	fmt.Printf("New identity: %v\n", id.Public.Fingerprint())
+	fmt.Printf("Restart the server to use the new identity\n")
+
+	return nil
+}
+
 func _main() error {
 	// flags and settings
 	var err error
@@ -161,6 +563,30 @@ func _main() error {
 		return userDisable(a)
 	case "userenable":
 		return userEnable(a)
+	case "sessionlist":
+		return sessionList(a)
+	case "sessionkick":
+		return sessionKick(a)
+	case "userpurge":
+		return userPurge(a)
+	case "usernick":
+		return userNick(a)
+	case "directorylist":
+		return directoryList(a)
+	case "directoryunlist":
+		return directoryUnlist(a)
+	case "notice":
+		return notice(a)
+	case "reload":
+		return reload(a)
+	case "certstage":
+		return certStage(a)
+	case "certrotate":
+		return certRotate(a)
+	case "auditverify":
+		return auditVerify(a, settings)
+	case "identityrotate":
+		return identityRotate(a, settings)
 	default:
 		return fmt.Errorf("invalid command: %v", a[0])
 	}
@@ -1,24 +1,17 @@
 package main
 
 import (
-	"bytes"
-	"encoding/base64"
 	"flag"
 	"fmt"
-	"io/ioutil"
 	"os"
 	"os/user"
 	"path"
-	"path/filepath"
 	"runtime"
 
-	"github.com/companyzero/zkc/inidb"
 	"github.com/companyzero/zkc/rpc"
-	"github.com/companyzero/zkc/zkidentity"
-	"github.com/companyzero/zkc/zkserver/account"
 	"github.com/companyzero/zkc/zkserver/settings"
+	"github.com/companyzero/zkc/zkserver/storage"
 	"github.com/companyzero/zkc/zkutil"
-	xdr "github.com/davecgh/go-xdr/xdr2"
 )
 
 func ObtainSettings() (*settings.Settings, error) {
@@ -63,32 +56,21 @@ func _main() error {
 
 	fmt.Printf("zkserverdump directory: %v\n", settings.Root)
 
-	fi, err := ioutil.ReadDir(path.Join(settings.Users))
+	store, err := storage.NewFilesystem(settings.Users, settings.Root)
+	if err != nil {
+		return err
+	}
+	ids, err := store.Identities()
 	if err != nil {
 		return err
 	}
 
-	for _, v := range fi {
-		user, err := inidb.New(filepath.Join(settings.Users, v.Name(),
-			account.UserIdentityFilename), false, 1)
-		if err != nil {
-			return err
-		}
-		b64, err := user.Get("", "identity")
+	for _, v := range ids {
+		user, err := store.GetIdentity(v)
 		if err != nil {
 			return fmt.Errorf("could not get user: %v", err)
 		}
-		blob, err := base64.StdEncoding.DecodeString(b64)
-		if err != nil {
-			return fmt.Errorf("could not decode user: %v", err)
-		}
-		id := new(zkidentity.PublicIdentity)
-		br := bytes.NewReader(blob)
-		_, err = xdr.Unmarshal(br, &id)
-		if err != nil {
-			return fmt.Errorf("could not unmarshal user: %v", err)
-		}
-		fmt.Printf("%v %v\n", v.Name(), id.Nick)
+		fmt.Printf("%x %v\n", v, user.Identity.Nick)
 	}
 
 	return nil
@@ -0,0 +1,109 @@
+// Copyright (c) 2020 Company 0, LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"path"
+	"path/filepath"
+	"runtime"
+	"time"
+
+	"github.com/companyzero/zkc/rpc"
+	"github.com/companyzero/zkc/zkserver/account"
+	"github.com/companyzero/zkc/zkserver/settings"
+	"github.com/companyzero/zkc/zkserver/socketapi"
+	"github.com/companyzero/zkc/zkserver/storage"
+	"github.com/companyzero/zkc/zkutil"
+)
+
+func _main() error {
+	// setup default paths
+	usr, err := user.Current()
+	if err != nil {
+		return fmt.Errorf("user.Current: %v", err)
+	}
+
+	// config file
+	filename := flag.String("cfg", path.Join(usr.HomeDir, ".zkserver",
+		"zkserver.conf"), "config file")
+	fix := flag.Bool("fix", false, "quarantine unusable accounts and "+
+		"messages, fix the layout and rebuild devices.ini")
+	version := flag.Bool("version", false, "show version")
+	flag.Parse()
+
+	if *version {
+		fmt.Fprintf(os.Stderr, "zkserverfsck %s (%s) protocol version "+
+			"%d\n", zkutil.Version(), runtime.Version(),
+			rpc.ProtocolVersion)
+		return nil
+	}
+
+	// load settings
+	s := settings.New()
+	err = s.Load(*filename)
+	if err != nil {
+		return fmt.Errorf("could not read config file: %v", err)
+	}
+
+	c, err := net.Dial("unix", filepath.Join(s.Root,
+		socketapi.SocketFilename))
+	if err == nil {
+		c.Close()
+		return fmt.Errorf("zkserver is running, stop it before " +
+			"checking its data directory")
+	}
+
+	quarantine := filepath.Join(s.Root, "quarantine",
+		time.Now().Format("20060102150405"))
+	problems, err := storage.Check(s.Users, storage.CheckOptions{
+		Message:    account.CheckMessage,
+		Repair:     *fix,
+		Quarantine: quarantine,
+	})
+	if err != nil {
+		return err
+	}
+
+	fixed := 0
+	for _, v := range problems {
+		fmt.Println(v)
+		if v.Action != "" {
+			fixed++
+		}
+	}
+	if _, err := os.Stat(quarantine); err == nil && fixed > 0 {
+		fmt.Printf("Quarantined files are in %v\n", quarantine)
+	}
+
+	switch {
+	case len(problems) == 0:
+		fmt.Printf("OK, no problems found in %v\n", s.Users)
+	case fixed == len(problems):
+		fmt.Printf("OK, fixed %v problems\n", fixed)
+	case *fix:
+		return fmt.Errorf("fixed %v of %v problems", fixed,
+			len(problems))
+	default:
+		return fmt.Errorf("found %v problems, run with -fix to fix "+
+			"them", len(problems))
+	}
+
+	return nil
+}
+
+func main() {
+	runtime.GOMAXPROCS(runtime.NumCPU())
+
+	err := _main()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+}
@@ -5,30 +5,82 @@
 package main
 
 import (
-	"errors"
 	"flag"
 	"fmt"
 	"os"
 	"os/user"
 	"path"
+	"path/filepath"
 	"runtime"
-	"strconv"
 	"strings"
+	"text/tabwriter"
 	"time"
 
-	"github.com/companyzero/zkc/inidb"
 	"github.com/companyzero/zkc/tools"
-	"github.com/vaughan0/go-ini"
+	"github.com/companyzero/zkc/zkserver/settings"
+	"github.com/companyzero/zkc/zkserver/socketapi"
 )
 
-const (
-	pendingDir  = "pending"
-	pendingFile = "pending.ini"
-)
+var socket string
 
-var (
-	pendingPath = path.Join(pendingDir, pendingFile)
-)
+func tokenCreate(hours, uses uint64, nick string) error {
+	var tcr socketapi.SocketCommandTokenCreateReply
+	err := tools.SocketCommand(socket, socketapi.SCTokenCreate,
+		socketapi.SocketCommandTokenCreate{
+			Hours: hours,
+			Uses:  uses,
+			Nick:  nick,
+		}, &tcr)
+	if err != nil {
+		return err
+	}
+	if tcr.Error != "" {
+		return fmt.Errorf("Server error: %v", tcr.Error)
+	}
+
+	fmt.Printf("%v\n", tcr.Token.Token)
+
+	return nil
+}
+
+func tokenList() error {
+	var tlr socketapi.SocketCommandTokenListReply
+	err := tools.SocketCommand(socket, socketapi.SCTokenList,
+		socketapi.SocketCommandTokenList{}, &tlr)
+	if err != nil {
+		return err
+	}
+	if tlr.Error != "" {
+		return fmt.Errorf("Server error: %v", tlr.Error)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 1, ' ', 0)
+	fmt.Fprintf(w, "Token\tExpires\tUses\tNick\n")
+	for _, v := range tlr.Tokens {
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\n", v.Token,
+			time.Unix(v.Expires, 0).Format(time.RFC3339), v.Uses,
+			v.Nick)
+	}
+	return w.Flush()
+}
+
+func tokenRevoke(token string) error {
+	var trr socketapi.SocketCommandTokenRevokeReply
+	err := tools.SocketCommand(socket, socketapi.SCTokenRevoke,
+		socketapi.SocketCommandTokenRevoke{
+			Token: token,
+		}, &trr)
+	if err != nil {
+		return err
+	}
+	if trr.Error != "" {
+		return fmt.Errorf("Server error: %v", trr.Error)
+	}
+
+	fmt.Printf("OK\n")
+
+	return nil
+}
 
 func _main() error {
 	// setup default paths
@@ -38,70 +90,49 @@ func _main() error {
 	}
 
 	// config file
-	filename := flag.String("cfg", usr.HomeDir+"/.zkserver/zkserver.conf",
-		"config file")
-	hours := flag.Uint("hours", 24, "hours before expiration")
+	filename := flag.String("cfg", path.Join(usr.HomeDir, ".zkserver",
+		"zkserver.conf"), "config file")
+	hours := flag.Uint64("hours", 24, "hours before expiration")
+	uses := flag.Uint64("uses", 1, "number of accounts the token creates")
+	nick := flag.String("nick", "", "nick reserved for the token")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: zkservertoken [flags] "+
+			"[create|list|revoke <token>]\n")
+		flag.PrintDefaults()
+	}
 	flag.Parse()
 
-	// parse file
-	cfg, err := ini.LoadFile(*filename)
-	if err != nil && *filename != flag.Lookup("cfg").DefValue {
+	// load settings
+	s := settings.New()
+	err = s.Load(*filename)
+	if err != nil {
 		return fmt.Errorf("could not read config file: %v", err)
 	}
+	socket = filepath.Join(s.Root, socketapi.SocketFilename)
 
-	// root directory
-	root, ok := cfg.Get("", "root")
-	if !ok {
-		return fmt.Errorf("config file does not contain entry: root")
-	}
-	root = strings.Replace(root, "~", usr.HomeDir, 1)
-
-	// open db
-	pending, err := inidb.New(path.Join(root, pendingPath), true, 10)
-	if err != nil && !errors.Is(err, inidb.ErrCreated) {
-		return fmt.Errorf("could not open inidb: %v", err)
+	a := flag.Args()
+	if len(a) == 0 {
+		a = []string{"create"}
 	}
-
-	for {
-		x, err := tools.RandomUint64()
-		if err != nil {
-			return fmt.Errorf("not enough entropy")
-		}
-		if x < 10000000000000000 {
-			continue
+	switch a[0] {
+	case "create":
+		if len(a) != 1 {
+			return fmt.Errorf("create takes no arguments")
 		}
-		x %= 10000000000000000
-
-		xs := strconv.FormatUint(x, 10)
-		_, err = pending.Get("", xs)
-		if err == nil {
-			continue
-		}
-
-		xsPrint, err := tools.InFours(xs)
-		if err != nil {
-			continue
-		}
-
-		// deal with it
-		expires := time.Now().Add(time.Duration(*hours) * time.Hour).Unix()
-		err = pending.Set("", xs, strconv.FormatUint(uint64(expires), 10))
-		if err != nil {
-			return fmt.Errorf("could not insert record")
+		return tokenCreate(*hours, *uses, *nick)
+	case "list":
+		if len(a) != 1 {
+			return fmt.Errorf("list takes no arguments")
 		}
-
-		err = pending.Save()
-		if err != nil {
-			return fmt.Errorf("could not save pending database: %v",
-				err)
+		return tokenList()
+	case "revoke":
+		if len(a) < 2 {
+			return fmt.Errorf("revoke <token>")
 		}
-
-		fmt.Printf("%v\n", xsPrint)
-
-		break
+		return tokenRevoke(strings.Join(a[1:], ""))
+	default:
+		return fmt.Errorf("invalid command: %v", a[0])
 	}
-
-	return nil
 }
 
 func main() {
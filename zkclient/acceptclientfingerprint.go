@@ -31,6 +31,7 @@ type acceptCFPWindow struct {
 	pid         *zkidentity.PublicIdentity // fetched Public Identity
 	dk          *[32]byte                  // blob derived key
 	newIdentity bool                       // save identity if true
+	server      string                     // home server of pid
 }
 
 var (
@@ -144,6 +145,7 @@ func (aw *acceptCFPWindow) KeyHandler(w *ttk.Window, k ttk.Key) {
 		idkx := rpc.IdentityKX{
 			Identity: aw.zkc.id.Public,
 			KX:       *kxRatchet,
+			Server:   aw.zkc.homeServer,
 		}
 		idkxXDR := &bytes.Buffer{}
 		_, err = xdr.Marshal(idkxXDR, idkx)
@@ -164,7 +166,7 @@ func (aw *acceptCFPWindow) KeyHandler(w *ttk.Window, k ttk.Key) {
 		aw.zkc.Dbg(idZKC, "step 2 (cache) idkx")
 
 		// send cache command, step 2 of idkx
-		err = aw.zkc.cache(aw.pid.Identity,
+		err = aw.zkc.cacheServer(aw.pid.Identity, aw.server,
 			blobshare.PackNonce(nonce, encrypted))
 		if err != nil {
 			aw.Status(w, true, "could not send IdentityKX %v", err)
@@ -184,6 +186,12 @@ func (aw *acceptCFPWindow) KeyHandler(w *ttk.Window, k ttk.Key) {
 				return
 			}
 		}
+		err = aw.zkc.saveServer(aw.pid.Identity, aw.server)
+		if err != nil {
+			aw.Status(w, true, "Could not save home server: %v",
+				err)
+			return
+		}
 
 		// save derived key, needed in step 3 of idkx
 		err = aw.zkc.saveKey(aw.dk)
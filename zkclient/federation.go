@@ -0,0 +1,57 @@
+// Copyright (c) 2020 Company 0, LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/companyzero/zkc/zkidentity"
+)
+
+const (
+	// serverFilename records the home server of an identity that lives
+	// on a federated server.
+	serverFilename = "server"
+)
+
+// splitPIN splits a key exchange PIN of the form pin[@server].
+func splitPIN(s string) (string, string) {
+	i := strings.LastIndex(s, "@")
+	if i < 0 {
+		return s, ""
+	}
+	return s[:i], s[i+1:]
+}
+
+// saveServer records the home server of id.  Identities that share our home
+// server have no server recorded.
+func (z *ZKC) saveServer(id [zkidentity.IdentitySize]byte, server string) error {
+	if server == "" || server == z.homeServer {
+		return nil
+	}
+	filename := path.Join(z.settings.Root, inboundDir,
+		hex.EncodeToString(id[:]), serverFilename)
+	return ioutil.WriteFile(filename, []byte(server), 0600)
+}
+
+// identityServer returns the home server of id or an empty string if id
+// shares our home server.
+func (z *ZKC) identityServer(id [zkidentity.IdentitySize]byte) string {
+	filename := path.Join(z.settings.Root, inboundDir,
+		hex.EncodeToString(id[:]), serverFilename)
+	server, err := ioutil.ReadFile(filename)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			z.Dbg(idZKC, "could not read home server %x: %v",
+				id, err)
+		}
+		return ""
+	}
+	return strings.TrimSpace(string(server))
+}
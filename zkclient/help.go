@@ -39,7 +39,9 @@ var (
 	cmdSave          = leader + "save"
 	cmdRestore       = leader + "restore"
 	cmdFind          = leader + "find"
+	cmdDirectory     = leader + "directory"
 	cmdResetRatchet  = leader + "reset"
+	cmdRevoke        = leader + "revoke"
 
 	helpArray = []help{
 		{
@@ -64,12 +66,14 @@ var (
 		},
 		{
 			command:     cmdFetch,
-			usage:       cmdFetch + " <pin>",
+			usage:       cmdFetch + " <pin>[@<server>]",
 			description: "download encrypted key exchange blob from server",
 			long: []string{
 				cmdFetch + " is used to download an encrypted key exchange blob from the server.  Once the blob id downloaded the user is prompted for the shared passphrase that was used to create the blob (see " + cmdKx + " for more information",
 				"",
 				"When this completes successfully the public identity of the other side is cached and one can commence exchanging messages.",
+				"",
+				"If the other side has an account on a federated server the PIN is printed as <pin>@<server> and must be entered as such.",
 			},
 		},
 		{
@@ -103,6 +107,8 @@ var (
 				cmdKx + " is used to upload an encrypted key exchange blob to the server.  A new window prompts the user for a passphrase that can be shared with a third party to decrypt the key exchange blob.",
 				"",
 				"When the command completes it prints a PIN code that a third party can use to obtain the encrypted key exchange blob.  See " + cmdFetch + " for more information.",
+				"",
+				"Depending on server policy the PIN becomes invalid once it has been fetched.  An outstanding PIN can be invalidated with " + cmdRevoke + ".",
 			},
 		},
 		{
@@ -215,9 +221,18 @@ var (
 		},
 		{
 			command:     cmdFind,
-			usage:       cmdFind + " <nick>",
+			usage:       cmdFind + " <nick>|<fingerprint>",
 			description: "looks up an identity in server",
 		},
+		{
+			command:     cmdDirectory,
+			usage:       cmdDirectory + " [list|unlist]",
+			description: "show or change directory listing",
+			long: []string{
+				"Without arguments this command prints whether your identity is listed in the server directory and can therefore be found by others using " + cmdFind + ".",
+				"list adds your identity to the directory and unlist removes it.  The server remembers the choice across reconnects.  An identity that was hidden by the server administrator can not be listed.",
+			},
+		},
 		{
 			command:     cmdResetRatchet,
 			usage:       cmdResetRatchet + " <nick>",
@@ -230,5 +245,16 @@ var (
 					"messages again.",
 			},
 		},
+		{
+			command:     cmdRevoke,
+			usage:       cmdRevoke + " <pin>",
+			description: "revoke an outstanding key exchange PIN",
+			long: []string{
+				"Remove the encrypted key exchange blob " +
+					"that was uploaded with " + cmdKx +
+					" from the server before it " +
+					"expires.",
+			},
+		},
 	}
 )
@@ -171,6 +171,7 @@ func (ka *kxAcceptWindow) KeyHandler(w *ttk.Window, k ttk.Key) {
 			pid:         &identity,
 			dk:          dk,
 			newIdentity: newIdentity,
+			server:      ka.rendezvousPullReply.Server,
 		}
 		ka.zkc.ttkACFPW = ttk.NewWindow(acfpw)
 		ttk.Focus(ka.zkc.ttkACFPW)
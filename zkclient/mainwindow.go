@@ -708,11 +708,30 @@ func (mw *mainWindow) action(cmd string) error {
 		}
 		return mw.zkc.find(args[1])
 
+	case cmdDirectory:
+		switch len(args) {
+		case 1:
+			return mw.zkc.directoryCmd(rpc.DirectoryStatus)
+		case 2:
+			if args[1] != rpc.DirectoryList &&
+				args[1] != rpc.DirectoryUnlist {
+				return mw.doUsage(args)
+			}
+			return mw.zkc.directoryCmd(args[1])
+		}
+		return mw.doUsage(args)
+
 	case cmdResetRatchet:
 		if len(args) != 2 {
 			return mw.doUsage(args)
 		}
 		return mw.zkc.reset(args[1])
+
+	case cmdRevoke:
+		if len(args) != 2 {
+			return mw.doUsage(args)
+		}
+		return mw.zkc.revoke(args[1])
 	}
 
 	return fmt.Errorf("invalid command: %v", cmd)
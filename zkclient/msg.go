@@ -40,6 +40,8 @@ type wireMsg struct {
 	payload interface{} // always set
 
 	callback func()
+
+	receipt uint64 // CRPC delivery receipt identifier, 0 for none
 }
 
 func (z *ZKC) scheduler() {
@@ -155,7 +157,8 @@ func (z *ZKC) scheduler() {
 					//z.Dbg(idSnd, "m.id %x %v", m.id, hiPrio)
 					if m.id != nil {
 						err = z.cacheCRPC(*m.id,
-							m.payload, m.callback)
+							m.payload, m.receipt,
+							m.callback)
 						if err != nil {
 							z.PrintfT(-1, REDBOLD+
 								"CRPC (rescheduled): %v"+
@@ -235,6 +238,21 @@ func (z *ZKC) scheduleCRPC(hi bool, id *[zkidentity.IdentitySize]byte, payload i
 	//z.Dbg(idSnd, "sending CRPC done")
 }
 
+// scheduleCRPCReceipt is scheduleCRPC for a message the server shall send a
+// delivery receipt for.
+func (z *ZKC) scheduleCRPCReceipt(hi bool, id *[zkidentity.IdentitySize]byte, payload interface{}, receipt uint64) {
+	m := wireMsg{
+		id:      id,
+		payload: payload,
+		receipt: receipt,
+	}
+	if hi {
+		z.hi <- m
+	} else {
+		z.lo <- m
+	}
+}
+
 func (z *ZKC) schedulePRPC(hi bool, msg rpc.Message, payload interface{}) {
 	m := wireMsg{
 		msg:     msg,
@@ -419,11 +437,16 @@ func (z *ZKC) crpc(r *ratchet.Ratchet, payload interface{}) ([]byte, error) {
 }
 
 func (z *ZKC) pm(id [zkidentity.IdentitySize]byte, message string, mode rpc.MessageMode) error {
-	z.scheduleCRPC(true, &id,
+	// servers only send receipts for their own users
+	var receipt uint64
+	if z.settings.Receipts && z.identityServer(id) == "" {
+		receipt = z.nextReceipt(id, message)
+	}
+	z.scheduleCRPCReceipt(true, &id,
 		rpc.PrivateMessage{
 			Text: message,
 			Mode: mode,
-		})
+		}, receipt)
 
 	return nil
 }
@@ -434,7 +457,7 @@ func (z *ZKC) isOnline() bool {
 	return z.online
 }
 
-func (z *ZKC) cacheCRPC(id [zkidentity.IdentitySize]byte, payload interface{}, f func()) error {
+func (z *ZKC) cacheCRPC(id [zkidentity.IdentitySize]byte, payload interface{}, receipt uint64, f func()) error {
 	// best effort to detect if we are offline
 	if !z.isOnline() {
 		return fmt.Errorf("not online")
@@ -492,6 +515,8 @@ func (z *ZKC) cacheCRPC(id [zkidentity.IdentitySize]byte, payload interface{}, f
 		rpc.Cache{
 			To:      *r.TheirIdentityPublic,
 			Payload: m,
+			Server:  z.identityServer(*r.TheirIdentityPublic),
+			Receipt: receipt,
 		})
 	if err != nil {
 		z.Lock()
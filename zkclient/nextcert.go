@@ -0,0 +1,128 @@
+// Copyright (c) 2020 Company 0, LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"path"
+
+	"github.com/companyzero/zkc/inidb"
+	"github.com/companyzero/zkc/rpc"
+	"github.com/companyzero/zkc/tools"
+)
+
+// parseNextCert obtains the certificate the server announced it rotates to
+// from myserver.ini.  The record is optional and announcements that do not
+// verify are discarded.
+func (z *ZKC) parseNextCert(server *inidb.INIDB) {
+	v, err := server.Get("", "nextcert")
+	if err != nil {
+		return
+	}
+	n, err := rpc.ParseNextCert(v)
+	if err != nil || !z.serverIdentity.VerifyMessage(n.Digest(),
+		n.Signature) {
+		z.Dbg(idZKC, "discarding invalid nextcert record")
+		return
+	}
+	z.nextCert = n
+}
+
+// saveNextCert records the announced certificate in myserver.ini.  If n is nil
+// the record is removed.
+func (z *ZKC) saveNextCert(n *rpc.NextCert) error {
+	server, err := inidb.New(path.Join(z.settings.Root,
+		tools.ZKCServerFilename), true, 10)
+	if err != nil && !errors.Is(err, inidb.ErrCreated) {
+		return fmt.Errorf("could not open server file: %v", err)
+	}
+	if n == nil {
+		err = server.Del("", "nextcert")
+	} else {
+		err = server.Set("", "nextcert", n.String())
+	}
+	if err != nil {
+		return fmt.Errorf("could not update record nextcert")
+	}
+	return server.Save()
+}
+
+// handleNextCert records the certificate announced in the welcome message.
+// The announcement must be signed by the server identity we pinned.
+func (z *ZKC) handleNextCert(welcome *rpc.Welcome) {
+	var value string
+	for _, v := range welcome.Properties {
+		if v.Key == rpc.PropNextCert {
+			value = v.Value
+			break
+		}
+	}
+
+	var n *rpc.NextCert
+	if value != "" {
+		var err error
+		n, err = rpc.ParseNextCert(value)
+		if err != nil {
+			z.PrintfT(0, REDBOLD+"Ignoring server certificate "+
+				"announcement: %v"+RESET, err)
+			return
+		}
+		if !z.serverIdentity.VerifyMessage(n.Digest(), n.Signature) {
+			z.PrintfT(0, REDBOLD+"Ignoring server certificate "+
+				"announcement with invalid signature"+RESET)
+			return
+		}
+	}
+
+	z.Lock()
+	defer z.Unlock()
+
+	if n == nil && z.nextCert == nil {
+		return
+	}
+	if n != nil && z.nextCert != nil &&
+		n.Fingerprint == z.nextCert.Fingerprint {
+		return
+	}
+	err := z.saveNextCert(n)
+	if err != nil {
+		z.PrintfT(0, REDBOLD+"Could not save server certificate "+
+			"announcement: %v"+RESET, err)
+		return
+	}
+	z.nextCert = n
+	if n != nil {
+		z.PrintfT(0, "Server announced certificate rotation, "+
+			"next outer fingerprint: %x", n.Fingerprint)
+	}
+}
+
+// acceptNextCert accepts a changed server certificate if the server announced
+// it before.  This function must be called with the mutex held.
+func (z *ZKC) acceptNextCert(cert []byte) bool {
+	if z.nextCert == nil || sha256.Sum256(cert) != z.nextCert.Fingerprint {
+		return false
+	}
+
+	err := z.saveServerRecord(z.serverIdentity, cert)
+	if err != nil {
+		z.PrintfT(0, REDBOLD+"Could not save server record: %v"+RESET,
+			err)
+		return false
+	}
+	err = z.saveNextCert(nil)
+	if err != nil {
+		z.Dbg(idZKC, "could not remove nextcert record: %v", err)
+	}
+	z.cert = cert
+	z.nextCert = nil
+
+	z.PrintfT(0, "Server certificate rotated, new outer fingerprint: %v",
+		tools.Fingerprint(cert))
+
+	return true
+}
@@ -200,7 +200,7 @@ func (z *ZKC) step2IDKX(msg rpc.Message, p rpc.Push) error {
 		var idkx rpc.IdentityKX
 		br := bytes.NewReader(decrypted)
 		_, err = xdr.Unmarshal(br, &idkx)
-		if err != nil {
+		if err != nil && !rpc.ShortRead(err) {
 			return fmt.Errorf("could not unmarshal IdentityKX")
 		}
 
@@ -235,6 +235,10 @@ func (z *ZKC) step2IDKX(msg rpc.Message, p rpc.Push) error {
 		if err != nil {
 			return fmt.Errorf("could not save identity %v", err)
 		}
+		err = z.saveServer(idkx.Identity.Identity, idkx.Server)
+		if err != nil {
+			return fmt.Errorf("could not save home server %v", err)
+		}
 
 		z.ratchetMtx.Lock()
 		err = z.updateRatchet(r, false)
@@ -320,7 +324,7 @@ func (z *ZKC) step2IDKX2(msg rpc.Message, p rpc.Push) error {
 	var idkx rpc.IdentityKX
 	br := bytes.NewReader(decrypted)
 	_, err = xdr.Unmarshal(br, &idkx)
-	if err != nil {
+	if err != nil && !rpc.ShortRead(err) {
 		return fmt.Errorf("could not unmarshal IdentityKX")
 	}
 
@@ -353,6 +357,10 @@ func (z *ZKC) step2IDKX2(msg rpc.Message, p rpc.Push) error {
 	if err != nil {
 		return fmt.Errorf("could not save identity %v", err)
 	}
+	err = z.saveServer(idkx.Identity.Identity, idkx.Server)
+	if err != nil {
+		return fmt.Errorf("could not save home server %v", err)
+	}
 
 	z.ratchetMtx.Lock()
 	err = z.updateRatchet(r, false)
@@ -0,0 +1,95 @@
+// Copyright (c) 2020 Company 0, LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/hex"
+	"time"
+
+	"github.com/companyzero/zkc/rpc"
+	"github.com/companyzero/zkc/tools"
+	"github.com/companyzero/zkc/zkidentity"
+)
+
+// sentMessage is a message that awaits a delivery receipt.
+type sentMessage struct {
+	text string    // message as typed
+	sent time.Time // time the message was sent
+}
+
+// nextReceipt returns a random delivery receipt identifier for message to id
+// and records message in the conversation with id so that the receipt can be
+// matched with it.  It returns 0, no receipt, if we are out of entropy.
+func (z *ZKC) nextReceipt(id [zkidentity.IdentitySize]byte, message string) uint64 {
+	receipt, err := tools.RandomUint64()
+	if err != nil || receipt == 0 {
+		return 0
+	}
+
+	z.Lock()
+	defer z.Unlock()
+
+	for k, v := range z.conversation {
+		if v == nil || k == 0 || v.group || v.id.Identity != id {
+			continue
+		}
+		if v.sent == nil {
+			v.sent = make(map[uint64]sentMessage)
+		}
+		v.sent[receipt] = sentMessage{
+			text: message,
+			sent: time.Now(),
+		}
+		break
+	}
+	return receipt
+}
+
+// handleDeliveryReceipt marks the message a receipt refers to as delivered in
+// the conversation with the recipient.
+func (z *ZKC) handleDeliveryReceipt(dr rpc.DeliveryReceipt) {
+	if !z.serverIdentity.VerifyMessage(dr.Digest(), dr.Signature) {
+		z.Error(idZKC, "delivery receipt signature verification "+
+			"failed")
+		z.PrintfT(0, REDBOLD+"discarded delivery receipt with "+
+			"invalid signature"+RESET)
+		return
+	}
+
+	nick := z.nickFromId(dr.Recipient)
+	if nick == "" {
+		nick = hex.EncodeToString(dr.Recipient[:])
+	}
+
+	// console unless a conversation with the recipient is open
+	var (
+		win   int
+		sm    sentMessage
+		found bool
+	)
+	z.Lock()
+	for k, v := range z.conversation {
+		if v == nil || k == 0 || v.group ||
+			v.id.Identity != dr.Recipient {
+			continue
+		}
+		win = k
+		sm, found = v.sent[dr.Receipt]
+		delete(v.sent, dr.Receipt)
+		break
+	}
+	z.Unlock()
+
+	delivered := time.Unix(dr.Delivered, 0)
+	if !found {
+		// sent before a restart or the window was closed
+		z.PrintfT(win, "message delivered to %v at %v", nick,
+			delivered.Format(z.settings.TimeFormat))
+		return
+	}
+	z.PrintfT(win, "message sent %v delivered to %v at %v: %v",
+		sm.sent.Format(z.settings.TimeFormat), nick,
+		delivered.Format(z.settings.TimeFormat), sm.text)
+}
@@ -33,6 +33,7 @@ type Settings struct {
 	TLSVerbose bool   // display outer TLS information
 	Beep       bool   // annoy people when message comes in
 	Separator  bool   // add line where conversation left off
+	Receipts   bool   // ask server to report message delivery
 
 	// log section
 	SaveHistory    bool
@@ -124,6 +125,7 @@ func ObtainSettings() (*Settings, error) {
 		TLSVerbose: true,
 		Beep:       false,
 		Separator:  false,
+		Receipts:   false,
 
 		// log
 		SaveHistory: false,
@@ -224,6 +226,12 @@ func ObtainSettings() (*Settings, error) {
 		return nil, err
 	}
 
+	// Delivery receipts
+	err = iniBool(cfg, &s.Receipts, "", "receipts")
+	if err != nil && !errors.Is(err, ErrIniNotFound) {
+		return nil, err
+	}
+
 	// logging and debug
 	err = iniBool(cfg, &s.SaveHistory, "log", "savehistory")
 	if err != nil && !errors.Is(err, ErrIniNotFound) {
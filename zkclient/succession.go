@@ -0,0 +1,66 @@
+// Copyright (c) 2020 Company 0, LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/companyzero/zkc/rpc"
+	xdr "github.com/davecgh/go-xdr/xdr2"
+)
+
+// followSuccession asks the server whether the identity we pinned was
+// succeeded.  If the server returns successions that are signed by the pinned
+// identity the server record is migrated to the successor and true is
+// returned.  Identity changes that are not signed are refused.  This function
+// must be called with the mutex held.
+func (z *ZKC) followSuccession() (bool, error) {
+	conn, cs, err := z.preSessionPhase()
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	if !bytes.Equal(cs.PeerCertificates[0].Raw, z.cert) {
+		return false, nil
+	}
+
+	_, err = xdr.Marshal(conn, rpc.InitialCmdSuccession)
+	if err != nil {
+		return false, fmt.Errorf("could not marshal succession command")
+	}
+	_, err = xdr.Marshal(conn, rpc.SuccessionRequest{
+		Identity: z.serverIdentity.Identity,
+	})
+	if err != nil {
+		return false, fmt.Errorf("could not marshal succession request")
+	}
+	var sr rpc.SuccessionReply
+	_, err = xdr.UnmarshalLimited(conn, &sr, z.msgSize)
+	if err != nil {
+		// servers that predate successions hang up
+		z.Dbg(idZKC, "could not unmarshal succession reply: %v", err)
+		return false, nil
+	}
+	if len(sr.Successions) == 0 {
+		return false, nil
+	}
+
+	pid, err := rpc.Successor(*z.serverIdentity, sr.Successions)
+	if err != nil {
+		return false, err
+	}
+	err = z.saveServerRecord(pid, z.cert)
+	if err != nil {
+		return false, err
+	}
+
+	z.PrintfT(0, "Server identity %v was succeeded by %v",
+		z.serverIdentity.Fingerprint(), pid.Fingerprint())
+	z.serverIdentity = pid
+
+	return true, nil
+}
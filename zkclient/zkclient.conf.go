@@ -14,6 +14,9 @@ tlsverbose = yes
 # Draw separator to show where conversation left off
 # separator = yes
 
+# Mark private messages as delivered once the recipient downloaded them
+# receipts = yes
+
 # logging and debug
 [log]
 
@@ -12,6 +12,7 @@ import (
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
@@ -291,6 +292,9 @@ type conversation struct {
 	mentioned      bool      // set when user nick is mentioned in group chat
 	lastMsg        time.Time // stamp of last received msg
 	seenCacheError int
+
+	// messages that await a delivery receipt, by receipt identifier
+	sent map[uint64]sentMessage
 }
 
 func (z *ZKC) nextConversation() {
@@ -628,14 +632,19 @@ type ZKC struct {
 	lastDuration    time.Duration // how many seconds before next ping
 	pingInProgress  bool          // waiting on pong?
 	kx              *session.KX
-	cert            []byte // remote cert for outer fingerprint
-	provisionalCert []byte // used when cert changed
+	cert            []byte        // remote cert for outer fingerprint
+	provisionalCert []byte        // used when cert changed
+	nextCert        *rpc.NextCert // cert the server announced it rotates to
 	tagStack        *tagstack.TagStack
 	tagCallback     []*cb  // what to do when tag is acknowledged
 	chunkSize       uint64 // max chunk size, provided by server
 	msgSize         uint   // max message size, provided by server
 	attachmentSize  uint64 // max attachment size, provided by server
 	directory       bool   // whether the server is in directory mode
+	homeServer      string // address federated servers know ours by
+	devices         bool   // whether the server accepts DeviceRegister
+
+	device [16]byte // identifies this client among our devices
 
 	// new rpc writer
 	done   chan struct{}    // shut it down
@@ -715,6 +724,10 @@ func (z *ZKC) saveServerRecord(pid *zkidentity.PublicIdentity,
 	if err != nil {
 		return fmt.Errorf("could not insert record myidentity")
 	}
+	err = server.Set("", "device", hex.EncodeToString(z.device[:]))
+	if err != nil {
+		return fmt.Errorf("could not insert record device")
+	}
 	err = server.Save()
 	if err != nil {
 		return fmt.Errorf("could not save server: %v", err)
@@ -750,11 +763,17 @@ func (z *ZKC) sessionPhase(conn net.Conn) (*session.KX, error) {
 		return nil, fmt.Errorf("can not go full session prior to dial")
 	}
 
-	// tell remote we want to go full session
-	_, err := xdr.Marshal(conn, rpc.InitialCmdSession)
+	// tell remote we want to go full session and which version we speak
+	_, err := xdr.Marshal(conn, rpc.InitialCmdSessionV)
 	if err != nil {
 		return nil, fmt.Errorf("could not marshal session command")
 	}
+	_, err = xdr.Marshal(conn, rpc.SessionV{
+		Version: rpc.ProtocolVersion,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not marshal session version")
+	}
 
 	// session with server and use a default msgSize
 	kx := new(session.KX)
@@ -838,6 +857,8 @@ func (z *ZKC) welcomePhase(kx *session.KX) (*rpc.Welcome, error) {
 		ms  uint64 = 0
 		as  uint64 = 0
 		dir bool   = false
+		hs  string = ""
+		dev bool   = false
 	)
 	if z.settings.Debug {
 		z.Dbg(idRPC, "remote properties:")
@@ -885,6 +906,19 @@ func (z *ZKC) welcomePhase(kx *session.KX) (*rpc.Welcome, error) {
 		case rpc.PropMOTD:
 			// ignore here, handled later
 
+		case rpc.PropNextCert:
+			// ignore here, handled later
+
+		case rpc.PropHomeServer:
+			hs = v.Value
+
+		case rpc.PropDevices:
+			dev, err = strconv.ParseBool(v.Value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid devices "+
+					"setting: %v", err)
+			}
+
 		case rpc.PropDirectory:
 			dir, err = strconv.ParseBool(v.Value)
 			if err != nil {
@@ -893,7 +927,11 @@ func (z *ZKC) welcomePhase(kx *session.KX) (*rpc.Welcome, error) {
 			}
 
 		default:
-			return nil, fmt.Errorf("unhandled property: %v", v.Key)
+			if v.Required {
+				return nil, fmt.Errorf("unhandled property: %v",
+					v.Key)
+			}
+			z.Dbg(idRPC, "ignoring optional property: %v", v.Key)
 		}
 	}
 
@@ -945,10 +983,49 @@ func (z *ZKC) welcomePhase(kx *session.KX) (*rpc.Welcome, error) {
 	z.msgSize = uint(ms)
 	z.attachmentSize = as
 	z.directory = dir
+	z.homeServer = hs
+	z.devices = dev
 
 	return &wmsg, nil
 }
 
+// devicePhase tells the server which of our devices this session belongs to.
+// It must be the first command of the session and is therefore written
+// directly instead of being scheduled.  Servers that do not accept devices
+// are skipped.
+// lock must be held
+func (z *ZKC) devicePhase() error {
+	if !z.devices {
+		return nil
+	}
+
+	tag, err := z.tagStack.Pop()
+	if err != nil {
+		return fmt.Errorf("could not obtain tag: %v", err)
+	}
+
+	var bb bytes.Buffer
+	_, err = xdr.Marshal(&bb, rpc.Message{
+		Command:   rpc.TaggedCmdDeviceRegister,
+		TimeStamp: time.Now().Unix(),
+		Tag:       tag,
+	})
+	if err != nil {
+		return fmt.Errorf("could not marshal DeviceRegister")
+	}
+	_, err = xdr.Marshal(&bb, rpc.DeviceRegister{Device: z.device})
+	if err != nil {
+		return fmt.Errorf("could not marshal DeviceRegister payload")
+	}
+
+	err = z.kx.Write(bb.Bytes())
+	if err != nil {
+		return fmt.Errorf("could not write DeviceRegister: %v", err)
+	}
+
+	return nil
+}
+
 // goOnline goes through all phases of a connection with a server.
 // If successful z.kx can be used to send commands back and forth.
 func (z *ZKC) goOnline() (*rpc.Welcome, error) {
@@ -965,14 +1042,31 @@ func (z *ZKC) goOnline() (*rpc.Welcome, error) {
 	}
 
 	// XXX check cert here
-	if !bytes.Equal(cs.PeerCertificates[0].Raw, z.cert) {
+	if !bytes.Equal(cs.PeerCertificates[0].Raw, z.cert) &&
+		!z.acceptNextCert(cs.PeerCertificates[0].Raw) {
 		z.provisionalCert = cs.PeerCertificates[0].Raw
 		return nil, errCert
 	}
 
 	kx, err := z.sessionPhase(conn)
 	if err != nil {
-		return nil, err
+		// the server identity may have been succeeded
+		ok, serr := z.followSuccession()
+		if serr != nil {
+			z.PrintfT(0, REDBOLD+"Refusing server identity "+
+				"change: %v"+RESET, serr)
+		}
+		if !ok {
+			return nil, err
+		}
+		conn, _, err = z.preSessionPhase()
+		if err != nil {
+			return nil, err
+		}
+		kx, err = z.sessionPhase(conn)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	welcome, err := z.welcomePhase(kx)
@@ -980,6 +1074,11 @@ func (z *ZKC) goOnline() (*rpc.Welcome, error) {
 		return nil, err
 	}
 
+	err = z.devicePhase()
+	if err != nil {
+		return nil, err
+	}
+
 	go z.handleRPC()
 
 	return welcome, nil
@@ -1071,6 +1170,7 @@ func (z *ZKC) step1IDKX(id zkidentity.PublicIdentity) error {
 	idkx := rpc.IdentityKX{
 		Identity: z.id.Public,
 		KX:       *kxRatchet,
+		Server:   z.homeServer,
 	}
 	idkxXDR := &bytes.Buffer{}
 	_, err = xdr.Marshal(idkxXDR, idkx)
@@ -1348,7 +1448,13 @@ func (z *ZKC) handleRPC() {
 			if r.Error != "" {
 				z.PrintfT(0, "key exchange failed: %v", r.Error)
 			} else {
-				z.PrintfT(0, "key exchange PIN: %v", r.Token)
+				if z.homeServer != "" {
+					z.PrintfT(0, "key exchange PIN: %v@%v",
+						r.Token, z.homeServer)
+				} else {
+					z.PrintfT(0, "key exchange PIN: %v",
+						r.Token)
+				}
 			}
 			err = z.tagStack.Push(message.Tag)
 			if err != nil {
@@ -1360,7 +1466,7 @@ func (z *ZKC) handleRPC() {
 		case rpc.TaggedCmdRendezvousPullReply:
 			var r rpc.RendezvousPullReply
 			_, err = xdr.Unmarshal(br, &r)
-			if err != nil {
+			if err != nil && !rpc.ShortRead(err) {
 				exitError = fmt.Errorf("unmarshal " +
 					"RendezvousPullReply")
 				return
@@ -1378,6 +1484,46 @@ func (z *ZKC) handleRPC() {
 				return
 			}
 
+		case rpc.TaggedCmdRendezvousRevokeReply:
+			var r rpc.RendezvousRevokeReply
+			_, err = xdr.Unmarshal(br, &r)
+			if err != nil {
+				exitError = fmt.Errorf("unmarshal " +
+					"RendezvousRevokeReply")
+				return
+			}
+			if r.Error != "" {
+				z.PrintfT(0, "revoke failed: %v", r.Error)
+			} else {
+				z.PrintfT(0, "key exchange PIN revoked: %v",
+					r.Token)
+			}
+			err = z.tagStack.Push(message.Tag)
+			if err != nil {
+				exitError = fmt.Errorf("RendezvousRevokeReply "+
+					"invalid tag: %v", message.Tag)
+				return
+			}
+
+		case rpc.TaggedCmdDeviceRegisterReply:
+			var r rpc.DeviceRegisterReply
+			_, err = xdr.Unmarshal(br, &r)
+			if err != nil {
+				exitError = fmt.Errorf("unmarshal " +
+					"DeviceRegisterReply")
+				return
+			}
+			if r.Error != "" {
+				z.PrintfT(0, REDBOLD+"device registration "+
+					"failed: %v"+RESET, r.Error)
+			}
+			err = z.tagStack.Push(message.Tag)
+			if err != nil {
+				exitError = fmt.Errorf("DeviceRegisterReply "+
+					"invalid tag: %v", message.Tag)
+				return
+			}
+
 		case rpc.TaggedCmdPush:
 			var p rpc.Push
 			_, err = xdr.Unmarshal(br, &p)
@@ -1429,6 +1575,51 @@ func (z *ZKC) handleRPC() {
 				},
 				rpc.Acknowledge{})
 
+		case rpc.TaggedCmdNotice:
+			var n rpc.Notice
+			_, err = xdr.Unmarshal(br, &n)
+			if err != nil {
+				exitError = fmt.Errorf("unmarshal Notice")
+				return
+			}
+
+			z.Dbg(idZKC, "handle CRPC %v tag %v",
+				message.Command,
+				message.Tag)
+
+			z.handleNotice(n)
+
+			// send ack
+			z.schedulePRPC(true,
+				rpc.Message{
+					Command: rpc.TaggedCmdAcknowledge,
+					Tag:     message.Tag,
+				},
+				rpc.Acknowledge{})
+
+		case rpc.TaggedCmdDeliveryReceipt:
+			var dr rpc.DeliveryReceipt
+			_, err = xdr.Unmarshal(br, &dr)
+			if err != nil {
+				exitError = fmt.Errorf("unmarshal " +
+					"DeliveryReceipt")
+				return
+			}
+
+			z.Dbg(idZKC, "handle CRPC %v tag %v",
+				message.Command,
+				message.Tag)
+
+			z.handleDeliveryReceipt(dr)
+
+			// send ack
+			z.schedulePRPC(true,
+				rpc.Message{
+					Command: rpc.TaggedCmdAcknowledge,
+					Tag:     message.Tag,
+				},
+				rpc.Acknowledge{})
+
 		case rpc.TaggedCmdAcknowledge:
 			var a rpc.Acknowledge
 			_, err = xdr.Unmarshal(br, &a)
@@ -1458,7 +1649,23 @@ func (z *ZKC) handleRPC() {
 			}
 
 			// print error if we got one
-			if a.Error != "" {
+			switch {
+			case c != nil && a.ErrorCode == rpc.ErrorCodeMailboxFull:
+				nick := z.nickFromId(c.to)
+				z.FloodfT(nick, REDBOLD+"message not delivered, "+
+					"recipient mailbox full: %v"+RESET, nick)
+			case c != nil && a.ErrorCode == rpc.ErrorCodeRelayFailed:
+				nick := z.nickFromId(c.to)
+				z.FloodfT(nick, REDBOLD+"message not delivered, "+
+					"home server unreachable: %v"+RESET, nick)
+			case c != nil && a.ErrorCode == rpc.ErrorCodeRateLimited:
+				nick := z.nickFromId(c.to)
+				z.FloodfT(nick, REDBOLD+"message not delivered, "+
+					"server rate limit exceeded: %v"+RESET, nick)
+			case a.ErrorCode == rpc.ErrorCodeRateLimited:
+				z.PrintfT(0, REDBOLD+"server rate limit "+
+					"exceeded: %v"+RESET, a.Error)
+			case a.Error != "":
 				z.PrintfT(0, REDBOLD+"cache error: %v"+RESET,
 					a.Error)
 			}
@@ -1511,6 +1718,34 @@ func (z *ZKC) handleRPC() {
 				}
 			}
 
+		case rpc.TaggedCmdDirectoryReply:
+			var r rpc.DirectoryReply
+			_, err = xdr.Unmarshal(br, &r)
+			if err != nil {
+				exitError = fmt.Errorf("unmarshal " +
+					"DirectoryReply")
+				return
+			}
+
+			err = z.tagStack.Push(message.Tag)
+			if err != nil {
+				exitError = fmt.Errorf("DirectoryReply "+
+					"invalid tag: %v", message.Tag)
+				return
+			}
+
+			switch {
+			case r.Error != "":
+				z.PrintfT(0, "directory %v: %v", r.Action, r.Error)
+			case r.Hidden:
+				z.PrintfT(0, "Not listed in directory: "+
+					"hidden by server administrator")
+			case r.Listed:
+				z.PrintfT(0, "Listed in directory")
+			default:
+				z.PrintfT(0, "Not listed in directory")
+			}
+
 		case rpc.TaggedCmdProxyReply:
 			var p rpc.ProxyReply
 			_, err = xdr.Unmarshal(br, &p)
@@ -1542,6 +1777,18 @@ func (z *ZKC) handleRPC() {
 					n, p.To)
 			}
 
+		case rpc.SessionCmdUnwelcome:
+			// the server is going away, e.g. because it shuts
+			// down; reconnect later
+			var u rpc.Unwelcome
+			_, err = xdr.Unmarshal(br, &u)
+			if err != nil {
+				exitError = fmt.Errorf("unmarshal Unwelcome")
+				return
+			}
+			exitError = fmt.Errorf("server unwelcome: %v", u.Reason)
+			return
+
 		default:
 			exitError = fmt.Errorf("unhandled message %v tag %v",
 				message.Command, message.Tag)
@@ -1550,7 +1797,30 @@ func (z *ZKC) handleRPC() {
 	}
 }
 
+// handleNotice renders an administrator notice in the console window.
+// Notices that were not signed by the server we pinned are rejected.
+func (z *ZKC) handleNotice(n rpc.Notice) {
+	if !z.serverIdentity.VerifyMessage(n.Digest(), n.Signature) {
+		z.Error(idZKC, "notice signature verification failed")
+		z.PrintfT(0, REDBOLD+"discarded server notice with invalid "+
+			"signature"+RESET)
+		return
+	}
+
+	sent := time.Unix(n.Sent, 0).Format(z.settings.LongTimeFormat)
+	z.PrintfT(0, MAGENTABOLD+"Server notice sent %v:"+RESET, sent)
+	for _, v := range strings.Split(n.Text, "\n") {
+		z.PrintfT(0, MAGENTABOLD+"%v"+RESET, v)
+	}
+}
+
 func (z *ZKC) cache(to [32]byte, blob []byte) error {
+	return z.cacheServer(to, z.identityServer(to), blob)
+}
+
+// cacheServer sends blob to an identity that lives on server.  An empty
+// server is our own.
+func (z *ZKC) cacheServer(to [32]byte, server string, blob []byte) error {
 	if !z.isOnline() {
 		return fmt.Errorf("not online")
 	}
@@ -1568,6 +1838,7 @@ func (z *ZKC) cache(to [32]byte, blob []byte) error {
 		rpc.Cache{
 			To:      to,
 			Payload: blob,
+			Server:  server,
 		})
 
 	return nil
@@ -1628,6 +1899,9 @@ func (z *ZKC) parseMyServer(server *inidb.INIDB) error {
 		return fmt.Errorf("could not decode servercert")
 	}
 
+	// nextcert is optional
+	z.parseNextCert(server)
+
 	return nil
 }
 
@@ -1650,6 +1924,30 @@ func (z *ZKC) parseMyIdentity(server *inidb.INIDB) error {
 	return nil
 }
 
+// parseMyDevice obtains the device identifier from myserver.ini.  Clients
+// that predate devices do not have one so it is created on the fly.
+func (z *ZKC) parseMyDevice(server *inidb.INIDB) error {
+	device, err := server.Get("", "device")
+	if err == nil {
+		d, err := hex.DecodeString(device)
+		if err != nil || len(d) != len(z.device) {
+			return fmt.Errorf("could not decode device")
+		}
+		copy(z.device[:], d)
+		return nil
+	}
+
+	_, err = io.ReadFull(rand.Reader, z.device[:])
+	if err != nil {
+		return fmt.Errorf("could not create device: %v", err)
+	}
+	err = server.Set("", "device", hex.EncodeToString(z.device[:]))
+	if err != nil {
+		return fmt.Errorf("could not insert record device")
+	}
+	return server.Save()
+}
+
 func (z *ZKC) welcomeUser(welcome *rpc.Welcome) error {
 	remoteId, ok := z.kx.TheirIdentity().([32]byte)
 	if !ok {
@@ -1684,6 +1982,8 @@ func (z *ZKC) welcomeUser(welcome *rpc.Welcome) error {
 		break
 	}
 
+	z.handleNextCert(welcome)
+
 	if len(z.conversation) == 1 {
 		_ = restoreConversations(z)
 	}
@@ -1691,8 +1991,11 @@ func (z *ZKC) welcomeUser(welcome *rpc.Welcome) error {
 	return nil
 }
 
-// fetch tries to obtain a Rendezvous blob using provided pin.
+// fetch tries to obtain a Rendezvous blob using provided pin.  A pin of the
+// form pin@server is fetched from the user's home server.
 func (z *ZKC) fetch(pin string) error {
+	token, server := splitPIN(pin)
+
 	if !z.isOnline() {
 		return fmt.Errorf("not online")
 	}
@@ -1707,13 +2010,37 @@ func (z *ZKC) fetch(pin string) error {
 			Tag:     tag,
 		},
 		rpc.RendezvousPull{
+			Token:  token,
+			Server: server,
+		})
+
+	return nil
+}
+
+// revoke removes a previously uploaded Rendezvous blob identified by pin.
+func (z *ZKC) revoke(pin string) error {
+	if !z.isOnline() {
+		return fmt.Errorf("not online")
+	}
+
+	tag, err := z.tagStack.Pop()
+	if err != nil {
+		return fmt.Errorf("could not obtain tag: %v", err)
+	}
+	z.schedulePRPC(true,
+		rpc.Message{
+			Command: rpc.TaggedCmdRendezvousRevoke,
+			Tag:     tag,
+		},
+		rpc.RendezvousRevoke{
 			Token: pin,
 		})
 
 	return nil
 }
 
-// find looks up a nickname on the server's identity directory.
+// find looks up a nickname or fingerprint on the server's identity
+// directory.
 func (z *ZKC) find(nick string) error {
 	if !z.isOnline() {
 		return fmt.Errorf("not online")
@@ -1724,13 +2051,17 @@ func (z *ZKC) find(nick string) error {
 	if nick == "" {
 		return fmt.Errorf("must provide nick")
 	}
-	if nick == z.id.Public.Nick {
+	if nick == z.id.Public.Nick || nick == z.id.Public.Fingerprint() {
 		return fmt.Errorf("can't find self")
 	}
 	_, err := z.ab.FindNick(nick)
 	if err == nil {
 		return fmt.Errorf("nick already known: %v", nick)
 	}
+	_, err = z.ab.FindIdentityS(nick)
+	if err == nil {
+		return fmt.Errorf("identity already known: %v", nick)
+	}
 
 	z.pendingIdentitiesMutex.Lock()
 	defer z.pendingIdentitiesMutex.Unlock()
@@ -1763,6 +2094,33 @@ func (z *ZKC) find(nick string) error {
 	return nil
 }
 
+// directoryCmd queries or changes whether our identity is listed in the
+// server's identity directory.
+func (z *ZKC) directoryCmd(action string) error {
+	if !z.isOnline() {
+		return fmt.Errorf("not online")
+	}
+	if !z.directory {
+		return fmt.Errorf("directory not supported")
+	}
+
+	tag, err := z.tagStack.Pop()
+	if err != nil {
+		return fmt.Errorf("could not obtain tag: %v", err)
+	}
+
+	z.schedulePRPC(true,
+		rpc.Message{
+			Command: rpc.TaggedCmdDirectory,
+			Tag:     tag,
+		},
+		rpc.Directory{
+			Action: action,
+		})
+
+	return nil
+}
+
 // reset sends an unencrypted proxy message to the server which will be
 // forwarded to the correct user in order to initiate a ratchet reset.
 func (z *ZKC) reset(nick string) error {
@@ -2146,6 +2504,16 @@ func _main() error {
 			// really can't happen
 			return fmt.Errorf("could not create new identity")
 		}
+		_, err = io.ReadFull(rand.Reader, z.device[:])
+		if err != nil {
+			return fmt.Errorf("could not create device: %v", err)
+		}
+	} else {
+		err = z.parseMyDevice(server)
+		if err != nil {
+			return fmt.Errorf("could not parse myserver: %v",
+				err)
+		}
 	}
 
 	// initialize terminal
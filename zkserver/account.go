@@ -11,6 +11,7 @@ import (
 
 	"github.com/companyzero/zkc/rpc"
 	"github.com/companyzero/zkc/zkidentity"
+	"github.com/companyzero/zkc/zkserver/account"
 	"github.com/companyzero/zkc/zkserver/socketapi"
 	xdr "github.com/davecgh/go-xdr/xdr2"
 )
@@ -37,20 +38,35 @@ func (z *ZKS) handleAccountCreate(conn net.Conn, ca rpc.CreateAccount) error {
 	z.T(idApp, "handleAccountCreate: %v %v",
 		conn.RemoteAddr(),
 		ca.PublicIdentity.Fingerprint())
+	// throttle attempts
+	if !z.accountCreateAllowed(conn.RemoteAddr()) {
+		z.accountReplyFailure("too many account create attempts",
+			conn, ca)
+		return fmt.Errorf("too many account create attempts")
+	}
+
 	// check policy
-	switch z.settings.CreatePolicy {
+	switch z.settings().CreatePolicy {
 	default:
 		fallthrough
 	case "no":
 		z.accountReplyFailure("disallowing account create", conn, ca)
 		return fmt.Errorf("disallowing account create")
 	case "token":
-		if !z.validToken(ca.Token, conn) {
+		if z.nickReserved(ca.PublicIdentity.Nick, ca.Token) {
+			z.accountReplyFailure("nick reserved", conn, ca)
+			return fmt.Errorf("nick reserved")
+		}
+		if !z.validToken(ca.Token, ca.PublicIdentity.Nick, conn) {
 			z.accountReplyFailure("invalid account create token",
 				conn, ca)
 			return fmt.Errorf("invalid account create token")
 		}
 	case "yes":
+		if z.nickReserved(ca.PublicIdentity.Nick, "") {
+			z.accountReplyFailure("nick reserved", conn, ca)
+			return fmt.Errorf("nick reserved")
+		}
 	}
 
 	// try to create account
@@ -64,6 +80,7 @@ func (z *ZKS) handleAccountCreate(conn net.Conn, ca rpc.CreateAccount) error {
 		z.Info(idApp, "created account %v: %v",
 			conn.RemoteAddr(),
 			ca.PublicIdentity.Fingerprint())
+		z.auditAccountCreate(conn, ca)
 	}
 
 	// send reply
@@ -100,6 +117,48 @@ func (z *ZKS) handleIdentityFind(writer chan *RPCWrapper, msg rpc.Message, nick
 	return nil
 }
 
+// handleDirectory lists or unlists the identity of a session in the directory
+// as requested by its owner and returns the resulting status.
+func (z *ZKS) handleDirectory(writer chan *RPCWrapper, rid [zkidentity.IdentitySize]byte, msg rpc.Message, d rpc.Directory) error {
+	reply := RPCWrapper{
+		Message: rpc.Message{
+			Command: rpc.TaggedCmdDirectoryReply,
+			Tag:     msg.Tag,
+		},
+	}
+	payload := rpc.DirectoryReply{
+		Action: d.Action,
+	}
+
+	var err error
+	switch {
+	case !z.settings().Directory:
+		err = fmt.Errorf("directory not supported")
+	case d.Action == rpc.DirectoryList:
+		err = z.account.SetUnlisted(rid, false)
+	case d.Action == rpc.DirectoryUnlist:
+		err = z.account.SetUnlisted(rid, true)
+	case d.Action != rpc.DirectoryStatus:
+		err = fmt.Errorf("invalid directory action: %v", d.Action)
+	}
+	if err == nil {
+		ir, gerr := z.store.GetIdentity(rid)
+		if gerr == nil {
+			payload.Listed = ir.Listed && !ir.Hidden && !ir.Unlisted
+			payload.Hidden = ir.Hidden
+		}
+		err = gerr
+	}
+	if err != nil {
+		payload.Error = err.Error()
+		z.Dbg(idApp, "directory %v %x: %v", d.Action, rid, err)
+	}
+
+	reply.Payload = payload
+	writer <- &reply
+	return nil
+}
+
 // handleIdentityDisable always returns an answer to the disable command.
 func (z *ZKS) handleIdentityDisable(ud socketapi.SocketCommandUserDisable) (udr *socketapi.SocketCommandUserDisableReply) {
 	udr = &socketapi.SocketCommandUserDisableReply{}
@@ -145,3 +204,115 @@ func (z *ZKS) handleIdentityEnable(ue socketapi.SocketCommandUserEnable) (uer *s
 
 	return
 }
+
+// parseIdentity decodes a hex encoded identity.
+func parseIdentity(s string) ([zkidentity.IdentitySize]byte, error) {
+	var id [zkidentity.IdentitySize]byte
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return id, err
+	}
+	if len(b) != zkidentity.IdentitySize {
+		return id, fmt.Errorf("invalid identity length: %v", len(b))
+	}
+	copy(id[:], b)
+	return id, nil
+}
+
+// handleIdentityPurge always returns an answer to the purge command.  Online
+// sessions of the identity are disconnected before the account is purged so
+// that they can't write to it while it is being removed.
+func (z *ZKS) handleIdentityPurge(up socketapi.SocketCommandUserPurge) *socketapi.SocketCommandUserPurgeReply {
+	upr := &socketapi.SocketCommandUserPurgeReply{}
+	id, err := parseIdentity(up.Identity)
+	if err != nil {
+		upr.Error = err.Error()
+		return upr
+	}
+
+	// knock all devices of user offline and keep new sessions out until
+	// the account is gone
+	z.Lock()
+	defer z.Unlock()
+	for device, sc := range z.sessions[up.Identity] {
+		z.Dbg(idSock, "user disconnected %v %x", up.Identity, device)
+		sc.kx.Close()
+		z.auditDisconnect(socketapi.SCUserPurge, up.Identity, device)
+	}
+
+	err = z.account.Purge(id)
+	if err != nil {
+		upr.Error = err.Error()
+		return upr
+	}
+
+	z.Info(idSock, "user purged %v", up.Identity)
+
+	return upr
+}
+
+// handleIdentityNick always returns an answer to the nick command.  The user
+// is sent a notice with the new nick.
+func (z *ZKS) handleIdentityNick(un socketapi.SocketCommandUserNick) *socketapi.SocketCommandUserNickReply {
+	unr := &socketapi.SocketCommandUserNickReply{}
+	id, err := parseIdentity(un.Identity)
+	if err != nil {
+		unr.Error = err.Error()
+		return unr
+	}
+	err = z.account.SetNick(id, un.Nick)
+	if err != nil {
+		unr.Error = err.Error()
+		return unr
+	}
+
+	// the directory already finds the new nick, tell the user as well
+	ir, err := z.store.GetIdentity(id)
+	if err != nil {
+		z.Warn(idSock, "could not notify %v of nick: %v", un.Identity,
+			err)
+		return unr
+	}
+	b, err := z.signNotice(fmt.Sprintf("Your directory nick is now %v",
+		ir.DirectoryNick()))
+	if err == nil {
+		_, err = z.account.Deliver(id, z.id.Public.Identity, b,
+			account.DeliverOptions{Cleartext: true})
+	}
+	if err != nil {
+		z.Warn(idSock, "could not notify %v of nick: %v", un.Identity,
+			err)
+	}
+	return unr
+}
+
+// handleDirectoryList always returns an answer to the directory list command.
+func (z *ZKS) handleDirectoryList(dl socketapi.SocketCommandDirectoryList) *socketapi.SocketCommandDirectoryListReply {
+	dlr := &socketapi.SocketCommandDirectoryListReply{}
+	id, err := parseIdentity(dl.Identity)
+	if err != nil {
+		dlr.Error = err.Error()
+		return dlr
+	}
+	err = z.account.List(id)
+	if err != nil {
+		dlr.Error = err.Error()
+	}
+	return dlr
+}
+
+// handleDirectoryUnlist always returns an answer to the directory unlist
+// command.
+func (z *ZKS) handleDirectoryUnlist(du socketapi.SocketCommandDirectoryUnlist) *socketapi.SocketCommandDirectoryUnlistReply {
+	dur := &socketapi.SocketCommandDirectoryUnlistReply{}
+	id, err := parseIdentity(du.Identity)
+	if err != nil {
+		dur.Error = err.Error()
+		return dur
+	}
+	err = z.account.Unlist(id)
+	if err != nil {
+		dur.Error = err.Error()
+	}
+	return dur
+}
@@ -6,27 +6,18 @@ package account
 
 import (
 	"bytes"
-	"encoding/base64"
 	"encoding/hex"
 	"errors"
 	"fmt"
-	"io"
-	"io/ioutil"
-	"os"
-	"path"
 	"sync"
 	"time"
 
-	"github.com/companyzero/zkc/inidb"
+	"github.com/companyzero/zkc/rpc"
 	"github.com/companyzero/zkc/zkidentity"
+	"github.com/companyzero/zkc/zkserver/storage"
 	xdr "github.com/davecgh/go-xdr/xdr2"
 )
 
-const (
-	CacheDir             = "cache"
-	UserIdentityFilename = "user.ini"
-)
-
 type ErrAlreadyOnline struct {
 	err error
 }
@@ -37,11 +28,20 @@ func (e ErrAlreadyOnline) Error() string {
 
 // Account opaque type that handles account related services.
 type Account struct {
-	root string // root location of all accounts
+	store storage.Backend // persistent account state
 
 	// mutexed memebers
 	sync.Mutex
-	online map[[32]byte]diskNotification
+	online       map[[32]byte]map[storage.DeviceID]diskNotification
+	quota        Quota
+	mailboxes    map[[zkidentity.IdentitySize]byte]*mailbox // quota usage
+	maxAge       time.Duration                              // undelivered message age
+	devicePolicy DevicePolicy
+
+	deliveredBytes uint64 // payload bytes stored by Deliver
+
+	directory *directory          // locks itself
+	unindexed []UnindexedIdentity // identities missing from directory
 }
 
 type diskNotification struct {
@@ -49,10 +49,11 @@ type diskNotification struct {
 	work      chan struct{}
 	quit      chan struct{}
 	processed map[string]struct{}
+	device    *storage.DeviceID // protected by the Account mutex
 }
 
 // diskMessage is the on disk structure of a message. To is identified by the
-// delivery directory name and from is stored in the structure.  That fully
+// mailbox it is stored in and from is stored in the structure.  That fully
 // identifies from where the message came and where it shall be delivered.
 type diskMessage struct {
 	From     [zkidentity.IdentitySize]byte
@@ -62,6 +63,12 @@ type diskMessage struct {
 	// the struct for compatibility reasons. Default is 0 which means
 	// content is encrypted as it always was prior to this change.
 	Cleartext bool // Content is cleartext when set
+	// Expires was added after Cleartext for the same reason.  Default is
+	// 0 which means the message only expires per server policy.
+	Expires int64 // unix time when message expires
+	// Receipt was added after Expires for the same reason.  Default is
+	// 0 which means the sender did not ask for a delivery receipt.
+	Receipt uint64 // sender chosen delivery receipt identifier
 }
 
 // Notification contains the necessary information to notify the caller that a
@@ -74,50 +81,33 @@ type Notification struct {
 	From       [zkidentity.IdentitySize]byte
 	Received   int64 // received time
 	Payload    []byte
-	Cleartext  bool // Set when payload is clear text
+	Cleartext  bool   // Set when payload is clear text
+	Receipt    uint64 // delivery receipt identifier, 0 for none
 	Identifier string
 	Error      error
 }
 
-// New initializes an Account context.  It creates the containing directory and
-// launches the push channel handling.
-// Note that New walks the root directory and removes stale locks.  The
-// directory walk is slow and this call may take a while to complete.
-func New(root string) (*Account, error) {
-	if root == "" {
-		return nil, fmt.Errorf("must provide root directory")
+// New initializes an Account context that keeps its state in store.
+func New(store storage.Backend) (*Account, error) {
+	if store == nil {
+		return nil, fmt.Errorf("must provide storage backend")
 	}
 
 	a := Account{
-		root:   root,
-		online: make(map[[zkidentity.IdentitySize]byte]diskNotification),
+		store:     store,
+		online:    make(map[[zkidentity.IdentitySize]byte]map[storage.DeviceID]diskNotification),
+		mailboxes: make(map[[zkidentity.IdentitySize]byte]*mailbox),
+		directory: newDirectory(),
 	}
-
-	// make directory
-	err := os.MkdirAll(root, 0700)
+	var err error
+	a.unindexed, err = a.buildDirectory()
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("could not build directory: %v", err)
 	}
 
 	return &a, nil
 }
 
-// AccountDirDisabled return the account directory for a given disabled identity.
-func (a *Account) accountDirDisabled(id [zkidentity.IdentitySize]byte) string {
-	return path.Join(a.root, "."+hex.EncodeToString(id[:]))
-}
-
-// AccountDir return the account directory for a given identity.
-func (a *Account) accountDir(id [zkidentity.IdentitySize]byte) string {
-	return path.Join(a.root, hex.EncodeToString(id[:]))
-}
-
-// AccountFile return the account filename for a given identity.
-func (a *Account) accountFile(id [zkidentity.IdentitySize]byte,
-	file string) string {
-	return path.Join(a.root, hex.EncodeToString(id[:]), file)
-}
-
 // createAccount creates all directories and files associated with an account.
 // It returns a logable and a sanitized error.
 func (a *Account) Create(pid zkidentity.PublicIdentity, force bool) error {
@@ -125,204 +115,149 @@ func (a *Account) Create(pid zkidentity.PublicIdentity, force bool) error {
 	if err == nil {
 		return fmt.Errorf("nickname already in use")
 	}
-	// make sure account doesn't exist
-	accountName := a.accountDir(pid.Identity)
-	_, err = os.Stat(accountName)
-	if err == nil {
-		if !force {
-			return fmt.Errorf("account already exists: %v",
-				accountName)
-		}
-	}
 
-	// open user db
-	user, err := inidb.New(a.accountFile(pid.Identity,
-		UserIdentityFilename), true, 10)
-	if err != nil && !errors.Is(err, inidb.ErrCreated) {
-		return fmt.Errorf("could not open userdb: %v", err)
-	}
-
-	// save public identity
-	var b bytes.Buffer
-	_, err = xdr.Marshal(&b, pid)
-	if err != nil {
-		return fmt.Errorf("create account Marshal PublicIdentity failed")
-	}
-	err = user.Set("", "identity",
-		base64.StdEncoding.EncodeToString(b.Bytes()))
-	if err != nil {
-		return fmt.Errorf("could not insert record identity: %v", err)
-	}
-	err = user.Save()
-	if err != nil {
-		return fmt.Errorf("could not save user: %v", err)
-	}
-
-	// make additional directories
-	err = os.Mkdir(a.accountFile(pid.Identity, CacheDir), 0700)
-	if err != nil && !os.IsExist(err) {
-		return fmt.Errorf("could not create cache directory: %v", err)
+	err = a.store.CreateIdentity(pid, force)
+	if errors.Is(err, storage.ErrExists) {
+		return fmt.Errorf("account already exists: %x",
+			pid.Identity)
+	} else if err != nil {
+		return err
 	}
 
-	return nil
+	// a forced create may replace a listed identity
+	return a.index(pid.Identity)
 }
 
+// Push lists an identity in the directory unless the administrator or its
+// owner keep it out of the directory.
 func (a *Account) Push(id [zkidentity.IdentitySize]byte) error {
-	accountName := a.accountDir(id)
-	_, err := os.Stat(accountName)
-	if err != nil {
+	ir, err := a.store.GetIdentity(id)
+	if errors.Is(err, storage.ErrNotFound) {
 		return fmt.Errorf("account not found")
+	} else if err != nil {
+		return fmt.Errorf("could not list user: %v", err)
 	}
-	user, err := inidb.New(a.accountFile(id, UserIdentityFilename), false, 10)
-	if err != nil {
-		return fmt.Errorf("could not open userdb: %v", err)
+	if ir.Hidden || ir.Unlisted {
+		return nil
 	}
 
-	err = user.Set("", "listed", "1")
-	if err != nil {
+	err = a.store.SetListed(id, true)
+	if errors.Is(err, storage.ErrNotFound) {
+		return fmt.Errorf("account not found")
+	} else if err != nil {
 		return fmt.Errorf("could not list user: %v", err)
 	}
-	err = user.Save()
-	if err != nil {
-		return fmt.Errorf("could not save user: %v", err)
-	}
 
-	return nil
+	return a.index(id)
 }
 
-func (a *Account) Find(nick string) (*zkidentity.PublicIdentity, error) {
-	a.Lock()
-	fi, err := ioutil.ReadDir(a.root)
-	if err != nil {
-		a.Unlock()
-		return nil, fmt.Errorf("could not find user: %v", err)
+// Find returns the identity that is listed in the directory with directory
+// nick s.  s may also be the hex or base64 encoded identity.
+func (a *Account) Find(s string) (*zkidentity.PublicIdentity, error) {
+	pid, ok := a.directory.find(s)
+	if !ok {
+		return nil, fmt.Errorf("user not found")
 	}
-	for _, v := range fi {
-		dirname := path.Join(a.root, v.Name())
-		user, err := inidb.New(path.Join(dirname, UserIdentityFilename), false, 10)
-		if err != nil {
-			a.Unlock()
-			return nil, fmt.Errorf("could not find user: %v", err)
-		}
-		a.Unlock()
-
-		listed, err := user.Get("", "listed")
-		if err == nil && listed == "1" {
-			b64, err := user.Get("", "identity")
-			if err != nil {
-				return nil, fmt.Errorf("could not get user: %v", err)
-			}
-			blob, err := base64.StdEncoding.DecodeString(b64)
-			if err != nil {
-				return nil, fmt.Errorf("could not decode user: %v", err)
-			}
-			id := new(zkidentity.PublicIdentity)
-			br := bytes.NewReader(blob)
-			_, err = xdr.Unmarshal(br, &id)
-			if err != nil {
-				return nil, fmt.Errorf("could not unmarshal user: %v", err)
-			}
-			if id.Nick == nick {
-				return id, nil
-			}
-		}
-		a.Lock()
-	}
-	a.Unlock()
-
-	return nil, fmt.Errorf("user not found")
+	return pid, nil
 }
 
 func (a *Account) Disabled(pid [zkidentity.IdentitySize]byte) bool {
-	_, err := os.Stat(a.accountDirDisabled(pid))
-	return err == nil
+	ir, err := a.store.GetIdentity(pid)
+	return err == nil && ir.Disabled
 }
 
 func (a *Account) Enabled(pid [zkidentity.IdentitySize]byte) bool {
-	_, err := os.Stat(a.accountDir(pid))
-	return err == nil
+	ir, err := a.store.GetIdentity(pid)
+	return err == nil && !ir.Disabled
 }
 
 func (a *Account) Disable(pid [zkidentity.IdentitySize]byte) error {
 	a.Lock()
 	defer a.Unlock()
 
-	accountNameDisabled := a.accountDirDisabled(pid)
-	_, err := os.Stat(accountNameDisabled)
-	if err == nil {
-		return fmt.Errorf("account already disabled: %v",
-			accountNameDisabled)
-	}
-
-	accountName := a.accountDir(pid)
-	_, err = os.Stat(accountName)
+	err := a.store.SetDisabled(pid, true)
 	if err != nil {
-		return fmt.Errorf("account doesn't exist: %v",
-			accountName)
+		return err
 	}
-
-	return os.Rename(accountName, accountNameDisabled)
+	return a.index(pid)
 }
 
 func (a *Account) Enable(pid [zkidentity.IdentitySize]byte) error {
 	a.Lock()
 	defer a.Unlock()
 
-	accountNameDisabled := a.accountDirDisabled(pid)
-	_, err := os.Stat(accountNameDisabled)
+	err := a.store.SetDisabled(pid, false)
 	if err != nil {
-		return fmt.Errorf("account not disable: %v",
-			accountNameDisabled)
+		return err
 	}
+	return a.index(pid)
+}
 
-	accountName := a.accountDir(pid)
-	_, err = os.Stat(accountName)
-	if err == nil {
-		return fmt.Errorf("account already enabled: %v",
-			accountName)
+func (a *Account) Pull(id [zkidentity.IdentitySize]byte) error {
+	err := a.store.SetListed(id, false)
+	if errors.Is(err, storage.ErrNotFound) {
+		return fmt.Errorf("account not found")
+	} else if err != nil {
+		return fmt.Errorf("could not unlist user: %v", err)
 	}
 
-	return os.Rename(accountNameDisabled, accountName)
+	return a.index(id)
 }
 
-func (a *Account) Pull(id [zkidentity.IdentitySize]byte) error {
-	accountName := a.accountDir(id)
-	_, err := os.Stat(accountName)
-	if err != nil {
+// SetUnlisted records whether the owner of an account wants to be kept out of
+// the directory and lists or unlists it accordingly.  Accounts the
+// administrator keeps out of the directory remain unlisted.
+func (a *Account) SetUnlisted(id [zkidentity.IdentitySize]byte, unlisted bool) error {
+	err := a.store.SetUnlisted(id, unlisted)
+	if errors.Is(err, storage.ErrNotFound) {
 		return fmt.Errorf("account not found")
-	}
-	user, err := inidb.New(a.accountFile(id, UserIdentityFilename), false, 10)
-	if err != nil {
-		return fmt.Errorf("could not open userdb: %v", err)
+	} else if err != nil {
+		return fmt.Errorf("could not set unlisted: %v", err)
 	}
 
-	err = user.Del("", "listed")
-	if err != nil {
-		return fmt.Errorf("could not unlist user: %v", err)
+	if unlisted {
+		return a.Pull(id)
 	}
-	err = user.Save()
-	if err != nil {
-		return fmt.Errorf("could not save user: %v", err)
-	}
-
-	return nil
+	return a.Push(id)
 }
 
-// Deliver physically drops a message on disk.  It returns the fullpath so that
-// callers can pretty log deliveries.
-func (a *Account) Deliver(to [zkidentity.IdentitySize]byte, from [zkidentity.IdentitySize]byte, payload []byte, cleartext bool) (string, error) {
-	// get directory
-	cache := a.accountFile(to, CacheDir)
+// DeliverOptions are the optional properties of a delivered message.
+type DeliverOptions struct {
+	// Cleartext marks a payload that is not end to end encrypted, e.g. a
+	// message from the server itself.
+	Cleartext bool
+
+	// TTL is a per message time to live.  The message is deleted if it
+	// has not been delivered once TTL has elapsed.  A TTL of 0 means that
+	// only the server wide maximum age applies.
+	TTL time.Duration
+
+	// Receipt is the delivery receipt identifier of the sender.  It is
+	// returned in the Notification of the message so that the caller can
+	// send a receipt once the message was acknowledged.  A receipt of 0
+	// means none was requested.
+	Receipt uint64
+}
 
+// Deliver physically drops a message in the recipient mailbox.  It returns the
+// message identifier so that callers can pretty log deliveries.  If the
+// message would exceed the quota of the recipient mailbox ErrMailboxFull is
+// returned.
+func (a *Account) Deliver(to [zkidentity.IdentitySize]byte, from [zkidentity.IdentitySize]byte, payload []byte, opts DeliverOptions) (string, error) {
 	// calculate next filename
-	filename := time.Now().Format("20060102150405.000000000")
+	now := time.Now()
+	filename := now.Format("20060102150405.000000000")
 
 	// convert to on disk format
 	dm := diskMessage{
 		From:      from,
-		Received:  time.Now().Unix(),
+		Received:  now.Unix(),
 		Payload:   payload,
-		Cleartext: cleartext,
+		Cleartext: opts.Cleartext,
+		Receipt:   opts.Receipt,
+	}
+	if opts.TTL > 0 {
+		dm.Expires = now.Add(opts.TTL).Unix()
 	}
 	var b bytes.Buffer
 	_, err := xdr.Marshal(&b, dm)
@@ -330,35 +265,40 @@ func (a *Account) Deliver(to [zkidentity.IdentitySize]byte, from [zkidentity.Ide
 		return "", fmt.Errorf("could not marshal diskMessage")
 	}
 
-	// sanity
-	fullPath := path.Join(cache, filename)
-	_, err = os.Stat(fullPath)
-	if err == nil {
-		return "", fmt.Errorf("duplicate filename %v", filename)
-	}
-
 	a.Lock()
 	defer a.Unlock()
 
-	// and dump it
-	err = ioutil.WriteFile(fullPath, b.Bytes(), 0600)
+	// enforce quota
+	err = a.quotaCheck(to, from, uint64(b.Len()))
 	if err != nil {
-		return "", fmt.Errorf("could not write to %v: %v", cache, err)
+		return "", err
 	}
 
-	// notify
-	dn, found := a.online[to]
-	if !found {
-		return fullPath, nil
+	// and dump it
+	err = a.store.PutMessage(to, filename, b.Bytes())
+	if err != nil {
+		return "", fmt.Errorf("could not deliver to %x: %v", to, err)
 	}
+	a.quotaAdd(to, from, filename, uint64(b.Len()))
+	a.deliveredBytes += uint64(len(payload))
 
-	// notify producer that there is work
-	select {
-	case dn.work <- struct{}{}:
-	default:
+	// notify producers of all online devices that there is work
+	for _, dn := range a.online[to] {
+		select {
+		case dn.work <- struct{}{}:
+		default:
+		}
 	}
 
-	return fullPath, nil
+	return filename, nil
+}
+
+// DeliveredBytes returns the number of payload bytes that were stored in
+// mailboxes since the Account was created.
+func (a *Account) DeliveredBytes() uint64 {
+	a.Lock()
+	defer a.Unlock()
+	return a.deliveredBytes
 }
 
 func (a *Account) Delete(from [zkidentity.IdentitySize]byte, identifier string) error {
@@ -366,67 +306,98 @@ func (a *Account) Delete(from [zkidentity.IdentitySize]byte, identifier string)
 	a.Lock()
 	defer a.Unlock()
 
-	cache := a.accountFile(from, CacheDir)
-	err := os.Remove(path.Join(cache, identifier))
+	err := a.store.DelMessage(from, identifier)
 	if err != nil {
 		return err
 	}
+	a.quotaDel(from, identifier)
+	a.forget(from, identifier)
 
-	dn, found := a.online[from]
-	if found {
+	return nil
+}
+
+// forget marks a message as not processed on all online devices.  This
+// function must be called with the mutex held.
+func (a *Account) forget(who [zkidentity.IdentitySize]byte, identifier string) {
+	for _, dn := range a.online[who] {
 		delete(dn.processed, identifier)
 	}
-
-	return nil
 }
 
-// offline closes open quit channels and deletes an account from the online
+// offline closes open quit channels and deletes a device from the online
 // map. This function must be called WITH the mutex held.
-func (a *Account) offline(who [zkidentity.IdentitySize]byte) {
-	dn, found := a.online[who]
-	if found {
-		close(dn.quit)
+func (a *Account) offline(who [zkidentity.IdentitySize]byte, device storage.DeviceID) {
+	dn, found := a.online[who][device]
+	if !found {
+		return
+	}
+	close(dn.quit)
+	delete(a.online[who], device)
+	if len(a.online[who]) == 0 {
+		delete(a.online, who)
+	}
+
+	// remember when the device was last seen; it may have been evicted
+	// in the meantime
+	devices, err := a.store.Devices(who)
+	if err != nil {
+		return
+	}
+	if _, ok := devices[device]; ok {
+		_ = a.store.PutDevice(who, device, time.Now().Unix())
 	}
-	delete(a.online, who)
 }
 
-// Offline knocks a user offline. This function must be called WITHOUT the
+// Offline knocks a device offline. This function must be called WITHOUT the
 // mutex held.
-func (a *Account) Offline(who [zkidentity.IdentitySize]byte) {
+func (a *Account) Offline(who [zkidentity.IdentitySize]byte, device storage.DeviceID) {
 	a.Lock()
 	defer a.Unlock()
-	a.offline(who)
+	a.offline(who, device)
 }
 
-// Online notifies Account that a user has become available.  It reads all
-// undelivered messages of disk and uses the Notification channel to propagate
-// them.
-func (a *Account) Online(who [zkidentity.IdentitySize]byte, ntfn chan *Notification) error {
-
-	cache := a.accountFile(who, CacheDir)
+// Online notifies Account that a device of a user has become available.  It
+// registers the device, reads all undelivered messages the device has not
+// acknowledged yet and uses the Notification channel to propagate them.
+func (a *Account) Online(who [zkidentity.IdentitySize]byte, device storage.DeviceID, ntfn chan *Notification) error {
 
 	a.Lock()
-	_, found := a.online[who]
+	_, found := a.online[who][device]
 	if found {
 		a.Unlock()
 		return ErrAlreadyOnline{
-			err: fmt.Errorf("already online: %v ",
-				hex.EncodeToString(who[:])),
+			err: fmt.Errorf("already online: %v %x",
+				hex.EncodeToString(who[:]), device),
 		}
 	}
 
+	err := a.registerDevice(who, device, time.Now())
+	if err != nil {
+		a.Unlock()
+		return fmt.Errorf("could not register device %x: %v",
+			device, err)
+	}
+
 	dn := diskNotification{
 		ntfn:      ntfn,
 		work:      make(chan struct{}, 1),
 		quit:      make(chan struct{}),
 		processed: make(map[string]struct{}),
+		device:    &device,
+	}
+	if a.online[who] == nil {
+		a.online[who] = make(map[storage.DeviceID]diskNotification)
 	}
-	a.online[who] = dn
+	a.online[who][device] = dn
 	a.Unlock()
 
 	go func() {
-		// first time around start delivering
-		dn.work <- struct{}{}
+		// first time around start delivering unless a delivery
+		// already queued work
+		select {
+		case dn.work <- struct{}{}:
+		default:
+		}
 
 		for {
 			select {
@@ -437,7 +408,7 @@ func (a *Account) Online(who [zkidentity.IdentitySize]byte, ntfn chan *Notificat
 			}
 
 			a.Lock()
-			fi, err := ioutil.ReadDir(cache)
+			fi, err := a.store.Messages(who)
 			if err != nil {
 				a.Unlock()
 				dn.send(&Notification{Error: err})
@@ -447,44 +418,43 @@ func (a *Account) Online(who [zkidentity.IdentitySize]byte, ntfn chan *Notificat
 
 			for _, v := range fi {
 				a.Lock()
-				_, found := dn.processed[v.Name()]
+				_, found := dn.processed[v.Name]
 				if found {
 					a.Unlock()
 					continue
 				}
-				dn.processed[v.Name()] = struct{}{}
-				a.Unlock()
+				dn.processed[v.Name] = struct{}{}
 
-				filename := path.Join(cache, v.Name())
-				f, err := os.Open(filename)
+				// skip messages this device acknowledged before
+				done, err := a.delivered(who, *dn.device,
+					v.Name)
+				a.Unlock()
 				if err != nil {
-					dn.send(&Notification{
-						Error: fmt.Errorf("%v: %v",
-							filename, err)})
+					dn.send(&Notification{Error: err})
+					continue
+				}
+				if done {
 					continue
 				}
 
-				var dm diskMessage
-				_, err = xdr.Unmarshal(f, &dm)
-				// Special error handling because of prior
-				// upgrade where we added Cleartext to the
-				// diskMessage. A short read is therefore
-				// an error we must ignore.
+				dm, err := a.readDiskMessage(who, v.Name)
 				if err != nil {
-					var uerr *xdr.UnmarshalError
-					if !errors.As(err, &uerr) ||
-						uerr.ErrorCode != xdr.ErrIO ||
-						!errors.Is(uerr.Err, io.EOF) {
-
-						f.Close()
-						dn.send(&Notification{
-							Error: fmt.Errorf("%v: unmarshal %v",
-								filename, err),
-						})
-						continue
+					dn.send(&Notification{Error: err})
+					continue
+				}
+
+				// don't bother delivering expired messages
+				a.Lock()
+				if a.expired(dm, time.Now()) {
+					err = a.store.DelMessage(who, v.Name)
+					if err == nil {
+						a.quotaDel(who, v.Name)
+						a.forget(who, v.Name)
 					}
+					a.Unlock()
+					continue
 				}
-				f.Close()
+				a.Unlock()
 
 				// notify and block
 				dn.send(&Notification{
@@ -493,7 +463,8 @@ func (a *Account) Online(who [zkidentity.IdentitySize]byte, ntfn chan *Notificat
 					Received:   dm.Received,
 					Payload:    dm.Payload,
 					Cleartext:  dm.Cleartext,
-					Identifier: v.Name(),
+					Receipt:    dm.Receipt,
+					Identifier: v.Name,
 				})
 			}
 		}
@@ -502,6 +473,55 @@ func (a *Account) Online(who [zkidentity.IdentitySize]byte, ntfn chan *Notificat
 	return nil
 }
 
+// readDiskMessage reads and decodes a diskMessage from a mailbox.
+func (a *Account) readDiskMessage(id [zkidentity.IdentitySize]byte, identifier string) (*diskMessage, error) {
+	blob, err := a.store.GetMessage(id, identifier)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", identifier, err)
+	}
+
+	var dm diskMessage
+	_, err = xdr.Unmarshal(bytes.NewReader(blob), &dm)
+	// Special error handling because of prior upgrades where we added
+	// Cleartext, Expires and Receipt to the diskMessage.  A short read is
+	// therefore an error we must ignore.
+	if err != nil && !rpc.ShortRead(err) {
+		return nil, fmt.Errorf("%v: unmarshal %v", identifier, err)
+	}
+
+	return &dm, nil
+}
+
+// CheckMessage returns an error if blob is not a complete diskMessage.
+// readDiskMessage accepts messages that end after Payload, Cleartext or
+// Expires because they were written before the fields that follow were added.
+// A message that ends anywhere else, or that has trailing data, was truncated
+// or is corrupt.
+func CheckMessage(blob []byte) error {
+	var legacy struct {
+		From     [zkidentity.IdentitySize]byte
+		Received int64
+		Payload  []byte
+	}
+	n, err := xdr.Unmarshal(bytes.NewReader(blob), &legacy)
+	if err != nil {
+		return fmt.Errorf("unmarshal: %v", err)
+	}
+	switch len(blob) - n {
+	case 0, 4, 12, 20: // Cleartext, Expires and Receipt
+	default:
+		return fmt.Errorf("invalid length %v", len(blob))
+	}
+
+	var dm diskMessage
+	_, err = xdr.Unmarshal(bytes.NewReader(blob), &dm)
+	if err != nil && !rpc.ShortRead(err) {
+		return fmt.Errorf("unmarshal: %v", err)
+	}
+
+	return nil
+}
+
 func (dn *diskNotification) send(n *Notification) {
 	// notify and block
 	select {
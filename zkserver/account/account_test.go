@@ -6,7 +6,11 @@ package account
 
 import (
 	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
 	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
@@ -15,17 +19,13 @@ import (
 	"time"
 
 	"github.com/companyzero/zkc/zkidentity"
+	"github.com/companyzero/zkc/zkserver/storage"
 	"github.com/davecgh/go-spew/spew"
 	xdr "github.com/davecgh/go-xdr/xdr2"
 )
 
 func newAccount(t *testing.T) (*Account, error) {
-	root, err := ioutil.TempDir("", "zkserver")
-	if err != nil {
-		return nil, err
-	}
-	t.Logf("tmpdir: %v", root)
-	return New(root)
+	return New(storage.NewMemory())
 }
 
 func TestUpgradeDiskMessage(t *testing.T) {
@@ -86,12 +86,53 @@ func TestUpgradeDiskMessage(t *testing.T) {
 	}
 }
 
+func TestCheckMessage(t *testing.T) {
+	var b bytes.Buffer
+	_, err := xdr.Marshal(&b, diskMessage{
+		Received: time.Now().Unix(),
+		Payload:  []byte("payload"),
+		Expires:  time.Now().Unix(),
+		Receipt:  1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	blob := b.Bytes()
+
+	// legacy messages end after Payload, Cleartext or Expires
+	for _, n := range []int{len(blob) - 20, len(blob) - 16, len(blob) - 8,
+		len(blob)} {
+		err = CheckMessage(blob[:n])
+		if err != nil {
+			t.Fatalf("%v bytes: %v", n, err)
+		}
+	}
+
+	// truncated anywhere else, with trailing data or with an invalid bool
+	for _, n := range []int{0, zkidentity.IdentitySize, len(blob) - 24,
+		len(blob) - 18, len(blob) - 1} {
+		err = CheckMessage(blob[:n])
+		if err == nil {
+			t.Fatalf("%v bytes: expected error", n)
+		}
+	}
+	err = CheckMessage(append(blob, 0))
+	if err == nil {
+		t.Fatal("trailing data: expected error")
+	}
+	invalid := append([]byte{}, blob...)
+	invalid[len(blob)-17] = 2
+	err = CheckMessage(invalid)
+	if err == nil {
+		t.Fatal("invalid bool: expected error")
+	}
+}
+
 func TestCreate(t *testing.T) {
 	a, err := newAccount(t)
 	if err != nil {
 		t.Fatal(err)
 	}
-	defer os.RemoveAll(a.root)
 
 	pi := zkidentity.PublicIdentity{}
 	err = a.Create(pi, false)
@@ -105,7 +146,6 @@ func TestDeliver(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	defer os.RemoveAll(a.root)
 
 	to := zkidentity.PublicIdentity{}
 	from := zkidentity.PublicIdentity{}
@@ -123,7 +163,7 @@ func TestDeliver(t *testing.T) {
 
 	// 0
 	id, err := a.Deliver(to.Identity, from.Identity, []byte("payload0"),
-		false)
+		DeliverOptions{})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -134,7 +174,7 @@ func TestDeliver(t *testing.T) {
 
 	// 1
 	id, err = a.Deliver(to.Identity, from.Identity, []byte("payload1"),
-		false)
+		DeliverOptions{})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -145,14 +185,815 @@ func TestDeliver(t *testing.T) {
 
 	// 1
 	id, err = a.Deliver(to.Identity, from.Identity, []byte("payload2"),
-		false)
+		DeliverOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = a.Delete(to.Identity, filepath.Base(id))
 	if err != nil {
 		t.Fatal(err)
 	}
+}
+
+func TestQuota(t *testing.T) {
+	a, err := newAccount(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	to := zkidentity.PublicIdentity{}
+	from1 := zkidentity.PublicIdentity{Nick: "from1"}
+	from1.Identity[0] = 1
+	from2 := zkidentity.PublicIdentity{Nick: "from2"}
+	from2.Identity[0] = 2
+
+	err = a.Create(to, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// deliver one message prior to enabling quota to verify that usage
+	// is read from disk
+	id, err := a.Deliver(to.Identity, from1.Identity, []byte("payload0"),
+		DeliverOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a.SetQuota(Quota{MaxMessages: 4, SenderShare: 50})
+
+	_, err = a.Deliver(to.Identity, from1.Identity, []byte("payload1"),
+		DeliverOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = a.Deliver(to.Identity, from1.Identity, []byte("payload2"),
+		DeliverOptions{})
+	if !errors.Is(err, ErrMailboxFull) {
+		t.Fatalf("expected ErrMailboxFull for sender share, got %v",
+			err)
+	}
+	_, err = a.Deliver(to.Identity, from2.Identity, []byte("payload3"),
+		DeliverOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = a.Deliver(to.Identity, from2.Identity, []byte("payload4"),
+		DeliverOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = a.Deliver(to.Identity, from2.Identity, []byte("payload5"),
+		DeliverOptions{})
+	if !errors.Is(err, ErrMailboxFull) {
+		t.Fatalf("expected ErrMailboxFull, got %v", err)
+	}
+
+	// deleting a message frees up space
 	err = a.Delete(to.Identity, filepath.Base(id))
 	if err != nil {
 		t.Fatal(err)
 	}
+	_, err = a.Deliver(to.Identity, from1.Identity, []byte("payload6"),
+		DeliverOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// byte limit
+	a.SetQuota(Quota{MaxBytes: 1024})
+	_, err = a.Deliver(to.Identity, from1.Identity, make([]byte, 1024),
+		DeliverOptions{})
+	if !errors.Is(err, ErrMailboxFull) {
+		t.Fatalf("expected ErrMailboxFull for size, got %v", err)
+	}
+}
+
+func TestExpire(t *testing.T) {
+	a, err := newAccount(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	to := zkidentity.PublicIdentity{}
+	from := zkidentity.PublicIdentity{}
+	from.Identity[0] = 1
+
+	err = a.Create(to, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// expires on the next sweep
+	id, err := a.Deliver(to.Identity, from.Identity, []byte("payload0"),
+		DeliverOptions{TTL: time.Nanosecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// no ttl
+	id2, err := a.Deliver(to.Identity, from.Identity, []byte("payload1"),
+		DeliverOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expired, err := a.Expire()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(expired) != 1 {
+		t.Fatalf("expected 1 expired message, got %v", len(expired))
+	}
+	if expired[0].Identifier != filepath.Base(id) ||
+		expired[0].To != to.Identity ||
+		expired[0].From != from.Identity {
+		t.Fatalf("unexpected expired message: %v", spew.Sdump(expired))
+	}
+
+	// server wide maximum age
+	a.SetMaxAge(time.Nanosecond)
+	expired, err = a.Expire()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(expired) != 1 || expired[0].Identifier != filepath.Base(id2) {
+		t.Fatalf("unexpected expired messages: %v", spew.Sdump(expired))
+	}
+
+	fi, err := a.store.Messages(to.Identity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fi) != 0 {
+		t.Fatalf("expected empty cache, got %v messages", len(fi))
+	}
+}
+
+func TestDevices(t *testing.T) {
+	a, err := newAccount(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	to := zkidentity.PublicIdentity{}
+	from := zkidentity.PublicIdentity{}
+	from.Identity[0] = 1
+	err = a.Create(to, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d1, d2 := storage.DeviceID{1}, storage.DeviceID{2}
+	c1 := make(chan *Notification, 1)
+	c2 := make(chan *Notification, 1)
+	err = a.Online(to.Identity, d1, c1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Offline(to.Identity, d1)
+	err = a.Online(to.Identity, d2, c2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Offline(to.Identity, d2)
+	err = a.Online(to.Identity, d2, c2)
+	if !errors.As(err, &ErrAlreadyOnline{}) {
+		t.Fatalf("expected ErrAlreadyOnline, got %v", err)
+	}
+
+	receive := func(c chan *Notification) *Notification {
+		t.Helper()
+		select {
+		case n := <-c:
+			if n.Error != nil {
+				t.Fatal(n.Error)
+			}
+			return n
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting for notification")
+		}
+		return nil
+	}
+	pending := func() int {
+		t.Helper()
+		fi, err := a.store.Messages(to.Identity)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(fi)
+	}
+
+	// every device must acknowledge
+	id, err := a.Deliver(to.Identity, from.Identity, []byte("payload1"),
+		DeliverOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := receive(c1); n.Identifier != id {
+		t.Fatalf("unexpected identifier %v", n.Identifier)
+	}
+	if n := receive(c2); n.Identifier != id {
+		t.Fatalf("unexpected identifier %v", n.Identifier)
+	}
+	first, err := a.Ack(to.Identity, d1, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !first {
+		t.Fatal("first acknowledgement not reported")
+	}
+	if pending() != 1 {
+		t.Fatal("message removed before all devices acknowledged")
+	}
+	first, err = a.Ack(to.Identity, d2, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first {
+		t.Fatal("second acknowledgement reported as first")
+	}
+	if pending() != 0 {
+		t.Fatal("message not removed")
+	}
+
+	// first acknowledgement wins
+	a.SetDevicePolicy(DevicePolicy{Ack: AckFirst})
+	id, err = a.Deliver(to.Identity, from.Identity, []byte("payload2"),
+		DeliverOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	receive(c1)
+	receive(c2)
+	first, err = a.Ack(to.Identity, d2, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !first {
+		t.Fatal("first acknowledgement not reported")
+	}
+	if pending() != 0 {
+		t.Fatal("message not removed")
+	}
+	first, err = a.Ack(to.Identity, d1, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first {
+		t.Fatal("second acknowledgement reported as first")
+	}
+
+	// receipts are pushed along with the message
+	id, err = a.Deliver(to.Identity, from.Identity, []byte("payload3"),
+		DeliverOptions{Receipt: 42})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := receive(c1); n.Receipt != 42 {
+		t.Fatalf("unexpected receipt %v", n.Receipt)
+	}
+	if n := receive(c2); n.Receipt != 42 {
+		t.Fatalf("unexpected receipt %v", n.Receipt)
+	}
+	_, err = a.Ack(to.Identity, d1, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// least recently seen device is forgotten
+	a.SetDevicePolicy(DevicePolicy{MaxDevices: 2})
+	a.Offline(to.Identity, d1)
+	a.Offline(to.Identity, d2)
+	err = a.store.PutDevice(to.Identity, d1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = a.store.PutDevice(to.Identity, d2, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d3 := storage.DeviceID{3}
+	err = a.Online(to.Identity, d3, c1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Offline(to.Identity, d3)
+	devices, err := a.store.Devices(to.Identity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := devices[d1]; ok || len(devices) != 2 {
+		t.Fatalf("unexpected devices: %x", devices)
+	}
+}
+
+func TestChangeDevice(t *testing.T) {
+	a, err := newAccount(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	to := zkidentity.PublicIdentity{}
+	from := zkidentity.PublicIdentity{}
+	from.Identity[0] = 1
+	err = a.Create(to, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// sessions start out with the anonymous device
+	var anonymous storage.DeviceID
+	d1, d2 := storage.DeviceID{1}, storage.DeviceID{2}
+	c1 := make(chan *Notification, 2)
+	c2 := make(chan *Notification, 2)
+	err = a.Online(to.Identity, anonymous, c1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := a.Deliver(to.Identity, from.Identity, []byte("payload"),
+		DeliverOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case n := <-c1:
+		if n.Error != nil || n.Identifier != id {
+			t.Fatalf("unexpected notification %v", spew.Sdump(n))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for notification")
+	}
+
+	// registering does not push the message again
+	err = a.ChangeDevice(to.Identity, anonymous, d1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Offline(to.Identity, d1)
+	id2, err := a.Deliver(to.Identity, from.Identity, []byte("payload2"),
+		DeliverOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case n := <-c1:
+		if n.Error != nil || n.Identifier != id2 {
+			t.Fatalf("unexpected notification %v", spew.Sdump(n))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for notification")
+	}
+
+	// the anonymous device is replaced
+	devices, err := a.store.Devices(to.Identity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := devices[anonymous]; ok || len(devices) != 1 {
+		t.Fatalf("unexpected devices %v", devices)
+	}
+	for _, v := range []string{id, id2} {
+		_, err = a.Ack(to.Identity, d1, v)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	fi, err := a.store.Messages(to.Identity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fi) != 0 {
+		t.Fatal("messages not removed")
+	}
+
+	// a device can only be online once
+	err = a.Online(to.Identity, anonymous, c2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Offline(to.Identity, anonymous)
+	err = a.ChangeDevice(to.Identity, anonymous, d1)
+	if !errors.As(err, &ErrAlreadyOnline{}) {
+		t.Fatalf("expected ErrAlreadyOnline, got %v", err)
+	}
+	err = a.ChangeDevice(to.Identity, d2, d1)
+	if err == nil {
+		t.Fatal("changed a device that is not online")
+	}
+}
+
+func TestAdmin(t *testing.T) {
+	a, err := newAccount(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	alice := zkidentity.PublicIdentity{Nick: "alice"}
+	bob := zkidentity.PublicIdentity{Nick: "bob"}
+	bob.Identity[0] = 1
+	for _, v := range []zkidentity.PublicIdentity{alice, bob} {
+		err = a.Create(v, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = a.Push(v.Identity)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// nick reassignment
+	err = a.SetNick(bob.Identity, "alice")
+	if err == nil {
+		t.Fatal("expected nick in use")
+	}
+	err = a.SetNick(bob.Identity, "robert")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = a.Find("bob")
+	if err == nil {
+		t.Fatal("found old nick")
+	}
+	id, err := a.Find("robert")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id.Identity != bob.Identity {
+		t.Fatalf("unexpected identity: %x", id.Identity)
+	}
+
+	// unlist survives Push
+	err = a.Unlist(bob.Identity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = a.Push(bob.Identity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = a.Find("robert")
+	if err == nil {
+		t.Fatal("found unlisted user")
+	}
+
+	// but its nicks remain in use
+	for _, v := range []string{"bob", "robert"} {
+		inUse, err := a.NickInUse(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !inUse {
+			t.Fatalf("nick of unlisted user not in use: %v", v)
+		}
+	}
+	inUse, err := a.NickInUse("carol")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inUse {
+		t.Fatal("unused nick in use")
+	}
+
+	err = a.List(bob.Identity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = a.Find("robert")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// purge
+	c := make(chan *Notification, 1)
+	err = a.Online(bob.Identity, storage.DeviceID{}, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = a.Deliver(bob.Identity, alice.Identity, []byte("x"),
+		DeliverOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-c
+	err = a.Purge(bob.Identity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.Offline(bob.Identity, storage.DeviceID{})
+	if a.Enabled(bob.Identity) || a.Disabled(bob.Identity) {
+		t.Fatal("account not purged")
+	}
+	_, err = a.Find("robert")
+	if err == nil {
+		t.Fatal("found purged user")
+	}
+	err = a.Purge(bob.Identity)
+	if err == nil {
+		t.Fatal("expected account not found")
+	}
+}
+
+func TestDirectory(t *testing.T) {
+	store := storage.NewMemory()
+	a, err := New(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	alice := zkidentity.PublicIdentity{Nick: "alice"}
+	alice.Identity[0] = 0xa1
+	bob := zkidentity.PublicIdentity{Nick: "bob"}
+	bob.Identity[0] = 0xb0
+	for _, v := range []zkidentity.PublicIdentity{alice, bob} {
+		err = a.Create(v, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// only listed identities are found
+	_, err = a.Find("alice")
+	if err == nil {
+		t.Fatal("found user that was not listed")
+	}
+	err = a.Push(alice.Identity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range []string{
+		"alice",
+		hex.EncodeToString(alice.Identity[:]),
+		alice.Fingerprint(),
+		base64.StdEncoding.EncodeToString(alice.Identity[:]),
+	} {
+		id, err := a.Find(v)
+		if err != nil {
+			t.Fatalf("%v: %v", v, err)
+		}
+		if id.Identity != alice.Identity {
+			t.Fatalf("%v: unexpected identity %x", v, id.Identity)
+		}
+	}
+	_, err = a.Find(hex.EncodeToString(bob.Identity[:]))
+	if err == nil {
+		t.Fatal("found user that was not listed")
+	}
+
+	// nicks are taken by listed identities
+	err = a.Create(zkidentity.PublicIdentity{Nick: "alice"}, false)
+	if err == nil {
+		t.Fatal("expected nick in use")
+	}
+
+	// the index is rebuilt from the store
+	err = a.Push(bob.Identity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err = New(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = a.Find("bob"); err != nil {
+		t.Fatal(err)
+	}
+
+	// disabled and pulled identities are not found
+	err = a.Disable(alice.Identity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = a.Find(alice.Fingerprint())
+	if err == nil {
+		t.Fatal("found disabled user")
+	}
+	err = a.Enable(alice.Identity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = a.Find("alice"); err != nil {
+		t.Fatal(err)
+	}
+	err = a.Pull(bob.Identity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = a.Find("bob")
+	if err == nil {
+		t.Fatal("found pulled user")
+	}
+
+	// the choice of the owner survives Push and a rebuild
+	err = a.SetUnlisted(alice.Identity, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = a.Push(alice.Identity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err = New(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = a.Find("alice")
+	if err == nil {
+		t.Fatal("found unlisted user")
+	}
+
+	// but does not override the administrator
+	err = a.Unlist(alice.Identity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = a.SetUnlisted(alice.Identity, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = a.Find("alice")
+	if err == nil {
+		t.Fatal("found hidden user")
+	}
+	err = a.List(alice.Identity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = a.Find("alice"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDirectorySharedNick(t *testing.T) {
+	a, err := New(storage.NewMemory())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// nicks are only checked against listed identities, so two unlisted
+	// identities can share one and both be listed later
+	first := zkidentity.PublicIdentity{Nick: "alice"}
+	first.Identity[0] = 0xa1
+	second := zkidentity.PublicIdentity{Nick: "alice"}
+	second.Identity[0] = 0xa2
+	for _, v := range []zkidentity.PublicIdentity{first, second} {
+		err = a.Create(v, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, v := range []zkidentity.PublicIdentity{first, second} {
+		err = a.Push(v.Identity)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	find := func(nick string, expected zkidentity.PublicIdentity) {
+		t.Helper()
+		id, err := a.Find(nick)
+		if err != nil {
+			t.Fatalf("%v: %v", nick, err)
+		}
+		if id.Identity != expected.Identity {
+			t.Fatalf("%v: unexpected identity %x", nick,
+				id.Identity)
+		}
+	}
+	find("alice", first)
+
+	// updating the found identity does not hand its nick over
+	err = a.Push(first.Identity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	find("alice", first)
+
+	// the nick falls to the identity that still has it
+	err = a.Pull(first.Identity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	find("alice", second)
+	err = a.Push(first.Identity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	find("alice", second)
+
+	// and back when that one is renamed
+	err = a.SetNick(second.Identity, "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	find("alice", first)
+	find("bob", second)
+
+	// a disabled identity takes only its own entry along
+	err = a.Disable(first.Identity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = a.Find("alice")
+	if err == nil {
+		t.Fatal("found disabled user")
+	}
+	find("bob", second)
+}
+
+func BenchmarkFind(b *testing.B) {
+	for _, n := range []int{100, 1000, 10000} {
+		a, err := New(storage.NewMemory())
+		if err != nil {
+			b.Fatal(err)
+		}
+		pids := make([]zkidentity.PublicIdentity, n)
+		for k := range pids {
+			pid := &pids[k]
+			pid.Nick = fmt.Sprintf("user%v", k)
+			binary.BigEndian.PutUint32(pid.Identity[:], uint32(k))
+			err = a.Create(*pid, false)
+			if err != nil {
+				b.Fatal(err)
+			}
+			err = a.Push(pid.Identity)
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+
+		b.Run(fmt.Sprintf("nick/%v", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				_, err := a.Find(pids[i%n].Nick)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		b.Run(fmt.Sprintf("fingerprint/%v", n), func(b *testing.B) {
+			fps := make([]string, n)
+			for k := range pids {
+				fps[k] = pids[k].Fingerprint()
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				_, err := a.Find(fps[i%n])
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestDirectoryUnreadable(t *testing.T) {
+	root, err := ioutil.TempDir("", "account")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	users := filepath.Join(root, "users")
+	store, err := storage.NewFilesystem(users, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := New(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice := zkidentity.PublicIdentity{Nick: "alice"}
+	alice.Identity[0] = 0xa1
+	bob := zkidentity.PublicIdentity{Nick: "bob"}
+	bob.Identity[0] = 0xb0
+	for _, v := range []zkidentity.PublicIdentity{alice, bob} {
+		err = a.Create(v, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = a.Push(v.Identity)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// an account that lost its user record does not prevent startup
+	err = os.Remove(filepath.Join(users, hex.EncodeToString(
+		alice.Identity[:]), storage.UserIdentityFilename))
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err = New(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := a.Unindexed()
+	if len(u) != 1 || u[0].Identity != alice.Identity {
+		t.Fatalf("unexpected unindexed identities %v", u)
+	}
+	_, err = a.Find("bob")
+	if err != nil {
+		t.Fatal(err)
+	}
 }
 
 func TestDeleteDoesntExist(t *testing.T) {
@@ -160,7 +1001,6 @@ func TestDeleteDoesntExist(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	defer os.RemoveAll(a.root)
 
 	to := zkidentity.PublicIdentity{}
 	err = a.Delete(to.Identity, "moo")
@@ -174,8 +1014,7 @@ func TestDeleteDoesntExist(t *testing.T) {
 //	if err != nil {
 //		t.Fatal(err)
 //	}
-//	defer os.RemoveAll(a.root)
-//
+////
 //	to := zkidentity.PublicIdentity{}
 //	from := zkidentity.PublicIdentity{}
 //	from.Identity[0] = 1
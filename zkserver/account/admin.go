@@ -0,0 +1,124 @@
+// Copyright (c) 2020 Company 0, LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package account
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/companyzero/zkc/zkidentity"
+	"github.com/companyzero/zkc/zkserver/storage"
+)
+
+// Purge permanently removes an account including its mailbox, devices and
+// directory entry.  Online devices stop receiving notifications; it is up to
+// the caller to disconnect their sessions.
+func (a *Account) Purge(id [zkidentity.IdentitySize]byte) error {
+	a.Lock()
+	defer a.Unlock()
+
+	for _, dn := range a.online[id] {
+		close(dn.quit)
+	}
+	delete(a.online, id)
+	delete(a.mailboxes, id)
+
+	err := a.store.DelIdentity(id)
+	if errors.Is(err, storage.ErrNotFound) {
+		return fmt.Errorf("account not found")
+	} else if err != nil {
+		return fmt.Errorf("could not purge user: %v", err)
+	}
+
+	return a.index(id)
+}
+
+// SetNick changes the nick an account is found by in the directory.  The nick
+// must not be used by another account.  An empty nick reverts to the nick
+// the user chose.
+func (a *Account) SetNick(id [zkidentity.IdentitySize]byte, nick string) error {
+	a.Lock()
+	defer a.Unlock()
+
+	ids, err := a.store.Identities()
+	if err != nil {
+		return fmt.Errorf("could not set nick: %v", err)
+	}
+	var ir *storage.IdentityRecord
+	for _, v := range ids {
+		r, err := a.store.GetIdentity(v)
+		if err != nil {
+			return fmt.Errorf("could not set nick: %v", err)
+		}
+		if v == id {
+			ir = r
+			continue
+		}
+		if nick != "" && r.DirectoryNick() == nick {
+			return fmt.Errorf("nickname already in use")
+		}
+	}
+	if ir == nil {
+		return fmt.Errorf("account not found")
+	}
+	if nick == ir.Identity.Nick {
+		nick = ""
+	}
+
+	err = a.store.SetNick(id, nick)
+	if err != nil {
+		return fmt.Errorf("could not set nick: %v", err)
+	}
+
+	return a.index(id)
+}
+
+// NickInUse returns true if nick is the nick or directory nick of any
+// account, whether it is listed or not.
+func (a *Account) NickInUse(nick string) (bool, error) {
+	ids, err := a.store.Identities()
+	if err != nil {
+		return false, err
+	}
+	for _, v := range ids {
+		ir, err := a.store.GetIdentity(v)
+		if err != nil {
+			return false, err
+		}
+		if ir.Identity.Nick == nick || ir.DirectoryNick() == nick {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// List allows an account in the directory and lists it.
+func (a *Account) List(id [zkidentity.IdentitySize]byte) error {
+	err := a.store.SetHidden(id, false)
+	if errors.Is(err, storage.ErrNotFound) {
+		return fmt.Errorf("account not found")
+	} else if err != nil {
+		return fmt.Errorf("could not list user: %v", err)
+	}
+
+	return a.Push(id)
+}
+
+// Unlist removes an account from the directory and keeps it out until it is
+// listed again by List.
+func (a *Account) Unlist(id [zkidentity.IdentitySize]byte) error {
+	err := a.store.SetHidden(id, true)
+	if errors.Is(err, storage.ErrNotFound) {
+		return fmt.Errorf("account not found")
+	} else if err != nil {
+		return fmt.Errorf("could not unlist user: %v", err)
+	}
+
+	// disabled accounts are already out of the directory
+	if a.Disabled(id) {
+		return nil
+	}
+	return a.Pull(id)
+}
@@ -0,0 +1,273 @@
+// Copyright (c) 2020 Company 0, LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package account
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/companyzero/zkc/zkidentity"
+	"github.com/companyzero/zkc/zkserver/storage"
+)
+
+// AckPolicy determines when a message that is pushed to several devices of the
+// same identity is removed from the mailbox.
+type AckPolicy int
+
+const (
+	// AckAll removes a message once every registered device acknowledged
+	// it.
+	AckAll AckPolicy = iota
+
+	// AckFirst removes a message as soon as any device acknowledged it.
+	AckFirst
+)
+
+// DevicePolicy limits the devices that may share an identity.  A limit that
+// is set to 0 is disabled.
+type DevicePolicy struct {
+	MaxDevices int           // registered devices per identity
+	MaxIdle    time.Duration // forget devices that were not seen this long
+	Ack        AckPolicy     // when to remove acknowledged messages
+}
+
+// SetDevicePolicy sets the policy that applies to all identities.
+func (a *Account) SetDevicePolicy(p DevicePolicy) {
+	a.Lock()
+	defer a.Unlock()
+
+	a.devicePolicy = p
+}
+
+// registerDevice registers a device that comes online and forgets devices
+// that exceed the device policy.  Online devices are never forgotten.  This
+// function must be called with the mutex held.
+func (a *Account) registerDevice(who [zkidentity.IdentitySize]byte, device storage.DeviceID, now time.Time) error {
+	err := a.store.PutDevice(who, device, now.Unix())
+	if err != nil {
+		return err
+	}
+	devices, err := a.store.Devices(who)
+	if err != nil {
+		return err
+	}
+
+	online := a.online[who]
+	forget := func(d storage.DeviceID) error {
+		delete(devices, d)
+		return a.store.DelDevice(who, d)
+	}
+
+	// The anonymous device of a client that predates device registration
+	// is replaced by the first device that registers.
+	var anonymous storage.DeviceID
+	if _, ok := devices[anonymous]; ok && device != anonymous {
+		if _, ok := online[anonymous]; !ok {
+			err = forget(anonymous)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	// forget idle devices
+	p := a.devicePolicy
+	for d, seen := range devices {
+		if p.MaxIdle == 0 {
+			break
+		}
+		if _, ok := online[d]; ok || d == device {
+			continue
+		}
+		if now.Sub(time.Unix(seen, 0)) < p.MaxIdle {
+			continue
+		}
+		err = forget(d)
+		if err != nil {
+			return err
+		}
+	}
+
+	// forget least recently seen devices; every session starts out with
+	// the anonymous device, which must not push out the device it is
+	// about to register
+	for p.MaxDevices != 0 && device != anonymous &&
+		len(devices) > p.MaxDevices {
+		var (
+			oldest storage.DeviceID
+			seen   int64
+			found  bool
+		)
+		for d, s := range devices {
+			if _, ok := online[d]; ok || d == device {
+				continue
+			}
+			if !found || s < seen {
+				oldest, seen, found = d, s, true
+			}
+		}
+		if !found {
+			break
+		}
+		err = forget(oldest)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ChangeDevice moves an online device of who to another device, e.g. once a
+// session that went online with the anonymous device registers its device.
+// Messages that were pushed to the old device are not pushed again and their
+// acknowledgements count for the new device.
+func (a *Account) ChangeDevice(who [zkidentity.IdentitySize]byte, from, to storage.DeviceID) error {
+	a.Lock()
+	defer a.Unlock()
+
+	dn, found := a.online[who][from]
+	if !found {
+		return fmt.Errorf("not online: %v %x",
+			hex.EncodeToString(who[:]), from)
+	}
+	if from == to {
+		return nil
+	}
+	if _, found := a.online[who][to]; found {
+		return ErrAlreadyOnline{
+			err: fmt.Errorf("already online: %v %x",
+				hex.EncodeToString(who[:]), to),
+		}
+	}
+
+	delete(a.online[who], from)
+	a.online[who][to] = dn
+	*dn.device = to
+	err := a.registerDevice(who, to, time.Now())
+	if err != nil {
+		delete(a.online[who], to)
+		a.online[who][from] = dn
+		*dn.device = from
+		return fmt.Errorf("could not register device %x: %v", to, err)
+	}
+
+	// remember when the old device was last seen
+	devices, err := a.store.Devices(who)
+	if err != nil {
+		return err
+	}
+	if _, ok := devices[from]; ok {
+		return a.store.PutDevice(who, from, time.Now().Unix())
+	}
+	return nil
+}
+
+// allAcked returns true if every registered device of who is in acks.  This
+// function must be called with the mutex held.
+func (a *Account) allAcked(who [zkidentity.IdentitySize]byte, acks []storage.DeviceID) (bool, error) {
+	devices, err := a.store.Devices(who)
+	if err != nil {
+		return false, err
+	}
+	for d := range devices {
+		acked := false
+		for _, v := range acks {
+			if v == d {
+				acked = true
+				break
+			}
+		}
+		if !acked {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// remove deletes an acknowledged message.  This function must be called with
+// the mutex held.
+func (a *Account) remove(who [zkidentity.IdentitySize]byte, identifier string) error {
+	err := a.store.DelMessage(who, identifier)
+	if err != nil {
+		return err
+	}
+	a.quotaDel(who, identifier)
+	a.forget(who, identifier)
+	return nil
+}
+
+// delivered returns true if a message must not be pushed to device because it
+// acknowledged it before.  Messages that turn out to be acknowledged by all
+// registered devices, e.g. because a device was forgotten, are removed.  This
+// function must be called with the mutex held.
+func (a *Account) delivered(who [zkidentity.IdentitySize]byte, device storage.DeviceID, identifier string) (bool, error) {
+	if a.devicePolicy.Ack == AckFirst {
+		return false, nil
+	}
+
+	acks, err := a.store.MessageAcks(who, identifier)
+	if err != nil || len(acks) == 0 {
+		return false, err
+	}
+	done, err := a.allAcked(who, acks)
+	if err != nil {
+		return false, err
+	}
+	if done {
+		return true, a.remove(who, identifier)
+	}
+	for _, v := range acks {
+		if v == device {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Ack records that device acknowledged a pushed message.  Depending on the ack
+// policy the message is removed from the mailbox once this device or all
+// registered devices acknowledged it.  Acknowledging a message that was
+// already removed, e.g. by another device, is not an error.  Ack returns true
+// if device is the first device that acknowledged the message.
+func (a *Account) Ack(who [zkidentity.IdentitySize]byte, device storage.DeviceID, identifier string) (bool, error) {
+	a.Lock()
+	defer a.Unlock()
+
+	var (
+		first bool
+		err   error
+	)
+	if a.devicePolicy.Ack == AckAll {
+		first, err = a.ack(who, device, identifier)
+	} else {
+		err = a.remove(who, identifier)
+		first = err == nil
+	}
+	if errors.Is(err, storage.ErrNotFound) {
+		return false, nil
+	}
+	return first, err
+}
+
+// ack implements Ack for the AckAll policy.  This function must be called
+// with the mutex held.
+func (a *Account) ack(who [zkidentity.IdentitySize]byte, device storage.DeviceID, identifier string) (bool, error) {
+	acks, err := a.store.MessageAcks(who, identifier)
+	if err != nil {
+		return false, err
+	}
+	first := len(acks) == 0
+	done, err := a.allAcked(who, append(acks, device))
+	if err != nil {
+		return false, err
+	}
+	if done {
+		return first, a.remove(who, identifier)
+	}
+	return first, a.store.AckMessage(who, identifier, device)
+}
@@ -0,0 +1,187 @@
+// Copyright (c) 2020 Company 0, LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package account
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/companyzero/zkc/zkidentity"
+	"github.com/companyzero/zkc/zkserver/storage"
+)
+
+// directory is an in memory index of the identities that are listed in the
+// directory.  It is built when the Account is created and kept up to date by
+// every operation that changes whether or how an identity is listed, so that
+// lookups do not have to walk the store.
+type directory struct {
+	sync.RWMutex
+	nicks      map[string][]*directoryEntry // in the order indexed
+	identities map[[zkidentity.IdentitySize]byte]*directoryEntry
+}
+
+// directoryEntry is a listed identity and the nick it is indexed by.
+type directoryEntry struct {
+	identity zkidentity.PublicIdentity
+	nick     string
+}
+
+func newDirectory() *directory {
+	return &directory{
+		nicks:      make(map[string][]*directoryEntry),
+		identities: make(map[[zkidentity.IdentitySize]byte]*directoryEntry),
+	}
+}
+
+// listed returns true if ir is found in the directory.
+func listed(ir *storage.IdentityRecord) bool {
+	return ir.Listed && !ir.Hidden && !ir.Unlisted && !ir.Disabled
+}
+
+// update indexes ir if it is listed and removes it otherwise.  If several
+// identities share a directory nick the first one indexed that is still listed
+// is found by it.
+func (d *directory) update(ir *storage.IdentityRecord) {
+	d.Lock()
+	defer d.Unlock()
+
+	if !listed(ir) {
+		d.remove(ir.Identity.Identity)
+		return
+	}
+	e := &directoryEntry{
+		identity: ir.Identity,
+		nick:     ir.DirectoryNick(),
+	}
+
+	// an identity that keeps its nick keeps its place
+	if old, ok := d.identities[e.identity.Identity]; ok &&
+		old.nick == e.nick {
+		for k, v := range d.nicks[e.nick] {
+			if v == old {
+				d.nicks[e.nick][k] = e
+			}
+		}
+		d.identities[e.identity.Identity] = e
+		return
+	}
+
+	d.remove(e.identity.Identity)
+	d.identities[e.identity.Identity] = e
+	d.nicks[e.nick] = append(d.nicks[e.nick], e)
+}
+
+// remove drops id from the index.  This function must be called with the
+// mutex held.
+func (d *directory) remove(id [zkidentity.IdentitySize]byte) {
+	e, ok := d.identities[id]
+	if !ok {
+		return
+	}
+	delete(d.identities, id)
+
+	// other identities with the same nick remain
+	var nicks []*directoryEntry
+	for _, v := range d.nicks[e.nick] {
+		if v != e {
+			nicks = append(nicks, v)
+		}
+	}
+	if len(nicks) == 0 {
+		delete(d.nicks, e.nick)
+		return
+	}
+	d.nicks[e.nick] = nicks
+}
+
+// find returns the listed identity with directory nick or identity s.
+func (d *directory) find(s string) (*zkidentity.PublicIdentity, bool) {
+	d.RLock()
+	defer d.RUnlock()
+
+	var e *directoryEntry
+	if nicks, ok := d.nicks[s]; ok {
+		e = nicks[0]
+	} else {
+		id, ok := parseFingerprint(s)
+		if !ok {
+			return nil, false
+		}
+		e, ok = d.identities[id]
+		if !ok {
+			return nil, false
+		}
+	}
+	pid := e.identity
+	return &pid, true
+}
+
+// parseFingerprint decodes a hex or base64 encoded identity.
+func parseFingerprint(s string) ([zkidentity.IdentitySize]byte, bool) {
+	var id [zkidentity.IdentitySize]byte
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		b, err = base64.StdEncoding.DecodeString(s)
+	}
+	if err != nil || len(b) != zkidentity.IdentitySize {
+		return id, false
+	}
+	copy(id[:], b)
+	return id, true
+}
+
+// UnindexedIdentity is an identity that was left out of the directory because
+// it could not be read.
+type UnindexedIdentity struct {
+	Identity [zkidentity.IdentitySize]byte
+	Err      error
+}
+
+// buildDirectory indexes every listed identity in the store.  Identities that
+// can't be read are skipped so that a single broken account does not prevent
+// startup.  They are returned so that the caller can log them.
+func (a *Account) buildDirectory() ([]UnindexedIdentity, error) {
+	ids, err := a.store.Identities()
+	if err != nil {
+		return nil, err
+	}
+	var unindexed []UnindexedIdentity
+	for _, v := range ids {
+		ir, err := a.store.GetIdentity(v)
+		if err != nil {
+			unindexed = append(unindexed, UnindexedIdentity{
+				Identity: v,
+				Err:      err,
+			})
+			continue
+		}
+		a.directory.update(ir)
+	}
+	return unindexed, nil
+}
+
+// Unindexed returns the identities that were left out of the directory when
+// the Account was created.
+func (a *Account) Unindexed() []UnindexedIdentity {
+	return a.unindexed
+}
+
+// index updates the directory entry of id from the store.
+func (a *Account) index(id [zkidentity.IdentitySize]byte) error {
+	ir, err := a.store.GetIdentity(id)
+	if errors.Is(err, storage.ErrNotFound) {
+		a.directory.Lock()
+		a.directory.remove(id)
+		a.directory.Unlock()
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("could not index user: %v", err)
+	}
+	a.directory.update(ir)
+	return nil
+}
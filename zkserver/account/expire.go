@@ -0,0 +1,110 @@
+// Copyright (c) 2020 Company 0, LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package account
+
+import (
+	"time"
+
+	"github.com/companyzero/zkc/zkidentity"
+)
+
+// ExpiredMessage describes an undelivered message that was deleted because it
+// expired.
+type ExpiredMessage struct {
+	To         [zkidentity.IdentitySize]byte
+	From       [zkidentity.IdentitySize]byte
+	Received   int64 // received time
+	Identifier string
+}
+
+// SetMaxAge sets the maximum age of undelivered messages.  Messages that are
+// older are deleted instead of delivered.  A maxAge of 0 disables expiration
+// of messages that do not carry their own time to live.
+func (a *Account) SetMaxAge(maxAge time.Duration) {
+	a.Lock()
+	defer a.Unlock()
+
+	a.maxAge = maxAge
+}
+
+// expired returns true if a message may no longer be delivered.  This
+// function must be called with the mutex held.
+func (a *Account) expired(dm *diskMessage, now time.Time) bool {
+	if dm.Expires != 0 && !now.Before(time.Unix(dm.Expires, 0)) {
+		return true
+	}
+	if a.maxAge != 0 &&
+		!now.Before(time.Unix(dm.Received, 0).Add(a.maxAge)) {
+		return true
+	}
+	return false
+}
+
+// Expire walks all enabled and disabled accounts and deletes every
+// undelivered message that has expired.  Messages that are currently being
+// pushed to an online device are left alone.  It returns the expired messages
+// so that the caller can log them.  Expire does not abort on errors; the last
+// error encountered is returned along with the messages that did expire.
+func (a *Account) Expire() ([]ExpiredMessage, error) {
+	a.Lock()
+	ids, err := a.store.Identities()
+	a.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		expired []ExpiredMessage
+		lastErr error
+	)
+	now := time.Now()
+	for _, id := range ids {
+		mfi, err := a.store.Messages(id)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		for _, m := range mfi {
+			dm, err := a.readDiskMessage(id, m.Name)
+			if err != nil {
+				lastErr = err
+				continue
+			}
+
+			a.Lock()
+			if !a.expired(dm, now) {
+				a.Unlock()
+				continue
+			}
+			inflight := false
+			for _, dn := range a.online[id] {
+				if _, found := dn.processed[m.Name]; found {
+					inflight = true
+				}
+			}
+			if inflight {
+				a.Unlock()
+				continue
+			}
+			err = a.store.DelMessage(id, m.Name)
+			if err != nil {
+				a.Unlock()
+				lastErr = err
+				continue
+			}
+			a.quotaDel(id, m.Name)
+			a.Unlock()
+
+			expired = append(expired, ExpiredMessage{
+				To:         id,
+				From:       dm.From,
+				Received:   dm.Received,
+				Identifier: m.Name,
+			})
+		}
+	}
+
+	return expired, lastErr
+}
@@ -0,0 +1,198 @@
+// Copyright (c) 2020 Company 0, LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package account
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/companyzero/zkc/zkidentity"
+)
+
+var (
+	// ErrMailboxFull is returned by Deliver when the recipient mailbox
+	// would exceed its quota.
+	ErrMailboxFull = errors.New("mailbox full")
+)
+
+// Quota limits the contents of a mailbox.  A limit that is set to 0 is
+// disabled.
+type Quota struct {
+	MaxMessages uint64 // maximum number of undelivered messages
+	MaxBytes    uint64 // maximum size of all undelivered messages
+
+	// SenderShare is the percentage of MaxMessages and MaxBytes a single
+	// sender may occupy.
+	SenderShare uint64
+}
+
+// enabled returns true if any limit is set.
+func (q Quota) enabled() bool {
+	return q.MaxMessages != 0 || q.MaxBytes != 0
+}
+
+// share returns the per sender limit that corresponds to max.
+func (q Quota) share(max uint64) uint64 {
+	if q.SenderShare == 0 || q.SenderShare >= 100 || max == 0 {
+		return max
+	}
+	s := max * q.SenderShare / 100
+	if s == 0 {
+		s = 1
+	}
+	return s
+}
+
+// usage is the number of messages and bytes occupied in a mailbox.
+type usage struct {
+	messages uint64
+	bytes    uint64
+}
+
+// mailboxEntry is the accounting information of a single message.
+type mailboxEntry struct {
+	from [zkidentity.IdentitySize]byte
+	size uint64
+}
+
+// mailbox tracks the usage of a single mailbox.
+type mailbox struct {
+	total   usage
+	senders map[[zkidentity.IdentitySize]byte]*usage
+	entries map[string]mailboxEntry
+}
+
+func (m *mailbox) add(filename string, e mailboxEntry) {
+	m.entries[filename] = e
+	m.total.messages++
+	m.total.bytes += e.size
+	u, ok := m.senders[e.from]
+	if !ok {
+		u = &usage{}
+		m.senders[e.from] = u
+	}
+	u.messages++
+	u.bytes += e.size
+}
+
+func (m *mailbox) del(filename string) {
+	e, ok := m.entries[filename]
+	if !ok {
+		return
+	}
+	delete(m.entries, filename)
+	m.total.messages--
+	m.total.bytes -= e.size
+	u := m.senders[e.from]
+	u.messages--
+	u.bytes -= e.size
+	if u.messages == 0 {
+		delete(m.senders, e.from)
+	}
+}
+
+// SetQuota sets the mailbox quota that is enforced by Deliver.  Usage is
+// recalculated from disk the next time a mailbox is delivered to.
+func (a *Account) SetQuota(q Quota) {
+	a.Lock()
+	defer a.Unlock()
+
+	a.quota = q
+	a.mailboxes = make(map[[zkidentity.IdentitySize]byte]*mailbox)
+}
+
+// loadMailbox returns the usage of the mailbox that belongs to id.  The
+// usage is read from storage if it is not cached yet.  This function must be
+// called with the mutex held.
+func (a *Account) loadMailbox(id [zkidentity.IdentitySize]byte) (*mailbox, error) {
+	m, ok := a.mailboxes[id]
+	if ok {
+		return m, nil
+	}
+
+	fi, err := a.store.Messages(id)
+	if err != nil {
+		return nil, err
+	}
+
+	m = &mailbox{
+		senders: make(map[[zkidentity.IdentitySize]byte]*usage),
+		entries: make(map[string]mailboxEntry),
+	}
+	for _, v := range fi {
+		e := mailboxEntry{size: uint64(v.Size)}
+
+		// From is the first member of diskMessage and is encoded
+		// as a fixed size opaque.
+		blob, err := a.store.GetMessage(id, v.Name)
+		if err != nil {
+			return nil, err
+		}
+		if len(blob) < len(e.from) {
+			return nil, fmt.Errorf("%v: short message", v.Name)
+		}
+		copy(e.from[:], blob)
+
+		m.add(v.Name, e)
+	}
+	a.mailboxes[id] = m
+
+	return m, nil
+}
+
+// quotaCheck returns ErrMailboxFull if a message of size bytes from sender
+// from does not fit in the mailbox of to.  This function must be called with
+// the mutex held.
+func (a *Account) quotaCheck(to, from [zkidentity.IdentitySize]byte, size uint64) error {
+	if !a.quota.enabled() {
+		return nil
+	}
+
+	m, err := a.loadMailbox(to)
+	if err != nil {
+		return err
+	}
+
+	q := a.quota
+	if q.MaxMessages != 0 && m.total.messages+1 > q.MaxMessages {
+		return ErrMailboxFull
+	}
+	if q.MaxBytes != 0 && m.total.bytes+size > q.MaxBytes {
+		return ErrMailboxFull
+	}
+
+	var u usage
+	if su, ok := m.senders[from]; ok {
+		u = *su
+	}
+	if q.MaxMessages != 0 && u.messages+1 > q.share(q.MaxMessages) {
+		return ErrMailboxFull
+	}
+	if q.MaxBytes != 0 && u.bytes+size > q.share(q.MaxBytes) {
+		return ErrMailboxFull
+	}
+
+	return nil
+}
+
+// quotaAdd accounts for a message that was written to the mailbox of to.
+// This function must be called with the mutex held.
+func (a *Account) quotaAdd(to, from [zkidentity.IdentitySize]byte, filename string, size uint64) {
+	m, ok := a.mailboxes[to]
+	if !ok {
+		return
+	}
+	m.add(filename, mailboxEntry{from: from, size: size})
+}
+
+// quotaDel accounts for a message that was removed from the mailbox of id.
+// This function must be called with the mutex held.
+func (a *Account) quotaDel(id [zkidentity.IdentitySize]byte, filename string) {
+	m, ok := a.mailboxes[id]
+	if !ok {
+		return
+	}
+	m.del(filename)
+}
@@ -0,0 +1,93 @@
+// Copyright (c) 2020 Company 0, LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/companyzero/zkc/zkserver/socketapi"
+	"github.com/companyzero/zkc/zkserver/storage"
+)
+
+func TestIdentityPurge(t *testing.T) {
+	root, err := ioutil.TempDir("", "zkserver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	z := newTestServer(t, root)
+	id := testAccount(t, z)
+	sc, client := addTestSession(t, z, make(chan *RPCWrapper, 1))
+	defer client.Close()
+	delete(z.sessions, sc.rids)
+	sc.rids = hex.EncodeToString(id[:])
+	z.sessions[sc.rids] = map[storage.DeviceID]*sessionContext{
+		sc.device: sc,
+	}
+
+	upr := z.handleIdentityPurge(socketapi.SocketCommandUserPurge{
+		Identity: sc.rids,
+	})
+	if upr.Error != "" {
+		t.Fatal(upr.Error)
+	}
+	if z.account.Enabled(id) {
+		t.Fatal("account not purged")
+	}
+
+	// the connection was closed on the client
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = client.Read(make([]byte, 1))
+	if err != io.EOF {
+		t.Fatalf("expected closed connection, got %v", err)
+	}
+}
+
+func TestIdentityNick(t *testing.T) {
+	root, err := ioutil.TempDir("", "zkserver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	z := newTestServer(t, root)
+	id := testAccount(t, z)
+	err = z.account.Push(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	unr := z.handleIdentityNick(socketapi.SocketCommandUserNick{
+		Identity: hex.EncodeToString(id[:]),
+		Nick:     "bob",
+	})
+	if unr.Error != "" {
+		t.Fatal(unr.Error)
+	}
+
+	// the directory finds the new nick right away
+	pid, err := z.account.Find("bob")
+	if err != nil || pid.Identity != id {
+		t.Fatalf("nick not in directory: %v", err)
+	}
+	if _, err = z.account.Find("alice"); err == nil {
+		t.Fatal("old nick still in directory")
+	}
+
+	// and the user is told
+	m, err := z.store.Messages(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m) != 1 {
+		t.Fatalf("expected notice, got %v messages", len(m))
+	}
+}
@@ -0,0 +1,301 @@
+// Copyright (c) 2020 Company 0, LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+// audit implements a tamper evident, append only log of administrative
+// actions.  Every entry is a line of JSON that contains the hash of the
+// previous entry and is signed with the server identity.  Removing, reordering
+// or altering entries breaks the chain; appending entries requires the server
+// key.  When the server identity is replaced the old identity appends a
+// succession entry that names its successor, which signs all later entries.
+package audit
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/companyzero/zkc/zkidentity"
+)
+
+// Entry kinds.
+const (
+	KindSocket        = "socket"        // socketapi command
+	KindAccountCreate = "accountcreate" // remote account creation
+	KindDisconnect    = "disconnect"    // forced session disconnect
+	KindSignal        = "signal"        // action triggered by a signal
+	KindSuccession    = "succession"    // server identity replaced
+)
+
+// Entry is a single audit log record.
+type Entry struct {
+	Seq       uint64 `json:"seq"`       // position in log, starts at 1
+	Time      int64  `json:"time"`      // unix time of action
+	Kind      string `json:"kind"`      // kind of action
+	Action    string `json:"action"`    // action within kind
+	Detail    string `json:"detail"`    // arguments of action
+	Result    string `json:"result"`    // outcome of action
+	Prev      string `json:"prev"`      // hash of previous entry
+	Hash      string `json:"hash"`      // hash of this entry
+	Signature string `json:"signature"` // server signature of hash
+}
+
+// digest returns the hash that chains and signs the entry.  Every field is
+// length prefixed so that fields can not be shifted into one another.
+func (e *Entry) digest() ([]byte, error) {
+	prev, err := hex.DecodeString(e.Prev)
+	if err != nil {
+		return nil, fmt.Errorf("invalid previous hash: %v", err)
+	}
+
+	d := sha256.New()
+	d.Write([]byte("zkc audit"))
+	binary.Write(d, binary.BigEndian, e.Seq)
+	binary.Write(d, binary.BigEndian, e.Time)
+	for _, v := range []string{e.Kind, e.Action, e.Detail, e.Result} {
+		binary.Write(d, binary.BigEndian, uint64(len(v)))
+		d.Write([]byte(v))
+	}
+	d.Write(prev)
+	return d.Sum(nil), nil
+}
+
+// genesis is the previous hash of the first entry.
+var genesis = hex.EncodeToString(make([]byte, sha256.Size))
+
+// Log is an open audit log.
+type Log struct {
+	sync.Mutex
+	f    *os.File
+	id   *zkidentity.FullIdentity
+	seq  uint64 // sequence of last entry
+	prev string // hash of last entry
+	torn int64  // length of incomplete entry removed by Open
+}
+
+// Open opens or creates an audit log that is signed by id.  The chain of an
+// existing log is verified before new entries are appended to it, see Verify
+// for predecessors.  An incomplete last entry, which is left behind when
+// Append is interrupted, is removed; see Torn.
+func Open(filename string, id *zkidentity.FullIdentity, predecessors ...zkidentity.PublicIdentity) (*Log, error) {
+	l := &Log{
+		id:   id,
+		prev: genesis,
+	}
+
+	f, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE|os.O_APPEND,
+		0600)
+	if err != nil {
+		return nil, err
+	}
+	last, size, err := verify(f, id.Public, predecessors...)
+	if errors.Is(err, ErrTorn) {
+		var fi os.FileInfo
+		fi, err = f.Stat()
+		if err == nil {
+			l.torn = fi.Size() - size
+			err = f.Truncate(size)
+		}
+	}
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%v: %w", filename, err)
+	}
+	if last != nil {
+		l.seq = last.Seq
+		l.prev = last.Hash
+	}
+	l.f = f
+
+	return l, nil
+}
+
+// Torn returns the length of the incomplete last entry that Open removed, 0
+// if there was none.
+func (l *Log) Torn() int64 {
+	return l.torn
+}
+
+// Append signs and writes an entry.  The entry is synced to disk before
+// Append returns.
+func (l *Log) Append(kind, action, detail, result string) error {
+	l.Lock()
+	defer l.Unlock()
+
+	e := Entry{
+		Seq:    l.seq + 1,
+		Time:   time.Now().Unix(),
+		Kind:   kind,
+		Action: action,
+		Detail: detail,
+		Result: result,
+		Prev:   l.prev,
+	}
+	digest, err := e.digest()
+	if err != nil {
+		return err
+	}
+	sig := l.id.SignMessage(digest)
+	e.Hash = hex.EncodeToString(digest)
+	e.Signature = hex.EncodeToString(sig[:])
+
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	_, err = l.f.Write(append(b, '\n'))
+	if err != nil {
+		return err
+	}
+	err = l.f.Sync()
+	if err != nil {
+		return err
+	}
+
+	l.seq = e.Seq
+	l.prev = e.Hash
+	return nil
+}
+
+// Close closes the log.
+func (l *Log) Close() error {
+	l.Lock()
+	defer l.Unlock()
+	return l.f.Close()
+}
+
+// Snapshot calls fn while no entries are appended, so that fn can copy a log
+// that ends on a complete entry.
+func (l *Log) Snapshot(fn func() error) error {
+	l.Lock()
+	defer l.Unlock()
+	return fn()
+}
+
+var (
+	// ErrChain is returned when the audit log has been tampered with.
+	ErrChain = errors.New("audit chain broken")
+
+	// ErrTorn is returned when the audit log ends in an incomplete
+	// entry without a newline, which is what an interrupted Append
+	// leaves behind.
+	ErrTorn = errors.New("audit log ends in an incomplete entry")
+)
+
+// Verify reads an audit log and verifies that every entry is chained to its
+// predecessor and signed by pid.  If the server identity was replaced,
+// predecessors are the replaced identities, oldest first.  The log may start
+// with any of them and every succession entry must name the next identity,
+// which signs the entries that follow.  The last entry must be signed by pid.
+// Verify returns the last entry, which is nil if the log is empty.  If the
+// log ends in an incomplete entry Verify returns the last complete entry and
+// an error that wraps ErrTorn.
+func Verify(r io.Reader, pid zkidentity.PublicIdentity, predecessors ...zkidentity.PublicIdentity) (*Entry, error) {
+	last, _, err := verify(r, pid, predecessors...)
+	if err != nil && !errors.Is(err, ErrTorn) {
+		return nil, err
+	}
+	return last, err
+}
+
+// verify implements Verify and additionally returns the length of the
+// complete entries.
+func verify(r io.Reader, pid zkidentity.PublicIdentity, predecessors ...zkidentity.PublicIdentity) (*Entry, int64, error) {
+	var (
+		last *Entry
+		size int64
+		prev = genesis
+		seq  uint64
+		key  = -1 // index in keys of the signer, -1 until known
+		keys = append(append([]zkidentity.PublicIdentity(nil),
+			predecessors...), pid)
+	)
+	torn := false
+	br := bufio.NewReaderSize(r, 64*1024)
+	for {
+		line, err := br.ReadBytes('\n')
+		if err == io.EOF {
+			// an interrupted Append wrote part of an entry
+			torn = len(line) != 0
+			break
+		} else if err != nil {
+			return nil, 0, err
+		}
+
+		var e Entry
+		err = json.Unmarshal(line, &e)
+		if err != nil {
+			return nil, 0, fmt.Errorf("%w: entry %v: %v", ErrChain,
+				seq+1, err)
+		}
+		if e.Seq != seq+1 {
+			return nil, 0, fmt.Errorf("%w: entry %v: unexpected "+
+				"sequence %v", ErrChain, seq+1, e.Seq)
+		}
+		if e.Prev != prev {
+			return nil, 0, fmt.Errorf("%w: entry %v: previous hash "+
+				"mismatch", ErrChain, e.Seq)
+		}
+		digest, err := e.digest()
+		if err != nil {
+			return nil, 0, fmt.Errorf("%w: entry %v: %v", ErrChain,
+				e.Seq, err)
+		}
+		if hex.EncodeToString(digest) != e.Hash {
+			return nil, 0, fmt.Errorf("%w: entry %v: hash mismatch",
+				ErrChain, e.Seq)
+		}
+		sig, err := hex.DecodeString(e.Signature)
+		if err != nil || len(sig) != 64 {
+			return nil, 0, fmt.Errorf("%w: entry %v: invalid "+
+				"signature", ErrChain, e.Seq)
+		}
+		var signature [64]byte
+		copy(signature[:], sig)
+		if key == -1 {
+			// the log starts with the first identity that
+			// signed it
+			for k := range keys {
+				if keys[k].VerifyMessage(digest, signature) {
+					key = k
+					break
+				}
+			}
+		}
+		if key == -1 || !keys[key].VerifyMessage(digest, signature) {
+			return nil, 0, fmt.Errorf("%w: entry %v: signature "+
+				"verification failed", ErrChain, e.Seq)
+		}
+		if e.Kind == KindSuccession {
+			if key+1 >= len(keys) ||
+				e.Detail != keys[key+1].Fingerprint() {
+				return nil, 0, fmt.Errorf("%w: entry %v: unknown "+
+					"successor %v", ErrChain, e.Seq,
+					e.Detail)
+			}
+			key++
+		}
+
+		seq = e.Seq
+		prev = e.Hash
+		last = &e
+		size += int64(len(line))
+	}
+	if last != nil && key != len(keys)-1 {
+		return nil, 0, fmt.Errorf("%w: entry %v: not signed by %v",
+			ErrChain, last.Seq, pid.Fingerprint())
+	}
+	if torn {
+		return last, size, fmt.Errorf("%w: entry %v", ErrTorn, seq+1)
+	}
+
+	return last, size, nil
+}
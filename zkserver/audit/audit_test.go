@@ -0,0 +1,285 @@
+// Copyright (c) 2020 Company 0, LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package audit
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/companyzero/zkc/zkidentity"
+)
+
+func TestAudit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "audit.log")
+
+	id, err := zkidentity.New("zkserver", "zkserver")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := Open(filename, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range []string{"userdisable", "userenable"} {
+		err = l.Append(KindSocket, v, `{"identity":"00"}`, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = l.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// reopen continues the chain
+	l, err = Open(filename, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = l.Append(KindDisconnect, "sessionkick", "00", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = l.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	log, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	last, err := Verify(bytes.NewReader(log), id.Public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last.Seq != 3 || last.Action != "sessionkick" {
+		t.Fatalf("unexpected last entry: %+v", last)
+	}
+
+	// wrong key
+	other, err := zkidentity.New("other", "other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = Verify(bytes.NewReader(log), other.Public)
+	if !errors.Is(err, ErrChain) {
+		t.Fatalf("expected ErrChain, got %v", err)
+	}
+
+	// altered entry
+	altered := bytes.Replace(log, []byte("userenable"),
+		[]byte("userdisable"), 1)
+	_, err = Verify(bytes.NewReader(altered), id.Public)
+	if !errors.Is(err, ErrChain) {
+		t.Fatalf("expected ErrChain, got %v", err)
+	}
+
+	// removed entry
+	lines := bytes.SplitAfter(log, []byte("\n"))
+	removed := append(append([]byte{}, lines[0]...), lines[2]...)
+	_, err = Verify(bytes.NewReader(removed), id.Public)
+	if !errors.Is(err, ErrChain) {
+		t.Fatalf("expected ErrChain, got %v", err)
+	}
+
+	// tampered log can not be opened
+	err = ioutil.WriteFile(filename, altered, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = Open(filename, id)
+	if err == nil {
+		t.Fatal("expected tampered log to fail")
+	}
+}
+
+func TestAuditSuccession(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "audit.log")
+
+	old, err := zkidentity.New("zkserver", "zkserver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := zkidentity.New("zkserver", "zkserver")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := Open(filename, old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = l.Append(KindSocket, "userdisable", `{"identity":"00"}`, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = l.Append(KindSuccession, "identity", id.Public.Fingerprint(),
+		"")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = l.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the successor continues the chain
+	l, err = Open(filename, id, old.Public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = l.Append(KindSocket, "userenable", `{"identity":"00"}`, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = l.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	log, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	last, err := Verify(bytes.NewReader(log), id.Public, old.Public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last.Seq != 3 || last.Action != "userenable" {
+		t.Fatalf("unexpected last entry: %+v", last)
+	}
+
+	// the successor is unknown without predecessors
+	_, err = Verify(bytes.NewReader(log), id.Public)
+	if !errors.Is(err, ErrChain) {
+		t.Fatalf("expected ErrChain, got %v", err)
+	}
+
+	// the last entry must be signed by the current identity
+	lines := bytes.SplitAfter(log, []byte("\n"))
+	truncated := bytes.Join(lines[:1], nil)
+	_, err = Verify(bytes.NewReader(truncated), id.Public, old.Public)
+	if !errors.Is(err, ErrChain) {
+		t.Fatalf("expected ErrChain, got %v", err)
+	}
+
+	// entries after the succession can not be signed by the old identity
+	l, err = Open(filename, old)
+	if err == nil {
+		l.Close()
+		t.Fatal("expected replaced identity to fail")
+	}
+}
+
+func TestAuditTorn(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "audit.log")
+
+	id, err := zkidentity.New("zkserver", "zkserver")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := Open(filename, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range []string{"userdisable", "userenable"} {
+		err = l.Append(KindSocket, v, `{"identity":"00"}`, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = l.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	log, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// an interrupted append leaves part of the last entry
+	lines := bytes.SplitAfter(log, []byte("\n"))
+	torn := append(append([]byte{}, lines[0]...),
+		lines[1][:len(lines[1])/2]...)
+	last, err := Verify(bytes.NewReader(torn), id.Public)
+	if !errors.Is(err, ErrTorn) {
+		t.Fatalf("expected ErrTorn, got %v", err)
+	}
+	if last == nil || last.Seq != 1 {
+		t.Fatalf("unexpected last entry: %+v", last)
+	}
+
+	// even a complete entry without newline is torn
+	_, err = Verify(bytes.NewReader(log[:len(log)-1]), id.Public)
+	if !errors.Is(err, ErrTorn) {
+		t.Fatalf("expected ErrTorn, got %v", err)
+	}
+
+	// open removes the incomplete entry and continues the chain
+	err = ioutil.WriteFile(filename, torn, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err = Open(filename, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.Torn() != int64(len(lines[1])/2) {
+		t.Fatalf("unexpected torn length %v", l.Torn())
+	}
+	err = l.Append(KindSocket, "userenable", `{"identity":"00"}`, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = l.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	log, err = ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	last, err = Verify(bytes.NewReader(log), id.Public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last.Seq != 2 || last.Action != "userenable" {
+		t.Fatalf("unexpected last entry: %+v", last)
+	}
+
+	// an altered complete entry is still tampering
+	altered := bytes.Replace(torn, []byte("userdisable"),
+		[]byte("userenable"), 1)
+	err = ioutil.WriteFile(filename, altered, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = Open(filename, id)
+	if !errors.Is(err, ErrChain) {
+		t.Fatalf("expected ErrChain, got %v", err)
+	}
+}
@@ -0,0 +1,61 @@
+// Copyright (c) 2020 Company 0, LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"reflect"
+
+	"github.com/companyzero/zkc/rpc"
+	"github.com/companyzero/zkc/zkserver/audit"
+	"github.com/companyzero/zkc/zkserver/storage"
+)
+
+// audit appends an entry to the audit log.  Failures are logged but do not
+// prevent the action.
+func (z *ZKS) audit(kind, action, detail, result string) {
+	err := z.auditLog.Append(kind, action, detail, result)
+	if err != nil {
+		z.Error(idApp, "could not write audit log: %v %v %v %v: %v",
+			kind, action, detail, result, err)
+	}
+}
+
+// auditSocket records a socket command, its arguments and the error of its
+// reply.
+func (z *ZKS) auditSocket(command string, request, reply interface{}) {
+	detail, err := json.Marshal(request)
+	if err != nil {
+		detail = []byte(fmt.Sprintf("%v", request))
+	}
+
+	result := "ok"
+	rv := reflect.Indirect(reflect.ValueOf(reply))
+	if rv.Kind() == reflect.Struct {
+		e := rv.FieldByName("Error")
+		if e.Kind() == reflect.String && e.String() != "" {
+			result = e.String()
+		}
+	}
+
+	z.audit(audit.KindSocket, command, string(detail), result)
+}
+
+// auditAccountCreate records a remote account creation.  Failed attempts are
+// not recorded because anyone can make them and they change nothing.
+func (z *ZKS) auditAccountCreate(conn net.Conn, ca rpc.CreateAccount) {
+	z.audit(audit.KindAccountCreate, z.settings().CreatePolicy,
+		fmt.Sprintf("%v %v %q", conn.RemoteAddr(),
+			ca.PublicIdentity.Fingerprint(), ca.PublicIdentity.Nick),
+		"ok")
+}
+
+// auditDisconnect records a session that was disconnected by the server.
+func (z *ZKS) auditDisconnect(reason, rids string, device storage.DeviceID) {
+	z.audit(audit.KindDisconnect, reason, fmt.Sprintf("%v %x", rids,
+		device), "ok")
+}
@@ -0,0 +1,116 @@
+// Copyright (c) 2020 Company 0, LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/companyzero/zkc/zkserver/backup"
+	"github.com/companyzero/zkc/zkserver/socketapi"
+	"github.com/companyzero/zkc/zkserver/storage"
+)
+
+// handleBackup always returns an answer to the backup command.  It writes the
+// root and users directories to an encrypted backup.  Writes to the store,
+// the audit log and the certificates are held off while the backup is taken
+// so that it is consistent; sessions carry on and their writes resume once
+// the backup completes.
+func (z *ZKS) handleBackup(b socketapi.SocketCommandBackup) *socketapi.SocketCommandBackupReply {
+	br := &socketapi.SocketCommandBackupReply{}
+
+	if !filepath.IsAbs(b.Filename) {
+		br.Error = "backup filename must be absolute"
+		return br
+	}
+	if b.Passphrase == "" {
+		br.Error = "must provide passphrase"
+		return br
+	}
+	ss, ok := z.store.(storage.Snapshotter)
+	if !ok {
+		br.Error = "storage does not support backups"
+		return br
+	}
+
+	f, err := os.OpenFile(b.Filename, os.O_WRONLY|os.O_CREATE|os.O_EXCL,
+		0600)
+	if err != nil {
+		br.Error = fmt.Sprintf("could not create backup: %v", err)
+		return br
+	}
+	start := time.Now()
+	err = z.writeBackup(f, ss, b)
+	if err == nil {
+		err = f.Sync()
+	}
+	if err == nil {
+		var fi os.FileInfo
+		fi, err = f.Stat()
+		if err == nil {
+			br.Size = fi.Size()
+		}
+	}
+	f.Close()
+	if err != nil {
+		os.Remove(b.Filename)
+		br.Error = fmt.Sprintf("could not write backup: %v", err)
+		z.Error(idApp, "backup %v: %v", b.Filename, err)
+		return br
+	}
+
+	br.Fingerprint = z.id.Public.Fingerprint()
+	z.Info(idApp, "Backup written to %v, %v bytes in %v", b.Filename,
+		br.Size, time.Since(start).Round(time.Millisecond))
+
+	return br
+}
+
+// writeBackup writes the backup to f.  The users directory is stored apart
+// from root since it may live elsewhere.  The backup itself, the log file and
+// sockets are left out.
+func (z *ZKS) writeBackup(f *os.File, ss storage.Snapshotter, b socketapi.SocketCommandBackup) error {
+	root := filepath.Clean(z.settings().Root)
+	users := filepath.Clean(z.settings().Users)
+	skip := map[string]bool{
+		users:                                true,
+		filepath.Clean(b.Filename):           true,
+		filepath.Clean(z.settings().LogFile): true,
+	}
+
+	bw := bufio.NewWriter(f)
+	w, err := backup.NewWriter(bw, []byte(b.Passphrase), z.id,
+		time.Now().Unix())
+	if err != nil {
+		return err
+	}
+
+	z.certMtx.Lock()
+	defer z.certMtx.Unlock()
+
+	err = z.auditLog.Snapshot(func() error {
+		return ss.Snapshot(func() error {
+			err := w.AddTree("root", root, func(p string) bool {
+				return skip[p]
+			})
+			if err != nil {
+				return err
+			}
+			return w.AddTree("users", users, nil)
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	err = w.Close()
+	if err != nil {
+		return err
+	}
+	return bw.Flush()
+}
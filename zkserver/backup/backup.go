@@ -0,0 +1,430 @@
+// Copyright (c) 2020 Company 0, LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+// Package backup reads and writes encrypted zkserver backups.  A backup is a
+// tar archive of the server state that is preceded by a manifest naming the
+// server identity.  The archive is encrypted in chunks with a key that is
+// derived from a passphrase and the last chunk carries a signature of the
+// server identity over everything that precedes it.  Truncated, altered or
+// foreign backups are therefore detected once the archive has been read.
+//
+// An archive starts with a cleartext header followed by chunks:
+//
+//	header = magic version salt nonce
+//	chunk  = length secretbox(plaintext)
+//
+// The nonce of a chunk is the nonce of the header followed by the chunk
+// counter.  The most significant bit of the counter is set on the last chunk,
+// whose plaintext is the signature.
+package backup
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/companyzero/zkc/blobshare"
+	"github.com/companyzero/zkc/zkidentity"
+	xdr "github.com/davecgh/go-xdr/xdr2"
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+// Version is the backup format version.
+const Version = 1
+
+const (
+	chunkSize = 64 * 1024 // plaintext bytes per chunk
+	lastChunk = 1 << 63   // counter flag of the last chunk
+)
+
+var (
+	// ErrFormat is returned when a file is not a backup or of an
+	// unsupported version.
+	ErrFormat = errors.New("not a zkserver backup")
+
+	// ErrDecrypt is returned when a chunk can not be decrypted, either
+	// because the passphrase is wrong or because the backup was altered.
+	ErrDecrypt = errors.New("could not decrypt backup, wrong passphrase " +
+		"or corrupt backup")
+
+	// ErrSignature is returned when the signature of the backup does not
+	// match the server identity of its manifest.
+	ErrSignature = errors.New("invalid backup signature")
+
+	magic = [8]byte{'z', 'k', 's', 'b', 'a', 'c', 'k', 'p'}
+)
+
+// header is the cleartext start of a backup.
+type header struct {
+	Magic   [8]byte
+	Version uint32
+	Salt    [32]byte
+	Nonce   [16]byte
+}
+
+// Manifest describes the server a backup was taken of.
+type Manifest struct {
+	Created  int64                     // unix time the backup was taken
+	Identity zkidentity.PublicIdentity // server identity
+}
+
+// newDigest returns the hash that is signed by the server identity.
+func newDigest(h []byte) hash.Hash {
+	d := sha256.New()
+	d.Write([]byte("zkc server backup"))
+	d.Write(h)
+	return d
+}
+
+// chunkNonce returns the nonce of chunk counter.
+func chunkNonce(prefix *[16]byte, counter uint64) *[24]byte {
+	var nonce [24]byte
+	copy(nonce[:], prefix[:])
+	binary.BigEndian.PutUint64(nonce[16:], counter)
+	return &nonce
+}
+
+// ciphertext encrypts plaintext in chunks and signs it.
+type ciphertext struct {
+	w       io.Writer
+	key     *[32]byte
+	nonce   [16]byte
+	counter uint64
+	digest  hash.Hash
+	buf     []byte // plaintext of the next chunk
+}
+
+// Write encrypts every complete chunk of plaintext.
+func (c *ciphertext) Write(b []byte) (int, error) {
+	c.digest.Write(b)
+	c.buf = append(c.buf, b...)
+	for len(c.buf) >= chunkSize {
+		err := c.seal(c.buf[:chunkSize], c.counter)
+		if err != nil {
+			return 0, err
+		}
+		c.buf = append(c.buf[:0], c.buf[chunkSize:]...)
+	}
+	return len(b), nil
+}
+
+// seal encrypts and writes a chunk.
+func (c *ciphertext) seal(b []byte, counter uint64) error {
+	sealed := secretbox.Seal(nil, b, chunkNonce(&c.nonce, counter), c.key)
+	var l [4]byte
+	binary.BigEndian.PutUint32(l[:], uint32(len(sealed)))
+	_, err := c.w.Write(append(l[:], sealed...))
+	if err != nil {
+		return err
+	}
+	c.counter++
+	return nil
+}
+
+// sign encrypts the remaining plaintext followed by the signature of id.
+func (c *ciphertext) sign(id *zkidentity.FullIdentity) error {
+	if len(c.buf) > 0 {
+		err := c.seal(c.buf, c.counter)
+		if err != nil {
+			return err
+		}
+		c.buf = nil
+	}
+	sig := id.SignMessage(c.digest.Sum(nil))
+	return c.seal(sig[:], c.counter|lastChunk)
+}
+
+// Writer writes an encrypted backup.  Files are added to the archive with
+// AddFile and AddTree and the backup is signed by Close.
+type Writer struct {
+	c  *ciphertext
+	id *zkidentity.FullIdentity
+	tw *tar.Writer
+}
+
+// NewWriter writes the header and manifest of a backup of the server with
+// identity id to w.  The backup is encrypted with a key derived from
+// passphrase.
+func NewWriter(w io.Writer, passphrase []byte, id *zkidentity.FullIdentity, created int64) (*Writer, error) {
+	key, salt, err := blobshare.NewKey(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	h := header{
+		Magic:   magic,
+		Version: Version,
+		Salt:    *salt,
+	}
+	_, err = io.ReadFull(rand.Reader, h.Nonce[:])
+	if err != nil {
+		return nil, err
+	}
+	var hb bytes.Buffer
+	_, err = xdr.Marshal(&hb, h)
+	if err != nil {
+		return nil, err
+	}
+	_, err = w.Write(hb.Bytes())
+	if err != nil {
+		return nil, err
+	}
+
+	bw := &Writer{
+		c: &ciphertext{
+			w:      w,
+			key:    key,
+			nonce:  h.Nonce,
+			digest: newDigest(hb.Bytes()),
+		},
+		id: id,
+	}
+	_, err = xdr.Marshal(bw.c, Manifest{
+		Created:  created,
+		Identity: id.Public,
+	})
+	if err != nil {
+		return nil, err
+	}
+	bw.tw = tar.NewWriter(bw.c)
+
+	return bw, nil
+}
+
+// AddFile adds filename to the archive as name.
+func (w *Writer) AddFile(name, filename string) error {
+	fi, err := os.Stat(filename)
+	if err != nil {
+		return err
+	}
+	return w.add(name, filename, fi)
+}
+
+// add adds a directory or regular file to the archive.
+func (w *Writer) add(name, filename string, fi os.FileInfo) error {
+	th, err := tar.FileInfoHeader(fi, "")
+	if err != nil {
+		return err
+	}
+	th.Name = name
+	if fi.IsDir() {
+		th.Name += "/"
+	}
+	err = w.tw.WriteHeader(th)
+	if err != nil {
+		return err
+	}
+	if !fi.Mode().IsRegular() {
+		return nil
+	}
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.CopyN(w.tw, f, fi.Size())
+	return err
+}
+
+// AddTree adds dir and everything below it to the archive under prefix.
+// Files for which skip returns true are left out, as are files that are
+// neither directories nor regular files, e.g. sockets.
+func (w *Writer) AddTree(prefix, dir string, skip func(string) bool) error {
+	return filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if skip != nil && skip(p) {
+			if fi.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !fi.IsDir() && !fi.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		return w.add(path.Join(prefix, filepath.ToSlash(rel)), p, fi)
+	})
+}
+
+// Close completes the archive and signs the backup.  It does not close the
+// underlying writer.
+func (w *Writer) Close() error {
+	err := w.tw.Close()
+	if err != nil {
+		return err
+	}
+	return w.c.sign(w.id)
+}
+
+// plaintext decrypts the chunks of a backup and verifies its signature.
+type plaintext struct {
+	r        io.Reader
+	key      *[32]byte
+	nonce    [16]byte
+	counter  uint64
+	digest   hash.Hash
+	buf      []byte // decrypted plaintext that has not been read
+	last     bool   // last chunk was read
+	identity *zkidentity.PublicIdentity
+}
+
+// Read reads decrypted plaintext.
+func (p *plaintext) Read(b []byte) (int, error) {
+	for len(p.buf) == 0 {
+		if p.last {
+			return 0, io.EOF
+		}
+		err := p.open()
+		if err != nil {
+			return 0, err
+		}
+	}
+	n := copy(b, p.buf)
+	p.digest.Write(b[:n])
+	p.buf = p.buf[n:]
+	return n, nil
+}
+
+// open reads and decrypts the next chunk.  The signature in the last chunk
+// is verified against identity.
+func (p *plaintext) open() error {
+	var l [4]byte
+	_, err := io.ReadFull(p.r, l[:])
+	if errors.Is(err, io.EOF) {
+		// the last chunk is missing
+		return io.ErrUnexpectedEOF
+	} else if err != nil {
+		return err
+	}
+	size := binary.BigEndian.Uint32(l[:])
+	if size < secretbox.Overhead || size > chunkSize+secretbox.Overhead {
+		return ErrDecrypt
+	}
+	sealed := make([]byte, size)
+	_, err = io.ReadFull(p.r, sealed)
+	if errors.Is(err, io.EOF) {
+		return io.ErrUnexpectedEOF
+	} else if err != nil {
+		return err
+	}
+
+	// try the counter of a regular and of the last chunk
+	b, ok := secretbox.Open(nil, sealed, chunkNonce(&p.nonce, p.counter),
+		p.key)
+	if ok {
+		p.counter++
+		p.buf = b
+		return nil
+	}
+	b, ok = secretbox.Open(nil, sealed,
+		chunkNonce(&p.nonce, p.counter|lastChunk), p.key)
+	if !ok {
+		return ErrDecrypt
+	}
+	p.last = true
+	if p.identity == nil || len(b) != ed25519.SignatureSize {
+		return ErrSignature
+	}
+	var sig [ed25519.SignatureSize]byte
+	copy(sig[:], b)
+	if !p.identity.VerifyMessage(p.digest.Sum(nil), sig) {
+		return ErrSignature
+	}
+	return nil
+}
+
+// Reader reads an encrypted backup.  The signature is verified once the
+// archive has been read; Next only returns io.EOF if the signature is valid.
+type Reader struct {
+	p        *plaintext
+	manifest Manifest
+	tr       *tar.Reader
+}
+
+// NewReader reads the header and manifest of a backup that is encrypted with
+// passphrase.
+func NewReader(r io.Reader, passphrase []byte) (*Reader, error) {
+	var h header
+	_, err := xdr.Unmarshal(r, &h)
+	if err != nil || h.Magic != magic {
+		return nil, ErrFormat
+	}
+	if h.Version != Version {
+		return nil, fmt.Errorf("%w: version %v", ErrFormat, h.Version)
+	}
+	var hb bytes.Buffer
+	_, err = xdr.Marshal(&hb, h)
+	if err != nil {
+		return nil, err
+	}
+	key, err := blobshare.DeriveKey(passphrase, &h.Salt)
+	if err != nil {
+		return nil, err
+	}
+
+	br := &Reader{
+		p: &plaintext{
+			r:      r,
+			key:    key,
+			nonce:  h.Nonce,
+			digest: newDigest(hb.Bytes()),
+		},
+	}
+
+	// the first chunk tells a wrong passphrase from a corrupt manifest
+	err = br.p.open()
+	if err != nil {
+		return nil, err
+	}
+	_, err = xdr.Unmarshal(br.p, &br.manifest)
+	if err != nil {
+		return nil, fmt.Errorf("could not read manifest: %v", err)
+	}
+	br.p.identity = &br.manifest.Identity
+	br.tr = tar.NewReader(br.p)
+
+	return br, nil
+}
+
+// Manifest returns the manifest of the backup.  The manifest is only known
+// to be authentic once Next returned io.EOF.
+func (r *Reader) Manifest() Manifest {
+	return r.manifest
+}
+
+// Next advances to the next file in the archive.  At the end of the archive
+// the signature is verified and io.EOF is returned if it is valid.
+func (r *Reader) Next() (*tar.Header, error) {
+	th, err := r.tr.Next()
+	if errors.Is(err, io.EOF) {
+		// read the padding and the signature that follow
+		_, err = io.Copy(ioutil.Discard, r.p)
+		if err != nil {
+			return nil, err
+		}
+		return nil, io.EOF
+	}
+	return th, err
+}
+
+// Read reads the current file.
+func (r *Reader) Read(b []byte) (int, error) {
+	return r.tr.Read(b)
+}
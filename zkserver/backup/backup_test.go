@@ -0,0 +1,174 @@
+// Copyright (c) 2020 Company 0, LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package backup
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/companyzero/zkc/zkidentity"
+)
+
+// readAll reads a backup and returns its files.
+func readAll(b []byte, passphrase string) (*Reader, map[string][]byte, error) {
+	r, err := NewReader(bytes.NewReader(b), []byte(passphrase))
+	if err != nil {
+		return nil, nil, err
+	}
+	files := make(map[string][]byte)
+	for {
+		th, err := r.Next()
+		if errors.Is(err, io.EOF) {
+			return r, files, nil
+		} else if err != nil {
+			return nil, nil, err
+		}
+		files[th.Name], err = ioutil.ReadAll(r)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+}
+
+func TestBackup(t *testing.T) {
+	id, err := zkidentity.New("zkserver", "zkserver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "backup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// a message larger than a chunk and an excluded file
+	big := bytes.Repeat([]byte("0123456789"), chunkSize/5)
+	err = os.MkdirAll(filepath.Join(dir, "home", "a", "cache"), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(dir, "home", "a", "cache", "1"),
+		big, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(dir, "zkserver.log"), []byte("x"),
+		0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(dir, "zkserver.id"), []byte("id"),
+		0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var b bytes.Buffer
+	w, err := NewWriter(&b, []byte("secret"), id, 1600000000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.AddTree("root", dir, func(p string) bool {
+		return filepath.Base(p) == "zkserver.log"
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.AddFile("users/id", filepath.Join(dir, "zkserver.id"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(b.Bytes(), []byte("0123456789")) {
+		t.Fatal("backup is not encrypted")
+	}
+
+	r, files, err := readAll(b.Bytes(), "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := r.Manifest()
+	if m.Created != 1600000000 ||
+		m.Identity.Identity != id.Public.Identity {
+		t.Fatalf("unexpected manifest: %v", m)
+	}
+	if !bytes.Equal(files["root/home/a/cache/1"], big) {
+		t.Fatal("message was not restored")
+	}
+	if string(files["root/zkserver.id"]) != "id" ||
+		string(files["users/id"]) != "id" {
+		t.Fatal("identity was not restored")
+	}
+	if _, ok := files["root/home/a/cache/"]; !ok {
+		t.Fatal("directory was not restored")
+	}
+	if _, ok := files["root/zkserver.log"]; ok {
+		t.Fatal("skipped file was restored")
+	}
+
+	// wrong passphrase
+	_, _, err = readAll(b.Bytes(), "wrong")
+	if !errors.Is(err, ErrDecrypt) {
+		t.Fatalf("expected ErrDecrypt, got %v", err)
+	}
+
+	// not a backup
+	_, _, err = readAll(big, "secret")
+	if !errors.Is(err, ErrFormat) {
+		t.Fatalf("expected ErrFormat, got %v", err)
+	}
+
+	// altered chunk
+	altered := append([]byte{}, b.Bytes()...)
+	altered[len(altered)/2] ^= 1
+	_, _, err = readAll(altered, "secret")
+	if !errors.Is(err, ErrDecrypt) {
+		t.Fatalf("expected ErrDecrypt, got %v", err)
+	}
+
+	// truncated backups never verify
+	for _, n := range []int{b.Len() - 1, b.Len() - 100, b.Len() / 2} {
+		_, _, err = readAll(b.Bytes()[:n], "secret")
+		if err == nil {
+			t.Fatalf("truncated backup of %v bytes verified", n)
+		}
+	}
+}
+
+func TestBackupSignature(t *testing.T) {
+	id, err := zkidentity.New("zkserver", "zkserver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := zkidentity.New("zkserver", "zkserver")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a backup that names id but is signed by other
+	var b bytes.Buffer
+	w, err := NewWriter(&b, []byte("secret"), id, 1600000000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.id = other
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, err = readAll(b.Bytes(), "secret")
+	if !errors.Is(err, ErrSignature) {
+		t.Fatalf("expected ErrSignature, got %v", err)
+	}
+}
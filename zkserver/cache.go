@@ -6,14 +6,44 @@ package main
 
 import (
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"math"
 	"path"
+	"time"
 
 	"github.com/companyzero/zkc/rpc"
 	"github.com/companyzero/zkc/session"
 	"github.com/companyzero/zkc/zkidentity"
+	"github.com/companyzero/zkc/zkserver/account"
 )
 
+const (
+	mailboxJanitorInterval = 10 * time.Minute
+)
+
+// mailboxJanitor periodically deletes undelivered messages that expired from
+// all accounts.
+func (z *ZKS) mailboxJanitor() {
+	ticker := time.NewTicker(mailboxJanitorInterval)
+	defer ticker.Stop()
+
+	for {
+		<-ticker.C
+
+		expired, err := z.account.Expire()
+		if err != nil {
+			z.Error(idApp, "mailboxJanitor: %v", err)
+		}
+		for _, v := range expired {
+			z.Info(idApp, "expired message %x -> %x: %v received %v",
+				v.From, v.To, v.Identifier,
+				time.Unix(v.Received, 0).Format(
+					z.settings().TimeFormat))
+		}
+	}
+}
+
 // think about establishing whitelist or just blind deliver
 func (z *ZKS) handleCache(writer chan *RPCWrapper, kx *session.KX, msg rpc.Message, cache rpc.Cache) error {
 	// sanity
@@ -30,11 +60,25 @@ func (z *ZKS) handleCache(writer chan *RPCWrapper, kx *session.KX, msg rpc.Messa
 	if !ok {
 		return fmt.Errorf("invalid identity type")
 	}
-	filename, err := z.account.Deliver(cache.To, from, cache.Payload, false)
+	// a TTL that does not fit in a time.Duration is as good as none
+	var ttl time.Duration
+	if cache.TTL <= uint64(math.MaxInt64/int64(time.Second)) {
+		ttl = time.Duration(cache.TTL) * time.Second
+	}
+	filename, err := z.account.Deliver(cache.To, from, cache.Payload,
+		account.DeliverOptions{
+			TTL:     ttl,
+			Receipt: cache.Receipt,
+		})
 	if err != nil {
 		replyError := "internal error"
 		replyErrorCode := rpc.ErrorCodeInvalid
-		if z.account.Disabled(cache.To) {
+		switch {
+		case errors.Is(err, account.ErrMailboxFull):
+			replyError = fmt.Sprintf("recipient mailbox full %x",
+				cache.To)
+			replyErrorCode = rpc.ErrorCodeMailboxFull
+		case z.account.Disabled(cache.To):
 			replyError = fmt.Sprintf("identity disabled %x",
 				cache.To)
 			replyErrorCode = rpc.ErrorCodeUserDisabled
@@ -64,7 +108,7 @@ func (z *ZKS) handleCache(writer chan *RPCWrapper, kx *session.KX, msg rpc.Messa
 	}
 
 	// dont eval if not in debug mode
-	if z.settings.Debug {
+	if z.settings().Debug {
 		z.Dbg(idApp, "handleCache: %v -> %v: %v",
 			hex.EncodeToString(cache.To[:]),
 			hex.EncodeToString(from[:]),
@@ -99,8 +143,14 @@ func (z *ZKS) handleProxy(writer chan *RPCWrapper, kx *session.KX, msg rpc.Messa
 	if !ok {
 		return fmt.Errorf("invalid identity type")
 	}
-	filename, err := z.account.Deliver(proxy.To, from, proxy.Payload, true)
-	if err != nil {
+	filename, err := z.account.Deliver(proxy.To, from, proxy.Payload,
+		account.DeliverOptions{Cleartext: true})
+	if errors.Is(err, account.ErrMailboxFull) {
+		payload.Error = fmt.Sprintf("proxy delivery failed, recipient "+
+			"mailbox full: %x", proxy.To)
+		z.Dbg(idApp, "proxy delivery failed %x -> %x: %v",
+			from, proxy.To, err)
+	} else if err != nil {
 		payload.Error = fmt.Sprintf("proxy delivery failed to: %x",
 			proxy.To)
 		z.Dbg(idApp, "proxy delivery failed %x -> %x: %v",
@@ -108,7 +158,7 @@ func (z *ZKS) handleProxy(writer chan *RPCWrapper, kx *session.KX, msg rpc.Messa
 	}
 
 	// dont eval if not in debug mode
-	if z.settings.Debug {
+	if z.settings().Debug {
 		z.Dbg(idApp, "handleProxy: %v -> %v: %v",
 			hex.EncodeToString(proxy.To[:]),
 			hex.EncodeToString(from[:]),
@@ -0,0 +1,165 @@
+// Copyright (c) 2020 Company 0, LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/companyzero/zkc/rpc"
+	"github.com/companyzero/zkc/zkserver/account"
+	"github.com/companyzero/zkc/zkserver/federation"
+)
+
+// federationHandler delivers the commands peers relay to this server.
+type federationHandler struct {
+	z *ZKS
+}
+
+var _ federation.Handler = (*federationHandler)(nil)
+
+// newFederation sets up relaying to and from the configured peers.
+func (z *ZKS) newFederation() (*federation.Federation, error) {
+	peers := make([]federation.Peer, 0, len(z.settings().FederationPeers))
+	for _, v := range z.settings().FederationPeers {
+		peers = append(peers, federation.Peer{
+			Address:  v.Address,
+			Identity: v.Identity,
+		})
+	}
+	f, err := federation.New(federation.Config{
+		Address:        z.settings().FederationAddress,
+		Identity:       z.id,
+		Peers:          peers,
+		MaxMessageSize: uint(z.settings().MaxMsgSize),
+		Timeout: time.Duration(z.settings().FederationTimeout) *
+			time.Second,
+		Handler: &federationHandler{z: z},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if f.Address() != "" {
+		z.Info(idApp, "Federating as %v", f.Address())
+		for _, v := range peers {
+			z.Info(idApp, "Federation peer: %v %x", v.Address,
+				v.Identity)
+		}
+	}
+
+	return f, nil
+}
+
+// relayCache relays a Cache to the home server of the recipient and
+// acknowledges the outcome to the sender.  It is called in its own go routine
+// so that a slow peer does not hold up the session.
+func (z *ZKS) relayCache(sc *sessionContext, msg rpc.Message, cache rpc.Cache) {
+	ack := z.federation.Cache(sc.rid, cache)
+	if ack.Error != "" {
+		z.Dbg(idApp, "relay failed %v -> %x@%v: %v", sc.rids,
+			cache.To, cache.Server, ack.Error)
+	} else {
+		z.Dbg(idApp, "relayed %v -> %x@%v", sc.rids, cache.To,
+			cache.Server)
+	}
+
+	select {
+	case sc.writer <- &RPCWrapper{
+		Message: rpc.Message{
+			Command: rpc.TaggedCmdAcknowledge,
+			Tag:     msg.Tag,
+		},
+		Payload: ack,
+	}:
+	case <-sc.quit:
+	}
+}
+
+// relayRendezvousPull pulls a rendezvous blob from the server it was uploaded
+// to and replies to the sender.  It is called in its own go routine.
+func (z *ZKS) relayRendezvousPull(sc *sessionContext, msg rpc.Message, r rpc.RendezvousPull) {
+	reply := z.federation.RendezvousPull(sc.rid, r)
+	if reply.Error != "" {
+		z.Dbg(idApp, "relay rendezvous pull failed %v -> %v: %v",
+			sc.rids, r.Server, reply.Error)
+	}
+
+	select {
+	case sc.writer <- &RPCWrapper{
+		Message: rpc.Message{
+			Command: rpc.TaggedCmdRendezvousPullReply,
+			Tag:     msg.Tag,
+		},
+		Payload: reply,
+	}:
+	case <-sc.quit:
+	}
+}
+
+// Cache delivers a message from a user on a peer to a local user.
+func (h *federationHandler) Cache(p federation.Peer, c rpc.FederatedCache) rpc.Acknowledge {
+	z := h.z
+
+	// peers may not speak for local users
+	if z.account.Enabled(c.From) || z.account.Disabled(c.From) {
+		z.Warn(idApp, "peer %v relayed message from local identity "+
+			"%x", p.Address, c.From)
+		return rpc.Acknowledge{
+			Error: "invalid sender",
+		}
+	}
+	if !z.account.Enabled(c.To) && !z.account.Disabled(c.To) {
+		return rpc.Acknowledge{
+			Error: fmt.Sprintf("unknown recipient %x", c.To),
+		}
+	}
+
+	// a TTL that does not fit in a time.Duration is as good as none
+	var ttl time.Duration
+	if c.TTL <= uint64(math.MaxInt64/int64(time.Second)) {
+		ttl = time.Duration(c.TTL) * time.Second
+	}
+	_, err := z.account.Deliver(c.To, c.From, c.Payload,
+		account.DeliverOptions{TTL: ttl})
+	if err != nil {
+		z.Dbg(idApp, "federated delivery failed %x@%v -> %x: %v",
+			c.From, p.Address, c.To, err)
+		switch {
+		case errors.Is(err, account.ErrMailboxFull):
+			return rpc.Acknowledge{
+				Error: fmt.Sprintf("recipient mailbox full "+
+					"%x", c.To),
+				ErrorCode: rpc.ErrorCodeMailboxFull,
+			}
+		case z.account.Disabled(c.To):
+			return rpc.Acknowledge{
+				Error: fmt.Sprintf("identity disabled %x",
+					c.To),
+				ErrorCode: rpc.ErrorCodeUserDisabled,
+			}
+		}
+		return rpc.Acknowledge{
+			Error: "internal error",
+		}
+	}
+
+	z.Dbg(idApp, "federated delivery %x@%v -> %x", c.From, p.Address,
+		c.To)
+
+	return rpc.Acknowledge{}
+}
+
+// RendezvousPull returns a rendezvous blob to a user on a peer.
+func (h *federationHandler) RendezvousPull(p federation.Peer, r rpc.FederatedRendezvousPull) rpc.FederatedRendezvousPullReply {
+	reply := h.z.rendezvousPull(hex.EncodeToString(r.From[:]), r.Token)
+	return rpc.FederatedRendezvousPullReply{
+		Error: reply.Error,
+		Blob:  reply.Blob,
+	}
+}
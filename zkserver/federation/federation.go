@@ -0,0 +1,480 @@
+// Copyright (c) 2020 Company 0, LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+// Package federation relays messages between servers so that users on
+// different servers can exchange keys and messages.  Servers only federate
+// with peers they were configured with.  A link between two servers is a
+// key exchange that is authenticated with both server identities; the
+// initiator pins the identity of the peer it dials and the responder only
+// accepts identities of its peers.  See rpc.FederatedCache for the protocol.
+package federation
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/companyzero/zkc/rpc"
+	"github.com/companyzero/zkc/session"
+	"github.com/companyzero/zkc/zkidentity"
+	xdr "github.com/davecgh/go-xdr/xdr2"
+)
+
+var (
+	// ErrUnknownServer is returned when a message is addressed to a
+	// server that is not a peer.
+	ErrUnknownServer = errors.New("unknown server")
+
+	// ErrUnknownPeer is returned when a server that is not a peer
+	// connects.
+	ErrUnknownPeer = errors.New("unknown peer")
+
+	// ErrIdentity is returned when a peer does not present the identity
+	// it was configured with.
+	ErrIdentity = errors.New("peer identity mismatch")
+
+	// ErrClosed is returned when the federation was closed.
+	ErrClosed = errors.New("federation closed")
+)
+
+// DefaultTimeout is the time a peer has to answer when none is configured.
+const DefaultTimeout = 30 * time.Second
+
+// Peer is a server users exchange messages with.
+type Peer struct {
+	Address  string   // address users know the server by
+	Identity [32]byte // server identity
+}
+
+// Handler processes the commands that peers relay to this server.
+type Handler interface {
+	// Cache delivers a message from a user on peer to a local user.
+	Cache(peer Peer, c rpc.FederatedCache) rpc.Acknowledge
+
+	// RendezvousPull returns a blob that was uploaded to this server to a
+	// user on peer.
+	RendezvousPull(peer Peer,
+		r rpc.FederatedRendezvousPull) rpc.FederatedRendezvousPullReply
+}
+
+// Config is the configuration of a Federation.
+type Config struct {
+	Address        string                   // address peers know us by, "" is disabled
+	Identity       *zkidentity.FullIdentity // server identity
+	Peers          []Peer                   // servers we federate with
+	MaxMessageSize uint                     // maximum message size on links
+	Timeout        time.Duration            // time a peer has to answer, 0 is DefaultTimeout
+	Handler        Handler                  // handles relayed commands
+
+	// Dial connects to a peer, it defaults to TLS.  The certificate of
+	// the peer is not verified since the link is authenticated by the
+	// server identities.
+	Dial func(address string, timeout time.Duration) (net.Conn, error)
+}
+
+// link is a connection to a peer.  Requests on a link are serialized.
+type link struct {
+	sync.Mutex
+	peer Peer
+	kx   *session.KX // nil when not connected
+}
+
+// Federation relays messages to peers and accepts messages from them.
+type Federation struct {
+	cfg Config
+
+	links map[string]*link // outbound by peer address
+	peers map[[32]byte]Peer
+
+	// inbound links, closed on Close
+	mtx     sync.Mutex
+	inbound map[*session.KX]struct{}
+	closed  bool
+}
+
+// New returns a Federation with the provided configuration.  A Federation
+// without address relays nothing and refuses all peers.
+func New(cfg Config) (*Federation, error) {
+	if cfg.Identity == nil {
+		return nil, fmt.Errorf("must provide identity")
+	}
+	if cfg.Dial == nil {
+		cfg.Dial = dialTLS
+	}
+	if cfg.Timeout == 0 {
+		cfg.Timeout = DefaultTimeout
+	}
+	f := &Federation{
+		cfg:     cfg,
+		links:   make(map[string]*link),
+		peers:   make(map[[32]byte]Peer),
+		inbound: make(map[*session.KX]struct{}),
+	}
+	if cfg.Address == "" {
+		return f, nil
+	}
+	for _, p := range cfg.Peers {
+		if p.Address == cfg.Address {
+			return nil, fmt.Errorf("peer has our address: %v",
+				p.Address)
+		}
+		if _, ok := f.links[p.Address]; ok {
+			return nil, fmt.Errorf("duplicate peer: %v", p.Address)
+		}
+		if _, ok := f.peers[p.Identity]; ok {
+			return nil, fmt.Errorf("duplicate peer identity: %x",
+				p.Identity)
+		}
+		f.links[p.Address] = &link{peer: p}
+		f.peers[p.Identity] = p
+	}
+	return f, nil
+}
+
+// dialTLS is the default Dial.
+func dialTLS(address string, timeout time.Duration) (net.Conn, error) {
+	return tls.DialWithDialer(&net.Dialer{
+		Timeout:   timeout,
+		KeepAlive: time.Minute,
+	}, "tcp", address, &tls.Config{
+		InsecureSkipVerify: true,
+	})
+}
+
+// Address returns the address peers know this server by.  It is empty if the
+// server does not federate.
+func (f *Federation) Address() string {
+	return f.cfg.Address
+}
+
+// Local returns true if server is the address of this server.  The empty
+// address is always this server.
+func (f *Federation) Local(server string) bool {
+	return server == "" || server == f.cfg.Address
+}
+
+// Cache relays a message from a local user to the home server of the
+// recipient.  Failures are returned as an Acknowledge with an error.
+func (f *Federation) Cache(from [32]byte, c rpc.Cache) rpc.Acknowledge {
+	var ack rpc.Acknowledge
+	err := f.request(c.Server, rpc.FederatedCmdCache, rpc.FederatedCache{
+		From:    from,
+		To:      c.To,
+		Payload: c.Payload,
+		TTL:     c.TTL,
+	}, rpc.TaggedCmdAcknowledge, &ack)
+	if err != nil {
+		return rpc.Acknowledge{
+			Error: fmt.Sprintf("could not relay to %v: %v",
+				c.Server, err),
+			ErrorCode: rpc.ErrorCodeRelayFailed,
+		}
+	}
+	return ack
+}
+
+// RendezvousPull pulls a blob on behalf of a local user from the server it
+// was uploaded to.
+func (f *Federation) RendezvousPull(from [32]byte, r rpc.RendezvousPull) rpc.RendezvousPullReply {
+	reply := rpc.RendezvousPullReply{
+		Token:  r.Token,
+		Server: r.Server,
+	}
+	var frr rpc.FederatedRendezvousPullReply
+	err := f.request(r.Server, rpc.FederatedCmdRendezvousPull,
+		rpc.FederatedRendezvousPull{
+			From:  from,
+			Token: r.Token,
+		}, rpc.FederatedCmdRendezvousPullReply, &frr)
+	if err != nil {
+		reply.Error = fmt.Sprintf("could not relay to %v: %v",
+			r.Server, err)
+		return reply
+	}
+	reply.Error = frr.Error
+	reply.Blob = frr.Blob
+	return reply
+}
+
+// request sends a command to the peer with the provided address and reads
+// its reply.  A link that failed is dialed again once, but only if the
+// command could not be written.  Once the peer may have received it the
+// command is not repeated so that it is not processed twice.
+func (f *Federation) request(address, command string, payload interface{},
+	replyCommand string, reply interface{}) error {
+
+	l, ok := f.links[address]
+	if !ok {
+		return ErrUnknownServer
+	}
+
+	l.Lock()
+	defer l.Unlock()
+
+	for {
+		if f.isClosed() {
+			return ErrClosed
+		}
+		fresh := false
+		if l.kx == nil {
+			kx, err := f.dial(l.peer)
+			if err != nil {
+				return err
+			}
+			l.kx = kx
+			fresh = true
+		}
+		written, err := f.exchange(l.kx, command, payload, replyCommand,
+			reply)
+		if err == nil {
+			return nil
+		}
+		l.kx.Close()
+		l.kx = nil
+		if fresh || written {
+			return err
+		}
+		// the peer may have closed an idle link, try again
+	}
+}
+
+// exchange writes a command to a link and reads the reply.  It returns true if
+// the command was written.
+func (f *Federation) exchange(kx *session.KX, command string,
+	payload interface{}, replyCommand string, reply interface{}) (bool, error) {
+
+	kx.Conn.SetDeadline(time.Now().Add(f.cfg.Timeout))
+	defer kx.Conn.SetDeadline(time.Time{})
+
+	err := f.write(kx, command, payload)
+	if err != nil {
+		return false, err
+	}
+
+	b, err := kx.Read()
+	if err != nil {
+		return true, err
+	}
+	br := bytes.NewReader(b)
+	var message rpc.Message
+	_, err = xdr.UnmarshalLimited(br, &message, f.cfg.MaxMessageSize)
+	if err != nil {
+		return true, fmt.Errorf("could not unmarshal reply: %v", err)
+	}
+	if message.Command != replyCommand {
+		return true, fmt.Errorf("unexpected reply: %v", message.Command)
+	}
+	_, err = xdr.UnmarshalLimited(br, reply, f.cfg.MaxMessageSize)
+	if err != nil {
+		return true, fmt.Errorf("could not unmarshal %v: %v",
+			message.Command, err)
+	}
+	return true, nil
+}
+
+// write marshals a command and sends it on a link.
+func (f *Federation) write(kx *session.KX, command string,
+	payload interface{}) error {
+
+	var b bytes.Buffer
+	_, err := xdr.Marshal(&b, rpc.Message{
+		Command:   command,
+		TimeStamp: time.Now().Unix(),
+	})
+	if err != nil {
+		return fmt.Errorf("could not marshal message %v", command)
+	}
+	_, err = xdr.Marshal(&b, payload)
+	if err != nil {
+		return fmt.Errorf("could not marshal payload %v", command)
+	}
+	return kx.Write(b.Bytes())
+}
+
+// dial opens a link to a peer.
+func (f *Federation) dial(p Peer) (*session.KX, error) {
+	conn, err := f.cfg.Dial(p.Address, f.cfg.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(f.cfg.Timeout))
+
+	_, err = xdr.Marshal(conn, rpc.InitialCmdFederate)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("could not marshal federate command")
+	}
+
+	// the peer identifies itself, it must be the identity we pinned
+	var pid zkidentity.PublicIdentity
+	_, err = xdr.UnmarshalLimited(conn, &pid, f.cfg.MaxMessageSize)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("could not obtain identity: %v", err)
+	}
+	if pid.Identity != p.Identity ||
+		sha256.Sum256(pid.Key[:]) != p.Identity || !pid.Verify() {
+		conn.Close()
+		return nil, fmt.Errorf("%w: %v", ErrIdentity, pid.Fingerprint())
+	}
+
+	kx := &session.KX{
+		Conn:           conn,
+		MaxMessageSize: f.cfg.MaxMessageSize,
+		OurPublicKey:   &f.cfg.Identity.Public.Key,
+		OurPrivateKey:  &f.cfg.Identity.PrivateKey,
+		TheirPublicKey: &pid.Key,
+	}
+	err = kx.Initiate()
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("could not complete key exchange: %v",
+			err)
+	}
+	conn.SetDeadline(time.Time{})
+
+	return kx, nil
+}
+
+// Accept completes the handshake of a link a peer opened with
+// InitialCmdFederate.  The caller is responsible for handshake deadlines.
+func (f *Federation) Accept(conn net.Conn) (Peer, *session.KX, error) {
+	if f.cfg.Address == "" {
+		return Peer{}, nil, fmt.Errorf("federation disabled")
+	}
+
+	_, err := xdr.Marshal(conn, f.cfg.Identity.Public)
+	if err != nil {
+		return Peer{}, nil, fmt.Errorf("could not marshal identity")
+	}
+
+	kx := &session.KX{
+		Conn:           conn,
+		MaxMessageSize: f.cfg.MaxMessageSize,
+		OurPublicKey:   &f.cfg.Identity.Public.Key,
+		OurPrivateKey:  &f.cfg.Identity.PrivateKey,
+	}
+	err = kx.Respond()
+	if err != nil {
+		return Peer{}, nil, fmt.Errorf("could not complete key "+
+			"exchange: %v", err)
+	}
+	id, ok := kx.TheirIdentity().([32]byte)
+	if !ok {
+		return Peer{}, nil, fmt.Errorf("invalid identity type")
+	}
+	p, ok := f.peers[id]
+	if !ok {
+		return Peer{}, nil, fmt.Errorf("%w: %x", ErrUnknownPeer, id)
+	}
+
+	return p, kx, nil
+}
+
+// Serve handles the commands a peer sends on a link until the link is closed.
+func (f *Federation) Serve(p Peer, kx *session.KX) error {
+	f.mtx.Lock()
+	if f.closed {
+		f.mtx.Unlock()
+		kx.Close()
+		return ErrClosed
+	}
+	f.inbound[kx] = struct{}{}
+	f.mtx.Unlock()
+
+	defer func() {
+		f.mtx.Lock()
+		delete(f.inbound, kx)
+		f.mtx.Unlock()
+		kx.Close()
+	}()
+
+	for {
+		b, err := kx.Read()
+		if err != nil {
+			if xdr.IsIO(err) {
+				return nil
+			}
+			return err
+		}
+		br := bytes.NewReader(b)
+		var message rpc.Message
+		_, err = xdr.UnmarshalLimited(br, &message,
+			f.cfg.MaxMessageSize)
+		if err != nil {
+			return fmt.Errorf("could not unmarshal message: %v",
+				err)
+		}
+
+		var (
+			replyCommand string
+			reply        interface{}
+		)
+		switch message.Command {
+		case rpc.FederatedCmdCache:
+			var c rpc.FederatedCache
+			_, err = xdr.UnmarshalLimited(br, &c,
+				f.cfg.MaxMessageSize)
+			if err != nil {
+				return fmt.Errorf("could not unmarshal "+
+					"FederatedCache: %v", err)
+			}
+			replyCommand = rpc.TaggedCmdAcknowledge
+			reply = f.cfg.Handler.Cache(p, c)
+
+		case rpc.FederatedCmdRendezvousPull:
+			var r rpc.FederatedRendezvousPull
+			_, err = xdr.UnmarshalLimited(br, &r,
+				f.cfg.MaxMessageSize)
+			if err != nil {
+				return fmt.Errorf("could not unmarshal "+
+					"FederatedRendezvousPull: %v", err)
+			}
+			replyCommand = rpc.FederatedCmdRendezvousPullReply
+			reply = f.cfg.Handler.RendezvousPull(p, r)
+
+		default:
+			return fmt.Errorf("invalid command: %v",
+				message.Command)
+		}
+
+		kx.Conn.SetWriteDeadline(time.Now().Add(f.cfg.Timeout))
+		err = f.write(kx, replyCommand, reply)
+		if err != nil {
+			return err
+		}
+		kx.Conn.SetWriteDeadline(time.Time{})
+	}
+}
+
+// isClosed returns true once the federation was closed.
+func (f *Federation) isClosed() bool {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	return f.closed
+}
+
+// Close closes all links.
+func (f *Federation) Close() {
+	f.mtx.Lock()
+	f.closed = true
+	for kx := range f.inbound {
+		kx.Close()
+	}
+	f.mtx.Unlock()
+
+	for _, l := range f.links {
+		l.Lock()
+		if l.kx != nil {
+			l.kx.Close()
+			l.kx = nil
+		}
+		l.Unlock()
+	}
+}
@@ -0,0 +1,325 @@
+// Copyright (c) 2020 Company 0, LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package federation
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/companyzero/zkc/rpc"
+	"github.com/companyzero/zkc/session"
+	"github.com/companyzero/zkc/zkidentity"
+	xdr "github.com/davecgh/go-xdr/xdr2"
+)
+
+func init() {
+	session.Init()
+}
+
+// testServer is an in-process server that keeps delivered messages and
+// rendezvous blobs in memory.
+type testServer struct {
+	f        *Federation
+	id       *zkidentity.FullIdentity
+	listener net.Listener
+
+	sync.Mutex
+	users      map[[32]byte]struct{}
+	delivered  []rpc.FederatedCache
+	rendezvous map[string][]byte
+	drop       bool // drop links before replying to Cache
+}
+
+func (s *testServer) Cache(p Peer, c rpc.FederatedCache) rpc.Acknowledge {
+	s.Lock()
+	defer s.Unlock()
+	if _, ok := s.users[c.To]; !ok {
+		return rpc.Acknowledge{Error: "unknown recipient"}
+	}
+	s.delivered = append(s.delivered, c)
+	if s.drop {
+		s.f.mtx.Lock()
+		for kx := range s.f.inbound {
+			kx.Close()
+		}
+		s.f.mtx.Unlock()
+	}
+	return rpc.Acknowledge{}
+}
+
+func (s *testServer) RendezvousPull(p Peer, r rpc.FederatedRendezvousPull) rpc.FederatedRendezvousPullReply {
+	s.Lock()
+	defer s.Unlock()
+	blob, ok := s.rendezvous[r.Token]
+	if !ok {
+		return rpc.FederatedRendezvousPullReply{Error: "invalid PIN"}
+	}
+	delete(s.rendezvous, r.Token)
+	return rpc.FederatedRendezvousPullReply{Blob: blob}
+}
+
+// serve accepts links like zkserver does.
+func (s *testServer) serve(t *testing.T) {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			var mode string
+			_, err := xdr.Unmarshal(conn, &mode)
+			if err != nil || mode != rpc.InitialCmdFederate {
+				return
+			}
+			p, kx, err := s.f.Accept(conn)
+			if err != nil {
+				t.Logf("accept: %v", err)
+				return
+			}
+			s.f.Serve(p, kx)
+		}()
+	}
+}
+
+func dialTCP(address string, timeout time.Duration) (net.Conn, error) {
+	return net.DialTimeout("tcp", address, timeout)
+}
+
+// newTestServers starts two servers that federate with each other.
+func newTestServers(t *testing.T) (*testServer, *testServer) {
+	t.Helper()
+
+	var servers [2]*testServer
+	for k := range servers {
+		id, err := zkidentity.New("zkserver", "zkserver")
+		if err != nil {
+			t.Fatal(err)
+		}
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		servers[k] = &testServer{
+			id:         id,
+			listener:   l,
+			users:      make(map[[32]byte]struct{}),
+			rendezvous: make(map[string][]byte),
+		}
+	}
+	for k, s := range servers {
+		peer := servers[1-k]
+		f, err := New(Config{
+			Address:  s.listener.Addr().String(),
+			Identity: s.id,
+			Peers: []Peer{{
+				Address:  peer.listener.Addr().String(),
+				Identity: peer.id.Public.Identity,
+			}},
+			MaxMessageSize: 1024 * 1024,
+			Timeout:        5 * time.Second,
+			Handler:        s,
+			Dial:           dialTCP,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.f = f
+		go s.serve(t)
+	}
+	return servers[0], servers[1]
+}
+
+func (s *testServer) close() {
+	s.listener.Close()
+	s.f.Close()
+}
+
+func TestFederation(t *testing.T) {
+	a, b := newTestServers(t)
+	defer a.close()
+	defer b.close()
+
+	alice := [32]byte{0xa1}
+	bob := [32]byte{0xb0}
+	a.users[alice] = struct{}{}
+	b.users[bob] = struct{}{}
+	b.rendezvous["123456"] = []byte("bob blob")
+
+	if !a.f.Local("") || !a.f.Local(a.f.Address()) || a.f.Local(b.f.Address()) {
+		t.Fatal("unexpected local servers")
+	}
+
+	// alice pulls bob's rendezvous blob from his server
+	r := a.f.RendezvousPull(alice, rpc.RendezvousPull{
+		Token:  "123456",
+		Server: b.f.Address(),
+	})
+	if r.Error != "" {
+		t.Fatal(r.Error)
+	}
+	if !bytes.Equal(r.Blob, []byte("bob blob")) || r.Token != "123456" ||
+		r.Server != b.f.Address() {
+		t.Fatalf("unexpected reply: %+v", r)
+	}
+	r = a.f.RendezvousPull(alice, rpc.RendezvousPull{
+		Token:  "123456",
+		Server: b.f.Address(),
+	})
+	if r.Error != "invalid PIN" {
+		t.Fatalf("expected invalid PIN, got %+v", r)
+	}
+
+	// messages flow both ways
+	ack := a.f.Cache(alice, rpc.Cache{
+		To:      bob,
+		Payload: []byte("hello bob"),
+		TTL:     60,
+		Server:  b.f.Address(),
+	})
+	if ack.Error != "" {
+		t.Fatal(ack.Error)
+	}
+	ack = b.f.Cache(bob, rpc.Cache{
+		To:      alice,
+		Payload: []byte("hello alice"),
+		Server:  a.f.Address(),
+	})
+	if ack.Error != "" {
+		t.Fatal(ack.Error)
+	}
+	if len(b.delivered) != 1 || b.delivered[0].From != alice ||
+		b.delivered[0].TTL != 60 ||
+		!bytes.Equal(b.delivered[0].Payload, []byte("hello bob")) {
+		t.Fatalf("unexpected delivery: %+v", b.delivered)
+	}
+	if len(a.delivered) != 1 || a.delivered[0].From != bob {
+		t.Fatalf("unexpected delivery: %+v", a.delivered)
+	}
+
+	// delivery failures are reported to the sender
+	ack = a.f.Cache(alice, rpc.Cache{
+		To:     [32]byte{0xee},
+		Server: b.f.Address(),
+	})
+	if ack.Error != "unknown recipient" {
+		t.Fatalf("expected unknown recipient, got %+v", ack)
+	}
+	ack = a.f.Cache(alice, rpc.Cache{
+		To:     bob,
+		Server: "127.0.0.1:1",
+	})
+	if ack.ErrorCode != rpc.ErrorCodeRelayFailed {
+		t.Fatalf("expected relay failure, got %+v", ack)
+	}
+
+	// a link that went away is dialed again
+	b.f.mtx.Lock()
+	for kx := range b.f.inbound {
+		kx.Close()
+	}
+	b.f.mtx.Unlock()
+	ack = a.f.Cache(alice, rpc.Cache{
+		To:     bob,
+		Server: b.f.Address(),
+	})
+	if ack.Error != "" {
+		t.Fatal(ack.Error)
+	}
+
+	// a message the peer may have stored is not sent again
+	b.Lock()
+	b.drop = true
+	b.Unlock()
+	ack = a.f.Cache(alice, rpc.Cache{
+		To:     bob,
+		Server: b.f.Address(),
+	})
+	if ack.ErrorCode != rpc.ErrorCodeRelayFailed {
+		t.Fatalf("expected relay failure, got %+v", ack)
+	}
+	b.Lock()
+	if len(b.delivered) != 3 {
+		t.Fatalf("expected 3 deliveries, got %v", len(b.delivered))
+	}
+	b.drop = false
+	b.Unlock()
+
+	// peer down
+	b.close()
+	ack = a.f.Cache(alice, rpc.Cache{
+		To:     bob,
+		Server: b.f.Address(),
+	})
+	if ack.ErrorCode != rpc.ErrorCodeRelayFailed {
+		t.Fatalf("expected relay failure, got %+v", ack)
+	}
+}
+
+func TestFederationIdentity(t *testing.T) {
+	a, b := newTestServers(t)
+	defer a.close()
+	defer b.close()
+
+	// a server that presents an identity other than the one we pinned
+	other, err := zkidentity.New("zkserver", "zkserver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := New(Config{
+		Address:  "other:12345",
+		Identity: other,
+		Peers: []Peer{{
+			Address:  b.f.Address(),
+			Identity: other.Public.Identity,
+		}},
+		MaxMessageSize: 1024 * 1024,
+		Timeout:        5 * time.Second,
+		Dial:           dialTCP,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.dial(f.links[b.f.Address()].peer)
+	if !errors.Is(err, ErrIdentity) {
+		t.Fatalf("expected ErrIdentity, got %v", err)
+	}
+
+	// a server that is not a peer is refused
+	f, err = New(Config{
+		Address:  "other:12345",
+		Identity: other,
+		Peers: []Peer{{
+			Address:  b.f.Address(),
+			Identity: b.id.Public.Identity,
+		}},
+		MaxMessageSize: 1024 * 1024,
+		Timeout:        5 * time.Second,
+		Dial:           dialTCP,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ack := f.Cache(other.Public.Identity, rpc.Cache{
+		To:     [32]byte{0xb0},
+		Server: b.f.Address(),
+	})
+	if ack.ErrorCode != rpc.ErrorCodeRelayFailed {
+		t.Fatalf("expected relay failure, got %+v", ack)
+	}
+	if len(b.delivered) != 0 {
+		t.Fatalf("unexpected delivery: %+v", b.delivered)
+	}
+
+	// unknown servers
+	ack = a.f.Cache([32]byte{}, rpc.Cache{Server: "unknown:12345"})
+	if ack.ErrorCode != rpc.ErrorCodeRelayFailed {
+		t.Fatalf("expected relay failure, got %+v", ack)
+	}
+}
@@ -0,0 +1,117 @@
+// Copyright (c) 2020 Company 0, LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net"
+	"time"
+
+	"github.com/companyzero/zkc/rpc"
+	"github.com/companyzero/zkc/zkserver/ratelimit"
+	"github.com/companyzero/zkc/zkserver/settings"
+)
+
+// newCommandLimits returns the per identity limiters of all tagged commands
+// that are rate limited.
+func (z *ZKS) newCommandLimits() map[string]*ratelimit.Limiter {
+	return map[string]*ratelimit.Limiter{
+		rpc.TaggedCmdCache: ratelimit.New(z.settings().RateLimitCache,
+			time.Minute),
+		rpc.TaggedCmdRendezvous: ratelimit.New(
+			z.settings().RateLimitRendezvous, time.Minute),
+		rpc.TaggedCmdIdentityFind: ratelimit.New(
+			z.settings().RateLimitIdentityFind, time.Minute),
+		rpc.TaggedCmdProxy: ratelimit.New(z.settings().RateLimitProxy,
+			time.Minute),
+	}
+}
+
+// setLimits applies the limiter capacities of s to the running limiters.
+func (z *ZKS) setLimits(s *settings.Settings) {
+	z.commandLimits[rpc.TaggedCmdCache].SetCapacity(s.RateLimitCache)
+	z.commandLimits[rpc.TaggedCmdRendezvous].SetCapacity(
+		s.RateLimitRendezvous)
+	z.commandLimits[rpc.TaggedCmdIdentityFind].SetCapacity(
+		s.RateLimitIdentityFind)
+	z.commandLimits[rpc.TaggedCmdProxy].SetCapacity(s.RateLimitProxy)
+	z.rendezvousFailures.SetCapacity(s.RendezvousPullFailures)
+	z.rendezvousFailuresGlobal.SetCapacity(s.RendezvousPullFailuresGlobal)
+	z.createLimit.SetCapacity(s.PreSessionCreateAccounts)
+	z.createLimitTotal.SetCapacity(s.PreSessionCreateAccountsGlobal)
+}
+
+// rateLimited consumes a token of the command limit of an identity and returns
+// true if the identity exceeded the limit.
+func (z *ZKS) rateLimited(rids, command string) bool {
+	l, ok := z.commandLimits[command]
+	if !ok || l.Allow(rids) {
+		return false
+	}
+	z.Dbg(idRPC, "rate limit exceeded: %v %v", rids, command)
+	return true
+}
+
+// remoteHost returns the host portion of a remote address.
+func remoteHost(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// preSessionEnter accounts for a new connection in the pre-session phase and
+// returns false if the connection exceeds the per address or server wide
+// limit.
+func (z *ZKS) preSessionEnter(addr net.Addr) bool {
+	host := remoteHost(addr)
+
+	z.preSessionMtx.Lock()
+	defer z.preSessionMtx.Unlock()
+
+	limit := z.settings().PreSessionMaxConns
+	if limit != 0 && z.preSessionTotal >= limit {
+		return false
+	}
+	limit = z.settings().PreSessionMaxConnsPerIP
+	if limit != 0 && z.preSessionConns[host] >= limit {
+		return false
+	}
+	z.preSessionConns[host]++
+	z.preSessionTotal++
+	return true
+}
+
+// preSessionLeave releases a connection that was accounted for by
+// preSessionEnter.
+func (z *ZKS) preSessionLeave(addr net.Addr) {
+	host := remoteHost(addr)
+
+	z.preSessionMtx.Lock()
+	defer z.preSessionMtx.Unlock()
+
+	if z.preSessionConns[host] <= 1 {
+		delete(z.preSessionConns, host)
+	} else {
+		z.preSessionConns[host]--
+	}
+	z.preSessionTotal--
+}
+
+// accountCreateAllowed consumes an account creation attempt of addr and
+// returns false if the per address or server wide limit is exceeded.
+func (z *ZKS) accountCreateAllowed(addr net.Addr) bool {
+	if z.createLimitTotal.Empty("") {
+		z.Warn(idApp, "server wide account create limit exceeded: %v",
+			addr)
+		return false
+	}
+	if !z.createLimit.Allow(remoteHost(addr)) {
+		z.Warn(idApp, "account create limit exceeded: %v", addr)
+		return false
+	}
+	z.createLimitTotal.Allow("")
+	return true
+}
@@ -0,0 +1,128 @@
+// Copyright (c) 2020 Company 0, LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/companyzero/zkc/zkserver/metrics"
+)
+
+// handshake outcomes
+const (
+	handshakeRefused       = "refused"       // connection limit exceeded
+	handshakeFailed        = "failed"        // TLS, key exchange or protocol error
+	handshakeIdentify      = "identify"      // server identified itself
+	handshakeCreateAccount = "createaccount" // account created
+	handshakeSuccession    = "succession"    // identity successions sent
+	handshakeDisabled      = "disabled"      // disabled identity
+	handshakeUnknown       = "unknown"       // unknown identity
+	handshakeSession       = "session"       // session established
+	handshakeFederate      = "federate"      // federation link established
+)
+
+// serverMetrics are the metrics of zkserver.  Labels never contain
+// identities.
+type serverMetrics struct {
+	registry   *metrics.Registry
+	handshakes *metrics.CounterVec
+	commands   *metrics.CounterVec
+	latencies  *metrics.HistogramVec
+}
+
+// newMetrics registers all zkserver metrics.  Gauges are computed when the
+// metrics are scraped.
+func (z *ZKS) newMetrics() *serverMetrics {
+	r := metrics.NewRegistry()
+	m := &serverMetrics{
+		registry: r,
+		handshakes: r.NewCounterVec("zkserver_handshakes_total",
+			"Connections by handshake outcome.", "outcome"),
+		commands: r.NewCounterVec("zkserver_commands_total",
+			"Tagged commands handled.", "command"),
+		latencies: r.NewHistogramVec("zkserver_command_duration_seconds",
+			"Time to handle tagged commands.", "command",
+			[]float64{.001, .005, .01, .05, .1, .5, 1, 5}),
+	}
+
+	r.NewGaugeFunc("zkserver_sessions_online", "Sessions online.",
+		func() float64 {
+			z.Lock()
+			defer z.Unlock()
+			n := 0
+			for _, v := range z.sessions {
+				n += len(v)
+			}
+			return float64(n)
+		})
+	r.NewCounterFunc("zkserver_delivered_bytes_total",
+		"Payload bytes stored in mailboxes.",
+		z.account.DeliveredBytes)
+	r.NewHistogramFunc("zkserver_spool_messages",
+		"Undelivered messages per account.",
+		[]float64{0, 1, 10, 100, 1000, 10000},
+		func() []float64 {
+			ids, err := z.store.Identities()
+			if err != nil {
+				return nil
+			}
+			depths := make([]float64, 0, len(ids))
+			for _, id := range ids {
+				mi, err := z.store.Messages(id)
+				if err != nil {
+					continue
+				}
+				depths = append(depths, float64(len(mi)))
+			}
+			return depths
+		})
+	r.NewGaugeFunc("zkserver_rendezvous_records",
+		"Outstanding rendezvous records.",
+		func() float64 {
+			all, err := z.store.AllRendezvous()
+			if err != nil {
+				return 0
+			}
+			return float64(len(all))
+		})
+	r.NewGaugeFunc("zkserver_tokens", "Outstanding account creation tokens.",
+		func() float64 {
+			tokens, err := z.store.Tokens()
+			if err != nil {
+				return 0
+			}
+			return float64(len(tokens))
+		})
+
+	return m
+}
+
+// handshake counts a pre-session connection by outcome.
+func (m *serverMetrics) handshake(outcome string) {
+	m.handshakes.Inc(outcome)
+}
+
+// command records a handled tagged command.  Only commands known to the
+// server are recorded.
+func (m *serverMetrics) command(command string, d time.Duration) {
+	m.commands.Inc(command)
+	m.latencies.Observe(command, d.Seconds())
+}
+
+// listenMetrics serves the metrics on their own listener so that the profiler
+// is never exposed along with them.
+func (z *ZKS) listenMetrics() {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", z.metrics.registry)
+	z.Info(idApp, "Metrics enabled on http://%v/metrics",
+		z.settings().Metrics)
+	go func() {
+		err := http.ListenAndServe(z.settings().Metrics, mux)
+		if err != nil {
+			z.Error(idApp, "metrics listener: %v", err)
+		}
+	}()
+}
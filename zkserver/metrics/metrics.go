@@ -0,0 +1,407 @@
+// Copyright (c) 2020 Company 0, LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+// metrics implements a minimal set of Prometheus metrics that are exposed in
+// the text exposition format.  Counters and histograms are updated by the
+// instrumented code; gauges and histograms may also be computed when the
+// metrics are scraped.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// collector writes a metric family in the text exposition format.
+type collector interface {
+	name() string
+	write(w io.Writer) error
+}
+
+// Registry is a collection of metrics.
+type Registry struct {
+	sync.Mutex
+	collectors []collector
+}
+
+// NewRegistry returns an empty registry.
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func (r *Registry) register(c collector) {
+	r.Lock()
+	defer r.Unlock()
+
+	for _, v := range r.collectors {
+		if v.name() == c.name() {
+			panic("duplicate metric " + c.name())
+		}
+	}
+	r.collectors = append(r.collectors, c)
+}
+
+// Write writes all metrics sorted by name.
+func (r *Registry) Write(w io.Writer) error {
+	r.Lock()
+	collectors := make([]collector, len(r.collectors))
+	copy(collectors, r.collectors)
+	r.Unlock()
+
+	sort.Slice(collectors, func(i, j int) bool {
+		return collectors[i].name() < collectors[j].name()
+	})
+
+	bw := bufio.NewWriter(w)
+	for _, c := range collectors {
+		err := c.write(bw)
+		if err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// ServeHTTP exposes the metrics to a Prometheus scraper.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	_ = r.Write(w)
+}
+
+func header(w io.Writer, name, help, kind string) error {
+	_, err := fmt.Fprintf(w, "# HELP %v %v\n# TYPE %v %v\n", name,
+		strings.Replace(help, "\n", " ", -1), name, kind)
+	return err
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// escaper escapes label values as required by the exposition format.
+var escaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+// labelPair formats a label pair.
+func labelPair(label, value string) string {
+	return fmt.Sprintf(`%v="%v"`, label, escaper.Replace(value))
+}
+
+// labels formats a label set that consists of a single optional label pair.
+func labels(label, value string) string {
+	if label == "" {
+		return ""
+	}
+	return "{" + labelPair(label, value) + "}"
+}
+
+// Counter is a monotonically increasing value.
+type Counter struct {
+	n, help string
+	v       uint64
+}
+
+// NewCounter registers a counter.
+func (r *Registry) NewCounter(name, help string) *Counter {
+	c := &Counter{n: name, help: help}
+	r.register(c)
+	return c
+}
+
+// Add increases the counter by v.
+func (c *Counter) Add(v uint64) {
+	atomic.AddUint64(&c.v, v)
+}
+
+// Inc increases the counter by one.
+func (c *Counter) Inc() {
+	c.Add(1)
+}
+
+// Value returns the current value of the counter.
+func (c *Counter) Value() uint64 {
+	return atomic.LoadUint64(&c.v)
+}
+
+func (c *Counter) name() string {
+	return c.n
+}
+
+func (c *Counter) write(w io.Writer) error {
+	err := header(w, c.n, c.help, "counter")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%v %v\n", c.n, c.Value())
+	return err
+}
+
+// CounterVec is a set of counters that are distinguished by the value of a
+// single label.  Label values must come from a small fixed set, never from
+// user controlled data.
+type CounterVec struct {
+	n, help, label string
+
+	sync.Mutex
+	counters map[string]uint64
+}
+
+// NewCounterVec registers a counter vector.
+func (r *Registry) NewCounterVec(name, help, label string) *CounterVec {
+	c := &CounterVec{
+		n:        name,
+		help:     help,
+		label:    label,
+		counters: make(map[string]uint64),
+	}
+	r.register(c)
+	return c
+}
+
+// Inc increases the counter identified by value by one.
+func (c *CounterVec) Inc(value string) {
+	c.Lock()
+	c.counters[value]++
+	c.Unlock()
+}
+
+func (c *CounterVec) name() string {
+	return c.n
+}
+
+func (c *CounterVec) write(w io.Writer) error {
+	c.Lock()
+	values := make([]string, 0, len(c.counters))
+	for k := range c.counters {
+		values = append(values, k)
+	}
+	sort.Strings(values)
+	counters := make([]uint64, len(values))
+	for k, v := range values {
+		counters[k] = c.counters[v]
+	}
+	c.Unlock()
+
+	err := header(w, c.n, c.help, "counter")
+	if err != nil {
+		return err
+	}
+	for k, v := range values {
+		_, err = fmt.Fprintf(w, "%v%v %v\n", c.n, labels(c.label, v),
+			counters[k])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CounterFunc is a monotonically increasing value that is maintained
+// elsewhere and obtained when the metrics are written.
+type CounterFunc struct {
+	n, help string
+	f       func() uint64
+}
+
+// NewCounterFunc registers a counter that is obtained from f.
+func (r *Registry) NewCounterFunc(name, help string, f func() uint64) *CounterFunc {
+	c := &CounterFunc{n: name, help: help, f: f}
+	r.register(c)
+	return c
+}
+
+func (c *CounterFunc) name() string {
+	return c.n
+}
+
+func (c *CounterFunc) write(w io.Writer) error {
+	err := header(w, c.n, c.help, "counter")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%v %v\n", c.n, c.f())
+	return err
+}
+
+// GaugeFunc is a value that is computed when the metrics are written.
+type GaugeFunc struct {
+	n, help string
+	f       func() float64
+}
+
+// NewGaugeFunc registers a gauge that is obtained from f.
+func (r *Registry) NewGaugeFunc(name, help string, f func() float64) *GaugeFunc {
+	g := &GaugeFunc{n: name, help: help, f: f}
+	r.register(g)
+	return g
+}
+
+func (g *GaugeFunc) name() string {
+	return g.n
+}
+
+func (g *GaugeFunc) write(w io.Writer) error {
+	err := header(w, g.n, g.help, "gauge")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%v %v\n", g.n, formatFloat(g.f()))
+	return err
+}
+
+// histogram counts observations in cumulative buckets.
+type histogram struct {
+	buckets []float64 // upper bounds, sorted
+	counts  []uint64  // observations per bucket, not cumulative
+	count   uint64
+	sum     float64
+}
+
+func newHistogram(buckets []float64) *histogram {
+	b := append([]float64(nil), buckets...)
+	sort.Float64s(b)
+	return &histogram{
+		buckets: b,
+		counts:  make([]uint64, len(b)),
+	}
+}
+
+func (h *histogram) observe(v float64) {
+	i := sort.SearchFloat64s(h.buckets, v)
+	if i < len(h.counts) {
+		h.counts[i]++
+	}
+	h.count++
+	h.sum += v
+}
+
+func (h *histogram) write(w io.Writer, name, label, value string) error {
+	prefix := ""
+	if label != "" {
+		prefix = labelPair(label, value) + ","
+	}
+	var cumulative uint64
+	for k, v := range h.buckets {
+		cumulative += h.counts[k]
+		_, err := fmt.Fprintf(w, "%v_bucket{%vle=\"%v\"} %v\n", name,
+			prefix, formatFloat(v), cumulative)
+		if err != nil {
+			return err
+		}
+	}
+	_, err := fmt.Fprintf(w, "%v_bucket{%vle=\"+Inf\"} %v\n"+
+		"%v_sum%v %v\n%v_count%v %v\n", name, prefix, h.count,
+		name, labels(label, value), formatFloat(h.sum),
+		name, labels(label, value), h.count)
+	return err
+}
+
+// HistogramVec is a set of histograms that are distinguished by the value of
+// a single label.  Label values must come from a small fixed set, never from
+// user controlled data.
+type HistogramVec struct {
+	n, help, label string
+	buckets        []float64
+
+	sync.Mutex
+	histograms map[string]*histogram
+}
+
+// NewHistogramVec registers a histogram vector with the provided bucket upper
+// bounds.
+func (r *Registry) NewHistogramVec(name, help, label string, buckets []float64) *HistogramVec {
+	h := &HistogramVec{
+		n:          name,
+		help:       help,
+		label:      label,
+		buckets:    buckets,
+		histograms: make(map[string]*histogram),
+	}
+	r.register(h)
+	return h
+}
+
+// Observe adds v to the histogram identified by value.
+func (h *HistogramVec) Observe(value string, v float64) {
+	h.Lock()
+	defer h.Unlock()
+
+	hh, ok := h.histograms[value]
+	if !ok {
+		hh = newHistogram(h.buckets)
+		h.histograms[value] = hh
+	}
+	hh.observe(v)
+}
+
+func (h *HistogramVec) name() string {
+	return h.n
+}
+
+func (h *HistogramVec) write(w io.Writer) error {
+	err := header(w, h.n, h.help, "histogram")
+	if err != nil {
+		return err
+	}
+
+	h.Lock()
+	defer h.Unlock()
+
+	values := make([]string, 0, len(h.histograms))
+	for k := range h.histograms {
+		values = append(values, k)
+	}
+	sort.Strings(values)
+	for _, v := range values {
+		err = h.histograms[v].write(w, h.n, h.label, v)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// HistogramFunc is a histogram of values that are computed when the metrics
+// are written.
+type HistogramFunc struct {
+	n, help string
+	buckets []float64
+	f       func() []float64
+}
+
+// NewHistogramFunc registers a histogram of the values returned by f.
+func (r *Registry) NewHistogramFunc(name, help string, buckets []float64, f func() []float64) *HistogramFunc {
+	h := &HistogramFunc{n: name, help: help, buckets: buckets, f: f}
+	r.register(h)
+	return h
+}
+
+func (h *HistogramFunc) name() string {
+	return h.n
+}
+
+func (h *HistogramFunc) write(w io.Writer) error {
+	err := header(w, h.n, h.help, "histogram")
+	if err != nil {
+		return err
+	}
+	hh := newHistogram(h.buckets)
+	for _, v := range h.f() {
+		hh.observe(v)
+	}
+	return hh.write(w, h.n, "", "")
+}
@@ -0,0 +1,79 @@
+// Copyright (c) 2020 Company 0, LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package metrics
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestWrite(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounter("test_bytes_total", "Bytes.")
+	cv := r.NewCounterVec("test_commands_total", "Commands.", "command")
+	r.NewGaugeFunc("test_online", "Online.", func() float64 { return 3 })
+	r.NewCounterFunc("test_func_total", "Func.", func() uint64 { return 7 })
+	hv := r.NewHistogramVec("test_duration_seconds", "Duration.",
+		"command", []float64{0.1, 1})
+	r.NewHistogramFunc("test_depth", "Depth.", []float64{1, 10},
+		func() []float64 { return []float64{0, 5, 50} })
+
+	c.Add(10)
+	c.Inc()
+	cv.Inc("ping")
+	cv.Inc("ping")
+	cv.Inc(`a"b`)
+	hv.Observe("ping", 0.05)
+	hv.Observe("ping", 0.5)
+	hv.Observe("ping", 5)
+
+	var b bytes.Buffer
+	err := r.Write(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `# HELP test_bytes_total Bytes.
+# TYPE test_bytes_total counter
+test_bytes_total 11
+# HELP test_commands_total Commands.
+# TYPE test_commands_total counter
+test_commands_total{command="a\"b"} 1
+test_commands_total{command="ping"} 2
+# HELP test_depth Depth.
+# TYPE test_depth histogram
+test_depth_bucket{le="1"} 1
+test_depth_bucket{le="10"} 2
+test_depth_bucket{le="+Inf"} 3
+test_depth_sum 55
+test_depth_count 3
+# HELP test_duration_seconds Duration.
+# TYPE test_duration_seconds histogram
+test_duration_seconds_bucket{command="ping",le="0.1"} 1
+test_duration_seconds_bucket{command="ping",le="1"} 2
+test_duration_seconds_bucket{command="ping",le="+Inf"} 3
+test_duration_seconds_sum{command="ping"} 5.55
+test_duration_seconds_count{command="ping"} 3
+# HELP test_func_total Func.
+# TYPE test_func_total counter
+test_func_total 7
+# HELP test_online Online.
+# TYPE test_online gauge
+test_online 3
+`
+	if b.String() != want {
+		t.Fatalf("unexpected output:\n%v\nwant:\n%v", b.String(), want)
+	}
+}
+
+func TestDuplicate(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected panic")
+		}
+	}()
+	r := NewRegistry()
+	r.NewCounter("test", "")
+	r.NewCounter("test", "")
+}
@@ -0,0 +1,107 @@
+// Copyright (c) 2020 Company 0, LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/companyzero/zkc/rpc"
+	"github.com/companyzero/zkc/zkserver/account"
+	"github.com/companyzero/zkc/zkserver/socketapi"
+	xdr "github.com/davecgh/go-xdr/xdr2"
+)
+
+// signNotice returns the marshaled notice of text signed by the server
+// identity.
+func (z *ZKS) signNotice(text string) ([]byte, error) {
+	notice := rpc.Notice{
+		Text: text,
+		Sent: time.Now().Unix(),
+	}
+	notice.Signature = z.id.SignMessage(notice.Digest())
+	var b bytes.Buffer
+	_, err := xdr.Marshal(&b, notice)
+	if err != nil {
+		return nil, fmt.Errorf("could not marshal notice: %v", err)
+	}
+	return b.Bytes(), nil
+}
+
+// handleNotice always returns an answer to the notice command.  The signed
+// notice is stored in the mailbox of every enabled user as a cleartext
+// message from the server identity.  This takes care of delivery to online
+// devices, queueing for offline users and acknowledgement.
+func (z *ZKS) handleNotice(n socketapi.SocketCommandNotice) *socketapi.SocketCommandNoticeReply {
+	nr := &socketapi.SocketCommandNoticeReply{}
+
+	if n.Text == "" {
+		nr.Error = "empty notice"
+		return nr
+	}
+
+	b, err := z.signNotice(n.Text)
+	if err != nil {
+		nr.Error = err.Error()
+		return nr
+	}
+
+	ids, err := z.store.Identities()
+	if err != nil {
+		nr.Error = fmt.Sprintf("could not obtain users: %v", err)
+		return nr
+	}
+	for _, id := range ids {
+		if !z.account.Enabled(id) {
+			continue
+		}
+		_, err = z.account.Deliver(id, z.id.Public.Identity, b,
+			account.DeliverOptions{Cleartext: true})
+		if err != nil {
+			z.Warn(idSock, "could not queue notice for %x: %v",
+				id, err)
+			continue
+		}
+		nr.Recipients++
+	}
+
+	if n.MOTD {
+		err = ioutil.WriteFile(z.settings().MOTD, []byte(n.Text), 0600)
+		if err != nil {
+			nr.Error = fmt.Sprintf("could not write motd: %v", err)
+			return nr
+		}
+	}
+
+	z.Info(idSock, "notice sent to %v users", nr.Recipients)
+
+	return nr
+}
+
+// isNotice returns true if n is a notice that was queued by handleNotice.
+func (z *ZKS) isNotice(n *account.Notification) bool {
+	return n.Cleartext && n.From == z.id.Public.Identity && n.Receipt == 0
+}
+
+// noticeMessage translates a notice notification into a tagged notice
+// command.
+func (z *ZKS) noticeMessage(n *account.Notification, tag uint32) (*RPCWrapper, error) {
+	var notice rpc.Notice
+	_, err := xdr.Unmarshal(bytes.NewReader(n.Payload), &notice)
+	if err != nil {
+		return nil, fmt.Errorf("could not unmarshal notice: %v", err)
+	}
+
+	return &RPCWrapper{
+		Message: rpc.Message{
+			Command: rpc.TaggedCmdNotice,
+			Tag:     tag,
+		},
+		Payload:    notice,
+		Identifier: n.Identifier,
+	}, nil
+}
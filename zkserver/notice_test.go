@@ -0,0 +1,118 @@
+// Copyright (c) 2020 Company 0, LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/companyzero/zkc/rpc"
+	"github.com/companyzero/zkc/session"
+	"github.com/companyzero/zkc/tagstack"
+	"github.com/companyzero/zkc/zkidentity"
+	"github.com/companyzero/zkc/zkserver/account"
+	"github.com/companyzero/zkc/zkserver/socketapi"
+)
+
+// startTestNtfn brings the default device of id online in a session of
+// version and runs its notification loop.  Pushed messages are written to
+// the returned channel.
+func startTestNtfn(t *testing.T, z *ZKS, id [zkidentity.IdentitySize]byte, version int) (chan *RPCWrapper, func()) {
+	t.Helper()
+
+	server, client := net.Pipe()
+	writer := make(chan *RPCWrapper, tagDepth)
+	sc := &sessionContext{
+		ntfn:       make(chan *account.Notification),
+		writer:     writer,
+		quit:       make(chan struct{}),
+		kx:         &session.KX{Conn: server},
+		rid:        id,
+		version:    version,
+		tagStack:   tagstack.NewBlocking(tagDepth),
+		tagMessage: make([]*RPCWrapper, tagDepth),
+	}
+	err := z.account.Online(id, sc.getDevice(), sc.ntfn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		z.sessionNtfn(sc)
+		close(done)
+	}()
+	return writer, func() {
+		close(sc.quit)
+		<-done
+		z.account.Offline(id, sc.getDevice())
+		client.Close()
+	}
+}
+
+// testAccount creates an enabled account.
+func testAccount(t *testing.T, z *ZKS) [zkidentity.IdentitySize]byte {
+	t.Helper()
+
+	id, err := zkidentity.New("alice", "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = z.account.Create(id.Public, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id.Public.Identity
+}
+
+func TestNoticeVersion(t *testing.T) {
+	root, err := ioutil.TempDir("", "zkserver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	z := newTestServer(t, root)
+	id := testAccount(t, z)
+	nr := z.handleNotice(socketapi.SocketCommandNotice{Text: "maintenance"})
+	if nr.Error != "" || nr.Recipients != 1 {
+		t.Fatalf("unexpected reply %+v", nr)
+	}
+
+	// current sessions receive the notice
+	writer, stop := startTestNtfn(t, z, id, rpc.ProtocolVersion)
+	select {
+	case r := <-writer:
+		if r.Message.Command != rpc.TaggedCmdNotice {
+			t.Fatalf("unexpected command %v", r.Message.Command)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("notice not pushed")
+	}
+	stop()
+
+	// legacy sessions skip it and never see it again
+	writer, stop = startTestNtfn(t, z, id, rpc.LegacyProtocolVersion)
+	defer stop()
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		m, err := z.store.Messages(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(m) == 0 {
+			break
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("notice not skipped")
+		}
+	}
+	select {
+	case r := <-writer:
+		t.Fatalf("unexpected push %+v", r.Message)
+	default:
+	}
+}
@@ -5,75 +5,214 @@
 package main
 
 import (
+	"errors"
+	"fmt"
 	"net"
-	"path"
-	"strconv"
+	"sort"
+	"strings"
 	"time"
 
-	"github.com/companyzero/zkc/inidb"
+	"github.com/companyzero/zkc/tools"
+	"github.com/companyzero/zkc/zkserver/socketapi"
+	"github.com/companyzero/zkc/zkserver/storage"
 )
 
-func (z *ZKS) prunePending(pending *inidb.INIDB) {
-	r := pending.Records("")
-	for k, v := range r {
-		t, err := strconv.ParseInt(v, 10, 64)
-		if err != nil {
-			// token corrupt, remove from db and complain
-			z.Error(idApp, "corrupt token %v", k)
-			_ = pending.Del("", k)
-			continue
-		}
-		ts := time.Unix(t, 0)
-		if ts.Before(time.Now()) {
-			// token expired, remove from db
-			_ = pending.Del("", k)
-			continue
+// prunePending removes all expired and corrupt account creation tokens.  This
+// function must be called with the pending mutex held.
+func (z *ZKS) prunePending() {
+	tokens, err := z.store.Tokens()
+	if err != nil {
+		z.Error(idApp, "could not read pending tokens: %v", err)
+		return
+	}
+	now := time.Now()
+	for k, v := range tokens {
+		if v.Expired(now) {
+			// token expired or corrupt, remove from store
+			_ = z.store.DelToken(k)
 		}
 	}
+}
 
-	// save db back
-	err := pending.Save()
+// nickReserved returns true if nick is reserved by an outstanding token other
+// than token.
+func (z *ZKS) nickReserved(nick, token string) bool {
+	z.pendingMtx.Lock()
+	defer z.pendingMtx.Unlock()
+
+	tokens, err := z.store.Tokens()
 	if err != nil {
-		z.Error(idApp, "could not save pending db: %v", err)
+		z.Error(idApp, "could not read pending tokens: %v", err)
+		return true
 	}
+	now := time.Now()
+	for k, v := range tokens {
+		if k != token && v.Nick == nick && !v.Expired(now) {
+			return true
+		}
+	}
+	return false
 }
 
-func (z *ZKS) validToken(token string, conn net.Conn) bool {
-	// open db
-	pending, err := inidb.New(path.Join(z.settings.Root, pendingPath),
-		true, 10)
-	if err != nil {
-		z.Error(idApp, "could not open pending db: %v", err)
-		return false
-	}
-	defer z.prunePending(pending) // kill all expired records
+// validToken consumes a use of token and returns true if it permits creating
+// an account with nick.
+func (z *ZKS) validToken(token, nick string, conn net.Conn) bool {
+	z.pendingMtx.Lock()
+	defer z.pendingMtx.Unlock()
+
+	defer z.prunePending() // kill all expired records
 
 	// get token
-	v, err := pending.Get("", token)
-	if err != nil {
+	t, err := z.store.GetToken(token)
+	if errors.Is(err, storage.ErrNotFound) {
 		z.Dbg(idApp, "%v invalid token %v", conn.RemoteAddr(), token)
 		return false
+	} else if err != nil {
+		z.Error(idApp, "%v corrupt token %v: %v", conn.RemoteAddr(),
+			token, err)
+		_ = z.store.DelToken(token)
+		return false
 	}
 
-	// delete token
-	err = pending.Del("", token)
-	if err != nil {
-		z.Error(idApp, "could not delete token %v", conn.RemoteAddr(),
-			token)
+	// check expiration
+	if t.Expired(time.Now()) {
+		z.Dbg(idApp, "%v token expired %v", conn.RemoteAddr(), token)
 		return false
 	}
 
-	// check expiration
-	t, err := strconv.ParseInt(v, 10, 64)
-	if err != nil {
-		z.Error(idApp, "%v corrupt token %v", conn.RemoteAddr(), token)
+	// check reserved nick, the token remains usable with the right nick
+	if t.Nick != "" && t.Nick != nick {
+		z.Dbg(idApp, "%v token %v reserved for nick %v",
+			conn.RemoteAddr(), token, t.Nick)
 		return false
 	}
-	ts := time.Unix(t, 0)
-	if ts.Before(time.Now()) {
-		z.Dbg(idApp, "%v token expired %v", conn.RemoteAddr(), token)
+
+	// consume token
+	if t.Uses > 1 {
+		t.Uses--
+		err = z.store.PutToken(token, *t)
+	} else {
+		err = z.store.DelToken(token)
+	}
+	if err != nil {
+		z.Error(idApp, "%v could not update token %v: %v",
+			conn.RemoteAddr(), token, err)
 		return false
 	}
 
 	return true
 }
+
+// handleTokenCreate always returns an answer to the token create command.
+func (z *ZKS) handleTokenCreate(tc socketapi.SocketCommandTokenCreate) *socketapi.SocketCommandTokenCreateReply {
+	tcr := &socketapi.SocketCommandTokenCreateReply{}
+
+	z.pendingMtx.Lock()
+	defer z.pendingMtx.Unlock()
+
+	if tc.Nick != "" {
+		inUse, err := z.account.NickInUse(tc.Nick)
+		if err != nil {
+			tcr.Error = fmt.Sprintf("could not check nick: %v", err)
+			return tcr
+		}
+		if inUse {
+			tcr.Error = fmt.Sprintf("nick already in use: %v",
+				tc.Nick)
+			return tcr
+		}
+	}
+
+	t := storage.Token{
+		Expires: time.Now().Add(time.Duration(tc.Hours) *
+			time.Hour).Unix(),
+		Uses: tc.Uses,
+		Nick: tc.Nick,
+	}
+	if t.Uses == 0 {
+		t.Uses = 1
+	}
+
+	for {
+		xs, err := tools.NewToken()
+		if err != nil {
+			tcr.Error = "not enough entropy"
+			return tcr
+		}
+		_, err = z.store.GetToken(xs)
+		if !errors.Is(err, storage.ErrNotFound) {
+			continue
+		}
+
+		xsPrint, err := tools.InFours(xs)
+		if err != nil {
+			continue
+		}
+
+		err = z.store.PutToken(xs, t)
+		if err != nil {
+			tcr.Error = fmt.Sprintf("could not insert token: %v",
+				err)
+			return tcr
+		}
+
+		tcr.Token = socketapi.Token{
+			Token:   xsPrint,
+			Expires: t.Expires,
+			Uses:    t.Uses,
+			Nick:    t.Nick,
+		}
+		return tcr
+	}
+}
+
+// handleTokenList always returns an answer to the token list command.
+func (z *ZKS) handleTokenList(tl socketapi.SocketCommandTokenList) *socketapi.SocketCommandTokenListReply {
+	tlr := &socketapi.SocketCommandTokenListReply{}
+
+	z.pendingMtx.Lock()
+	defer z.pendingMtx.Unlock()
+
+	z.prunePending()
+	tokens, err := z.store.Tokens()
+	if err != nil {
+		tlr.Error = err.Error()
+		return tlr
+	}
+	tlr.Tokens = make([]socketapi.Token, 0, len(tokens))
+	for k, v := range tokens {
+		token, err := tools.InFours(k)
+		if err != nil {
+			token = k
+		}
+		tlr.Tokens = append(tlr.Tokens, socketapi.Token{
+			Token:   token,
+			Expires: v.Expires,
+			Uses:    v.Uses,
+			Nick:    v.Nick,
+		})
+	}
+	sort.Slice(tlr.Tokens, func(i, j int) bool {
+		return tlr.Tokens[i].Expires < tlr.Tokens[j].Expires
+	})
+
+	return tlr
+}
+
+// handleTokenRevoke always returns an answer to the token revoke command.
+func (z *ZKS) handleTokenRevoke(tr socketapi.SocketCommandTokenRevoke) *socketapi.SocketCommandTokenRevokeReply {
+	trr := &socketapi.SocketCommandTokenRevokeReply{}
+
+	z.pendingMtx.Lock()
+	defer z.pendingMtx.Unlock()
+
+	token := strings.Replace(tr.Token, " ", "", -1)
+	err := z.store.DelToken(token)
+	if errors.Is(err, storage.ErrNotFound) {
+		trr.Error = fmt.Sprintf("token not found: %v", tr.Token)
+	} else if err != nil {
+		trr.Error = err.Error()
+	}
+
+	return trr
+}
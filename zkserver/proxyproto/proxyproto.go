@@ -0,0 +1,242 @@
+// Copyright (c) 2020 Company 0, LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+// Package proxyproto reads the PROXY protocol header that load balancers such
+// as HAProxy send ahead of a proxied connection.  Both the human readable
+// version 1 and the binary version 2 of the header are understood.  The
+// header carries the address of the client that connected to the load
+// balancer, which is then reported as the remote address of the connection.
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+var (
+	// ErrNoHeader is returned when a connection does not start with a
+	// PROXY protocol header.
+	ErrNoHeader = errors.New("no PROXY protocol header")
+
+	// ErrInvalidHeader is returned when a PROXY protocol header is
+	// malformed.
+	ErrInvalidHeader = errors.New("invalid PROXY protocol header")
+)
+
+const (
+	// v1MaxLength is the maximum length of a version 1 header including
+	// the terminating CRLF.
+	v1MaxLength = 107
+
+	// v2HeaderLength is the length of the fixed part of a version 2
+	// header.
+	v2HeaderLength = 16
+)
+
+var (
+	v1Signature = []byte("PROXY ")
+	v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+// Conn is a connection that was preceded by a PROXY protocol header.
+type Conn struct {
+	net.Conn
+	r      *bufio.Reader
+	remote net.Addr
+	local  net.Addr
+}
+
+// Read reads data that follows the PROXY protocol header.
+func (c *Conn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// RemoteAddr returns the client address announced by the header.  If the
+// header did not announce an address the address of the load balancer is
+// returned.
+func (c *Conn) RemoteAddr() net.Addr {
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// LocalAddr returns the destination address announced by the header or the
+// local address of the connection if none was announced.
+func (c *Conn) LocalAddr() net.Addr {
+	if c.local != nil {
+		return c.local
+	}
+	return c.Conn.LocalAddr()
+}
+
+// NewConn reads the PROXY protocol header from conn.  The caller is
+// responsible for setting a deadline on conn.
+func NewConn(conn net.Conn) (*Conn, error) {
+	c := &Conn{
+		Conn: conn,
+		r:    bufio.NewReader(conn),
+	}
+
+	b, err := c.r.Peek(len(v1Signature))
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(b, v1Signature) {
+		err = c.readV1()
+		if err != nil {
+			return nil, err
+		}
+		return c, nil
+	}
+
+	b, err = c.r.Peek(len(v2Signature))
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(b, v2Signature) {
+		err = c.readV2()
+		if err != nil {
+			return nil, err
+		}
+		return c, nil
+	}
+
+	return nil, ErrNoHeader
+}
+
+// readV1 parses a version 1 header, e.g.
+// PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\n
+func (c *Conn) readV1() error {
+	var line []byte
+	for {
+		b, err := c.r.ReadByte()
+		if err != nil {
+			return err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+		if len(line) >= v1MaxLength {
+			return fmt.Errorf("%w: line too long", ErrInvalidHeader)
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return fmt.Errorf("%w: missing CRLF", ErrInvalidHeader)
+	}
+
+	f := strings.Split(string(line[:len(line)-2]), " ")
+	if len(f) < 2 {
+		return ErrInvalidHeader
+	}
+	switch f[1] {
+	case "UNKNOWN":
+		// the load balancer could not tell, use the real addresses
+		return nil
+	case "TCP4", "TCP6":
+	default:
+		return fmt.Errorf("%w: invalid protocol %v", ErrInvalidHeader,
+			f[1])
+	}
+	if len(f) != 6 {
+		return ErrInvalidHeader
+	}
+
+	src, err := parseV1Addr(f[1], f[2], f[4])
+	if err != nil {
+		return err
+	}
+	dst, err := parseV1Addr(f[1], f[3], f[5])
+	if err != nil {
+		return err
+	}
+	c.remote = src
+	c.local = dst
+	return nil
+}
+
+// parseV1Addr parses an address and port of a version 1 header.
+func parseV1Addr(proto, addr, port string) (*net.TCPAddr, error) {
+	ip := net.ParseIP(addr)
+	if ip == nil || (proto == "TCP4") != (ip.To4() != nil) {
+		return nil, fmt.Errorf("%w: invalid address %v",
+			ErrInvalidHeader, addr)
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid port %v",
+			ErrInvalidHeader, port)
+	}
+	return &net.TCPAddr{IP: ip, Port: int(p)}, nil
+}
+
+// readV2 parses a version 2 header.
+func (c *Conn) readV2() error {
+	var h [v2HeaderLength]byte
+	_, err := io.ReadFull(c.r, h[:])
+	if err != nil {
+		return err
+	}
+	if h[12]>>4 != 2 {
+		return fmt.Errorf("%w: invalid version %v", ErrInvalidHeader,
+			h[12]>>4)
+	}
+	command := h[12] & 0x0f
+	family := h[13]
+	payload := make([]byte, binary.BigEndian.Uint16(h[14:]))
+	_, err = io.ReadFull(c.r, payload)
+	if err != nil {
+		return err
+	}
+
+	switch command {
+	case 0x0:
+		// LOCAL, e.g. a health check of the load balancer itself
+		return nil
+	case 0x1:
+		// PROXY
+	default:
+		return fmt.Errorf("%w: invalid command %v", ErrInvalidHeader,
+			command)
+	}
+
+	switch family {
+	case 0x11: // TCP over IPv4
+		if len(payload) < 12 {
+			return fmt.Errorf("%w: short address", ErrInvalidHeader)
+		}
+		c.remote = &net.TCPAddr{
+			IP:   net.IP(payload[0:4]),
+			Port: int(binary.BigEndian.Uint16(payload[8:])),
+		}
+		c.local = &net.TCPAddr{
+			IP:   net.IP(payload[4:8]),
+			Port: int(binary.BigEndian.Uint16(payload[10:])),
+		}
+	case 0x21: // TCP over IPv6
+		if len(payload) < 36 {
+			return fmt.Errorf("%w: short address", ErrInvalidHeader)
+		}
+		c.remote = &net.TCPAddr{
+			IP:   net.IP(payload[0:16]),
+			Port: int(binary.BigEndian.Uint16(payload[32:])),
+		}
+		c.local = &net.TCPAddr{
+			IP:   net.IP(payload[16:32]),
+			Port: int(binary.BigEndian.Uint16(payload[34:])),
+		}
+	default:
+		// unspecified, datagram and UNIX addresses are not useful to
+		// tell clients apart, use the real addresses
+	}
+	return nil
+}
@@ -0,0 +1,222 @@
+// Copyright (c) 2020 Company 0, LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package proxyproto
+
+import (
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"net"
+	"testing"
+)
+
+// newConn writes header followed by data to one end of a pipe and reads the
+// header from the other end.
+func newConn(t *testing.T, header []byte) (*Conn, error) {
+	t.Helper()
+
+	client, server := net.Pipe()
+	go func() {
+		client.Write(append(header, []byte("hello")...))
+		client.Close()
+	}()
+	c, err := NewConn(server)
+	if err != nil {
+		server.Close()
+		return nil, err
+	}
+
+	// the data after the header must be left intact
+	b, err := ioutil.ReadAll(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "hello" {
+		t.Fatalf("unexpected data after header: %q", b)
+	}
+	return c, nil
+}
+
+func v2Header(command, family byte, payload []byte) []byte {
+	h := append([]byte{}, v2Signature...)
+	h = append(h, 0x20|command, family, 0, 0)
+	binary.BigEndian.PutUint16(h[14:], uint16(len(payload)))
+	return append(h, payload...)
+}
+
+func TestV1(t *testing.T) {
+	tests := []struct {
+		header string
+		remote string
+		local  string
+	}{
+		{
+			"PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\n",
+			"192.0.2.1:56324",
+			"192.0.2.2:443",
+		},
+		{
+			"PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n",
+			"[2001:db8::1]:56324",
+			"[2001:db8::2]:443",
+		},
+		{
+			"PROXY UNKNOWN\r\n",
+			"pipe",
+			"pipe",
+		},
+		{
+			"PROXY UNKNOWN ffff::1 ffff::2 1 2\r\n",
+			"pipe",
+			"pipe",
+		},
+	}
+	for _, test := range tests {
+		c, err := newConn(t, []byte(test.header))
+		if err != nil {
+			t.Fatalf("%q: %v", test.header, err)
+		}
+		if c.RemoteAddr().String() != test.remote {
+			t.Fatalf("%q: remote %v, expected %v", test.header,
+				c.RemoteAddr(), test.remote)
+		}
+		if c.LocalAddr().String() != test.local {
+			t.Fatalf("%q: local %v, expected %v", test.header,
+				c.LocalAddr(), test.local)
+		}
+	}
+}
+
+func TestV2(t *testing.T) {
+	ipv4 := []byte{
+		192, 0, 2, 1, // source
+		192, 0, 2, 2, // destination
+		0xdc, 0x04, // source port 56324
+		0x01, 0xbb, // destination port 443
+	}
+	ipv6 := make([]byte, 36)
+	copy(ipv6, net.ParseIP("2001:db8::1"))
+	copy(ipv6[16:], net.ParseIP("2001:db8::2"))
+	binary.BigEndian.PutUint16(ipv6[32:], 56324)
+	binary.BigEndian.PutUint16(ipv6[34:], 443)
+
+	tests := []struct {
+		name   string
+		header []byte
+		remote string
+		local  string
+	}{
+		{
+			"tcp4",
+			v2Header(0x1, 0x11, ipv4),
+			"192.0.2.1:56324",
+			"192.0.2.2:443",
+		},
+		{
+			"tcp4 with tlv",
+			v2Header(0x1, 0x11, append(ipv4, 0x04, 0x00, 0x01, 0x00)),
+			"192.0.2.1:56324",
+			"192.0.2.2:443",
+		},
+		{
+			"tcp6",
+			v2Header(0x1, 0x21, ipv6),
+			"[2001:db8::1]:56324",
+			"[2001:db8::2]:443",
+		},
+		{
+			"local",
+			v2Header(0x0, 0x00, nil),
+			"pipe",
+			"pipe",
+		},
+		{
+			"unix",
+			v2Header(0x1, 0x31, make([]byte, 216)),
+			"pipe",
+			"pipe",
+		},
+	}
+	for _, test := range tests {
+		c, err := newConn(t, test.header)
+		if err != nil {
+			t.Fatalf("%v: %v", test.name, err)
+		}
+		if c.RemoteAddr().String() != test.remote {
+			t.Fatalf("%v: remote %v, expected %v", test.name,
+				c.RemoteAddr(), test.remote)
+		}
+		if c.LocalAddr().String() != test.local {
+			t.Fatalf("%v: local %v, expected %v", test.name,
+				c.LocalAddr(), test.local)
+		}
+	}
+}
+
+func TestInvalid(t *testing.T) {
+	tests := []struct {
+		name   string
+		header []byte
+		err    error
+	}{
+		{
+			"no header",
+			[]byte("\x16\x03\x01\x02\x00\x01\x00\x01\xfc\x03\x03\x00"),
+			ErrNoHeader,
+		},
+		{
+			"v1 protocol",
+			[]byte("PROXY UDP4 192.0.2.1 192.0.2.2 1 2\r\n"),
+			ErrInvalidHeader,
+		},
+		{
+			"v1 family mismatch",
+			[]byte("PROXY TCP4 2001:db8::1 192.0.2.2 1 2\r\n"),
+			ErrInvalidHeader,
+		},
+		{
+			"v1 port",
+			[]byte("PROXY TCP4 192.0.2.1 192.0.2.2 1 65536\r\n"),
+			ErrInvalidHeader,
+		},
+		{
+			"v1 fields",
+			[]byte("PROXY TCP4 192.0.2.1 192.0.2.2 1\r\n"),
+			ErrInvalidHeader,
+		},
+		{
+			"v1 crlf",
+			[]byte("PROXY TCP4 192.0.2.1 192.0.2.2 1 2\n"),
+			ErrInvalidHeader,
+		},
+		{
+			"v1 length",
+			append([]byte("PROXY TCP4 "), make([]byte, 200)...),
+			ErrInvalidHeader,
+		},
+		{
+			"v2 version",
+			append(append([]byte{}, v2Signature...), 0x11, 0x11, 0, 0),
+			ErrInvalidHeader,
+		},
+		{
+			"v2 command",
+			v2Header(0x2, 0x11, make([]byte, 12)),
+			ErrInvalidHeader,
+		},
+		{
+			"v2 short address",
+			v2Header(0x1, 0x21, make([]byte, 12)),
+			ErrInvalidHeader,
+		},
+	}
+	for _, test := range tests {
+		_, err := newConn(t, test.header)
+		if !errors.Is(err, test.err) {
+			t.Fatalf("%v: got %v, expected %v", test.name, err,
+				test.err)
+		}
+	}
+}
@@ -0,0 +1,187 @@
+// Copyright (c) 2020 Company 0, LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+// ratelimit implements token bucket rate limiters.  A bucket holds up to
+// capacity tokens and is refilled at a rate of capacity tokens per period.
+// Every permitted event consumes one token.
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// Bucket is a single token bucket.  It is not safe for concurrent use.
+type Bucket struct {
+	capacity float64   // maximum tokens in bucket
+	rate     float64   // tokens added per second
+	tokens   float64   // currently available tokens
+	last     time.Time // last time tokens were added
+}
+
+// NewBucket returns a full bucket that holds capacity tokens and is refilled
+// with capacity tokens every period.
+func NewBucket(capacity uint64, period time.Duration) *Bucket {
+	return newBucket(capacity, period, time.Now())
+}
+
+func newBucket(capacity uint64, period time.Duration, now time.Time) *Bucket {
+	return &Bucket{
+		capacity: float64(capacity),
+		rate:     float64(capacity) / period.Seconds(),
+		tokens:   float64(capacity),
+		last:     now,
+	}
+}
+
+// refill adds all tokens that accrued since the last refill.
+func (b *Bucket) refill(now time.Time) {
+	elapsed := now.Sub(b.last).Seconds()
+	if elapsed <= 0 {
+		return
+	}
+	b.tokens += elapsed * b.rate
+	if b.tokens > b.capacity {
+		b.tokens = b.capacity
+	}
+	b.last = now
+}
+
+func (b *Bucket) allow(now time.Time) bool {
+	b.refill(now)
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+func (b *Bucket) empty(now time.Time) bool {
+	b.refill(now)
+	return b.tokens < 1
+}
+
+func (b *Bucket) full(now time.Time) bool {
+	b.refill(now)
+	return b.tokens >= b.capacity
+}
+
+// Allow consumes a token and returns true if one was available.
+func (b *Bucket) Allow() bool {
+	return b.allow(time.Now())
+}
+
+// Empty returns true if there are no tokens available.  It does not consume a
+// token.
+func (b *Bucket) Empty() bool {
+	return b.empty(time.Now())
+}
+
+// Limiter is a concurrency safe collection of token buckets that are
+// identified by a key.  Buckets are created on demand and discarded once they
+// have been refilled completely.  A Limiter with a capacity of 0 is disabled
+// and allows everything.
+type Limiter struct {
+	period time.Duration
+
+	sync.Mutex
+	capacity uint64
+	buckets  map[string]*Bucket
+	pruned   time.Time // last time full buckets were discarded
+}
+
+// New returns a Limiter of which every bucket holds capacity tokens and is
+// refilled with capacity tokens every period.
+func New(capacity uint64, period time.Duration) *Limiter {
+	return &Limiter{
+		capacity: capacity,
+		period:   period,
+		buckets:  make(map[string]*Bucket),
+		pruned:   time.Now(),
+	}
+}
+
+// Disabled returns true if the limiter allows everything.
+func (l *Limiter) Disabled() bool {
+	l.Lock()
+	defer l.Unlock()
+	return l.disabled()
+}
+
+// disabled implements Disabled.  This function must be called with the mutex
+// held.
+func (l *Limiter) disabled() bool {
+	return l.capacity == 0 || l.period <= 0
+}
+
+// SetCapacity changes the number of tokens every bucket holds.  Existing
+// buckets are discarded, i.e. all keys start over with a full bucket.
+func (l *Limiter) SetCapacity(capacity uint64) {
+	l.Lock()
+	defer l.Unlock()
+
+	if capacity == l.capacity {
+		return
+	}
+	l.capacity = capacity
+	l.buckets = make(map[string]*Bucket)
+}
+
+// bucket returns the bucket identified by key and creates it if it does not
+// exist.  This function must be called with the mutex held.
+func (l *Limiter) bucket(key string, now time.Time) *Bucket {
+	// discard full buckets every now and then so that the map does not
+	// grow without bounds
+	if now.Sub(l.pruned) > l.period {
+		for k, b := range l.buckets {
+			if b.full(now) {
+				delete(l.buckets, k)
+			}
+		}
+		l.pruned = now
+	}
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = newBucket(l.capacity, l.period, now)
+		l.buckets[key] = b
+	}
+	return b
+}
+
+func (l *Limiter) allow(key string, now time.Time) bool {
+	l.Lock()
+	defer l.Unlock()
+
+	if l.disabled() {
+		return true
+	}
+	return l.bucket(key, now).allow(now)
+}
+
+func (l *Limiter) empty(key string, now time.Time) bool {
+	l.Lock()
+	defer l.Unlock()
+
+	if l.disabled() {
+		return false
+	}
+	b, ok := l.buckets[key]
+	if !ok {
+		return false
+	}
+	return b.empty(now)
+}
+
+// Allow consumes a token from the bucket identified by key and returns true
+// if one was available.
+func (l *Limiter) Allow(key string) bool {
+	return l.allow(key, time.Now())
+}
+
+// Empty returns true if the bucket identified by key has no tokens available.
+// It does not consume a token.
+func (l *Limiter) Empty(key string) bool {
+	return l.empty(key, time.Now())
+}
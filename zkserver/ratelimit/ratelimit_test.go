@@ -0,0 +1,125 @@
+// Copyright (c) 2020 Company 0, LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBucket(t *testing.T) {
+	now := time.Now()
+	b := newBucket(3, time.Minute, now)
+
+	for i := 0; i < 3; i++ {
+		if !b.allow(now) {
+			t.Fatalf("token %v should have been allowed", i)
+		}
+	}
+	if b.allow(now) {
+		t.Fatal("bucket should have been empty")
+	}
+	if !b.empty(now) {
+		t.Fatal("bucket should have reported empty")
+	}
+
+	// one token accrues every 20 seconds
+	now = now.Add(20 * time.Second)
+	if b.empty(now) {
+		t.Fatal("bucket should have been refilled")
+	}
+	if !b.allow(now) {
+		t.Fatal("refilled token should have been allowed")
+	}
+	if b.allow(now) {
+		t.Fatal("bucket should have been empty again")
+	}
+
+	// refill never exceeds capacity
+	now = now.Add(time.Hour)
+	if !b.full(now) {
+		t.Fatal("bucket should have been full")
+	}
+	for i := 0; i < 3; i++ {
+		if !b.allow(now) {
+			t.Fatalf("token %v should have been allowed", i)
+		}
+	}
+	if b.allow(now) {
+		t.Fatal("bucket exceeded capacity")
+	}
+}
+
+func TestLimiter(t *testing.T) {
+	now := time.Now()
+	l := New(1, time.Minute)
+
+	if l.empty("a", now) {
+		t.Fatal("unknown key should not be empty")
+	}
+	if !l.allow("a", now) {
+		t.Fatal("a should have been allowed")
+	}
+	if l.allow("a", now) {
+		t.Fatal("a should have been denied")
+	}
+	if !l.empty("a", now) {
+		t.Fatal("a should have been empty")
+	}
+	if !l.allow("b", now) {
+		t.Fatal("b should have been allowed")
+	}
+
+	// full buckets are discarded
+	now = now.Add(2 * time.Minute)
+	if !l.allow("c", now) {
+		t.Fatal("c should have been allowed")
+	}
+	if len(l.buckets) != 1 {
+		t.Fatalf("expected 1 bucket, got %v", len(l.buckets))
+	}
+}
+
+func TestLimiterDisabled(t *testing.T) {
+	now := time.Now()
+	l := New(0, time.Minute)
+
+	for i := 0; i < 100; i++ {
+		if !l.allow("a", now) {
+			t.Fatal("disabled limiter denied")
+		}
+	}
+	if l.empty("a", now) {
+		t.Fatal("disabled limiter reported empty")
+	}
+}
+
+func TestLimiterSetCapacity(t *testing.T) {
+	now := time.Now()
+	l := New(1, time.Minute)
+
+	if !l.allow("a", now) {
+		t.Fatal("a should have been allowed")
+	}
+	if l.allow("a", now) {
+		t.Fatal("a should have been denied")
+	}
+
+	// a larger capacity starts over with a full bucket
+	l.SetCapacity(2)
+	for i := 0; i < 2; i++ {
+		if !l.allow("a", now) {
+			t.Fatal("a should have been allowed")
+		}
+	}
+	if l.allow("a", now) {
+		t.Fatal("a should have been denied")
+	}
+
+	l.SetCapacity(0)
+	if !l.Disabled() || !l.allow("a", now) {
+		t.Fatal("limiter should have been disabled")
+	}
+}
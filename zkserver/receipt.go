@@ -0,0 +1,65 @@
+// Copyright (c) 2020 Company 0, LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+
+	"github.com/companyzero/zkc/rpc"
+	"github.com/companyzero/zkc/zkidentity"
+	"github.com/companyzero/zkc/zkserver/account"
+	xdr "github.com/davecgh/go-xdr/xdr2"
+)
+
+// queueReceipt tells the sender of a message that recipient acknowledged it.
+// The signed receipt is stored in the mailbox of the sender as a cleartext
+// message from the server identity, just like a notice, and carries the
+// receipt identifier so that it can be told apart from notices.
+func (z *ZKS) queueReceipt(sender, recipient [zkidentity.IdentitySize]byte, receipt uint64) error {
+	dr := rpc.DeliveryReceipt{
+		Receipt:   receipt,
+		Recipient: recipient,
+		Delivered: time.Now().Unix(),
+	}
+	dr.Signature = z.id.SignMessage(dr.Digest())
+	var b bytes.Buffer
+	_, err := xdr.Marshal(&b, dr)
+	if err != nil {
+		return fmt.Errorf("could not marshal receipt: %v", err)
+	}
+
+	_, err = z.account.Deliver(sender, z.id.Public.Identity, b.Bytes(),
+		account.DeliverOptions{
+			Cleartext: true,
+			Receipt:   receipt,
+		})
+	return err
+}
+
+// isReceipt returns true if n is a receipt that was queued by queueReceipt.
+func (z *ZKS) isReceipt(n *account.Notification) bool {
+	return n.Cleartext && n.From == z.id.Public.Identity && n.Receipt != 0
+}
+
+// receiptMessage translates a receipt notification into a tagged delivery
+// receipt command.
+func (z *ZKS) receiptMessage(n *account.Notification, tag uint32) (*RPCWrapper, error) {
+	var dr rpc.DeliveryReceipt
+	_, err := xdr.Unmarshal(bytes.NewReader(n.Payload), &dr)
+	if err != nil {
+		return nil, fmt.Errorf("could not unmarshal receipt: %v", err)
+	}
+
+	return &RPCWrapper{
+		Message: rpc.Message{
+			Command: rpc.TaggedCmdDeliveryReceipt,
+			Tag:     tag,
+		},
+		Payload:    dr,
+		Identifier: n.Identifier,
+	}, nil
+}
@@ -0,0 +1,50 @@
+// Copyright (c) 2020 Company 0, LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/companyzero/zkc/rpc"
+)
+
+func TestReceiptVersion(t *testing.T) {
+	root, err := ioutil.TempDir("", "zkserver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	z := newTestServer(t, root)
+	sender := testAccount(t, z)
+	err = z.queueReceipt(sender, [32]byte{1}, 42)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// legacy senders skip the receipt instead of disconnecting on it
+	writer, stop := startTestNtfn(t, z, sender, rpc.LegacyProtocolVersion)
+	defer stop()
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		m, err := z.store.Messages(sender)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(m) == 0 {
+			break
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("receipt not skipped")
+		}
+	}
+	select {
+	case r := <-writer:
+		t.Fatalf("unexpected push %+v", r.Message)
+	default:
+	}
+}
@@ -0,0 +1,189 @@
+// Copyright (c) 2020 Company 0, LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/companyzero/zkc/zkserver/account"
+	"github.com/companyzero/zkc/zkserver/audit"
+	"github.com/companyzero/zkc/zkserver/settings"
+	"github.com/companyzero/zkc/zkserver/socketapi"
+)
+
+// reloadFields maps the settings fields to their configuration keys.  Fields
+// that are marked restart are only read during startup; changing them
+// requires a restart and they are ignored on reload.
+var reloadFields = []struct {
+	field   string
+	key     string
+	restart bool
+}{
+	{"Root", "root", true},
+	{"Users", "users", true},
+	{"Listen", "listen", true},
+	{"AllowIdentify", "allowidentify", false},
+	{"CreatePolicy", "createpolicy", false},
+	{"Directory", "directory", false},
+	{"MOTD", "motd", false},
+	{"MaxAttachmentSize", "maxattachmentsize", false},
+	{"MaxChunkSize", "maxchunksize", false},
+	{"MaxMsgSize", "maxmsgsize", false},
+	{"ShutdownTimeout", "shutdowntimeout", false},
+	{"MailboxMaxMessages", "[mailbox]maxmessages", false},
+	{"MailboxMaxBytes", "[mailbox]maxbytes", false},
+	{"MailboxSenderShare", "[mailbox]sendershare", false},
+	{"MailboxMaxAge", "[mailbox]maxage", false},
+	{"RendezvousMaxPulls", "[rendezvous]maxpulls", false},
+	{"RendezvousPullFailures", "[rendezvous]pullfailures", false},
+	{"RendezvousPullFailuresGlobal", "[rendezvous]pullfailuresglobal", false},
+	{"DevicesMax", "[devices]maxdevices", false},
+	{"DevicesMaxIdle", "[devices]maxidle", false},
+	{"DevicesAckPolicy", "[devices]ackpolicy", false},
+	{"PreSessionTimeout", "[presession]timeout", false},
+	{"PreSessionMaxConns", "[presession]maxconns", false},
+	{"PreSessionMaxConnsPerIP", "[presession]maxconnsperip", false},
+	{"PreSessionCreateAccounts", "[presession]createaccounts", false},
+	{"PreSessionCreateAccountsGlobal", "[presession]createaccountsglobal", false},
+	{"RateLimitCache", "[ratelimit]cache", false},
+	{"RateLimitRendezvous", "[ratelimit]rendezvous", false},
+	{"RateLimitIdentityFind", "[ratelimit]identityfind", false},
+	{"RateLimitProxy", "[ratelimit]proxy", false},
+	{"FederationAddress", "[federation]address", true},
+	{"FederationPeers", "[federation]peers", true},
+	{"FederationTimeout", "[federation]timeout", true},
+	{"LogFile", "[log]logfile", true},
+	{"TimeFormat", "[log]timeformat", true},
+	{"Debug", "[log]debug", false},
+	{"Trace", "[log]trace", false},
+	{"Profiler", "[log]profiler", true},
+	{"Metrics", "[log]metrics", true},
+	{"AuditLog", "[log]auditlog", true},
+}
+
+// settings returns the current settings.  The returned settings must not be
+// modified since they are shared by all sessions.
+func (z *ZKS) settings() *settings.Settings {
+	return z.config.Load().(*settings.Settings)
+}
+
+// reload reads the configuration file again and atomically replaces the
+// current settings.  Changes to settings that require a restart are ignored
+// and retain their current value.  It returns the configuration keys that
+// were applied and ignored.
+func (z *ZKS) reload() ([]string, []string, error) {
+	z.reloadMtx.Lock()
+	defer z.reloadMtx.Unlock()
+
+	s := settings.New()
+	err := s.Load(z.configFile)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var applied, ignored []string
+	ov := reflect.ValueOf(z.settings()).Elem()
+	nv := reflect.ValueOf(s).Elem()
+	for _, f := range reloadFields {
+		o := ov.FieldByName(f.field)
+		n := nv.FieldByName(f.field)
+		if reflect.DeepEqual(o.Interface(), n.Interface()) {
+			continue
+		}
+		if f.restart {
+			n.Set(o)
+			ignored = append(ignored, f.key)
+			continue
+		}
+		applied = append(applied, f.key)
+	}
+
+	// subsystems that keep a copy of their settings
+	z.setLogLevel(s)
+	z.setAccountPolicy(s)
+	z.setLimits(s)
+
+	z.config.Store(s)
+
+	return applied, ignored, nil
+}
+
+// setLogLevel enables or disables debug and trace output.
+func (z *ZKS) setLogLevel(s *settings.Settings) {
+	if s.Debug {
+		z.EnableDebug()
+	} else {
+		z.DisableDebug()
+	}
+	if s.Debug && s.Trace {
+		z.EnableTrace()
+	} else {
+		z.DisableTrace()
+	}
+}
+
+// setAccountPolicy applies the mailbox and device settings to the account
+// subsystem.
+func (z *ZKS) setAccountPolicy(s *settings.Settings) {
+	z.account.SetQuota(account.Quota{
+		MaxMessages: s.MailboxMaxMessages,
+		MaxBytes:    s.MailboxMaxBytes,
+		SenderShare: s.MailboxSenderShare,
+	})
+	z.account.SetMaxAge(time.Duration(s.MailboxMaxAge) * time.Hour)
+	ackPolicy := account.AckAll
+	if s.DevicesAckPolicy == "first" {
+		ackPolicy = account.AckFirst
+	}
+	z.account.SetDevicePolicy(account.DevicePolicy{
+		MaxDevices: int(s.DevicesMax),
+		MaxIdle:    time.Duration(s.DevicesMaxIdle) * 24 * time.Hour,
+		Ack:        ackPolicy,
+	})
+}
+
+// reloadSignal reloads the configuration after a SIGHUP and logs the
+// outcome.
+func (z *ZKS) reloadSignal() {
+	applied, ignored, err := z.reload()
+	if err != nil {
+		z.Error(idApp, "could not reload configuration: %v", err)
+		z.audit(audit.KindSignal, "reload", "", err.Error())
+		return
+	}
+	z.logReload(applied, ignored)
+	z.audit(audit.KindSignal, "reload", fmt.Sprintf("applied %v "+
+		"ignored %v", applied, ignored), "ok")
+}
+
+// logReload logs the configuration keys that were applied and ignored.
+func (z *ZKS) logReload(applied, ignored []string) {
+	z.Info(idApp, "Configuration reloaded, applied: %v",
+		strings.Join(applied, " "))
+	if len(ignored) != 0 {
+		z.Warn(idApp, "Configuration changes that require a restart "+
+			"were ignored: %v", strings.Join(ignored, " "))
+	}
+}
+
+// handleReload always returns an answer to the reload command.
+func (z *ZKS) handleReload(r socketapi.SocketCommandReload) *socketapi.SocketCommandReloadReply {
+	rr := &socketapi.SocketCommandReloadReply{}
+
+	applied, ignored, err := z.reload()
+	if err != nil {
+		rr.Error = fmt.Sprintf("could not reload configuration: %v",
+			err)
+		return rr
+	}
+	z.logReload(applied, ignored)
+	rr.Applied = applied
+	rr.Ignored = ignored
+
+	return rr
+}
@@ -5,111 +5,238 @@
 package main
 
 import (
-	"bytes"
-	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"fmt"
-	"path"
 	"strconv"
 	"time"
 
-	"github.com/companyzero/zkc/inidb"
 	"github.com/companyzero/zkc/rpc"
+	"github.com/companyzero/zkc/session"
 	"github.com/companyzero/zkc/tools"
-	xdr "github.com/davecgh/go-xdr/xdr2"
+	"github.com/companyzero/zkc/zkserver/storage"
 )
 
-//func (z *ZKS) pruneRendezvous(rz *inidb.INIDB) error {
-//	r := rz.Records("")
-//	for k, v := range r {
-//		rzXDR, err := base64.StdEncoding.DecodeString(v)
-//		if err != nil {
-//			return fmt.Errorf("corrupt rendezvous record: %v", k)
-//		}
-//		rzRecord := rpc.Rendezvous{} // deliberate instantiate
-//		br := bytes.NewReader(rzXDR)
-//		_, err = z.unmarshal(br, &rzRecord)
-//		if err != nil {
-//			return fmt.Errorf("could not unmarshal rendezvous "+
-//				"record: %v", k)
-//		}
-//
-//		t := time.Now().Add(rzRecord.Expiration * time.Hour)
-//		//	t, err := strconv.ParseInt(v, 10, 64)
-//		//	if err != nil {
-//		//		// token corrupt, remove from db and complain
-//		//		z.Dbg(idApp, "corrupt token %v", k)
-//		//		_ = rz.Del("", k)
-//		//		continue
-//		//	}
-//		//	ts := time.Unix(t, 0)
-//		//	if ts.Before(time.Now()) {
-//		//		// token expired, remove from db
-//		//		_ = rz.Del("", k)
-//		//		continue
-//		//	}
-//	}
-//
-//}
-
-func (z *ZKS) handleRendezvousPull(writer chan *RPCWrapper,
+const (
+	rendezvousPruneInterval = 10 * time.Minute
+
+	// rendezvousLegacyLifetime is the lifetime of records that were
+	// stored without expiration time, counted from the first prune.  It
+	// matches the expiration clients ask for.
+	rendezvousLegacyLifetime = 24 * time.Hour
+)
+
+// pruneRendezvous removes all expired and corrupt records from the rendezvous
+// store and gives legacy records a lifetime.  It returns the number of
+// removed records.  This function must be called with the rendezvous mutex
+// held.
+func (z *ZKS) pruneRendezvous() int {
+	all, err := z.store.AllRendezvous()
+	if err != nil {
+		z.Error(idApp, "could not read rendezvous records: %v", err)
+		return 0
+	}
+
+	now := time.Now()
+	pruned := 0
+	for k, v := range all {
+		if v.Legacy() {
+			v.Expires = now.Add(rendezvousLegacyLifetime).Unix()
+			err = z.store.PutRendezvous(k, v)
+			if err != nil {
+				z.Error(idApp, "could not update rendezvous "+
+					"record %v: %v", k, err)
+			}
+			continue
+		}
+		if !v.Expired(now) {
+			continue
+		}
+		// record expired or corrupt, remove from store
+		err = z.store.DelRendezvous(k)
+		if err != nil {
+			z.Error(idApp, "could not delete rendezvous record "+
+				"%v: %v", k, err)
+			continue
+		}
+		pruned++
+	}
+
+	return pruned
+}
+
+// rendezvousPruner periodically removes expired rendezvous records so that
+// stale identity blobs do not pile up on disk.
+func (z *ZKS) rendezvousPruner() {
+	ticker := time.NewTicker(rendezvousPruneInterval)
+	defer ticker.Stop()
+
+	for {
+		z.rendezvousMtx.Lock()
+		pruned := z.pruneRendezvous()
+		if pruned > 0 {
+			z.Dbg(idApp, "pruned %v rendezvous records", pruned)
+		}
+		z.rendezvousMtx.Unlock()
+
+		<-ticker.C
+	}
+}
+
+// rendezvousPullFailed records a failed RendezvousPull attempt against the
+// per identity and global failure limits.
+func (z *ZKS) rendezvousPullFailed(rids string) {
+	z.rendezvousFailures.Allow(rids)
+	if z.rendezvousFailures.Empty(rids) {
+		z.Warn(idRPC, "rendezvous pull failure limit reached: %v",
+			rids)
+	}
+	z.rendezvousFailuresGlobal.Allow("")
+	if z.rendezvousFailuresGlobal.Empty("") {
+		z.Warn(idRPC, "global rendezvous pull failure limit reached")
+	}
+}
+
+func (z *ZKS) handleRendezvousPull(writer chan *RPCWrapper, kx *session.KX,
 	msg rpc.Message, r rpc.RendezvousPull) error {
 
 	z.T(idRPC, "handleRendezvousPull tag %v", msg.Tag)
 
-	// always reply from here on out (provided non fatal error)
-	reply := RPCWrapper{
+	rid, ok := kx.TheirIdentity().([32]byte)
+	if !ok {
+		return fmt.Errorf("invalid identity type")
+	}
+	rids := hex.EncodeToString(rid[:])
+
+	writer <- &RPCWrapper{
 		Message: rpc.Message{
 			Command: rpc.TaggedCmdRendezvousPullReply,
 			Tag:     msg.Tag,
 		},
+		Payload: z.rendezvousPull(rids, r.Token),
 	}
+	return nil
+}
 
+// rendezvousPull returns the rendezvous blob identified by token to rids.
+// Failed attempts count against the failure limits of rids.
+func (z *ZKS) rendezvousPull(rids, token string) rpc.RendezvousPullReply {
 	// default error
 	payload := rpc.RendezvousPullReply{
 		Error: "internal error, contact server administrator",
 	}
 
-	// open db
-	rz, err := inidb.New(path.Join(z.settings.Root, rendezvousPath),
-		true, 10)
-	if err != nil && !errors.Is(err, inidb.ErrCreated) {
-		return fmt.Errorf("could not open rendezvous db: %v", err)
-	}
+	z.rendezvousMtx.Lock()
+	defer z.rendezvousMtx.Unlock()
 
 	// vars to deal with go bitching about goto
 	var (
-		rzXDR    []byte
-		rzRecord rpc.Rendezvous
-		br       *bytes.Reader
+		rzRecord *storage.Rendezvous
+		err      error
 	)
 
+	// refuse to even look at the PIN when there were too many failures
+	if z.rendezvousFailures.Empty(rids) ||
+		z.rendezvousFailuresGlobal.Empty("") {
+		payload.Error = "too many invalid PINs, try again later"
+		goto bad
+	}
+
 	// get token
-	v, err := rz.Get("", r.Token)
-	if err != nil {
+	rzRecord, err = z.store.GetRendezvous(token)
+	if errors.Is(err, storage.ErrNotFound) {
+		z.rendezvousPullFailed(rids)
 		payload.Error = "invalid PIN"
 		goto bad
+	} else if err != nil {
+		z.Error(idRPC, "handleRendezvousPull: %v", err)
+		payload.Error = "internal error decode"
+		goto bad
 	}
 
-	// decode value
-	rzXDR, err = base64.StdEncoding.DecodeString(v)
-	if err != nil {
-		payload.Error = "internal error base64decode"
+	// check for expiration and kill all expired records
+	if rzRecord.Expired(time.Now()) {
+		z.rendezvousPullFailed(rids)
+		z.pruneRendezvous()
+		payload.Error = "expired PIN"
 		goto bad
 	}
-	br = bytes.NewReader(rzXDR)
-	_, err = z.unmarshal(br, &rzRecord)
+
+	// account for this pull and remove the record once it is consumed
+	rzRecord.Pulls++
+	if rzRecord.Consumed() {
+		err = z.store.DelRendezvous(token)
+	} else {
+		err = z.store.PutRendezvous(token, *rzRecord)
+	}
 	if err != nil {
-		payload.Error = "internal error unmarshal"
+		z.Error(idRPC, "handleRendezvousPull: could not update "+
+			"record: %v", err)
 		goto bad
 	}
 
-	// XXX check for expiration here
-
 	// setup reply
 	payload.Error = ""
-	payload.Token = r.Token
+	payload.Token = token
 	payload.Blob = rzRecord.Blob
+bad:
+	return payload
+}
+
+// handleRendezvousRevoke removes a rendezvous record on behalf of its
+// creator.  Records that do not exist and records created by someone else
+// are both reported as an invalid PIN.
+func (z *ZKS) handleRendezvousRevoke(writer chan *RPCWrapper, kx *session.KX,
+	msg rpc.Message, r rpc.RendezvousRevoke) error {
+
+	z.T(idRPC, "handleRendezvousRevoke tag %v", msg.Tag)
+
+	rid, ok := kx.TheirIdentity().([32]byte)
+	if !ok {
+		return fmt.Errorf("invalid identity type")
+	}
+
+	// always reply from here on out (provided non fatal error)
+	reply := RPCWrapper{
+		Message: rpc.Message{
+			Command: rpc.TaggedCmdRendezvousRevokeReply,
+			Tag:     msg.Tag,
+		},
+	}
+
+	// default error
+	payload := rpc.RendezvousRevokeReply{
+		Token: r.Token,
+		Error: "internal error, contact server administrator",
+	}
+
+	z.rendezvousMtx.Lock()
+	defer z.rendezvousMtx.Unlock()
+
+	// get token
+	rzRecord, err := z.store.GetRendezvous(r.Token)
+	if errors.Is(err, storage.ErrNotFound) {
+		payload.Error = "invalid PIN"
+		goto bad
+	} else if err != nil {
+		z.Error(idRPC, "handleRendezvousRevoke: %v", err)
+		payload.Error = "internal error decode"
+		goto bad
+	}
+	if rzRecord.Owner != rid {
+		payload.Error = "invalid PIN"
+		goto bad
+	}
+
+	// delete record
+	err = z.store.DelRendezvous(r.Token)
+	if err != nil {
+		z.Error(idRPC, "handleRendezvousRevoke: could not delete "+
+			"record: %v", err)
+		goto bad
+	}
+
+	payload.Error = ""
 bad:
 	reply.Payload = payload
 	writer <- &reply
@@ -119,11 +246,16 @@ bad:
 // handleRendezvous handles all aspects of a Rendezvous message.  This
 // includes the client reply.  Note that returning an error from this
 // function will result in a closed connection.
-func (z *ZKS) handleRendezvous(writer chan *RPCWrapper,
+func (z *ZKS) handleRendezvous(writer chan *RPCWrapper, kx *session.KX,
 	msg rpc.Message, r rpc.Rendezvous) error {
 
 	z.T(idRPC, "handleRendezvous tag %v", msg.Tag)
 
+	rid, ok := kx.TheirIdentity().([32]byte)
+	if !ok {
+		return fmt.Errorf("invalid identity type")
+	}
+
 	// always reply from here on out (provided non fatal error)
 	reply := RPCWrapper{
 		Message: rpc.Message{
@@ -138,23 +270,12 @@ func (z *ZKS) handleRendezvous(writer chan *RPCWrapper,
 	}
 
 	// do these declarations before goto to shut go compiler up
+	var expires time.Time
 	retry := 25
 
-	// open db
-	rz, err := inidb.New(path.Join(z.settings.Root, rendezvousPath),
-		true, 10)
-	if err != nil && !errors.Is(err, inidb.ErrCreated) {
-		return fmt.Errorf("could not open rendezvous db: %v",
-			err)
-	}
-	//defer z.pruneRendezvous(rz) // kill all expired records
-	defer func() {
-		// save db back
-		err := rz.Save()
-		if err != nil {
-			z.Error(idApp, "could not save rendezvous db: %v", err)
-		}
-	}()
+	z.rendezvousMtx.Lock()
+	defer z.rendezvousMtx.Unlock()
+	defer z.pruneRendezvous() // kill all expired records
 
 	// sanitize inputs
 	if len(r.Blob) > 4096 {
@@ -162,9 +283,11 @@ func (z *ZKS) handleRendezvous(writer chan *RPCWrapper,
 		goto bad
 	}
 	if exp, err := strconv.ParseUint(r.Expiration, 10, 64); err != nil ||
-		exp > 168 {
+		exp == 0 || exp > 168 {
 		payload.Error = "invalid expiration"
 		goto bad
+	} else {
+		expires = time.Now().Add(time.Duration(exp) * time.Hour)
 	}
 
 	// store blob
@@ -180,22 +303,20 @@ func (z *ZKS) handleRendezvous(writer chan *RPCWrapper,
 		tokenS := strconv.FormatUint(token, 10)
 
 		// get token
-		_, err = rz.Get("", tokenS)
-		if err == nil {
+		_, err = z.store.GetRendezvous(tokenS)
+		if !errors.Is(err, storage.ErrNotFound) {
 			// duplicate
 			retry--
 			continue
 		}
 
-		// value = base64(xdr(TaggedCmdRendezvous))
-		var b bytes.Buffer
-		_, err = xdr.Marshal(&b, r)
-		if err != nil {
-			z.Error(idRPC, "handleRendezvous: could not marshal")
-			goto bad
-		}
-		err = rz.Set("", tokenS,
-			base64.StdEncoding.EncodeToString(b.Bytes()))
+		err = z.store.PutRendezvous(tokenS, storage.Rendezvous{
+			Blob:       r.Blob,
+			Expiration: r.Expiration,
+			Expires:    expires.Unix(),
+			Owner:      rid,
+			MaxPulls:   z.settings().RendezvousMaxPulls,
+		})
 		if err != nil {
 			// db error
 			retry--
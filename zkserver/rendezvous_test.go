@@ -0,0 +1,50 @@
+// Copyright (c) 2020 Company 0, LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/companyzero/zkc/zkserver/storage"
+)
+
+func TestPruneRendezvousLegacy(t *testing.T) {
+	root, err := ioutil.TempDir("", "zkserver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	z := newTestServer(t, root)
+	records := map[string]storage.Rendezvous{
+		"111111": {Blob: []byte("legacy"), Expiration: "24"},
+		"222222": {},
+		"333333": {Blob: []byte("expired"), Expiration: "1", Expires: 1},
+	}
+	for k, v := range records {
+		err = z.store.PutRendezvous(k, v)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// legacy records survive the first prune with a lifetime
+	now := time.Now()
+	if pruned := z.pruneRendezvous(); pruned != 2 {
+		t.Fatalf("expected 2 pruned records, got %v", pruned)
+	}
+	r, err := z.store.GetRendezvous("111111")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Legacy() || r.Expired(now.Add(rendezvousLegacyLifetime-
+		time.Minute)) || !r.Expired(now.Add(rendezvousLegacyLifetime+
+		time.Minute)) {
+		t.Fatalf("unexpected legacy record %+v", r)
+	}
+}
@@ -0,0 +1,150 @@
+// Copyright (c) 2020 Company 0, LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/companyzero/zkc/rpc"
+	"github.com/companyzero/zkc/tools"
+	"github.com/companyzero/zkc/zkserver/socketapi"
+)
+
+// serverCerts are the outer certificates of the server.  The staged
+// certificate is announced to clients, signed by the server identity, so that
+// they accept it once it is rotated in.
+type serverCerts struct {
+	active   tls.Certificate
+	next     *tls.Certificate // staged certificate, nil if none
+	nextProp string           // PropNextCert value of next
+}
+
+// getCerts returns the current outer certificates.
+func (z *ZKS) getCerts() *serverCerts {
+	return z.certs.Load().(*serverCerts)
+}
+
+// getCertificate returns the active certificate to the TLS handshake.
+func (z *ZKS) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return &z.getCerts().active, nil
+}
+
+// setCerts atomically replaces the outer certificates and signs the
+// announcement of the staged certificate.
+func (z *ZKS) setCerts(active tls.Certificate, next *tls.Certificate) {
+	sc := &serverCerts{
+		active: active,
+		next:   next,
+	}
+	if next != nil {
+		n := rpc.NextCert{
+			Fingerprint: sha256.Sum256(next.Certificate[0]),
+		}
+		n.Signature = z.id.SignMessage(n.Digest())
+		sc.nextProp = n.String()
+	}
+	z.certs.Store(sc)
+}
+
+// loadNextCert loads the staged certificate.  It returns nil if there is no
+// staged certificate.
+func (z *ZKS) loadNextCert() (*tls.Certificate, error) {
+	certFile := filepath.Join(z.settings().Root, tools.ZKSNextCertFilename)
+	keyFile := filepath.Join(z.settings().Root, tools.ZKSNextKeyFilename)
+	if _, err := os.Stat(certFile); os.IsNotExist(err) {
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	if len(cert.Certificate) != 1 {
+		return nil, fmt.Errorf("unexpected chained certificate")
+	}
+	return &cert, nil
+}
+
+// handleCertStage always returns an answer to the cert stage command.  It
+// creates a new certificate and announces it to clients.  A certificate that
+// was staged before is replaced.
+func (z *ZKS) handleCertStage(cs socketapi.SocketCommandCertStage) *socketapi.SocketCommandCertStageReply {
+	csr := &socketapi.SocketCommandCertStageReply{}
+
+	z.certMtx.Lock()
+	defer z.certMtx.Unlock()
+
+	valid := time.Date(2049, 12, 31, 23, 59, 59, 0, time.UTC)
+	cp, kp, err := newTLSCertPair("", valid, []string{})
+	if err != nil {
+		csr.Error = fmt.Sprintf("could not create a new cert: %v", err)
+		return csr
+	}
+	next, err := tls.X509KeyPair(cp, kp)
+	if err != nil {
+		csr.Error = fmt.Sprintf("X509KeyPair: %v", err)
+		return csr
+	}
+
+	err = ioutil.WriteFile(filepath.Join(z.settings().Root,
+		tools.ZKSNextKeyFilename), kp, 0600)
+	if err != nil {
+		csr.Error = fmt.Sprintf("could not save key: %v", err)
+		return csr
+	}
+	err = ioutil.WriteFile(filepath.Join(z.settings().Root,
+		tools.ZKSNextCertFilename), cp, 0600)
+	if err != nil {
+		csr.Error = fmt.Sprintf("could not save cert: %v", err)
+		return csr
+	}
+
+	z.setCerts(z.getCerts().active, &next)
+	csr.Fingerprint = tools.FingerprintDER(next)
+	z.Info(idApp, "Staged outer fingerprint: %v", csr.Fingerprint)
+
+	return csr
+}
+
+// handleCertRotate always returns an answer to the cert rotate command.  It
+// replaces the active certificate with the staged one.  New connections are
+// presented the new certificate, established sessions are not affected.
+func (z *ZKS) handleCertRotate(cr socketapi.SocketCommandCertRotate) *socketapi.SocketCommandCertRotateReply {
+	crr := &socketapi.SocketCommandCertRotateReply{}
+
+	z.certMtx.Lock()
+	defer z.certMtx.Unlock()
+
+	next := z.getCerts().next
+	if next == nil {
+		crr.Error = "no staged certificate"
+		return crr
+	}
+
+	root := z.settings().Root
+	err := os.Rename(filepath.Join(root, tools.ZKSNextKeyFilename),
+		filepath.Join(root, tools.ZKSKeyFilename))
+	if err != nil {
+		crr.Error = fmt.Sprintf("could not rotate key: %v", err)
+		return crr
+	}
+	err = os.Rename(filepath.Join(root, tools.ZKSNextCertFilename),
+		filepath.Join(root, tools.ZKSCertFilename))
+	if err != nil {
+		crr.Error = fmt.Sprintf("could not rotate cert: %v", err)
+		return crr
+	}
+
+	z.setCerts(*next, nil)
+	crr.Fingerprint = tools.FingerprintDER(*next)
+	z.Info(idApp, "Rotated outer fingerprint: %v", crr.Fingerprint)
+
+	return crr
+}
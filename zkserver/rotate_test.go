@@ -0,0 +1,129 @@
+// Copyright (c) 2020 Company 0, LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/companyzero/zkc/rpc"
+	"github.com/companyzero/zkc/tools"
+	"github.com/companyzero/zkc/zkserver/socketapi"
+)
+
+func TestCertRotate(t *testing.T) {
+	root, err := ioutil.TempDir("", "zkserver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	z := newTestServer(t, root)
+	valid := time.Date(2049, 12, 31, 23, 59, 59, 0, time.UTC)
+	cp, kp, err := newTLSCertPair("", valid, []string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	active, err := tls.X509KeyPair(cp, kp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	z.setCerts(active, nil)
+	presented := func() []byte {
+		t.Helper()
+		c, err := z.getCertificate(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c.Certificate[0]
+	}
+
+	// nothing is announced or rotated without a staged certificate
+	if z.getCerts().nextProp != "" {
+		t.Fatalf("unexpected announcement %v", z.getCerts().nextProp)
+	}
+	if _, ok := propertyKeys(z, rpc.ProtocolVersion)[rpc.PropNextCert]; ok {
+		t.Fatal("announcement sent without staged certificate")
+	}
+	crr := z.handleCertRotate(socketapi.SocketCommandCertRotate{})
+	if crr.Error == "" {
+		t.Fatal("rotated without staged certificate")
+	}
+
+	// the staged certificate is announced signed by the server identity
+	// while the active one is still presented
+	csr := z.handleCertStage(socketapi.SocketCommandCertStage{})
+	if csr.Error != "" {
+		t.Fatal(csr.Error)
+	}
+	next, err := z.loadNextCert()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next == nil || tools.FingerprintDER(*next) != csr.Fingerprint {
+		t.Fatalf("staged certificate not saved")
+	}
+	n, err := rpc.ParseNextCert(z.getCerts().nextProp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n.Fingerprint != sha256.Sum256(next.Certificate[0]) {
+		t.Fatalf("announced %x, staged %v", n.Fingerprint,
+			csr.Fingerprint)
+	}
+	if !z.id.Public.VerifyMessage(n.Digest(), n.Signature) {
+		t.Fatal("announcement not signed by server identity")
+	}
+	if propertyKeys(z, rpc.ProtocolVersion)[rpc.PropNextCert] !=
+		z.getCerts().nextProp {
+		t.Fatal("staged certificate not announced")
+	}
+	if _, ok := propertyKeys(z, rpc.LegacyProtocolVersion)[rpc.PropNextCert]; ok {
+		t.Fatal("announcement sent to legacy session")
+	}
+	if !bytes.Equal(presented(), active.Certificate[0]) {
+		t.Fatal("staged certificate presented before rotation")
+	}
+
+	// rotation presents the staged certificate and ends the announcement
+	crr = z.handleCertRotate(socketapi.SocketCommandCertRotate{})
+	if crr.Error != "" {
+		t.Fatal(crr.Error)
+	}
+	if crr.Fingerprint != csr.Fingerprint {
+		t.Fatalf("rotated to %v, staged %v", crr.Fingerprint,
+			csr.Fingerprint)
+	}
+	if !bytes.Equal(presented(), next.Certificate[0]) {
+		t.Fatal("staged certificate not presented after rotation")
+	}
+	if z.getCerts().nextProp != "" {
+		t.Fatalf("unexpected announcement %v", z.getCerts().nextProp)
+	}
+	if _, ok := propertyKeys(z, rpc.ProtocolVersion)[rpc.PropNextCert]; ok {
+		t.Fatal("announcement sent after rotation")
+	}
+
+	// and replaces the certificate that is loaded on startup
+	next, err = z.loadNextCert()
+	if err != nil || next != nil {
+		t.Fatalf("staged certificate not moved: %v", err)
+	}
+	cert, err := tls.LoadX509KeyPair(filepath.Join(root,
+		tools.ZKSCertFilename), filepath.Join(root,
+		tools.ZKSKeyFilename))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tools.FingerprintDER(cert) != csr.Fingerprint {
+		t.Fatal("rotated certificate not saved")
+	}
+}
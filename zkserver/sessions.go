@@ -0,0 +1,117 @@
+// Copyright (c) 2020 Company 0, LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"sort"
+
+	"github.com/companyzero/zkc/zkserver/socketapi"
+	"github.com/companyzero/zkc/zkserver/storage"
+)
+
+// sessionInfo returns a description of sc.
+func (z *ZKS) sessionInfo(sc *sessionContext) socketapi.Session {
+	device := sc.getDevice()
+	s := socketapi.Session{
+		Identity:      sc.rids,
+		Device:        hex.EncodeToString(device[:]),
+		RemoteAddress: sc.kx.Conn.RemoteAddr().String(),
+		Connected:     sc.connected.Unix(),
+		Notifications: len(sc.ntfn),
+	}
+	ir, err := z.store.GetIdentity(sc.rid)
+	if err == nil {
+		s.Nick = ir.Identity.Nick
+	}
+
+	sc.Lock()
+	for _, v := range sc.tagMessage {
+		if v != nil {
+			s.Tags++
+		}
+	}
+	sc.Unlock()
+
+	return s
+}
+
+// allSessions returns all online sessions.
+func (z *ZKS) allSessions() []*sessionContext {
+	z.Lock()
+	defer z.Unlock()
+
+	scs := make([]*sessionContext, 0, len(z.sessions))
+	for _, devices := range z.sessions {
+		for _, sc := range devices {
+			scs = append(scs, sc)
+		}
+	}
+	return scs
+}
+
+// handleSessionList always returns an answer to the session list command.
+func (z *ZKS) handleSessionList(sl socketapi.SocketCommandSessionList) *socketapi.SocketCommandSessionListReply {
+	scs := z.allSessions()
+	slr := &socketapi.SocketCommandSessionListReply{
+		Sessions: make([]socketapi.Session, 0, len(scs)),
+	}
+	for _, sc := range scs {
+		slr.Sessions = append(slr.Sessions, z.sessionInfo(sc))
+	}
+	sort.Slice(slr.Sessions, func(i, j int) bool {
+		return slr.Sessions[i].Connected < slr.Sessions[j].Connected
+	})
+
+	return slr
+}
+
+// handleSessionKick always returns an answer to the session kick command.
+func (z *ZKS) handleSessionKick(sk socketapi.SocketCommandSessionKick) *socketapi.SocketCommandSessionKickReply {
+	skr := &socketapi.SocketCommandSessionKickReply{}
+
+	z.Lock()
+	defer z.Unlock()
+
+	devices, ok := z.sessions[sk.Identity]
+	if !ok {
+		skr.Error = fmt.Sprintf("user not online: %v", sk.Identity)
+		return skr
+	}
+
+	var sc *sessionContext
+	if sk.Device == "" {
+		if len(devices) != 1 {
+			skr.Error = fmt.Sprintf("user has %v sessions, device "+
+				"required", len(devices))
+			return skr
+		}
+		for _, v := range devices {
+			sc = v
+		}
+	} else {
+		d, err := hex.DecodeString(sk.Device)
+		if err != nil || len(d) != storage.DeviceIDSize {
+			skr.Error = fmt.Sprintf("invalid device: %v", sk.Device)
+			return skr
+		}
+		var device storage.DeviceID
+		copy(device[:], d)
+		sc, ok = devices[device]
+		if !ok {
+			skr.Error = fmt.Sprintf("device not online: %v",
+				sk.Device)
+			return skr
+		}
+	}
+
+	// Closing the connection knocks the session offline.
+	z.Dbg(idSock, "session kicked %v %x", sc.rids, sc.getDevice())
+	sc.kx.Close()
+	z.auditDisconnect(socketapi.SCSessionKick, sc.rids, sc.getDevice())
+
+	return skr
+}
@@ -13,14 +13,14 @@ import (
 	"github.com/companyzero/zkc/zkutil"
 )
 
-func ObtainSettings() (*settings.Settings, error) {
+func ObtainSettings() (*settings.Settings, string, error) {
 	// defaults
 	s := settings.New()
 
 	// setup default paths
 	usr, err := user.Current()
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 
 	// config file
@@ -38,8 +38,8 @@ func ObtainSettings() (*settings.Settings, error) {
 	// load file
 	err = s.Load(*filename)
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 
-	return s, nil
+	return s, *filename, nil
 }
@@ -1,6 +1,7 @@
 package settings
 
 import (
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"os/user"
@@ -16,16 +17,51 @@ import (
 // in order to be able to reuse in various tests.
 type Settings struct {
 	// default section
-	Root              string // root directory for zkserver
-	Users             string // user home directories
-	Listen            string // listen address and port
-	AllowIdentify     bool   // identify server policy
-	CreatePolicy      string // create account server policy
-	Directory         bool   // whether we keep a directory of identities
-	MOTD              string // filename to message of the day
-	MaxAttachmentSize uint64 // maximum attachment size
-	MaxChunkSize      uint64 // maximum chunk size
-	MaxMsgSize        uint64 // maximum message size
+	Root              string     // root directory for zkserver
+	Users             string     // user home directories
+	Listen            []Listener // addresses to listen for connections
+	AllowIdentify     bool       // identify server policy
+	CreatePolicy      string     // create account server policy
+	Directory         bool       // whether we keep a directory of identities
+	MOTD              string     // filename to message of the day
+	MaxAttachmentSize uint64     // maximum attachment size
+	MaxChunkSize      uint64     // maximum chunk size
+	MaxMsgSize        uint64     // maximum message size
+	ShutdownTimeout   uint64     // seconds to drain sessions on shutdown
+
+	// mailbox section
+	MailboxMaxMessages uint64 // undelivered messages per account, 0 is unlimited
+	MailboxMaxBytes    uint64 // undelivered bytes per account, 0 is unlimited
+	MailboxSenderShare uint64 // percentage of a mailbox one sender may fill
+	MailboxMaxAge      uint64 // hours before undelivered messages expire, 0 is forever
+
+	// rendezvous section
+	RendezvousMaxPulls           uint64 // pulls before a PIN is consumed, 0 is unlimited
+	RendezvousPullFailures       uint64 // failed pulls per identity per hour, 0 is unlimited
+	RendezvousPullFailuresGlobal uint64 // failed pulls per hour, 0 is unlimited
+
+	// devices section
+	DevicesMax       uint64 // registered devices per account, 0 is unlimited
+	DevicesMaxIdle   uint64 // days before an unseen device is forgotten, 0 is forever
+	DevicesAckPolicy string // remove messages once "all" or the "first" device acknowledged
+
+	// presession section
+	PreSessionTimeout              uint64 // seconds to complete the handshake, 0 is forever
+	PreSessionMaxConns             uint64 // concurrent handshakes, 0 is unlimited
+	PreSessionMaxConnsPerIP        uint64 // concurrent handshakes per address, 0 is unlimited
+	PreSessionCreateAccounts       uint64 // account creations per address per hour, 0 is unlimited
+	PreSessionCreateAccountsGlobal uint64 // account creations per hour, 0 is unlimited
+
+	// ratelimit section, commands per identity per minute, 0 is unlimited
+	RateLimitCache        uint64
+	RateLimitRendezvous   uint64
+	RateLimitIdentityFind uint64
+	RateLimitProxy        uint64
+
+	// federation section
+	FederationAddress string           // address other servers know us by, "" is disabled
+	FederationPeers   []FederationPeer // servers messages are relayed to and accepted from
+	FederationTimeout uint64           // seconds to wait for a peer
 
 	// log section
 	LogFile    string // log filename
@@ -33,6 +69,33 @@ type Settings struct {
 	Debug      bool   // enable debug
 	Trace      bool   // enable tracing
 	Profiler   string // go profiler link
+	Metrics    string // metrics listen address, "" is disabled
+	AuditLog   string // audit log filename
+}
+
+// Listener is an address clients connect to.
+type Listener struct {
+	Network string // "tcp" or "unix"
+	Address string // host and port or UNIX socket path
+	Proxy   bool   // connections start with a PROXY protocol header
+}
+
+// String returns the listener the way it is configured.
+func (l Listener) String() string {
+	s := l.Address
+	if l.Network == "unix" {
+		s = "unix:" + s
+	}
+	if l.Proxy {
+		s += " proxy"
+	}
+	return s
+}
+
+// FederationPeer is a server users on this server exchange messages with.
+type FederationPeer struct {
+	Address  string   // address users know the server by
+	Identity [32]byte // server identity
 }
 
 var (
@@ -45,7 +108,7 @@ func New() *Settings {
 		// default
 		Root:              "~/.zkserver",
 		Users:             "~/.zkserver/" + tools.ZKSHome,
-		Listen:            "127.0.0.1:12345",
+		Listen:            []Listener{{Network: "tcp", Address: "127.0.0.1:12345"}},
 		AllowIdentify:     false,
 		CreatePolicy:      "no",
 		Directory:         false,
@@ -53,6 +116,40 @@ func New() *Settings {
 		MaxAttachmentSize: rpc.PropMaxAttachmentSizeDefault,
 		MaxChunkSize:      rpc.PropMaxChunkSizeDefault,
 		MaxMsgSize:        rpc.PropMaxMsgSizeDefault,
+		ShutdownTimeout:   10,
+
+		// mailbox
+		MailboxMaxMessages: 0,
+		MailboxMaxBytes:    0,
+		MailboxSenderShare: 100,
+		MailboxMaxAge:      0,
+
+		// rendezvous
+		RendezvousMaxPulls:           1,
+		RendezvousPullFailures:       10,
+		RendezvousPullFailuresGlobal: 1000,
+
+		// devices
+		DevicesMax:       5,
+		DevicesMaxIdle:   30,
+		DevicesAckPolicy: "all",
+
+		// presession
+		PreSessionTimeout:              30,
+		PreSessionMaxConns:             1024,
+		PreSessionMaxConnsPerIP:        16,
+		PreSessionCreateAccounts:       10,
+		PreSessionCreateAccountsGlobal: 100,
+
+		// ratelimit
+		RateLimitCache:        600,
+		RateLimitRendezvous:   10,
+		RateLimitIdentityFind: 60,
+		RateLimitProxy:        600,
+
+		// federation
+		FederationAddress: "",
+		FederationTimeout: 30,
 
 		// log
 		LogFile:    "~/.zkserver/zkserver.log",
@@ -60,6 +157,8 @@ func New() *Settings {
 		Debug:      false,
 		Trace:      false,
 		Profiler:   "localhost:6060",
+		Metrics:    "",
+		AuditLog:   "~/.zkserver/audit.log",
 	}
 }
 
@@ -92,12 +191,20 @@ func (s *Settings) Load(filename string) error {
 	}
 	s.Users = strings.Replace(s.Users, "~", usr.HomeDir, 1)
 
-	// listen address
+	// listen addresses
 	listen, ok := cfg.Get("", "listen")
 	if ok {
-		s.Listen = listen
+		s.Listen, err = parseListeners(listen)
+		if err != nil {
+			return fmt.Errorf("listen invalid: %v", err)
+		}
+	}
+	for k := range s.Listen {
+		if s.Listen[k].Network == "unix" {
+			s.Listen[k].Address = strings.Replace(s.Listen[k].Address,
+				"~", usr.HomeDir, 1)
+		}
 	}
-	s.Listen = strings.Replace(s.Listen, "~", usr.HomeDir, 1)
 
 	// identify policy
 	err = iniBool(cfg, &s.AllowIdentify, "", "allowidentify")
@@ -149,6 +256,148 @@ func (s *Settings) Load(filename string) error {
 		}
 	}
 
+	// shutdown timeout
+	err = iniUint64(cfg, &s.ShutdownTimeout, "", "shutdowntimeout")
+	if err != nil && !errors.Is(err, errIniNotFound) {
+		return err
+	}
+
+	// mailbox quota
+	err = iniUint64(cfg, &s.MailboxMaxMessages, "mailbox", "maxmessages")
+	if err != nil && !errors.Is(err, errIniNotFound) {
+		return err
+	}
+
+	err = iniUint64(cfg, &s.MailboxMaxBytes, "mailbox", "maxbytes")
+	if err != nil && !errors.Is(err, errIniNotFound) {
+		return err
+	}
+
+	err = iniUint64(cfg, &s.MailboxSenderShare, "mailbox", "sendershare")
+	if err != nil && !errors.Is(err, errIniNotFound) {
+		return err
+	}
+	if s.MailboxSenderShare == 0 || s.MailboxSenderShare > 100 {
+		return fmt.Errorf("[mailbox]sendershare must be between 1 " +
+			"and 100")
+	}
+
+	err = iniUint64(cfg, &s.MailboxMaxAge, "mailbox", "maxage")
+	if err != nil && !errors.Is(err, errIniNotFound) {
+		return err
+	}
+
+	// rendezvous
+	err = iniUint64(cfg, &s.RendezvousMaxPulls, "rendezvous", "maxpulls")
+	if err != nil && !errors.Is(err, errIniNotFound) {
+		return err
+	}
+
+	err = iniUint64(cfg, &s.RendezvousPullFailures, "rendezvous",
+		"pullfailures")
+	if err != nil && !errors.Is(err, errIniNotFound) {
+		return err
+	}
+
+	err = iniUint64(cfg, &s.RendezvousPullFailuresGlobal, "rendezvous",
+		"pullfailuresglobal")
+	if err != nil && !errors.Is(err, errIniNotFound) {
+		return err
+	}
+
+	// devices
+	err = iniUint64(cfg, &s.DevicesMax, "devices", "maxdevices")
+	if err != nil && !errors.Is(err, errIniNotFound) {
+		return err
+	}
+
+	err = iniUint64(cfg, &s.DevicesMaxIdle, "devices", "maxidle")
+	if err != nil && !errors.Is(err, errIniNotFound) {
+		return err
+	}
+
+	ap, ok := cfg.Get("devices", "ackpolicy")
+	if ok {
+		switch ap {
+		case "all":
+		case "first":
+		default:
+			return fmt.Errorf("invalid [devices]ackpolicy value: %v",
+				ap)
+		}
+		s.DevicesAckPolicy = ap
+	}
+
+	// presession
+	err = iniUint64(cfg, &s.PreSessionTimeout, "presession", "timeout")
+	if err != nil && !errors.Is(err, errIniNotFound) {
+		return err
+	}
+
+	err = iniUint64(cfg, &s.PreSessionMaxConns, "presession", "maxconns")
+	if err != nil && !errors.Is(err, errIniNotFound) {
+		return err
+	}
+
+	err = iniUint64(cfg, &s.PreSessionMaxConnsPerIP, "presession",
+		"maxconnsperip")
+	if err != nil && !errors.Is(err, errIniNotFound) {
+		return err
+	}
+
+	err = iniUint64(cfg, &s.PreSessionCreateAccounts, "presession",
+		"createaccounts")
+	if err != nil && !errors.Is(err, errIniNotFound) {
+		return err
+	}
+
+	err = iniUint64(cfg, &s.PreSessionCreateAccountsGlobal, "presession",
+		"createaccountsglobal")
+	if err != nil && !errors.Is(err, errIniNotFound) {
+		return err
+	}
+
+	// ratelimit
+	err = iniUint64(cfg, &s.RateLimitCache, "ratelimit", "cache")
+	if err != nil && !errors.Is(err, errIniNotFound) {
+		return err
+	}
+
+	err = iniUint64(cfg, &s.RateLimitRendezvous, "ratelimit", "rendezvous")
+	if err != nil && !errors.Is(err, errIniNotFound) {
+		return err
+	}
+
+	err = iniUint64(cfg, &s.RateLimitIdentityFind, "ratelimit",
+		"identityfind")
+	if err != nil && !errors.Is(err, errIniNotFound) {
+		return err
+	}
+
+	err = iniUint64(cfg, &s.RateLimitProxy, "ratelimit", "proxy")
+	if err != nil && !errors.Is(err, errIniNotFound) {
+		return err
+	}
+
+	// federation
+	address, ok := cfg.Get("federation", "address")
+	if ok {
+		s.FederationAddress = address
+	}
+
+	peers, ok := cfg.Get("federation", "peers")
+	if ok {
+		s.FederationPeers, err = parsePeers(peers)
+		if err != nil {
+			return fmt.Errorf("[federation]peers invalid: %v", err)
+		}
+	}
+
+	err = iniUint64(cfg, &s.FederationTimeout, "federation", "timeout")
+	if err != nil && !errors.Is(err, errIniNotFound) {
+		return err
+	}
+
 	// logging and debug
 	logFile, ok := cfg.Get("log", "logfile")
 	if ok {
@@ -176,6 +425,17 @@ func (s *Settings) Load(filename string) error {
 		s.Profiler = profiler
 	}
 
+	metrics, ok := cfg.Get("log", "metrics")
+	if ok {
+		s.Metrics = metrics
+	}
+
+	auditLog, ok := cfg.Get("log", "auditlog")
+	if ok {
+		s.AuditLog = auditLog
+	}
+	s.AuditLog = strings.Replace(s.AuditLog, "~", usr.HomeDir, 1)
+
 	return nil
 }
 
@@ -197,3 +457,78 @@ func iniBool(cfg ini.File, p *bool, section, key string) error {
 	}
 	return errIniNotFound
 }
+
+func iniUint64(cfg ini.File, p *uint64, section, key string) error {
+
+	v, ok := cfg.Get(section, key)
+	if ok {
+		x, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			return fmt.Errorf("[%v]%v invalid: %v", section, key,
+				err)
+		}
+		*p = x
+		return nil
+	}
+	return errIniNotFound
+}
+
+// parseListeners parses a comma separated list of listeners.  Every listener
+// is a host and port or unix: followed by a socket path, optionally followed
+// by proxy.
+func parseListeners(v string) ([]Listener, error) {
+	var listeners []Listener
+	for _, l := range strings.Split(v, ",") {
+		f := strings.Fields(l)
+		if len(f) == 0 {
+			continue
+		}
+		listener := Listener{Network: "tcp", Address: f[0]}
+		if strings.HasPrefix(f[0], "unix:") {
+			listener.Network = "unix"
+			listener.Address = strings.TrimPrefix(f[0], "unix:")
+			if listener.Address == "" {
+				return nil, fmt.Errorf("missing socket path: %v",
+					strings.TrimSpace(l))
+			}
+		}
+		for _, o := range f[1:] {
+			switch o {
+			case "proxy":
+				listener.Proxy = true
+			default:
+				return nil, fmt.Errorf("invalid option %v: %v", o,
+					strings.TrimSpace(l))
+			}
+		}
+		listeners = append(listeners, listener)
+	}
+	if len(listeners) == 0 {
+		return nil, fmt.Errorf("no address")
+	}
+	return listeners, nil
+}
+
+// parsePeers parses a comma separated list of peers.  Every peer is an
+// address followed by the hex encoded server identity.
+func parsePeers(v string) ([]FederationPeer, error) {
+	var peers []FederationPeer
+	for _, p := range strings.Split(v, ",") {
+		f := strings.Fields(p)
+		if len(f) == 0 {
+			continue
+		}
+		if len(f) != 2 {
+			return nil, fmt.Errorf("expected address and identity: "+
+				"%v", strings.TrimSpace(p))
+		}
+		id, err := hex.DecodeString(f[1])
+		if err != nil || len(id) != 32 {
+			return nil, fmt.Errorf("invalid identity: %v", f[1])
+		}
+		peer := FederationPeer{Address: f[0]}
+		copy(peer.Identity[:], id)
+		peers = append(peers, peer)
+	}
+	return peers, nil
+}
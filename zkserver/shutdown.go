@@ -0,0 +1,156 @@
+// Copyright (c) 2020 Company 0, LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/companyzero/zkc/rpc"
+	"github.com/companyzero/zkc/zkserver/socketapi"
+)
+
+const (
+	// shutdownReason is sent to all sessions when the server shuts down.
+	shutdownReason = "server shutting down"
+
+	// shutdownGrace is the time sessions have to go away after they were
+	// sent an unwelcome.
+	shutdownGrace = 2 * time.Second
+
+	// shutdownPoll is the interval at which sessions are checked while
+	// draining.
+	shutdownPoll = 100 * time.Millisecond
+)
+
+// isDraining returns true once the server started shutting down.
+func (z *ZKS) isDraining() bool {
+	z.Lock()
+	defer z.Unlock()
+	return z.draining
+}
+
+// drained returns true if the session has no pushed messages that were not
+// acknowledged and no pending notifications.
+func (sc *sessionContext) drained() bool {
+	sc.Lock()
+	defer sc.Unlock()
+
+	if len(sc.ntfn) != 0 {
+		return false
+	}
+	for _, v := range sc.tagMessage {
+		if v != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// shutdown stops the server gracefully.  It stops accepting connections and
+// pushing messages and waits up to the shutdown timeout for sessions to
+// acknowledge outstanding pushes, so that delivered messages are removed
+// from the mailboxes and undelivered messages are retained.  Sessions are
+// then sent an unwelcome, the storage is flushed and the admin socket is
+// removed.
+func (z *ZKS) shutdown() {
+	timeout := time.Duration(z.settings().ShutdownTimeout) * time.Second
+	z.Info(idApp, "Shutting down, draining sessions for up to %v", timeout)
+
+	// stop accepting connections
+	z.Lock()
+	z.draining = true
+	listeners := z.listeners
+	z.Unlock()
+	for _, l := range listeners {
+		l.Close()
+	}
+
+	// close federation links, relaying fails from here on
+	z.federation.Close()
+
+	// stop pushing messages, they remain in the mailbox
+	sessions := z.allSessions()
+	for _, sc := range sessions {
+		z.account.Offline(sc.rid, sc.getDevice())
+	}
+
+	// wait for outstanding acknowledgements
+	deadline := time.Now().Add(timeout)
+	for _, sc := range sessions {
+		for !sc.drained() && time.Now().Before(deadline) {
+			time.Sleep(shutdownPoll)
+		}
+		if !sc.drained() {
+			z.Warn(idApp, "session not drained: %v %x", sc.rids,
+				sc.getDevice())
+		}
+	}
+
+	// Tell everyone to go away and wait for the sessions to exit.
+	// Sessions that came online in the meantime are sent an unwelcome
+	// as well.
+	unwelcomed := make(map[*sessionContext]struct{})
+	deadline = time.Now().Add(shutdownGrace)
+	for {
+		sessions = z.allSessions()
+		if len(sessions) == 0 {
+			break
+		}
+		if !time.Now().Before(deadline) {
+			for _, sc := range sessions {
+				z.Warn(idApp, "closing session: %v %x",
+					sc.rids, sc.getDevice())
+				sc.kx.Close()
+			}
+			break
+		}
+		for _, sc := range sessions {
+			if _, ok := unwelcomed[sc]; ok {
+				continue
+			}
+			unwelcomed[sc] = struct{}{}
+			z.account.Offline(sc.rid, sc.getDevice())
+			z.unwelcomeSession(sc)
+		}
+		time.Sleep(shutdownPoll)
+	}
+
+	// flush storage
+	err := z.store.Close()
+	if err != nil {
+		z.Error(idApp, "could not flush storage: %v", err)
+	}
+
+	// remove admin socket
+	if z.socket != nil {
+		z.socket.Close()
+	}
+	err = os.Remove(filepath.Join(z.settings().Root,
+		socketapi.SocketFilename))
+	if err != nil && !os.IsNotExist(err) {
+		z.Error(idApp, "could not remove socket: %v", err)
+	}
+}
+
+// unwelcomeSession queues an unwelcome for sc.  The session writer exits after
+// writing it.  Sessions that can not take the unwelcome are closed.
+func (z *ZKS) unwelcomeSession(sc *sessionContext) {
+	r := &RPCWrapper{
+		Message: rpc.Message{
+			Command: rpc.SessionCmdUnwelcome,
+		},
+		Payload: rpc.Unwelcome{
+			Version: rpc.ProtocolVersion,
+			Reason:  shutdownReason,
+		},
+	}
+	select {
+	case sc.writer <- r:
+	default:
+		sc.kx.Close()
+	}
+}
@@ -0,0 +1,174 @@
+// Copyright (c) 2020 Company 0, LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/companyzero/zkc/debug"
+	"github.com/companyzero/zkc/rpc"
+	"github.com/companyzero/zkc/session"
+	"github.com/companyzero/zkc/zkidentity"
+	"github.com/companyzero/zkc/zkserver/account"
+	"github.com/companyzero/zkc/zkserver/audit"
+	"github.com/companyzero/zkc/zkserver/federation"
+	"github.com/companyzero/zkc/zkserver/settings"
+	"github.com/companyzero/zkc/zkserver/socketapi"
+	"github.com/companyzero/zkc/zkserver/storage"
+)
+
+// newTestServer returns a server in root that is set up far enough to run
+// the handlers that do not touch the network.
+func newTestServer(t *testing.T, root string) *ZKS {
+	t.Helper()
+
+	s := settings.New()
+	s.Root = root
+	z := &ZKS{
+		sessions: make(map[string]map[storage.DeviceID]*sessionContext),
+		store:    storage.NewMemory(),
+	}
+	z.config.Store(s)
+	var err error
+	z.Debug, err = debug.New(filepath.Join(root, "zkserver.log"),
+		s.TimeFormat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	z.id, err = zkidentity.New("zkserver", "zkserver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	z.auditLog, err = audit.Open(filepath.Join(root, "audit.log"), z.id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	z.account, err = account.New(z.store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	z.federation, err = federation.New(federation.Config{Identity: z.id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	z.setCerts(tls.Certificate{}, nil)
+	return z
+}
+
+// addTestSession registers a session with one unacknowledged push.  The
+// returned connection is the client end of the session.
+func addTestSession(t *testing.T, z *ZKS, writer chan *RPCWrapper) (*sessionContext, net.Conn) {
+	t.Helper()
+
+	server, client := net.Pipe()
+	sc := &sessionContext{
+		writer:     writer,
+		quit:       make(chan struct{}),
+		kx:         &session.KX{Conn: server},
+		rids:       "00",
+		online:     true,
+		tagMessage: []*RPCWrapper{{}},
+	}
+	z.sessions[sc.rids] = map[storage.DeviceID]*sessionContext{
+		sc.device: sc,
+	}
+	return sc, client
+}
+
+// shutdownTimed runs shutdown and returns how long it took.
+func shutdownTimed(z *ZKS) time.Duration {
+	start := time.Now()
+	z.shutdown()
+	return time.Since(start)
+}
+
+func TestShutdownDrain(t *testing.T) {
+	root, err := ioutil.TempDir("", "zkserver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	z := newTestServer(t, root)
+	z.settings().ShutdownTimeout = 10
+	socket := filepath.Join(z.settings().Root, socketapi.SocketFilename)
+	err = ioutil.WriteFile(socket, nil, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer := make(chan *RPCWrapper, 1)
+	sc, client := addTestSession(t, z, writer)
+	defer client.Close()
+
+	// the client acknowledges the push, then exits on the unwelcome
+	const ack = 300 * time.Millisecond
+	go func() {
+		time.Sleep(ack)
+		sc.Lock()
+		sc.tagMessage[0] = nil
+		sc.Unlock()
+	}()
+	unwelcome := make(chan *RPCWrapper, 1)
+	go func() {
+		r := <-writer
+		z.Lock()
+		delete(z.sessions, sc.rids)
+		z.Unlock()
+		unwelcome <- r
+	}()
+
+	d := shutdownTimed(z)
+	if d < ack || d >= time.Duration(z.settings().ShutdownTimeout)*
+		time.Second {
+		t.Fatalf("unexpected shutdown duration %v", d)
+	}
+	if !z.isDraining() {
+		t.Fatal("server not draining")
+	}
+	r := <-unwelcome
+	u, ok := r.Payload.(rpc.Unwelcome)
+	if r.Message.Command != rpc.SessionCmdUnwelcome || !ok ||
+		u.Reason != shutdownReason {
+		t.Fatalf("unexpected message %+v", r)
+	}
+	if _, err := os.Stat(socket); !os.IsNotExist(err) {
+		t.Fatalf("socket not removed: %v", err)
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	root, err := ioutil.TempDir("", "zkserver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	z := newTestServer(t, root)
+	z.settings().ShutdownTimeout = 1
+
+	// the client never acknowledges and never reads the unwelcome
+	_, client := addTestSession(t, z, make(chan *RPCWrapper))
+	defer client.Close()
+
+	d := shutdownTimed(z)
+	timeout := time.Duration(z.settings().ShutdownTimeout) * time.Second
+	if d < timeout+shutdownGrace {
+		t.Fatalf("unexpected shutdown duration %v", d)
+	}
+
+	// the connection was closed on the client
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = client.Read(make([]byte, 1))
+	if err != io.EOF {
+		t.Fatalf("expected closed connection, got %v", err)
+	}
+}
@@ -6,6 +6,21 @@ const (
 	SCVersion     = 1             // socket API version
 	SCUserEnable  = "userenable"  // ID for SocketCommandUserEnable
 	SCUserDisable = "userdisable" // ID for SocketCommandUserDisable
+	SCSessionList = "sessionlist" // ID for SocketCommandSessionList
+	SCSessionKick = "sessionkick" // ID for SocketCommandSessionKick
+	SCTokenCreate = "tokencreate" // ID for SocketCommandTokenCreate
+	SCTokenList   = "tokenlist"   // ID for SocketCommandTokenList
+	SCTokenRevoke = "tokenrevoke" // ID for SocketCommandTokenRevoke
+
+	SCUserPurge       = "userpurge"       // ID for SocketCommandUserPurge
+	SCUserNick        = "usernick"        // ID for SocketCommandUserNick
+	SCDirectoryList   = "directorylist"   // ID for SocketCommandDirectoryList
+	SCDirectoryUnlist = "directoryunlist" // ID for SocketCommandDirectoryUnlist
+	SCNotice          = "notice"          // ID for SocketCommandNotice
+	SCReload          = "reload"          // ID for SocketCommandReload
+	SCCertStage       = "certstage"       // ID for SocketCommandCertStage
+	SCCertRotate      = "certrotate"      // ID for SocketCommandCertRotate
+	SCBackup          = "backup"          // ID for SocketCommandBackup
 )
 
 // SocketCommandID identifies the command that follows.
@@ -35,3 +50,191 @@ type SocketCommandUserEnable struct {
 type SocketCommandUserEnableReply struct {
 	Error string `json:"error"`
 }
+
+// SocketCommandSessionList requests all online sessions.
+type SocketCommandSessionList struct{}
+
+// Session describes an online session.
+type Session struct {
+	Identity      string `json:"identity"`      // public identity
+	Device        string `json:"device"`        // device identifier
+	Nick          string `json:"nick"`          // nick of identity
+	RemoteAddress string `json:"remoteaddress"` // remote address
+	Connected     int64  `json:"connected"`     // connect time, unix seconds
+	Tags          int    `json:"tags"`          // outstanding tags
+	Notifications int    `json:"notifications"` // pending notifications
+}
+
+// SocketCommandSessionListReply returns all online sessions.  Error is "" if
+// the command was successful.
+type SocketCommandSessionListReply struct {
+	Sessions []Session `json:"sessions"`
+	Error    string    `json:"error"`
+}
+
+// SocketCommandSessionKick attempts to disconnect a session without
+// disabling the user.  Device may be omitted if the user has a single
+// session.
+type SocketCommandSessionKick struct {
+	Identity string `json:"identity"` // public identity
+	Device   string `json:"device"`   // device identifier
+}
+
+// SocketCommandSessionKickReply returns "" if the command was successful.
+type SocketCommandSessionKickReply struct {
+	Error string `json:"error"`
+}
+
+// SocketCommandTokenCreate creates an account creation token.
+type SocketCommandTokenCreate struct {
+	Hours uint64 `json:"hours"` // hours before expiration
+	Uses  uint64 `json:"uses"`  // accounts that may be created, 0 is 1
+	Nick  string `json:"nick"`  // reserved nick, "" allows any nick
+}
+
+// SocketCommandTokenCreateReply returns the new token.  Error is "" if the
+// command was successful.
+type SocketCommandTokenCreateReply struct {
+	Token Token  `json:"token"`
+	Error string `json:"error"`
+}
+
+// Token describes an account creation token.
+type Token struct {
+	Token   string `json:"token"`   // token as entered by users
+	Expires int64  `json:"expires"` // expiration time, unix seconds
+	Uses    uint64 `json:"uses"`    // remaining account creations
+	Nick    string `json:"nick"`    // reserved nick
+}
+
+// SocketCommandTokenList requests all outstanding tokens.
+type SocketCommandTokenList struct{}
+
+// SocketCommandTokenListReply returns all outstanding tokens.  Error is "" if
+// the command was successful.
+type SocketCommandTokenListReply struct {
+	Tokens []Token `json:"tokens"`
+	Error  string  `json:"error"`
+}
+
+// SocketCommandTokenRevoke removes an outstanding token.
+type SocketCommandTokenRevoke struct {
+	Token string `json:"token"`
+}
+
+// SocketCommandTokenRevokeReply returns "" if the command was successful.
+type SocketCommandTokenRevokeReply struct {
+	Error string `json:"error"`
+}
+
+// SocketCommandUserPurge permanently removes a user, its undelivered messages
+// and its directory entry.
+type SocketCommandUserPurge struct {
+	Identity string `json:"identity"` // public identity
+}
+
+// SocketCommandUserPurgeReply returns "" if the command was successful.
+type SocketCommandUserPurgeReply struct {
+	Error string `json:"error"`
+}
+
+// SocketCommandUserNick changes the nick a user is found by in the directory.
+// An empty nick reverts to the nick the user chose.
+type SocketCommandUserNick struct {
+	Identity string `json:"identity"` // public identity
+	Nick     string `json:"nick"`     // new directory nick
+}
+
+// SocketCommandUserNickReply returns "" if the command was successful.
+type SocketCommandUserNickReply struct {
+	Error string `json:"error"`
+}
+
+// SocketCommandDirectoryList lists a user in the directory and allows it to
+// remain listed.
+type SocketCommandDirectoryList struct {
+	Identity string `json:"identity"` // public identity
+}
+
+// SocketCommandDirectoryListReply returns "" if the command was successful.
+type SocketCommandDirectoryListReply struct {
+	Error string `json:"error"`
+}
+
+// SocketCommandDirectoryUnlist removes a user from the directory and keeps it
+// out until it is listed again.
+type SocketCommandDirectoryUnlist struct {
+	Identity string `json:"identity"` // public identity
+}
+
+// SocketCommandDirectoryUnlistReply returns "" if the command was successful.
+type SocketCommandDirectoryUnlistReply struct {
+	Error string `json:"error"`
+}
+
+// SocketCommandNotice sends a server signed notice to all users.  Users that
+// are offline receive the notice when they connect.  If MOTD is set the notice
+// also replaces the message of the day.
+type SocketCommandNotice struct {
+	Text string `json:"text"` // announcement
+	MOTD bool   `json:"motd"` // replace message of the day
+}
+
+// SocketCommandNoticeReply returns the number of users the notice was queued
+// for.  Error is "" if the command was successful.
+type SocketCommandNoticeReply struct {
+	Recipients int    `json:"recipients"`
+	Error      string `json:"error"`
+}
+
+// SocketCommandReload rereads the server configuration file.  Settings that
+// are only read during startup, e.g. the listen address, are not changed.
+type SocketCommandReload struct{}
+
+// SocketCommandReloadReply returns the configuration keys that changed.
+// Applied keys are in effect, ignored keys require a restart.  Error is "" if
+// the command was successful.
+type SocketCommandReloadReply struct {
+	Applied []string `json:"applied"`
+	Ignored []string `json:"ignored"`
+	Error   string   `json:"error"`
+}
+
+// SocketCommandCertStage creates a new outer certificate and announces its
+// fingerprint to clients, signed by the server identity.  Clients that saw the
+// announcement accept the certificate once it is rotated in.
+type SocketCommandCertStage struct{}
+
+// SocketCommandCertStageReply returns the fingerprint of the staged
+// certificate.  Error is "" if the command was successful.
+type SocketCommandCertStageReply struct {
+	Fingerprint string `json:"fingerprint"`
+	Error       string `json:"error"`
+}
+
+// SocketCommandCertRotate replaces the outer certificate with the staged
+// certificate.
+type SocketCommandCertRotate struct{}
+
+// SocketCommandCertRotateReply returns the fingerprint of the new outer
+// certificate.  Error is "" if the command was successful.
+type SocketCommandCertRotateReply struct {
+	Fingerprint string `json:"fingerprint"`
+	Error       string `json:"error"`
+}
+
+// SocketCommandBackup writes an encrypted backup of the server state to
+// Filename, which must not exist.  The passphrase is never logged.
+type SocketCommandBackup struct {
+	Filename   string `json:"filename"`   // absolute path of the backup
+	Passphrase string `json:"passphrase"` // backup encryption passphrase
+}
+
+// SocketCommandBackupReply returns the size of the backup and the fingerprint
+// of the server identity that signed it.  Error is "" if the command was
+// successful.
+type SocketCommandBackupReply struct {
+	Size        int64  `json:"size"`
+	Fingerprint string `json:"fingerprint"`
+	Error       string `json:"error"`
+}
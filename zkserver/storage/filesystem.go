@@ -0,0 +1,964 @@
+// Copyright (c) 2016-2020 Company 0, LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package storage
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/companyzero/zkc/inidb"
+	"github.com/companyzero/zkc/rpc"
+	"github.com/companyzero/zkc/zkidentity"
+	xdr "github.com/davecgh/go-xdr/xdr2"
+)
+
+const (
+	CacheDir             = "cache"
+	UserIdentityFilename = "user.ini"
+	DevicesFilename      = "devices.ini"
+
+	PendingDir     = "pending"
+	PendingFile    = "pending.ini"
+	RendezvousDir  = "rendezvous"
+	RendezvousFile = "rendezvous.ini"
+)
+
+var (
+	PendingPath    = path.Join(PendingDir, PendingFile)
+	RendezvousPath = path.Join(RendezvousDir, RendezvousFile)
+)
+
+// Filesystem stores zkserver state in a directory tree.  Every account has a
+// directory in users that is named after the hex encoded identity and that
+// contains a user.ini and a cache directory with one file per message.
+// Disabled accounts are prefixed with a '.'.  Rendezvous records and tokens
+// are stored in inidb files in root.
+type Filesystem struct {
+	users string // user home directories
+	root  string // root directory for zkserver
+
+	// inidbs are reopened on every access because external tools write to
+	// them as well.  The mutex serializes access from within zkserver.
+	sync.Mutex
+
+	// writes hold a read lock for their duration so that Snapshot can
+	// hold them off.
+	writes sync.RWMutex
+}
+
+var _ Backend = (*Filesystem)(nil)
+
+// NewFilesystem returns a Filesystem backend that stores accounts in users and
+// rendezvous and pending databases in root.
+func NewFilesystem(users, root string) (*Filesystem, error) {
+	if users == "" || root == "" {
+		return nil, fmt.Errorf("must provide root directory")
+	}
+
+	err := os.MkdirAll(users, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Filesystem{
+		users: users,
+		root:  root,
+	}, nil
+}
+
+// accountDirDisabled return the account directory for a given disabled
+// identity.
+func (f *Filesystem) accountDirDisabled(id [zkidentity.IdentitySize]byte) string {
+	return path.Join(f.users, "."+hex.EncodeToString(id[:]))
+}
+
+// accountDir return the account directory for a given identity.
+func (f *Filesystem) accountDir(id [zkidentity.IdentitySize]byte) string {
+	return path.Join(f.users, hex.EncodeToString(id[:]))
+}
+
+// dir returns the enabled account directory if it exists and the disabled
+// one otherwise.
+func (f *Filesystem) dir(id [zkidentity.IdentitySize]byte) string {
+	dir := f.accountDir(id)
+	if _, err := os.Stat(dir); err == nil {
+		return dir
+	}
+	return f.accountDirDisabled(id)
+}
+
+func exists(filename string) bool {
+	_, err := os.Stat(filename)
+	return err == nil
+}
+
+// IdentityFromDir returns the identity that corresponds to an account
+// directory name.  Disabled account directories are prefixed with a '.'.
+func IdentityFromDir(name string) ([zkidentity.IdentitySize]byte, bool) {
+	var id [zkidentity.IdentitySize]byte
+	b, err := hex.DecodeString(strings.TrimPrefix(name, "."))
+	if err != nil || len(b) != zkidentity.IdentitySize {
+		return id, false
+	}
+	copy(id[:], b)
+	return id, true
+}
+
+// CreateIdentity creates all directories and files associated with an
+// account.
+func (f *Filesystem) CreateIdentity(pid zkidentity.PublicIdentity, force bool) error {
+	f.writes.RLock()
+	defer f.writes.RUnlock()
+
+	// make sure account doesn't exist
+	accountName := f.accountDir(pid.Identity)
+	if !force && (exists(accountName) ||
+		exists(f.accountDirDisabled(pid.Identity))) {
+		return fmt.Errorf("%v: %w", accountName, ErrExists)
+	}
+
+	// open user db
+	user, err := inidb.New(path.Join(accountName, UserIdentityFilename),
+		true, 10)
+	if err != nil && !errors.Is(err, inidb.ErrCreated) {
+		return fmt.Errorf("could not open userdb: %v", err)
+	}
+
+	// save public identity
+	var b bytes.Buffer
+	_, err = xdr.Marshal(&b, pid)
+	if err != nil {
+		return fmt.Errorf("create account Marshal PublicIdentity failed")
+	}
+	err = user.Set("", "identity",
+		base64.StdEncoding.EncodeToString(b.Bytes()))
+	if err != nil {
+		return fmt.Errorf("could not insert record identity: %v", err)
+	}
+	err = user.Save()
+	if err != nil {
+		return fmt.Errorf("could not save user: %v", err)
+	}
+
+	// make additional directories
+	err = os.Mkdir(path.Join(accountName, CacheDir), 0700)
+	if err != nil && !os.IsExist(err) {
+		return fmt.Errorf("could not create cache directory: %v", err)
+	}
+
+	return nil
+}
+
+// GetIdentity reads the user.ini of an enabled or disabled account.
+func (f *Filesystem) GetIdentity(id [zkidentity.IdentitySize]byte) (*IdentityRecord, error) {
+	ir := IdentityRecord{}
+	dir := f.accountDir(id)
+	if !exists(dir) {
+		dir = f.accountDirDisabled(id)
+		if !exists(dir) {
+			return nil, ErrNotFound
+		}
+		ir.Disabled = true
+	}
+
+	user, err := inidb.New(path.Join(dir, UserIdentityFilename), false, 10)
+	if err != nil {
+		return nil, fmt.Errorf("could not open userdb: %v", err)
+	}
+	err = userIdentity(user, &ir.Identity)
+	if err != nil {
+		return nil, err
+	}
+	listed, err := user.Get("", "listed")
+	ir.Listed = err == nil && listed == "1"
+	hidden, err := user.Get("", "hidden")
+	ir.Hidden = err == nil && hidden == "1"
+	unlisted, err := user.Get("", "unlisted")
+	ir.Unlisted = err == nil && unlisted == "1"
+	nick, err := user.Get("", "nick")
+	if err == nil {
+		ir.Nick = nick
+	}
+
+	return &ir, nil
+}
+
+// userIdentity decodes the identity record of a user.ini.
+func userIdentity(user *inidb.INIDB, pid *zkidentity.PublicIdentity) error {
+	b64, err := user.Get("", "identity")
+	if err != nil {
+		return fmt.Errorf("could not get user: %v", err)
+	}
+	blob, err := base64.StdEncoding.DecodeString(b64)
+	if err != nil {
+		return fmt.Errorf("could not decode user: %v", err)
+	}
+	br := bytes.NewReader(blob)
+	_, err = xdr.Unmarshal(br, pid)
+	if err != nil {
+		return fmt.Errorf("could not unmarshal user: %v", err)
+	}
+	return nil
+}
+
+// Identities returns the identities of all account directories.
+func (f *Filesystem) Identities() ([][zkidentity.IdentitySize]byte, error) {
+	fi, err := ioutil.ReadDir(f.users)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([][zkidentity.IdentitySize]byte, 0, len(fi))
+	for _, v := range fi {
+		if !v.IsDir() {
+			continue
+		}
+		id, ok := IdentityFromDir(v.Name())
+		if !ok {
+			continue
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, nil
+}
+
+// SetListed sets or removes the listed record in user.ini.
+func (f *Filesystem) SetListed(id [zkidentity.IdentitySize]byte, listed bool) error {
+	f.writes.RLock()
+	defer f.writes.RUnlock()
+
+	accountName := f.accountDir(id)
+	if !exists(accountName) {
+		return ErrNotFound
+	}
+	user, err := inidb.New(path.Join(accountName, UserIdentityFilename),
+		false, 10)
+	if err != nil {
+		return fmt.Errorf("could not open userdb: %v", err)
+	}
+
+	if listed {
+		err = user.Set("", "listed", "1")
+	} else {
+		err = user.Del("", "listed")
+	}
+	if err != nil {
+		return fmt.Errorf("could not set listed: %v", err)
+	}
+	err = user.Save()
+	if err != nil {
+		return fmt.Errorf("could not save user: %v", err)
+	}
+
+	return nil
+}
+
+// setUser sets or, if value is empty, removes a record in the user.ini of an
+// enabled or disabled account.
+func (f *Filesystem) setUser(id [zkidentity.IdentitySize]byte, key, value string) error {
+	f.writes.RLock()
+	defer f.writes.RUnlock()
+
+	accountName := f.dir(id)
+	if !exists(accountName) {
+		return ErrNotFound
+	}
+	user, err := inidb.New(path.Join(accountName, UserIdentityFilename),
+		false, 10)
+	if err != nil {
+		return fmt.Errorf("could not open userdb: %v", err)
+	}
+
+	if value != "" {
+		err = user.Set("", key, value)
+	} else if _, err = user.Get("", key); err != nil {
+		return nil
+	} else {
+		err = user.Del("", key)
+	}
+	if err != nil {
+		return fmt.Errorf("could not set %v: %v", key, err)
+	}
+	err = user.Save()
+	if err != nil {
+		return fmt.Errorf("could not save user: %v", err)
+	}
+
+	return nil
+}
+
+// SetNick sets or removes the nick record in user.ini.
+func (f *Filesystem) SetNick(id [zkidentity.IdentitySize]byte, nick string) error {
+	return f.setUser(id, "nick", nick)
+}
+
+// SetHidden sets or removes the hidden record in user.ini.
+func (f *Filesystem) SetHidden(id [zkidentity.IdentitySize]byte, hidden bool) error {
+	if hidden {
+		return f.setUser(id, "hidden", "1")
+	}
+	return f.setUser(id, "hidden", "")
+}
+
+// SetUnlisted sets or removes the unlisted record in user.ini.
+func (f *Filesystem) SetUnlisted(id [zkidentity.IdentitySize]byte, unlisted bool) error {
+	if unlisted {
+		return f.setUser(id, "unlisted", "1")
+	}
+	return f.setUser(id, "unlisted", "")
+}
+
+// DelIdentity overwrites all files of an account with zeros and removes the
+// account directory.
+func (f *Filesystem) DelIdentity(id [zkidentity.IdentitySize]byte) error {
+	f.writes.RLock()
+	defer f.writes.RUnlock()
+
+	accountName := f.dir(id)
+	if !exists(accountName) {
+		return ErrNotFound
+	}
+
+	f.Lock()
+	defer f.Unlock()
+
+	err := filepath.Walk(accountName, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+		return wipe(p, fi.Size())
+	})
+	if err != nil {
+		return fmt.Errorf("could not wipe account: %v", err)
+	}
+
+	return os.RemoveAll(accountName)
+}
+
+// wipe overwrites the first size bytes of a file with zeros.
+func wipe(filename string, size int64) error {
+	fd, err := os.OpenFile(filename, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	_, err = io.CopyN(fd, zeroReader{}, size)
+	if err != nil {
+		fd.Close()
+		return err
+	}
+	err = fd.Sync()
+	if err != nil {
+		fd.Close()
+		return err
+	}
+	return fd.Close()
+}
+
+// zeroReader is an endless stream of zeros.
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+// SetDisabled renames the account directory.
+func (f *Filesystem) SetDisabled(id [zkidentity.IdentitySize]byte, disabled bool) error {
+	f.writes.RLock()
+	defer f.writes.RUnlock()
+
+	accountNameDisabled := f.accountDirDisabled(id)
+	accountName := f.accountDir(id)
+
+	if disabled {
+		if exists(accountNameDisabled) {
+			return fmt.Errorf("account already disabled: %v",
+				accountNameDisabled)
+		}
+		if !exists(accountName) {
+			return fmt.Errorf("account doesn't exist: %v",
+				accountName)
+		}
+		return os.Rename(accountName, accountNameDisabled)
+	}
+
+	if !exists(accountNameDisabled) {
+		return fmt.Errorf("account not disable: %v",
+			accountNameDisabled)
+	}
+	if exists(accountName) {
+		return fmt.Errorf("account already enabled: %v",
+			accountName)
+	}
+	return os.Rename(accountNameDisabled, accountName)
+}
+
+// PutMessage writes a message file into the cache directory of an enabled
+// account.
+func (f *Filesystem) PutMessage(id [zkidentity.IdentitySize]byte, name string, msg []byte) error {
+	f.writes.RLock()
+	defer f.writes.RUnlock()
+
+	accountName := f.accountDir(id)
+	if !exists(accountName) {
+		if exists(f.accountDirDisabled(id)) {
+			return ErrDisabled
+		}
+		return ErrNotFound
+	}
+
+	fullPath := path.Join(accountName, CacheDir, name)
+	if exists(fullPath) {
+		return fmt.Errorf("duplicate filename %v: %w", name, ErrExists)
+	}
+
+	return ioutil.WriteFile(fullPath, msg, 0600)
+}
+
+// GetMessage reads a message file.
+func (f *Filesystem) GetMessage(id [zkidentity.IdentitySize]byte, name string) ([]byte, error) {
+	msg, err := ioutil.ReadFile(path.Join(f.dir(id), CacheDir, name))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("%v: %w", name, ErrNotFound)
+	}
+	return msg, err
+}
+
+// DelMessage removes a message file and its acknowledgements.
+func (f *Filesystem) DelMessage(id [zkidentity.IdentitySize]byte, name string) error {
+	f.writes.RLock()
+	defer f.writes.RUnlock()
+
+	dir := f.dir(id)
+	err := os.Remove(path.Join(dir, CacheDir, name))
+	if os.IsNotExist(err) {
+		return fmt.Errorf("%v: %w", name, ErrNotFound)
+	} else if err != nil {
+		return err
+	}
+
+	// only accounts with several devices have acknowledgements
+	if !exists(path.Join(dir, DevicesFilename)) {
+		return nil
+	}
+
+	f.Lock()
+	defer f.Unlock()
+
+	devices, err := f.openDevices(id)
+	if err != nil {
+		return err
+	}
+	if _, err := devices.Get("acks", name); err != nil {
+		return nil
+	}
+	err = devices.Del("acks", name)
+	if err != nil {
+		return err
+	}
+	return devices.Save()
+}
+
+// Messages lists the cache directory of an account.
+func (f *Filesystem) Messages(id [zkidentity.IdentitySize]byte) ([]MessageInfo, error) {
+	fi, err := ioutil.ReadDir(path.Join(f.dir(id), CacheDir))
+	if err != nil {
+		return nil, err
+	}
+
+	mi := make([]MessageInfo, 0, len(fi))
+	for _, v := range fi {
+		mi = append(mi, MessageInfo{
+			Name: v.Name(),
+			Size: v.Size(),
+		})
+	}
+	sort.Slice(mi, func(i, j int) bool { return mi[i].Name < mi[j].Name })
+
+	return mi, nil
+}
+
+// Devices are stored in devices.ini of an account.  The devices section maps
+// hex encoded devices to the unix time they were last seen and the acks
+// section maps messages to a comma separated list of hex encoded devices.
+
+// openDevices opens the devices db of an account and creates it if it
+// doesn't exist.  This function must be called with the mutex held.
+func (f *Filesystem) openDevices(id [zkidentity.IdentitySize]byte) (*inidb.INIDB, error) {
+	dir := f.dir(id)
+	if !exists(dir) {
+		return nil, ErrNotFound
+	}
+	db, err := inidb.New(path.Join(dir, DevicesFilename), true, 0)
+	if err != nil && !errors.Is(err, inidb.ErrCreated) {
+		return nil, err
+	}
+	return db, nil
+}
+
+// decodeDevice decodes a hex encoded device.
+func decodeDevice(s string) (DeviceID, error) {
+	var device DeviceID
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) != DeviceIDSize {
+		return device, fmt.Errorf("invalid device: %v", s)
+	}
+	copy(device[:], b)
+	return device, nil
+}
+
+// Devices returns the devices recorded in devices.ini and the unix time they
+// were last seen.  Records that can not be decoded are skipped.
+func (f *Filesystem) Devices(id [zkidentity.IdentitySize]byte) (map[DeviceID]int64, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	devices, err := f.openDevices(id)
+	if err != nil {
+		return nil, err
+	}
+	records := devices.Records("devices")
+	all := make(map[DeviceID]int64, len(records))
+	for k, v := range records {
+		device, err := decodeDevice(k)
+		if err != nil {
+			continue
+		}
+		// a corrupt time stamp makes the device look idle
+		all[device], _ = strconv.ParseInt(v, 10, 64)
+	}
+	return all, nil
+}
+
+// PutDevice records a device in devices.ini or updates the time it was last
+// seen.
+func (f *Filesystem) PutDevice(id [zkidentity.IdentitySize]byte, device DeviceID, lastSeen int64) error {
+	f.writes.RLock()
+	defer f.writes.RUnlock()
+
+	f.Lock()
+	defer f.Unlock()
+
+	devices, err := f.openDevices(id)
+	if err != nil {
+		return err
+	}
+	devices.NewTable("devices")
+	err = devices.Set("devices", hex.EncodeToString(device[:]),
+		strconv.FormatInt(lastSeen, 10))
+	if err != nil {
+		return err
+	}
+	return devices.Save()
+}
+
+// DelDevice removes a device from devices.ini.  Its acknowledgements are
+// kept until the messages are deleted.
+func (f *Filesystem) DelDevice(id [zkidentity.IdentitySize]byte, device DeviceID) error {
+	f.writes.RLock()
+	defer f.writes.RUnlock()
+
+	f.Lock()
+	defer f.Unlock()
+
+	devices, err := f.openDevices(id)
+	if err != nil {
+		return err
+	}
+	ds := hex.EncodeToString(device[:])
+	if _, err = devices.Get("devices", ds); err != nil {
+		return ErrNotFound
+	}
+	err = devices.Del("devices", ds)
+	if err != nil {
+		return err
+	}
+	return devices.Save()
+}
+
+// AckMessage adds device to the acknowledgements of a message in devices.ini.
+// The message file must exist.
+func (f *Filesystem) AckMessage(id [zkidentity.IdentitySize]byte, name string, device DeviceID) error {
+	f.writes.RLock()
+	defer f.writes.RUnlock()
+
+	if !exists(path.Join(f.dir(id), CacheDir, name)) {
+		return fmt.Errorf("%v: %w", name, ErrNotFound)
+	}
+
+	f.Lock()
+	defer f.Unlock()
+
+	devices, err := f.openDevices(id)
+	if err != nil {
+		return err
+	}
+	ds := hex.EncodeToString(device[:])
+	v, err := devices.Get("acks", name)
+	if err == nil {
+		for _, acked := range strings.Split(v, ",") {
+			if acked == ds {
+				return nil
+			}
+		}
+		ds = v + "," + ds
+	}
+	devices.NewTable("acks")
+	err = devices.Set("acks", name, ds)
+	if err != nil {
+		return err
+	}
+	return devices.Save()
+}
+
+// MessageAcks returns the devices that acknowledged a message according to
+// devices.ini.
+func (f *Filesystem) MessageAcks(id [zkidentity.IdentitySize]byte, name string) ([]DeviceID, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	devices, err := f.openDevices(id)
+	if err != nil {
+		return nil, err
+	}
+	v, err := devices.Get("acks", name)
+	if err != nil {
+		return nil, nil
+	}
+	var acks []DeviceID
+	for _, ds := range strings.Split(v, ",") {
+		device, err := decodeDevice(ds)
+		if err != nil {
+			return nil, err
+		}
+		acks = append(acks, device)
+	}
+	return acks, nil
+}
+
+// openDB opens an inidb in root and creates it if it doesn't exist.
+func (f *Filesystem) openDB(filename string) (*inidb.INIDB, error) {
+	db, err := inidb.New(path.Join(f.root, filename), true, 10)
+	if err != nil && !errors.Is(err, inidb.ErrCreated) {
+		return nil, err
+	}
+	return db, nil
+}
+
+// encodeRendezvous encodes a rendezvous record into a rendezvous db value.
+// value = base64(xdr(Rendezvous))
+func encodeRendezvous(r Rendezvous) (string, error) {
+	var b bytes.Buffer
+	_, err := xdr.Marshal(&b, r)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(b.Bytes()), nil
+}
+
+// decodeRendezvous decodes a rendezvous db value.  The first two fields of
+// Rendezvous mirror rpc.Rendezvous, which used to be stored verbatim.
+func decodeRendezvous(v string) (*Rendezvous, error) {
+	rzXDR, err := base64.StdEncoding.DecodeString(v)
+	if err != nil {
+		return nil, fmt.Errorf("base64decode: %v", err)
+	}
+	r := Rendezvous{} // deliberate instantiate
+	br := bytes.NewReader(rzXDR)
+	_, err = xdr.Unmarshal(br, &r)
+	// Special error handling because of prior upgrade where we added
+	// Expires and friends to the record.  A short read is therefore an
+	// error we must ignore.
+	if err != nil && !rpc.ShortRead(err) {
+		return nil, fmt.Errorf("unmarshal: %v", err)
+	}
+
+	return &r, nil
+}
+
+// GetRendezvous reads a record from the rendezvous db.
+func (f *Filesystem) GetRendezvous(token string) (*Rendezvous, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	rz, err := f.openDB(RendezvousPath)
+	if err != nil {
+		return nil, err
+	}
+	v, err := rz.Get("", token)
+	if err != nil {
+		return nil, ErrNotFound
+	}
+	return decodeRendezvous(v)
+}
+
+// PutRendezvous adds or replaces a record in the rendezvous db.
+func (f *Filesystem) PutRendezvous(token string, r Rendezvous) error {
+	f.writes.RLock()
+	defer f.writes.RUnlock()
+
+	f.Lock()
+	defer f.Unlock()
+
+	rz, err := f.openDB(RendezvousPath)
+	if err != nil {
+		return err
+	}
+	v, err := encodeRendezvous(r)
+	if err != nil {
+		return err
+	}
+	err = rz.Set("", token, v)
+	if err != nil {
+		return err
+	}
+	return rz.Save()
+}
+
+// DelRendezvous removes a record from the rendezvous db.
+func (f *Filesystem) DelRendezvous(token string) error {
+	f.writes.RLock()
+	defer f.writes.RUnlock()
+
+	f.Lock()
+	defer f.Unlock()
+
+	rz, err := f.openDB(RendezvousPath)
+	if err != nil {
+		return err
+	}
+	if _, err = rz.Get("", token); err != nil {
+		return ErrNotFound
+	}
+	err = rz.Del("", token)
+	if err != nil {
+		return err
+	}
+	return rz.Save()
+}
+
+// AllRendezvous reads every record from the rendezvous db.  Records that can
+// not be decoded are returned as a zero Rendezvous.
+func (f *Filesystem) AllRendezvous() (map[string]Rendezvous, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	rz, err := f.openDB(RendezvousPath)
+	if err != nil {
+		return nil, err
+	}
+	records := rz.Records("")
+	all := make(map[string]Rendezvous, len(records))
+	for k, v := range records {
+		r, err := decodeRendezvous(v)
+		if err != nil {
+			all[k] = Rendezvous{}
+			continue
+		}
+		all[k] = *r
+	}
+	return all, nil
+}
+
+// Tokens are stored as token = expiration unix time,uses,nick.  Tokens that
+// predate use counts consist of the expiration time only and are good for a
+// single use.
+
+func encodeToken(t Token) string {
+	return fmt.Sprintf("%v,%v,%v", t.Expires, t.Uses, t.Nick)
+}
+
+func decodeToken(v string) (*Token, error) {
+	var (
+		t   Token
+		err error
+	)
+	f := strings.SplitN(v, ",", 3)
+	t.Expires, err = strconv.ParseInt(f[0], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("corrupt token: %v", err)
+	}
+	if len(f) == 1 {
+		t.Uses = 1
+		return &t, nil
+	}
+	if len(f) != 3 {
+		return nil, fmt.Errorf("corrupt token: %v", v)
+	}
+	t.Uses, err = strconv.ParseUint(f[1], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("corrupt token: %v", err)
+	}
+	t.Nick = f[2]
+	return &t, nil
+}
+
+// GetToken reads a token from the pending db.
+func (f *Filesystem) GetToken(token string) (*Token, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	pending, err := f.openDB(PendingPath)
+	if err != nil {
+		return nil, err
+	}
+	v, err := pending.Get("", token)
+	if err != nil {
+		return nil, ErrNotFound
+	}
+	return decodeToken(v)
+}
+
+// PutToken adds or replaces a token in the pending db.
+func (f *Filesystem) PutToken(token string, t Token) error {
+	f.writes.RLock()
+	defer f.writes.RUnlock()
+
+	f.Lock()
+	defer f.Unlock()
+
+	pending, err := f.openDB(PendingPath)
+	if err != nil {
+		return err
+	}
+	err = pending.Set("", token, encodeToken(t))
+	if err != nil {
+		return err
+	}
+	return pending.Save()
+}
+
+// DelToken removes a token from the pending db.
+func (f *Filesystem) DelToken(token string) error {
+	f.writes.RLock()
+	defer f.writes.RUnlock()
+
+	f.Lock()
+	defer f.Unlock()
+
+	pending, err := f.openDB(PendingPath)
+	if err != nil {
+		return err
+	}
+	if _, err = pending.Get("", token); err != nil {
+		return ErrNotFound
+	}
+	err = pending.Del("", token)
+	if err != nil {
+		return err
+	}
+	return pending.Save()
+}
+
+// Tokens reads every token from the pending db.  Tokens that can not be
+// decoded are returned as a zero Token.
+func (f *Filesystem) Tokens() (map[string]Token, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	pending, err := f.openDB(PendingPath)
+	if err != nil {
+		return nil, err
+	}
+	records := pending.Records("")
+	all := make(map[string]Token, len(records))
+	for k, v := range records {
+		t, err := decodeToken(v)
+		if err != nil {
+			all[k] = Token{}
+			continue
+		}
+		all[k] = *t
+	}
+	return all, nil
+}
+
+// Snapshot calls fn while all writes are held off, so that fn can copy a
+// consistent state of the directory trees.  Reads proceed as usual.
+func (f *Filesystem) Snapshot(fn func() error) error {
+	f.writes.Lock()
+	defer f.writes.Unlock()
+	return fn()
+}
+
+// syncFile commits a file or directory to stable storage.  Files that do not
+// exist are ignored.
+func syncFile(filename string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
+
+// Close waits for pending writes and commits all inidb files, messages and
+// the directories they are in to stable storage.
+func (f *Filesystem) Close() error {
+	f.writes.Lock()
+	defer f.writes.Unlock()
+	f.Lock()
+	defer f.Unlock()
+
+	fi, err := ioutil.ReadDir(f.users)
+	if err != nil {
+		return err
+	}
+	filenames := make([]string, 0, 4*len(fi)+5)
+	for _, v := range fi {
+		if !v.IsDir() {
+			continue
+		}
+		dir := path.Join(f.users, v.Name())
+		cache := path.Join(dir, CacheDir)
+		messages, err := ioutil.ReadDir(cache)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		for _, m := range messages {
+			filenames = append(filenames, path.Join(cache, m.Name()))
+		}
+		filenames = append(filenames,
+			path.Join(dir, UserIdentityFilename),
+			path.Join(dir, DevicesFilename),
+			cache,
+			dir)
+	}
+	filenames = append(filenames,
+		path.Join(f.root, PendingPath),
+		path.Join(f.root, PendingDir),
+		path.Join(f.root, RendezvousPath),
+		path.Join(f.root, RendezvousDir),
+		f.users)
+
+	for _, v := range filenames {
+		err = syncFile(v)
+		if err != nil {
+			return fmt.Errorf("could not sync %v: %v", v, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,410 @@
+// Copyright (c) 2020 Company 0, LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package storage
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/companyzero/zkc/inidb"
+	"github.com/companyzero/zkc/zkidentity"
+)
+
+// Problem is an inconsistency that Check found in a users directory.
+type Problem struct {
+	Path   string // offending file or directory
+	Reason string // what is wrong with it
+	Action string // how it was repaired, empty if it was not
+}
+
+func (p Problem) String() string {
+	if p.Action == "" {
+		return fmt.Sprintf("%v: %v", p.Path, p.Reason)
+	}
+	return fmt.Sprintf("%v: %v, %v", p.Path, p.Reason, p.Action)
+}
+
+// CheckOptions control what Check looks at and whether it repairs what it
+// finds.
+type CheckOptions struct {
+	// Message returns an error if a message file can not be decoded.
+	// Messages are not checked if it is nil.
+	Message func([]byte) error
+
+	// Repair moves unusable accounts, messages and files to Quarantine,
+	// restores user.ini from its journal, creates missing cache
+	// directories and removes invalid devices.ini records.  Nothing is
+	// ever deleted.
+	Repair     bool
+	Quarantine string
+}
+
+// checker is the state of a Check.
+type checker struct {
+	users    string
+	o        CheckOptions
+	problems []Problem
+}
+
+// Check walks a Filesystem users directory and reports what zkserver would
+// trip over: entries that are not accounts, accounts that are both enabled
+// and disabled, accounts without a valid user.ini, incomplete inidb saves,
+// messages that can not be decoded and devices.ini records that are invalid
+// or acknowledge messages that do not exist.  Check must not be called while
+// zkserver is running.
+func Check(users string, o CheckOptions) ([]Problem, error) {
+	if o.Repair && o.Quarantine == "" {
+		return nil, fmt.Errorf("must provide quarantine directory")
+	}
+
+	c := checker{
+		users: path.Clean(users),
+		o:     o,
+	}
+	fi, err := ioutil.ReadDir(c.users)
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range fi {
+		p := path.Join(c.users, v.Name())
+		id, ok := IdentityFromDir(v.Name())
+		if !ok || !v.IsDir() {
+			c.problem(p, "not an account directory", nil)
+			continue
+		}
+
+		// the server only sees the enabled account
+		if strings.HasPrefix(v.Name(), ".") &&
+			exists(path.Join(c.users, hex.EncodeToString(id[:]))) {
+			err = c.problem(p, "account is also enabled",
+				c.quarantine(p))
+			if err != nil {
+				return nil, err
+			}
+			if c.o.Repair {
+				continue
+			}
+		}
+
+		err = c.account(p, id)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return c.problems, nil
+}
+
+// problem records a problem with p and, when repairing, fixes it with fix.
+func (c *checker) problem(p, reason string, fix func() (string, error)) error {
+	pr := Problem{
+		Path:   p,
+		Reason: reason,
+	}
+	if c.o.Repair && fix != nil {
+		action, err := fix()
+		if err != nil {
+			return fmt.Errorf("could not repair %v: %v", p, err)
+		}
+		pr.Action = action
+	}
+	c.problems = append(c.problems, pr)
+	return nil
+}
+
+// quarantine returns a fix that moves p to the same place below the
+// quarantine directory as it has below the users directory.
+func (c *checker) quarantine(p string) func() (string, error) {
+	return func() (string, error) {
+		target := path.Join(c.o.Quarantine,
+			strings.TrimPrefix(p, c.users+"/"))
+		err := os.MkdirAll(path.Dir(target), 0700)
+		if err != nil {
+			return "", err
+		}
+		err = os.Rename(p, target)
+		if err != nil {
+			return "", err
+		}
+		return "moved to " + target, nil
+	}
+}
+
+// account checks an account directory.
+func (c *checker) account(dir string, id [zkidentity.IdentitySize]byte) error {
+	quarantined, err := c.user(dir, id)
+	if err != nil || quarantined {
+		return err
+	}
+
+	// what is left of interrupted inidb saves
+	fi, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, v := range fi {
+		if !isInidbTemp(v.Name(), UserIdentityFilename) &&
+			!isInidbTemp(v.Name(), DevicesFilename) {
+			continue
+		}
+		p := path.Join(dir, v.Name())
+		err = c.problem(p, "incomplete inidb save", c.quarantine(p))
+		if err != nil {
+			return err
+		}
+	}
+
+	messages, err := c.cache(dir)
+	if err != nil {
+		return err
+	}
+	return c.devices(dir, messages)
+}
+
+// isInidbTemp returns true if name is a temporary file that inidb writes
+// filename to before renaming it.
+func isInidbTemp(name, filename string) bool {
+	suffix := strings.TrimPrefix(name, filename)
+	if suffix == name || suffix == "" {
+		return false
+	}
+	_, err := strconv.ParseUint(suffix, 10, 64)
+	return err == nil
+}
+
+// checkUser returns an error if filename is not a valid user.ini of id.
+func checkUser(filename string, id [zkidentity.IdentitySize]byte) error {
+	user, err := inidb.New(filename, false, 10)
+	if err != nil {
+		return err
+	}
+	var pid zkidentity.PublicIdentity
+	err = userIdentity(user, &pid)
+	if err != nil {
+		return err
+	}
+	if pid.Identity != id {
+		return fmt.Errorf("identity %x does not match account",
+			pid.Identity)
+	}
+	return nil
+}
+
+// user checks the user.ini of an account.  An invalid one is restored from
+// the newest valid copy that inidb kept, either in its journal or in a
+// temporary file of an interrupted save.  Without one the account is
+// unusable and quarantined, in which case user returns true.
+func (c *checker) user(dir string, id [zkidentity.IdentitySize]byte) (bool, error) {
+	filename := path.Join(dir, UserIdentityFilename)
+	err := checkUser(filename, id)
+	if err == nil {
+		return false, nil
+	}
+	reason := fmt.Sprintf("invalid %v: %v", UserIdentityFilename, err)
+	if !exists(filename) {
+		reason = "missing " + UserIdentityFilename
+	}
+
+	fi, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return false, err
+	}
+	sort.SliceStable(fi, func(i, j int) bool {
+		return fi[i].ModTime().After(fi[j].ModTime())
+	})
+	var good string
+	for _, v := range fi {
+		if v.Name() == UserIdentityFilename || !v.Mode().IsRegular() ||
+			!strings.HasPrefix(v.Name(), UserIdentityFilename) {
+			continue
+		}
+		if checkUser(path.Join(dir, v.Name()), id) == nil {
+			good = path.Join(dir, v.Name())
+			break
+		}
+	}
+
+	if good == "" {
+		err = c.problem(dir, reason+" and no valid copy",
+			c.quarantine(dir))
+		return c.o.Repair, err
+	}
+	return false, c.problem(filename, reason, func() (string, error) {
+		if exists(filename) {
+			_, err := c.quarantine(filename)()
+			if err != nil {
+				return "", err
+			}
+		}
+		blob, err := ioutil.ReadFile(good)
+		if err != nil {
+			return "", err
+		}
+		err = ioutil.WriteFile(filename, blob, 0600)
+		if err != nil {
+			return "", err
+		}
+		return "restored from " + path.Base(good), nil
+	})
+}
+
+// cache checks the messages of an account and returns the valid ones.
+func (c *checker) cache(dir string) (map[string]bool, error) {
+	cache := path.Join(dir, CacheDir)
+	fi, err := os.Lstat(cache)
+	if os.IsNotExist(err) {
+		return nil, c.problem(cache, "missing cache directory",
+			func() (string, error) {
+				return "created", os.Mkdir(cache, 0700)
+			})
+	} else if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return nil, c.problem(cache, "cache is not a directory",
+			func() (string, error) {
+				action, err := c.quarantine(cache)()
+				if err != nil {
+					return "", err
+				}
+				return action + " and created",
+					os.Mkdir(cache, 0700)
+			})
+	}
+
+	entries, err := ioutil.ReadDir(cache)
+	if err != nil {
+		return nil, err
+	}
+	messages := make(map[string]bool, len(entries))
+	for _, v := range entries {
+		p := path.Join(cache, v.Name())
+		reason := ""
+		if !v.Mode().IsRegular() {
+			reason = "not a message"
+		} else if c.o.Message != nil {
+			blob, err := ioutil.ReadFile(p)
+			if err != nil {
+				return nil, err
+			}
+			err = c.o.Message(blob)
+			if err != nil {
+				reason = fmt.Sprintf("invalid message: %v", err)
+			}
+		}
+		if reason != "" {
+			err = c.problem(p, reason, c.quarantine(p))
+			if err != nil {
+				return nil, err
+			}
+			if c.o.Repair {
+				continue
+			}
+		}
+		messages[v.Name()] = true
+	}
+
+	return messages, nil
+}
+
+// devices checks the devices.ini of an account.  Invalid records and
+// acknowledgements of messages that are not in the cache are removed.  A
+// devices.ini that can not be read is quarantined; the server creates a new
+// one when devices log in.
+func (c *checker) devices(dir string, messages map[string]bool) error {
+	filename := path.Join(dir, DevicesFilename)
+	if !exists(filename) {
+		return nil
+	}
+	db, err := inidb.New(filename, false, 0)
+	if err != nil {
+		return c.problem(filename, fmt.Sprintf("invalid %v: %v",
+			DevicesFilename, err), c.quarantine(filename))
+	}
+
+	changed := false
+	remove := func(table, key string) func() (string, error) {
+		return func() (string, error) {
+			changed = true
+			return "removed", db.Del(table, key)
+		}
+	}
+
+	devices := db.Records("devices")
+	for _, k := range sortedKeys(devices) {
+		_, err := decodeDevice(k)
+		if err == nil {
+			_, err = strconv.ParseInt(devices[k], 10, 64)
+		}
+		if err == nil {
+			continue
+		}
+		err = c.problem(filename, "invalid device "+k,
+			remove("devices", k))
+		if err != nil {
+			return err
+		}
+	}
+
+	acks := db.Records("acks")
+	for _, k := range sortedKeys(acks) {
+		if !messages[k] {
+			err = c.problem(filename, "acknowledgement of missing "+
+				"message "+k, remove("acks", k))
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		var valid []string
+		for _, ds := range strings.Split(acks[k], ",") {
+			if _, err := decodeDevice(ds); err == nil {
+				valid = append(valid, ds)
+			}
+		}
+		if len(valid) == len(strings.Split(acks[k], ",")) {
+			continue
+		}
+		fix := remove("acks", k)
+		if len(valid) > 0 {
+			fix = func() (string, error) {
+				changed = true
+				return "removed invalid devices",
+					db.Set("acks", k, strings.Join(valid, ","))
+			}
+		}
+		err = c.problem(filename, "invalid acknowledgement of message "+
+			k, fix)
+		if err != nil {
+			return err
+		}
+	}
+
+	if !changed {
+		return nil
+	}
+	err = db.Save()
+	if err != nil {
+		return fmt.Errorf("could not save %v: %v", filename, err)
+	}
+	return nil
+}
+
+// sortedKeys returns the keys of m in order.
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,219 @@
+// Copyright (c) 2020 Company 0, LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package storage
+
+import (
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/companyzero/zkc/zkidentity"
+)
+
+func TestCheck(t *testing.T) {
+	root, err := ioutil.TempDir("", "zkserver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	users := path.Join(root, "home")
+	f, err := NewFilesystem(users, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dirs := make(map[string]string)
+	for i, nick := range []string{"alice", "bob", "carol", "dave", "eve"} {
+		pid := zkidentity.PublicIdentity{Nick: nick}
+		pid.Identity[0] = byte(i + 1)
+		err = f.CreateIdentity(pid, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dirs[nick] = path.Join(users,
+			hex.EncodeToString(pid.Identity[:]))
+	}
+	write := func(filename, content string) {
+		t.Helper()
+		err := ioutil.WriteFile(filename, []byte(content), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// alice has a corrupt message, an incomplete save and stale and
+	// invalid device records
+	var alice [zkidentity.IdentitySize]byte
+	alice[0] = 1
+	device := DeviceID{1}
+	for _, name := range []string{"good", "bad", "gone"} {
+		err = f.PutMessage(alice, name, []byte(name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = f.AckMessage(alice, name, device)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = os.Remove(path.Join(dirs["alice"], CacheDir, "gone"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	write(path.Join(dirs["alice"], DevicesFilename),
+		"[devices]\n"+
+			hex.EncodeToString(device[:])+" = 1\n"+
+			"zz = 1\n"+
+			"[acks]\n"+
+			"good = "+hex.EncodeToString(device[:])+",zz\n"+
+			"bad = "+hex.EncodeToString(device[:])+"\n"+
+			"gone = "+hex.EncodeToString(device[:])+"\n")
+	write(path.Join(dirs["alice"], DevicesFilename+"123"), "[dev")
+
+	// bob's user.ini is corrupt but its journal has a valid copy
+	user := path.Join(dirs["bob"], UserIdentityFilename)
+	blob, err := ioutil.ReadFile(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	write(user+".20200101.000000.000000000", string(blob))
+	write(user, "identity = AAAA\n")
+
+	// carol is also disabled, dave has no user.ini and eve has no cache
+	disabled := path.Join(users, "."+path.Base(dirs["carol"]))
+	err = os.MkdirAll(path.Join(disabled, CacheDir), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blob, err = ioutil.ReadFile(path.Join(dirs["carol"],
+		UserIdentityFilename))
+	if err != nil {
+		t.Fatal(err)
+	}
+	write(path.Join(disabled, UserIdentityFilename), string(blob))
+	err = os.Remove(path.Join(dirs["dave"], UserIdentityFilename))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Remove(path.Join(dirs["eve"], CacheDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	write(path.Join(users, "README"), "")
+
+	o := CheckOptions{
+		Message: func(b []byte) error {
+			if string(b) == "bad" {
+				return errors.New("bad")
+			}
+			return nil
+		},
+		Quarantine: path.Join(root, "quarantine"),
+	}
+	expected := []Problem{
+		{Path: disabled, Reason: "account is also enabled"},
+		{Path: path.Join(dirs["alice"], DevicesFilename+"123"),
+			Reason: "incomplete inidb save"},
+		{Path: path.Join(dirs["alice"], CacheDir, "bad"),
+			Reason: "invalid message: bad"},
+		{Path: path.Join(dirs["alice"], DevicesFilename),
+			Reason: "invalid device zz"},
+		{Path: path.Join(dirs["alice"], DevicesFilename),
+			Reason: "acknowledgement of missing message gone"},
+		{Path: path.Join(dirs["alice"], DevicesFilename),
+			Reason: "invalid acknowledgement of message good"},
+		{Path: user, Reason: "invalid user.ini: could not unmarshal " +
+			"user"},
+		{Path: dirs["dave"],
+			Reason: "missing user.ini and no valid copy"},
+		{Path: path.Join(dirs["eve"], CacheDir),
+			Reason: "missing cache directory"},
+		{Path: path.Join(users, "README"),
+			Reason: "not an account directory"},
+	}
+	sortProblems := func(p []Problem) {
+		sort.SliceStable(p, func(i, j int) bool {
+			return p[i].Path < p[j].Path
+		})
+	}
+	sortProblems(expected)
+
+	// report only
+	problems, err := Check(users, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sortProblems(problems)
+	if len(problems) != len(expected) {
+		t.Fatalf("expected %v problems, got %v", len(expected),
+			problems)
+	}
+	for i := range expected {
+		if problems[i].Path != expected[i].Path ||
+			!strings.HasPrefix(problems[i].Reason,
+				expected[i].Reason) ||
+			problems[i].Action != "" {
+			t.Fatalf("expected %v, got %v", expected[i], problems[i])
+		}
+	}
+
+	// repair, the acknowledgement of the quarantined message goes as well
+	o.Repair = true
+	problems, err = Check(users, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != len(expected)+1 {
+		t.Fatalf("expected %v problems, got %v", len(expected)+1,
+			problems)
+	}
+	for _, p := range problems {
+		if p.Action == "" && p.Reason != "not an account directory" {
+			t.Fatalf("not repaired: %v", p)
+		}
+	}
+	for _, p := range []string{
+		path.Join(root, "quarantine", path.Base(disabled)),
+		path.Join(root, "quarantine", path.Base(dirs["dave"]), CacheDir),
+		path.Join(root, "quarantine", path.Base(dirs["alice"]),
+			CacheDir, "bad"),
+		path.Join(root, "quarantine", path.Base(dirs["bob"]),
+			UserIdentityFilename),
+		path.Join(dirs["eve"], CacheDir),
+	} {
+		if !exists(p) {
+			t.Fatalf("%v does not exist", p)
+		}
+	}
+	ir, err := f.GetIdentity([zkidentity.IdentitySize]byte{2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ir.Identity.Nick != "bob" {
+		t.Fatalf("unexpected identity: %v", ir.Identity.Nick)
+	}
+	acks, err := f.MessageAcks(alice, "good")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(acks) != 1 || acks[0] != device {
+		t.Fatalf("unexpected acks: %v", acks)
+	}
+
+	// only what is not ours is left
+	problems, err = Check(users, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != 1 ||
+		problems[0].Path != path.Join(users, "README") {
+		t.Fatalf("unexpected problems after repair: %v", problems)
+	}
+}
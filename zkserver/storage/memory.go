@@ -0,0 +1,386 @@
+// Copyright (c) 2020 Company 0, LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package storage
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/companyzero/zkc/zkidentity"
+)
+
+// memoryAccount is an account that is stored in memory.
+type memoryAccount struct {
+	record   IdentityRecord
+	messages map[string][]byte
+	devices  map[DeviceID]int64
+	acks     map[string][]DeviceID
+}
+
+// Memory stores zkserver state in memory.  All state is lost when the process
+// exits which makes it suitable for tests only.
+type Memory struct {
+	sync.Mutex
+	accounts   map[[zkidentity.IdentitySize]byte]*memoryAccount
+	rendezvous map[string]Rendezvous
+	tokens     map[string]Token
+}
+
+var _ Backend = (*Memory)(nil)
+
+// NewMemory returns an empty Memory backend.
+func NewMemory() *Memory {
+	return &Memory{
+		accounts:   make(map[[zkidentity.IdentitySize]byte]*memoryAccount),
+		rendezvous: make(map[string]Rendezvous),
+		tokens:     make(map[string]Token),
+	}
+}
+
+func (m *Memory) CreateIdentity(pid zkidentity.PublicIdentity, force bool) error {
+	m.Lock()
+	defer m.Unlock()
+
+	a, ok := m.accounts[pid.Identity]
+	if ok {
+		if !force {
+			return ErrExists
+		}
+		a.record.Identity = pid
+		return nil
+	}
+	m.accounts[pid.Identity] = &memoryAccount{
+		record:   IdentityRecord{Identity: pid},
+		messages: make(map[string][]byte),
+		devices:  make(map[DeviceID]int64),
+		acks:     make(map[string][]DeviceID),
+	}
+	return nil
+}
+
+func (m *Memory) GetIdentity(id [zkidentity.IdentitySize]byte) (*IdentityRecord, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	a, ok := m.accounts[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	ir := a.record
+	return &ir, nil
+}
+
+func (m *Memory) Identities() ([][zkidentity.IdentitySize]byte, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	ids := make([][zkidentity.IdentitySize]byte, 0, len(m.accounts))
+	for id := range m.accounts {
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+func (m *Memory) SetListed(id [zkidentity.IdentitySize]byte, listed bool) error {
+	m.Lock()
+	defer m.Unlock()
+
+	a, ok := m.accounts[id]
+	if !ok || a.record.Disabled {
+		return ErrNotFound
+	}
+	a.record.Listed = listed
+	return nil
+}
+
+func (m *Memory) SetDisabled(id [zkidentity.IdentitySize]byte, disabled bool) error {
+	m.Lock()
+	defer m.Unlock()
+
+	a, ok := m.accounts[id]
+	if !ok {
+		return ErrNotFound
+	}
+	if a.record.Disabled == disabled {
+		return ErrExists
+	}
+	a.record.Disabled = disabled
+	return nil
+}
+
+func (m *Memory) SetNick(id [zkidentity.IdentitySize]byte, nick string) error {
+	m.Lock()
+	defer m.Unlock()
+
+	a, ok := m.accounts[id]
+	if !ok {
+		return ErrNotFound
+	}
+	a.record.Nick = nick
+	return nil
+}
+
+func (m *Memory) SetHidden(id [zkidentity.IdentitySize]byte, hidden bool) error {
+	m.Lock()
+	defer m.Unlock()
+
+	a, ok := m.accounts[id]
+	if !ok {
+		return ErrNotFound
+	}
+	a.record.Hidden = hidden
+	return nil
+}
+
+func (m *Memory) SetUnlisted(id [zkidentity.IdentitySize]byte, unlisted bool) error {
+	m.Lock()
+	defer m.Unlock()
+
+	a, ok := m.accounts[id]
+	if !ok {
+		return ErrNotFound
+	}
+	a.record.Unlisted = unlisted
+	return nil
+}
+
+func (m *Memory) DelIdentity(id [zkidentity.IdentitySize]byte) error {
+	m.Lock()
+	defer m.Unlock()
+
+	if _, ok := m.accounts[id]; !ok {
+		return ErrNotFound
+	}
+	delete(m.accounts, id)
+	return nil
+}
+
+func (m *Memory) PutMessage(id [zkidentity.IdentitySize]byte, name string, msg []byte) error {
+	m.Lock()
+	defer m.Unlock()
+
+	a, ok := m.accounts[id]
+	if !ok {
+		return ErrNotFound
+	}
+	if a.record.Disabled {
+		return ErrDisabled
+	}
+	if _, ok := a.messages[name]; ok {
+		return ErrExists
+	}
+	a.messages[name] = append([]byte(nil), msg...)
+	return nil
+}
+
+func (m *Memory) GetMessage(id [zkidentity.IdentitySize]byte, name string) ([]byte, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	a, ok := m.accounts[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	msg, ok := a.messages[name]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return append([]byte(nil), msg...), nil
+}
+
+func (m *Memory) DelMessage(id [zkidentity.IdentitySize]byte, name string) error {
+	m.Lock()
+	defer m.Unlock()
+
+	a, ok := m.accounts[id]
+	if !ok {
+		return ErrNotFound
+	}
+	if _, ok := a.messages[name]; !ok {
+		return ErrNotFound
+	}
+	delete(a.messages, name)
+	delete(a.acks, name)
+	return nil
+}
+
+func (m *Memory) Messages(id [zkidentity.IdentitySize]byte) ([]MessageInfo, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	a, ok := m.accounts[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	mi := make([]MessageInfo, 0, len(a.messages))
+	for k, v := range a.messages {
+		mi = append(mi, MessageInfo{
+			Name: k,
+			Size: int64(len(v)),
+		})
+	}
+	sort.Slice(mi, func(i, j int) bool { return mi[i].Name < mi[j].Name })
+	return mi, nil
+}
+
+func (m *Memory) Devices(id [zkidentity.IdentitySize]byte) (map[DeviceID]int64, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	a, ok := m.accounts[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	all := make(map[DeviceID]int64, len(a.devices))
+	for k, v := range a.devices {
+		all[k] = v
+	}
+	return all, nil
+}
+
+func (m *Memory) PutDevice(id [zkidentity.IdentitySize]byte, device DeviceID, lastSeen int64) error {
+	m.Lock()
+	defer m.Unlock()
+
+	a, ok := m.accounts[id]
+	if !ok {
+		return ErrNotFound
+	}
+	a.devices[device] = lastSeen
+	return nil
+}
+
+func (m *Memory) DelDevice(id [zkidentity.IdentitySize]byte, device DeviceID) error {
+	m.Lock()
+	defer m.Unlock()
+
+	a, ok := m.accounts[id]
+	if !ok {
+		return ErrNotFound
+	}
+	if _, ok := a.devices[device]; !ok {
+		return ErrNotFound
+	}
+	delete(a.devices, device)
+	return nil
+}
+
+func (m *Memory) AckMessage(id [zkidentity.IdentitySize]byte, name string, device DeviceID) error {
+	m.Lock()
+	defer m.Unlock()
+
+	a, ok := m.accounts[id]
+	if !ok {
+		return ErrNotFound
+	}
+	if _, ok := a.messages[name]; !ok {
+		return ErrNotFound
+	}
+	for _, v := range a.acks[name] {
+		if v == device {
+			return nil
+		}
+	}
+	a.acks[name] = append(a.acks[name], device)
+	return nil
+}
+
+func (m *Memory) MessageAcks(id [zkidentity.IdentitySize]byte, name string) ([]DeviceID, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	a, ok := m.accounts[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return append([]DeviceID(nil), a.acks[name]...), nil
+}
+
+func (m *Memory) GetRendezvous(token string) (*Rendezvous, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	r, ok := m.rendezvous[token]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &r, nil
+}
+
+func (m *Memory) PutRendezvous(token string, r Rendezvous) error {
+	m.Lock()
+	defer m.Unlock()
+
+	m.rendezvous[token] = r
+	return nil
+}
+
+func (m *Memory) DelRendezvous(token string) error {
+	m.Lock()
+	defer m.Unlock()
+
+	if _, ok := m.rendezvous[token]; !ok {
+		return ErrNotFound
+	}
+	delete(m.rendezvous, token)
+	return nil
+}
+
+func (m *Memory) AllRendezvous() (map[string]Rendezvous, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	all := make(map[string]Rendezvous, len(m.rendezvous))
+	for k, v := range m.rendezvous {
+		all[k] = v
+	}
+	return all, nil
+}
+
+func (m *Memory) GetToken(token string) (*Token, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	t, ok := m.tokens[token]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &t, nil
+}
+
+func (m *Memory) PutToken(token string, t Token) error {
+	m.Lock()
+	defer m.Unlock()
+
+	m.tokens[token] = t
+	return nil
+}
+
+func (m *Memory) DelToken(token string) error {
+	m.Lock()
+	defer m.Unlock()
+
+	if _, ok := m.tokens[token]; !ok {
+		return ErrNotFound
+	}
+	delete(m.tokens, token)
+	return nil
+}
+
+func (m *Memory) Tokens() (map[string]Token, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	all := make(map[string]Token, len(m.tokens))
+	for k, v := range m.tokens {
+		all[k] = v
+	}
+	return all, nil
+}
+
+// Close is a no-op since there is nothing to flush.
+func (m *Memory) Close() error {
+	return nil
+}
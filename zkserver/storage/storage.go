@@ -0,0 +1,212 @@
+// Copyright (c) 2020 Company 0, LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+// storage defines the persistent state of zkserver.  It is separated into
+// identities, mailboxes, devices, rendezvous records and account creation
+// tokens.  Filesystem is the traditional on disk layout and Memory is a
+// volatile implementation that is intended for tests.
+package storage
+
+import (
+	"errors"
+	"time"
+
+	"github.com/companyzero/zkc/zkidentity"
+)
+
+var (
+	ErrNotFound = errors.New("not found")
+	ErrExists   = errors.New("already exists")
+	ErrDisabled = errors.New("account disabled")
+)
+
+// IdentityRecord is the stored state of an account.
+type IdentityRecord struct {
+	Identity zkidentity.PublicIdentity // long lived public identity
+	Listed   bool                      // listed in directory
+	Disabled bool                      // disabled by administrator
+	Nick     string                    // directory nick set by administrator
+	Hidden   bool                      // kept out of directory by administrator
+	Unlisted bool                      // kept out of directory by its owner
+}
+
+// DirectoryNick returns the nick the identity is found by in the directory.
+// The nick of the identity is signed by its owner and therefore can not be
+// changed by the server.
+func (ir *IdentityRecord) DirectoryNick() string {
+	if ir.Nick != "" {
+		return ir.Nick
+	}
+	return ir.Identity.Nick
+}
+
+// IdentityStore stores account identities.  Disabled accounts retain their
+// identity and mailbox.
+type IdentityStore interface {
+	// CreateIdentity stores a new identity.  If the identity exists
+	// ErrExists is returned unless force is set.
+	CreateIdentity(pid zkidentity.PublicIdentity, force bool) error
+
+	// GetIdentity returns the identity record of id.
+	GetIdentity(id [zkidentity.IdentitySize]byte) (*IdentityRecord, error)
+
+	// Identities returns all enabled and disabled identities.
+	Identities() ([][zkidentity.IdentitySize]byte, error)
+
+	// SetListed adds or removes an enabled identity from the directory.
+	SetListed(id [zkidentity.IdentitySize]byte, listed bool) error
+
+	// SetDisabled disables or enables an identity.
+	SetDisabled(id [zkidentity.IdentitySize]byte, disabled bool) error
+
+	// SetNick sets the directory nick of an identity.  An empty nick
+	// reverts to the nick of the identity.
+	SetNick(id [zkidentity.IdentitySize]byte, nick string) error
+
+	// SetHidden keeps an identity out of the directory or allows it to
+	// be listed again.
+	SetHidden(id [zkidentity.IdentitySize]byte, hidden bool) error
+
+	// SetUnlisted records that the owner of an identity does not want to
+	// be listed in the directory or changed their mind.
+	SetUnlisted(id [zkidentity.IdentitySize]byte, unlisted bool) error
+
+	// DelIdentity permanently removes an enabled or disabled identity
+	// including its mailbox and devices.
+	DelIdentity(id [zkidentity.IdentitySize]byte) error
+}
+
+// MessageInfo describes a message in a mailbox.
+type MessageInfo struct {
+	Name string // unique name within mailbox
+	Size int64  // size in bytes
+}
+
+// MailboxStore stores undelivered messages.  Messages are opaque to the store
+// and identified by a name that is unique within the mailbox.
+type MailboxStore interface {
+	// PutMessage stores a message in the mailbox of an enabled identity.
+	PutMessage(id [zkidentity.IdentitySize]byte, name string, msg []byte) error
+
+	// GetMessage returns a message.
+	GetMessage(id [zkidentity.IdentitySize]byte, name string) ([]byte, error)
+
+	// DelMessage deletes a message.
+	DelMessage(id [zkidentity.IdentitySize]byte, name string) error
+
+	// Messages returns all messages in a mailbox sorted by name.
+	Messages(id [zkidentity.IdentitySize]byte) ([]MessageInfo, error)
+}
+
+// DeviceIDSize is the size of a device identifier.
+const DeviceIDSize = 16
+
+// DeviceID identifies one of possibly several clients that share an identity.
+// Clients that do not identify their device use the zero DeviceID.
+type DeviceID [DeviceIDSize]byte
+
+// DeviceStore keeps track of the devices of an identity and which of them
+// acknowledged a message.
+type DeviceStore interface {
+	// Devices returns the registered devices of id and the unix time they
+	// were last seen.
+	Devices(id [zkidentity.IdentitySize]byte) (map[DeviceID]int64, error)
+
+	// PutDevice registers a device or updates the time it was last seen.
+	PutDevice(id [zkidentity.IdentitySize]byte, device DeviceID, lastSeen int64) error
+
+	// DelDevice unregisters a device.
+	DelDevice(id [zkidentity.IdentitySize]byte, device DeviceID) error
+
+	// AckMessage records that device acknowledged a message.  The
+	// acknowledgements of a message are dropped when it is deleted.
+	AckMessage(id [zkidentity.IdentitySize]byte, name string, device DeviceID) error
+
+	// MessageAcks returns the devices that acknowledged a message.
+	MessageAcks(id [zkidentity.IdentitySize]byte, name string) ([]DeviceID, error)
+}
+
+// Rendezvous is a stored rendezvous record.
+type Rendezvous struct {
+	Blob       []byte // data being shared
+	Expiration string // hours until Rendezvous expires, as sent by client
+	Expires    int64  // unix time when the Rendezvous expires
+
+	Owner    [zkidentity.IdentitySize]byte // identity that created record
+	MaxPulls uint64                        // pulls allowed, 0 is unlimited
+	Pulls    uint64                        // successful pulls so far
+}
+
+// Legacy returns true if the rendezvous record was stored before expiration
+// times were recorded.  Such records must be given a lifetime instead of being
+// considered expired.
+func (r *Rendezvous) Legacy() bool {
+	return r.Expires == 0 && r.Expiration != ""
+}
+
+// Expired returns true if the rendezvous record may no longer be served.
+// Legacy records never expire on their own.
+func (r *Rendezvous) Expired(now time.Time) bool {
+	return !r.Legacy() && !now.Before(time.Unix(r.Expires, 0))
+}
+
+// Consumed returns true if the rendezvous record has been pulled as often as
+// it was allowed to.
+func (r *Rendezvous) Consumed() bool {
+	return r.MaxPulls != 0 && r.Pulls >= r.MaxPulls
+}
+
+// RendezvousStore stores rendezvous records that are identified by their PIN.
+type RendezvousStore interface {
+	GetRendezvous(token string) (*Rendezvous, error)
+	PutRendezvous(token string, r Rendezvous) error
+	DelRendezvous(token string) error
+
+	// AllRendezvous returns all records.  Records that can not be
+	// decoded are returned as a zero Rendezvous, which is expired.
+	AllRendezvous() (map[string]Rendezvous, error)
+}
+
+// Token is an account creation token.
+type Token struct {
+	Expires int64  // unix time when the token expires
+	Uses    uint64 // remaining account creations
+	Nick    string // nick accounts must use, "" allows any nick
+}
+
+// Expired returns true if the token may no longer be used.
+func (t *Token) Expired(now time.Time) bool {
+	return time.Unix(t.Expires, 0).Before(now)
+}
+
+// TokenStore stores account creation tokens.
+type TokenStore interface {
+	GetToken(token string) (*Token, error)
+	PutToken(token string, t Token) error
+	DelToken(token string) error
+
+	// Tokens returns all tokens.  Tokens that can not be decoded are
+	// returned as a zero Token, which is expired.
+	Tokens() (map[string]Token, error)
+}
+
+// Snapshotter is implemented by backends whose state can be copied while they
+// are in use.
+type Snapshotter interface {
+	// Snapshot calls fn while the backend is not modified.
+	Snapshot(fn func() error) error
+}
+
+// Backend is the complete zkserver state.
+type Backend interface {
+	IdentityStore
+	MailboxStore
+	DeviceStore
+	RendezvousStore
+	TokenStore
+
+	// Close waits for pending writes and flushes all state to stable
+	// storage.  The backend must not be used afterwards.
+	Close() error
+}
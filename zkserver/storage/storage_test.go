@@ -0,0 +1,453 @@
+// Copyright (c) 2020 Company 0, LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package storage
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/companyzero/zkc/zkidentity"
+	xdr "github.com/davecgh/go-xdr/xdr2"
+)
+
+// testBackend runs the common backend tests against b.
+func testBackend(t *testing.T, b Backend) {
+	pid := zkidentity.PublicIdentity{Nick: "alice"}
+	pid.Identity[0] = 1
+
+	// identities
+	err := b.CreateIdentity(pid, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = b.CreateIdentity(pid, false)
+	if !errors.Is(err, ErrExists) {
+		t.Fatalf("expected ErrExists, got %v", err)
+	}
+	err = b.CreateIdentity(pid, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ir, err := b.GetIdentity(pid.Identity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ir.Identity.Nick != "alice" || ir.Listed || ir.Disabled {
+		t.Fatalf("unexpected identity record: %+v", ir)
+	}
+	err = b.SetListed(pid.Identity, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ir, err = b.GetIdentity(pid.Identity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ir.Listed {
+		t.Fatal("identity not listed")
+	}
+	var unknown [zkidentity.IdentitySize]byte
+	_, err = b.GetIdentity(unknown)
+	if !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+
+	// mailbox
+	err = b.PutMessage(pid.Identity, "2", []byte("second"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = b.PutMessage(pid.Identity, "1", []byte("first"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = b.PutMessage(unknown, "1", []byte("first"))
+	if !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+	mi, err := b.Messages(pid.Identity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mi) != 2 || mi[0].Name != "1" || mi[0].Size != 5 ||
+		mi[1].Name != "2" {
+		t.Fatalf("unexpected messages: %+v", mi)
+	}
+	msg, err := b.GetMessage(pid.Identity, "2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(msg, []byte("second")) {
+		t.Fatalf("unexpected message: %s", msg)
+	}
+	err = b.DelMessage(pid.Identity, "2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = b.GetMessage(pid.Identity, "2")
+	if err == nil {
+		t.Fatal("message not deleted")
+	}
+
+	// devices and acknowledgements
+	d1, d2 := DeviceID{1}, DeviceID{2}
+	err = b.PutDevice(pid.Identity, d1, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = b.PutDevice(pid.Identity, d2, 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	devices, err := b.Devices(pid.Identity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(devices) != 2 || devices[d1] != 10 || devices[d2] != 20 {
+		t.Fatalf("unexpected devices: %v", devices)
+	}
+	err = b.DelDevice(pid.Identity, d2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = b.DelDevice(pid.Identity, d2)
+	if !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+	err = b.AckMessage(pid.Identity, "1", d1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = b.AckMessage(pid.Identity, "1", d1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = b.AckMessage(pid.Identity, "1", d2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = b.AckMessage(pid.Identity, "2", d1)
+	if !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+	acks, err := b.MessageAcks(pid.Identity, "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(acks) != 2 || acks[0] != d1 || acks[1] != d2 {
+		t.Fatalf("unexpected acks: %x", acks)
+	}
+
+	// disable retains the mailbox but refuses delivery
+	err = b.SetDisabled(pid.Identity, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ir, err = b.GetIdentity(pid.Identity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ir.Disabled {
+		t.Fatal("identity not disabled")
+	}
+	err = b.PutMessage(pid.Identity, "3", []byte("third"))
+	if !errors.Is(err, ErrDisabled) {
+		t.Fatalf("expected ErrDisabled, got %v", err)
+	}
+	mi, err = b.Messages(pid.Identity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mi) != 1 {
+		t.Fatalf("unexpected messages: %+v", mi)
+	}
+	ids, err := b.Identities()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 1 || ids[0] != pid.Identity {
+		t.Fatalf("unexpected identities: %x", ids)
+	}
+	err = b.SetDisabled(pid.Identity, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// directory nick, hidden and unlisted
+	err = b.SetNick(pid.Identity, "alice2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = b.SetHidden(pid.Identity, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = b.SetUnlisted(pid.Identity, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ir, err = b.GetIdentity(pid.Identity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ir.DirectoryNick() != "alice2" || ir.Identity.Nick != "alice" ||
+		!ir.Hidden || !ir.Unlisted {
+		t.Fatalf("unexpected identity record: %+v", ir)
+	}
+	err = b.SetNick(pid.Identity, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = b.SetHidden(pid.Identity, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = b.SetUnlisted(pid.Identity, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ir, err = b.GetIdentity(pid.Identity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ir.DirectoryNick() != "alice" || ir.Hidden || ir.Unlisted {
+		t.Fatalf("unexpected identity record: %+v", ir)
+	}
+
+	// rendezvous
+	now := time.Now()
+	r := Rendezvous{
+		Blob:     []byte("blob"),
+		Expires:  now.Add(time.Hour).Unix(),
+		Owner:    pid.Identity,
+		MaxPulls: 1,
+	}
+	err = b.PutRendezvous("123456", r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = b.PutRendezvous("654321", Rendezvous{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr, err := b.GetRendezvous("123456")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(rr.Blob, r.Blob) || rr.Owner != r.Owner ||
+		rr.Expired(now) || rr.Consumed() {
+		t.Fatalf("unexpected rendezvous: %+v", rr)
+	}
+	all, err := b.AllRendezvous()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 2 || !func() bool {
+		r := all["654321"]
+		return r.Expired(now)
+	}() {
+		t.Fatalf("unexpected rendezvous records: %+v", all)
+	}
+	err = b.DelRendezvous("123456")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = b.GetRendezvous("123456")
+	if !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+	err = b.DelRendezvous("123456")
+	if !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+
+	// purge
+	bob := zkidentity.PublicIdentity{Nick: "bob"}
+	bob.Identity[0] = 2
+	err = b.CreateIdentity(bob, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = b.PutMessage(bob.Identity, "1", []byte("first"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = b.PutDevice(bob.Identity, d1, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = b.DelIdentity(bob.Identity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = b.GetIdentity(bob.Identity)
+	if !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+	err = b.DelIdentity(bob.Identity)
+	if !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+	err = b.CreateIdentity(bob, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mi, err = b.Messages(bob.Identity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mi) != 0 {
+		t.Fatalf("unexpected messages: %+v", mi)
+	}
+	err = b.DelIdentity(bob.Identity)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// tokens
+	err = b.PutToken("42", Token{
+		Expires: now.Add(time.Hour).Unix(),
+		Uses:    3,
+		Nick:    "bob, the builder",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tk, err := b.GetToken("42")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tk.Expired(now) || tk.Uses != 3 || tk.Nick != "bob, the builder" {
+		t.Fatalf("unexpected token: %+v", tk)
+	}
+	tokens, err := b.Tokens()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tokens) != 1 {
+		t.Fatalf("unexpected tokens: %+v", tokens)
+	}
+	err = b.DelToken("42")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = b.GetToken("42")
+	if !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+
+	err = b.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMemory(t *testing.T) {
+	testBackend(t, NewMemory())
+}
+
+func TestFilesystem(t *testing.T) {
+	root, err := ioutil.TempDir("", "zkserver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	f, err := NewFilesystem(root+"/home", root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testBackend(t, f)
+}
+
+func TestFilesystemSnapshot(t *testing.T) {
+	root, err := ioutil.TempDir("", "zkserver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	f, err := NewFilesystem(root+"/home", root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pid := zkidentity.PublicIdentity{Nick: "alice"}
+	err = f.CreateIdentity(pid, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// writes wait for the snapshot, reads do not
+	written := make(chan error)
+	err = f.Snapshot(func() error {
+		go func() {
+			written <- f.PutMessage(pid.Identity, "1", []byte("m"))
+		}()
+		select {
+		case err := <-written:
+			t.Fatalf("write during snapshot: %v", err)
+		case <-time.After(100 * time.Millisecond):
+		}
+		_, err := f.GetIdentity(pid.Identity)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = <-written
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := f.Messages(pid.Identity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m) != 1 {
+		t.Fatalf("expected 1 message, got %v", len(m))
+	}
+}
+
+func TestDecodeLegacyToken(t *testing.T) {
+	tk, err := decodeToken("1600000000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tk.Expires != 1600000000 || tk.Uses != 1 || tk.Nick != "" {
+		t.Fatalf("unexpected token: %+v", tk)
+	}
+	_, err = decodeToken("1600000000,1")
+	if err == nil {
+		t.Fatal("expected corrupt token")
+	}
+}
+
+func TestDecodeLegacyRendezvous(t *testing.T) {
+	// rpc.Rendezvous as it used to be stored
+	type rendezvousOld struct {
+		Blob       []byte
+		Expiration string
+	}
+	var b bytes.Buffer
+	_, err := xdr.Marshal(&b, rendezvousOld{
+		Blob:       []byte("blob"),
+		Expiration: "24",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := decodeRendezvous(base64.StdEncoding.EncodeToString(b.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !r.Legacy() || r.Expired(time.Now()) {
+		t.Fatalf("unexpected rendezvous: %+v", r)
+	}
+}
@@ -0,0 +1,56 @@
+// Copyright (c) 2020 Company 0, LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/companyzero/zkc/rpc"
+	"github.com/companyzero/zkc/tools"
+)
+
+// loadSuccessions loads the signed statements of the identities this server
+// succeeded.  The statements must lead to the server identity, otherwise
+// clients that pinned an older identity could not follow them.
+func (z *ZKS) loadSuccessions() error {
+	successions, err := tools.ReadSuccessions(filepath.Join(
+		z.settings().Root, tools.ZKSSuccessionFilename))
+	if err != nil {
+		return fmt.Errorf("could not read successions: %v", err)
+	}
+	if len(successions) == 0 {
+		return nil
+	}
+
+	pid, err := rpc.Successor(successions[0].Old, successions)
+	if err != nil {
+		return err
+	}
+	if pid.Identity != z.id.Public.Identity {
+		return fmt.Errorf("%w: successions lead to %v, not to the "+
+			"server identity", rpc.ErrSuccession, pid.Fingerprint())
+	}
+	z.successions = successions
+
+	z.Info(idApp, "Server identity succeeded %v identities, first %v",
+		len(successions), successions[0].Old.Fingerprint())
+
+	return nil
+}
+
+// successionReply returns the successions that lead from the requested
+// identity to the server identity.  The reply is empty if the identity was
+// never succeeded.
+func (z *ZKS) successionReply(sr rpc.SuccessionRequest) rpc.SuccessionReply {
+	for k, v := range z.successions {
+		if v.Old.Identity == sr.Identity {
+			return rpc.SuccessionReply{
+				Successions: z.successions[k:],
+			}
+		}
+	}
+	return rpc.SuccessionReply{}
+}
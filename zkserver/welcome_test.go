@@ -0,0 +1,75 @@
+// Copyright (c) 2020 Company 0, LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/companyzero/zkc/rpc"
+	"github.com/companyzero/zkc/zkserver/federation"
+)
+
+// propertyKeys returns the keys of the welcome properties of version.
+func propertyKeys(z *ZKS, version int) map[string]string {
+	keys := make(map[string]string)
+	for _, v := range z.serverProperties(version) {
+		keys[v.Key] = v.Value
+	}
+	return keys
+}
+
+func TestServerPropertiesVersion(t *testing.T) {
+	root, err := ioutil.TempDir("", "zkserver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	z := newTestServer(t, root)
+
+	// legacy sessions only receive the properties they know
+	legacy := propertyKeys(z, rpc.LegacyProtocolVersion)
+	if len(legacy) != len(rpc.SupportedServerProperties) {
+		t.Fatalf("unexpected legacy properties %v", legacy)
+	}
+	if _, ok := legacy[rpc.PropDevices]; ok {
+		t.Fatal("devices sent to legacy session")
+	}
+
+	current := propertyKeys(z, rpc.ProtocolVersion)
+	if _, ok := current[rpc.PropDevices]; !ok {
+		t.Fatal("devices not sent to current session")
+	}
+	if _, ok := current[rpc.PropHomeServer]; ok {
+		t.Fatal("home server sent without federation")
+	}
+}
+
+func TestServerPropertiesHomeServer(t *testing.T) {
+	root, err := ioutil.TempDir("", "zkserver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	const address = "zk.example.com:12346"
+	z := newTestServer(t, root)
+	z.federation, err = federation.New(federation.Config{
+		Identity: z.id,
+		Address:  address,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if hs := propertyKeys(z, rpc.ProtocolVersion)[rpc.PropHomeServer]; hs != address {
+		t.Fatalf("unexpected home server %q", hs)
+	}
+	if _, ok := propertyKeys(z, rpc.LegacyProtocolVersion)[rpc.PropHomeServer]; ok {
+		t.Fatal("home server sent to legacy session")
+	}
+}
@@ -22,6 +22,7 @@ import (
 	"runtime"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -32,8 +33,12 @@ import (
 	"github.com/companyzero/zkc/tools"
 	"github.com/companyzero/zkc/zkidentity"
 	"github.com/companyzero/zkc/zkserver/account"
-	"github.com/companyzero/zkc/zkserver/settings"
+	"github.com/companyzero/zkc/zkserver/audit"
+	"github.com/companyzero/zkc/zkserver/federation"
+	"github.com/companyzero/zkc/zkserver/proxyproto"
+	"github.com/companyzero/zkc/zkserver/ratelimit"
 	"github.com/companyzero/zkc/zkserver/socketapi"
+	"github.com/companyzero/zkc/zkserver/storage"
 	"github.com/companyzero/zkc/zkutil"
 	"github.com/davecgh/go-spew/spew"
 	xdr "github.com/davecgh/go-xdr/xdr2"
@@ -46,16 +51,6 @@ const (
 	idSock = 3
 
 	tagDepth = 32
-
-	pendingDir     = "pending"
-	pendingFile    = "pending.ini"
-	rendezvousDir  = "rendezvous"
-	rendezvousFile = "rendezvous.ini"
-)
-
-var (
-	pendingPath    = filepath.Join(pendingDir, pendingFile)
-	rendezvousPath = filepath.Join(rendezvousDir, rendezvousFile)
 )
 
 // RPCWrapper is a wrapped RPC Message for internal use.  This is required because RPC messages
@@ -64,6 +59,7 @@ type RPCWrapper struct {
 	Message    rpc.Message
 	Payload    interface{}
 	Identifier string
+	Receipt    uint64 // delivery receipt the sender of a Push asked for
 }
 
 type sessionContext struct {
@@ -71,30 +67,72 @@ type sessionContext struct {
 	writer   chan *RPCWrapper
 	quit     chan struct{}
 	kx       *session.KX
+	rid      [zkidentity.IdentitySize]byte
 	rids     string
+	version  int  // negotiated protocol version
+	online   bool // registered with account and sessions
 	tagStack *tagstack.TagStack
 
+	connected time.Time // time session was established
+
 	// protected
 	sync.Mutex
+	device     storage.DeviceID // anonymous until the client registers
 	tagMessage []*RPCWrapper
 }
 
 type ZKS struct {
 	sync.Mutex
-	sessions map[string]*sessionContext
+	sessions map[string]map[storage.DeviceID]*sessionContext
+	draining bool // server is shutting down, refuse new sessions
+
+	socket    net.Listener   // socket for zkserverctl
+	listeners []net.Listener // client connections
+
+	rendezvousMtx sync.Mutex // serializes rendezvous record updates
+	pendingMtx    sync.Mutex // serializes account creation token updates
 
-	socket net.Listener // socket for zkserverctl
+	// failed RendezvousPull attempts per identity and server wide
+	rendezvousFailures       *ratelimit.Limiter
+	rendezvousFailuresGlobal *ratelimit.Limiter
+
+	// per identity limits of tagged commands
+	commandLimits map[string]*ratelimit.Limiter
+
+	// connections in the pre-session phase per address and server wide
+	preSessionMtx    sync.Mutex
+	preSessionConns  map[string]uint64
+	preSessionTotal  uint64
+	createLimit      *ratelimit.Limiter
+	createLimitTotal *ratelimit.Limiter
+
+	// settings are replaced as a whole when the configuration is reloaded
+	reloadMtx  sync.Mutex   // serializes reloads
+	configFile string       // configuration filename
+	config     atomic.Value // *settings.Settings
+
+	// outer certificates are replaced as a whole when they are rotated
+	certMtx sync.Mutex   // serializes staging and rotation
+	certs   atomic.Value // *serverCerts
 
 	// Not mutex entries
 	*debug.Debug
+	metrics  *serverMetrics
+	auditLog *audit.Log
 	account  *account.Account
-	settings *settings.Settings
+	store    storage.Backend
 	id       *zkidentity.FullIdentity
+
+	// relays messages to and from peer servers
+	federation *federation.Federation
+
+	// signed statements of replaced server identities, oldest first
+	successions []rpc.Succession
 }
 
 // unmarshal performs a limited xdr Unmarshal operation.
 func (z *ZKS) unmarshal(r io.Reader, v interface{}) (int, error) {
-	return xdr.UnmarshalLimited(r, v, uint(z.settings.MaxMsgSize))
+	return xdr.UnmarshalLimited(r, v, uint(z.settings().MaxMsgSize))
 }
 
 // writeMessage marshals and sends encrypted message to client.
@@ -117,7 +155,7 @@ func (z *ZKS) writeMessage(kx *session.KX, msg *RPCWrapper) error {
 			msg.Message.Command, err)
 	}
 
-	if z.settings.Debug {
+	if z.settings().Debug {
 		rid := kx.TheirIdentity().([32]byte)
 		rids := hex.EncodeToString(rid[:])
 		z.T(idS, "writeMessage: %v %v tag %v",
@@ -158,45 +196,69 @@ func (z *ZKS) unwelcome(kx *session.KX, reason string) error {
 	return nil
 }
 
-func (z *ZKS) welcome(kx *session.KX) error {
+// serverProperties returns the welcome properties of a session of version.
+// Sessions of LegacyProtocolVersion only receive the properties they know.
+func (z *ZKS) serverProperties(version int) []rpc.ServerProperty {
 	// obtain message of the day
-	motd, err := ioutil.ReadFile(z.settings.MOTD)
+	motd, err := ioutil.ReadFile(z.settings().MOTD)
 	if err != nil {
 		motd = []byte{}
 	}
 
-	properties := rpc.SupportedServerProperties
+	properties := append([]rpc.ServerProperty(nil),
+		rpc.SupportedServerProperties...)
+	if version > rpc.LegacyProtocolVersion {
+		properties = append(properties, rpc.DefaultPropDevices)
+
+		// announce the staged certificate while a rotation is pending
+		if next := z.getCerts().nextProp; next != "" {
+			nc := rpc.DefaultPropNextCert
+			nc.Value = next
+			properties = append(properties, nc)
+		}
+
+		// tell clients where users on other servers reach them
+		if address := z.federation.Address(); address != "" {
+			hs := rpc.DefaultPropHomeServer
+			hs.Value = address
+			properties = append(properties, hs)
+		}
+	}
 	for k, v := range properties {
 		switch v.Key {
 		case rpc.PropTagDepth:
 			properties[k].Value = strconv.FormatUint(tagDepth, 10)
 		case rpc.PropMaxAttachmentSize:
-			properties[k].Value = strconv.FormatUint(z.settings.MaxAttachmentSize, 10)
+			properties[k].Value = strconv.FormatUint(z.settings().MaxAttachmentSize, 10)
 		case rpc.PropMaxChunkSize:
-			properties[k].Value = strconv.FormatUint(z.settings.MaxChunkSize, 10)
+			properties[k].Value = strconv.FormatUint(z.settings().MaxChunkSize, 10)
 		case rpc.PropMaxMsgSize:
-			properties[k].Value = strconv.FormatUint(z.settings.MaxMsgSize, 10)
+			properties[k].Value = strconv.FormatUint(z.settings().MaxMsgSize, 10)
 		case rpc.PropServerTime:
 			properties[k].Value = strconv.FormatInt(time.Now().Unix(), 10)
 		case rpc.PropMOTD:
 			properties[k].Value = string(motd)
 		case rpc.PropDirectory:
-			properties[k].Value = strconv.FormatBool(z.settings.Directory)
+			properties[k].Value = strconv.FormatBool(z.settings().Directory)
 		}
 	}
+	return properties
+}
 
+// welcome sends the welcome of the negotiated protocol version.
+func (z *ZKS) welcome(kx *session.KX, version int) error {
 	// assemble command
 	message := rpc.Message{
 		Command: rpc.SessionCmdWelcome,
 	}
 	payload := rpc.Welcome{
-		Version:    rpc.ProtocolVersion,
-		Properties: properties,
+		Version:    version,
+		Properties: z.serverProperties(version),
 	}
 
 	// encode command
 	var bb bytes.Buffer
-	_, err = xdr.Marshal(&bb, message)
+	_, err := xdr.Marshal(&bb, message)
 	if err != nil {
 		return fmt.Errorf("could not marshal Welcome message")
 	}
@@ -252,6 +314,11 @@ func (z *ZKS) sessionWriter(sc *sessionContext) {
 					err)
 				return
 			}
+
+			// the client goes away after an unwelcome
+			if msg.Message.Command == rpc.SessionCmdUnwelcome {
+				return
+			}
 		}
 	}
 }
@@ -286,6 +353,17 @@ func (z *ZKS) sessionNtfn(sc *sessionContext) {
 				return
 			}
 
+			// legacy clients disconnect on commands they don't
+			// know, skip notices and receipts on their behalf
+			if sc.version == rpc.LegacyProtocolVersion &&
+				(z.isNotice(n) || z.isReceipt(n)) {
+				z.Dbg(idS, "sessionNtfn skip: %v %v",
+					sc.rids, n.Identifier)
+				_, _ = z.account.Ack(sc.rid, sc.getDevice(),
+					n.Identifier)
+				continue
+			}
+
 			// obtain tag
 			tag, err := sc.tagStack.Pop()
 			if err != nil {
@@ -305,7 +383,7 @@ func (z *ZKS) sessionNtfn(sc *sessionContext) {
 			}
 
 			// translate notification into msg
-			r := RPCWrapper{
+			r := &RPCWrapper{
 				Message: rpc.Message{
 					Command:   rpc.TaggedCmdPush,
 					Cleartext: n.Cleartext,
@@ -317,8 +395,24 @@ func (z *ZKS) sessionNtfn(sc *sessionContext) {
 					Payload:  n.Payload,
 				},
 				Identifier: n.Identifier,
+				Receipt:    n.Receipt,
+			}
+			switch {
+			case z.isNotice(n):
+				r, err = z.noticeMessage(n, tag)
+			case z.isReceipt(n):
+				r, err = z.receiptMessage(n, tag)
+			}
+			if err != nil {
+				// drop corrupt notice or receipt
+				sc.Unlock()
+				z.Error(idS, "%v %v", sc.rids, err)
+				_, _ = z.account.Ack(sc.rid, sc.getDevice(),
+					n.Identifier)
+				_ = sc.tagStack.Push(tag)
+				continue
 			}
-			sc.tagMessage[tag] = &r
+			sc.tagMessage[tag] = r
 			sc.Unlock()
 
 			z.T(idS, "sessionNtfn ntfy: %v %v",
@@ -326,79 +420,144 @@ func (z *ZKS) sessionNtfn(sc *sessionContext) {
 				r.Message.Command,
 				r.Message.Tag)
 
-			sc.writer <- &r
+			sc.writer <- r
 		}
 	}
 }
 
-// handleSession deals with incoming RPC calls.  For now treat all errors as
-// critical and return which in turns shuts down the connection.
-func (z *ZKS) handleSession(kx *session.KX) error {
-	rid, ok := kx.TheirIdentity().([32]byte)
-	if !ok {
-		return fmt.Errorf("invalid KX identity type %T", rid)
-	}
-	rids := hex.EncodeToString(rid[:])
+// getDevice returns the device of a session.
+func (sc *sessionContext) getDevice() storage.DeviceID {
+	sc.Lock()
+	defer sc.Unlock()
+	return sc.device
+}
 
-	// create session context
-	sc := sessionContext{
-		ntfn:       make(chan *account.Notification, tagDepth),
-		writer:     make(chan *RPCWrapper, tagDepth),
-		quit:       make(chan struct{}),
-		kx:         kx,
-		rids:       rids,
-		tagStack:   tagstack.NewBlocking(tagDepth),
-		tagMessage: make([]*RPCWrapper, tagDepth),
+// knockOffline closes the session that has device online.  This fixes the
+// issue where phantom server connections remain online preventing the client
+// from connecting to the server altogether.
+func (z *ZKS) knockOffline(sc *sessionContext, device storage.DeviceID) error {
+	z.Dbg(idS, "handleSession forced offline: %v %x", sc.rids, device)
+
+	z.Lock()
+	defer z.Unlock()
+	oldSc, ok := z.sessions[sc.rids][device]
+	if !ok {
+		// This should not happen.
+		return fmt.Errorf("handleSession: account online without a "+
+			"session %v %x", sc.rids, device)
 	}
+	// Closing the connection should knock everything offline.
+	oldSc.kx.Close()
+	z.auditDisconnect("duplicatedevice", sc.rids, device)
+	delete(z.sessions[sc.rids], device)
+	return nil
+}
 
-	// register identity
-	err := z.account.Online(rid, sc.ntfn)
+// sessionOnline registers the device of a session with the account subsystem
+// and marks the session online.  If the device is already online and kick is
+// set the old session is knocked offline and an error is returned.  Without
+// kick the session simply stays offline.
+func (z *ZKS) sessionOnline(sc *sessionContext, device storage.DeviceID, kick bool) error {
+	err := z.account.Online(sc.rid, device, sc.ntfn)
 	if err != nil {
-		// If the account is already online we are knocking it offline.
-		// This may be annoying for users that have two clients open
-		// but it fixes the issue where phantom server connections
-		// remain online preventing the client from connecting to the
-		// server altogether.
 		var aErr account.ErrAlreadyOnline
 		if errors.As(err, &aErr) {
-			z.Dbg(idS, "handleSession forced offline: %v", rids)
-			z.Lock()
-			if oldSc, ok := z.sessions[rids]; ok {
-				// Closing the connection should knock
-				// everything offline.
-				oldSc.kx.Close()
-				delete(z.sessions, rids)
-			} else {
-				// This should not happen.
-				z.Unlock()
-				return fmt.Errorf("handleSession: account "+
-					"online without a session %v", rids)
+			if !kick {
+				return nil
+			}
+			kerr := z.knockOffline(sc, device)
+			if kerr != nil {
+				return kerr
 			}
-			z.Unlock()
 		}
 
 		// Regardless of the failure we return an error in order to
 		// give the server the opportunity to close the connection and
 		// settle down.
-		return fmt.Errorf("handleSession: %v %v", rids, err)
+		return fmt.Errorf("handleSession: %v %v", sc.rids, err)
 	}
 
 	// mark session online
+	sc.Lock()
+	sc.device = device
+	sc.Unlock()
+	sc.online = true
 	z.Lock()
-	z.sessions[rids] = &sc
+	if z.sessions[sc.rids] == nil {
+		z.sessions[sc.rids] = make(map[storage.DeviceID]*sessionContext)
+	}
+	z.sessions[sc.rids][device] = sc
 	z.Unlock()
 
-	z.Dbg(idS, "handleSession account online: %v", rids)
+	z.Dbg(idS, "handleSession account online: %v %x", sc.rids, device)
 
 	// populate identity in directory
-	if z.settings.Directory {
-		err := z.account.Push(rid)
+	if z.settings().Directory {
+		err := z.account.Push(sc.rid)
 		if err != nil {
 			return fmt.Errorf("handleSession: Push(%v) = %v",
-				rids, err)
+				sc.rids, err)
 		}
 	}
 
+	return nil
+}
+
+// sessionDevice moves an online session from the anonymous device to the
+// device the client registered.  If that device is already online the old
+// session is knocked offline and an error is returned.
+func (z *ZKS) sessionDevice(sc *sessionContext, device storage.DeviceID) error {
+	anonymous := sc.getDevice()
+	err := z.account.ChangeDevice(sc.rid, anonymous, device)
+	if err != nil {
+		var aErr account.ErrAlreadyOnline
+		if errors.As(err, &aErr) {
+			kerr := z.knockOffline(sc, device)
+			if kerr != nil {
+				return kerr
+			}
+		}
+		return fmt.Errorf("handleSession: %v %v", sc.rids, err)
+	}
+
+	z.Lock()
+	if z.sessions[sc.rids][anonymous] == sc {
+		delete(z.sessions[sc.rids], anonymous)
+	}
+	z.sessions[sc.rids][device] = sc
+	sc.Lock()
+	sc.device = device
+	sc.Unlock()
+	z.Unlock()
+
+	z.Dbg(idS, "handleSession device registered: %v %x", sc.rids, device)
+
+	return nil
+}
+
+// handleSession deals with incoming RPC calls.  For now treat all errors as
+// critical and return which in turns shuts down the connection.
+func (z *ZKS) handleSession(kx *session.KX, version int) error {
+	rid, ok := kx.TheirIdentity().([32]byte)
+	if !ok {
+		return fmt.Errorf("invalid KX identity type %T", rid)
+	}
+	rids := hex.EncodeToString(rid[:])
+
+	// create session context
+	sc := sessionContext{
+		ntfn:       make(chan *account.Notification, tagDepth),
+		writer:     make(chan *RPCWrapper, tagDepth),
+		quit:       make(chan struct{}),
+		kx:         kx,
+		rid:        rid,
+		rids:       rids,
+		version:    version,
+		tagStack:   tagstack.NewBlocking(tagDepth),
+		tagMessage: make([]*RPCWrapper, tagDepth),
+		connected:  time.Now(),
+	}
+
 	tagBitmap := make([]bool, tagDepth) // see if there is a duplicate tag
 	go z.sessionWriter(&sc)
 	go z.sessionNtfn(&sc)
@@ -408,16 +567,35 @@ func (z *ZKS) handleSession(kx *session.KX) error {
 		// stop it all
 		close(sc.quit)
 
-		z.account.Offline(rid)
+		if !sc.online {
+			z.Dbg(idS, "handleSession exit: %v", rids)
+			return
+		}
+
+		z.account.Offline(rid, sc.device)
 
 		// mark session offline
 		z.Lock()
-		delete(z.sessions, rids)
+		if z.sessions[rids][sc.device] == &sc {
+			delete(z.sessions[rids], sc.device)
+		}
+		if len(z.sessions[rids]) == 0 {
+			delete(z.sessions, rids)
+		}
 		z.Unlock()
 
-		z.Dbg(idS, "handleSession exit: %v", rids)
+		z.Dbg(idS, "handleSession exit: %v %x", rids, sc.device)
 	}()
 
+	// Go online with the anonymous device right away so that pushes do
+	// not wait for the first command.  If the anonymous device is online
+	// already, e.g. with a phantom connection, the first command decides
+	// instead of knocking the other session offline.
+	err := z.sessionOnline(&sc, storage.DeviceID{}, false)
+	if err != nil {
+		return err
+	}
+
 	for {
 		var message rpc.Message
 
@@ -461,6 +639,62 @@ func (z *ZKS) handleSession(kx *session.KX) error {
 			message.Command,
 			message.Tag)
 
+		// A client that registers its device moves the session off
+		// the anonymous device.  A session that could not go online
+		// with the anonymous device does so now.
+		var anonymous storage.DeviceID
+		if message.Command == rpc.TaggedCmdDeviceRegister &&
+			(!sc.online || sc.getDevice() == anonymous) {
+			var r rpc.DeviceRegister
+			_, err = z.unmarshal(br, &r)
+			if err != nil {
+				return fmt.Errorf("unmarshal DeviceRegister " +
+					"failed")
+			}
+			if sc.online {
+				err = z.sessionDevice(&sc, r.Device)
+			} else {
+				err = z.sessionOnline(&sc, r.Device, true)
+			}
+			if err != nil {
+				return err
+			}
+			sc.writer <- &RPCWrapper{
+				Message: rpc.Message{
+					Command: rpc.TaggedCmdDeviceRegisterReply,
+					Tag:     message.Tag,
+				},
+				Payload: rpc.DeviceRegisterReply{},
+			}
+			tagBitmap[message.Tag] = false
+			continue
+		}
+		if !sc.online {
+			err = z.sessionOnline(&sc, anonymous, true)
+			if err != nil {
+				return err
+			}
+		}
+
+		// enforce per identity command limits
+		if z.rateLimited(rids, message.Command) {
+			sc.writer <- &RPCWrapper{
+				Message: rpc.Message{
+					Command: rpc.TaggedCmdAcknowledge,
+					Tag:     message.Tag,
+				},
+				Payload: rpc.Acknowledge{
+					Error: "rate limit exceeded, try " +
+						"again later",
+					ErrorCode: rpc.ErrorCodeRateLimited,
+				},
+			}
+			tagBitmap[message.Tag] = false
+			continue
+		}
+
+		start := time.Now()
+
 		// unmarshal payload
 		switch message.Command {
 		case rpc.TaggedCmdPing:
@@ -483,7 +717,7 @@ func (z *ZKS) handleSession(kx *session.KX) error {
 			if err != nil {
 				return fmt.Errorf("unmarshal Rendezvous failed")
 			}
-			err = z.handleRendezvous(sc.writer, message, r)
+			err = z.handleRendezvous(sc.writer, kx, message, r)
 			if err != nil {
 				return fmt.Errorf("handleRendezvous: %v", err)
 			}
@@ -491,22 +725,53 @@ func (z *ZKS) handleSession(kx *session.KX) error {
 		case rpc.TaggedCmdRendezvousPull:
 			var r rpc.RendezvousPull
 			_, err = z.unmarshal(br, &r)
-			if err != nil {
+			// Server was added to RendezvousPull after the fact,
+			// see Cache.
+			if err != nil && !rpc.ShortRead(err) {
 				return fmt.Errorf("unmarshal RendezvousPull " +
 					"failed")
 			}
-			err = z.handleRendezvousPull(sc.writer, message, r)
+			if !z.federation.Local(r.Server) {
+				go z.relayRendezvousPull(&sc, message, r)
+				break
+			}
+			err = z.handleRendezvousPull(sc.writer, kx, message, r)
 			if err != nil {
 				return fmt.Errorf("handleRendezvousPull: %v",
 					err)
 			}
 
+		case rpc.TaggedCmdRendezvousRevoke:
+			var r rpc.RendezvousRevoke
+			_, err = z.unmarshal(br, &r)
+			if err != nil {
+				return fmt.Errorf("unmarshal RendezvousRevoke " +
+					"failed")
+			}
+			err = z.handleRendezvousRevoke(sc.writer, kx, message,
+				r)
+			if err != nil {
+				return fmt.Errorf("handleRendezvousRevoke: %v",
+					err)
+			}
+
 		case rpc.TaggedCmdCache:
 			var r rpc.Cache
 			_, err = z.unmarshal(br, &r)
-			if err != nil {
+			// Special error handling because of prior upgrades
+			// where we added TTL, Server and Receipt to Cache.  A
+			// short read is therefore an error we must ignore.
+			if err != nil && !rpc.ShortRead(err) {
 				return fmt.Errorf("unmarshal Cache failed")
 			}
+			// legacy senders can't handle receipts
+			if sc.version == rpc.LegacyProtocolVersion {
+				r.Receipt = 0
+			}
+			if !z.federation.Local(r.Server) {
+				go z.relayCache(&sc, message, r)
+				break
+			}
 			err = z.handleCache(sc.writer, kx, message, r)
 			if err != nil {
 				return fmt.Errorf("handleCache: %v", err)
@@ -530,18 +795,33 @@ func (z *ZKS) handleSession(kx *session.KX) error {
 					rids)
 			}
 			// see if we have work to do
-			if m != nil && m.Message.Command == rpc.TaggedCmdPush {
-				from := kx.TheirIdentity().([32]byte)
+			if m != nil && (m.Message.Command == rpc.TaggedCmdPush ||
+				m.Message.Command == rpc.TaggedCmdNotice ||
+				m.Message.Command == rpc.TaggedCmdDeliveryReceipt) {
 				// err is reporting only
-				err = z.account.Delete(from, m.Identifier)
+				first, err := z.account.Ack(rid, sc.device,
+					m.Identifier)
 				if err != nil {
 					z.Error(idS,
-						"handleSession: %v delete "+
+						"handleSession: %v ack "+
 							"failed %v %v",
 						rids,
 						m.Identifier,
 						err)
 				}
+
+				// only the first device that acknowledges a
+				// message produces a receipt
+				p, ok := m.Payload.(rpc.Push)
+				if first && ok && m.Receipt != 0 {
+					err = z.queueReceipt(p.From, rid,
+						m.Receipt)
+					if err != nil {
+						z.Warn(idS, "could not queue "+
+							"receipt %x -> %x: %v",
+							rid, p.From, err)
+					}
+				}
 			}
 
 			// mark free
@@ -570,6 +850,17 @@ func (z *ZKS) handleSession(kx *session.KX) error {
 				return fmt.Errorf("handleIdentityFind: %v", err)
 			}
 
+		case rpc.TaggedCmdDirectory:
+			var d rpc.Directory
+			_, err = z.unmarshal(br, &d)
+			if err != nil {
+				return fmt.Errorf("unmarshal Directory failed")
+			}
+			err = z.handleDirectory(sc.writer, rid, message, d)
+			if err != nil {
+				return fmt.Errorf("handleDirectory: %v", err)
+			}
+
 		case rpc.TaggedCmdProxy:
 			var p rpc.Proxy
 			_, err = z.unmarshal(br, &p)
@@ -581,9 +872,13 @@ func (z *ZKS) handleSession(kx *session.KX) error {
 				return fmt.Errorf("handleProxy: %v", err)
 			}
 
+		case rpc.TaggedCmdDeviceRegister:
+			return fmt.Errorf("device already registered")
+
 		default:
 			return fmt.Errorf("invalid message: %v", message)
 		}
+		z.metrics.command(message.Command, time.Since(start))
 
 		tagBitmap[message.Tag] = false
 	}
@@ -592,11 +887,23 @@ func (z *ZKS) handleSession(kx *session.KX) error {
 func (z *ZKS) preSession(conn net.Conn) {
 	z.Dbg(idApp, "incoming connection: %v", conn.RemoteAddr())
 
+	inSession := false
+	outcome := handshakeFailed
 	defer func() {
+		if !inSession {
+			z.preSessionLeave(conn.RemoteAddr())
+			z.metrics.handshake(outcome)
+		}
 		conn.Close()
 		z.Info(idApp, "connection closed: %v", conn.RemoteAddr())
 	}()
 
+	// the TLS and key exchange handshakes must complete in time
+	if z.settings().PreSessionTimeout != 0 {
+		conn.SetDeadline(time.Now().Add(time.Duration(
+			z.settings().PreSessionTimeout) * time.Second))
+	}
+
 	// pre session state
 	var mode string
 	for {
@@ -610,7 +917,7 @@ func (z *ZKS) preSession(conn net.Conn) {
 		switch mode {
 		case rpc.InitialCmdIdentify:
 			z.T(idApp, "InitialCmdIdentify: %v", conn.RemoteAddr())
-			if !z.settings.AllowIdentify {
+			if !z.settings().AllowIdentify {
 				z.Warn(idApp, "disallowing identify to: %v",
 					conn.RemoteAddr())
 				return
@@ -625,6 +932,7 @@ func (z *ZKS) preSession(conn net.Conn) {
 
 			z.Dbg(idApp, "identifying self to: %v",
 				conn.RemoteAddr())
+			outcome = handshakeIdentify
 
 		case rpc.InitialCmdCreateAccount:
 			z.T(idApp, "InitialCmdCreateAccount: %v", conn.RemoteAddr())
@@ -644,15 +952,80 @@ func (z *ZKS) preSession(conn net.Conn) {
 					err)
 				return // treat as fatal
 			}
+			outcome = handshakeCreateAccount
+
+			continue
+
+		case rpc.InitialCmdSuccession:
+			z.T(idApp, "InitialCmdSuccession: %v", conn.RemoteAddr())
+			var sr rpc.SuccessionRequest
+			_, err := z.unmarshal(conn, &sr)
+			if err != nil {
+				z.Error(idApp, "could not unmarshal "+
+					"SuccessionRequest: %v",
+					conn.RemoteAddr())
+				return
+			}
+
+			_, err = xdr.Marshal(conn, z.successionReply(sr))
+			if err != nil {
+				z.Error(idApp, "could not marshal "+
+					"SuccessionReply: %v",
+					conn.RemoteAddr())
+				return
+			}
+			outcome = handshakeSuccession
 
 			continue
 
-		case rpc.InitialCmdSession:
-			z.T(idApp, "InitialCmdSession: %v", conn.RemoteAddr())
+		case rpc.InitialCmdFederate:
+			z.T(idApp, "InitialCmdFederate: %v", conn.RemoteAddr())
+			peer, kx, err := z.federation.Accept(conn)
+			if err != nil {
+				z.Warn(idApp, "federation refused: %v %v",
+					conn.RemoteAddr(), err)
+				return
+			}
+
+			z.Info(idApp, "federation link from %v peer %v",
+				conn.RemoteAddr(), peer.Address)
+
+			// handshake complete, links stay up until either side
+			// closes them
+			inSession = true
+			z.preSessionLeave(conn.RemoteAddr())
+			z.metrics.handshake(handshakeFederate)
+			conn.SetDeadline(time.Time{})
+
+			err = z.federation.Serve(peer, kx)
+			if err != nil {
+				z.Error(idApp, "federation link failed: %v %v",
+					peer.Address, err)
+			}
+			return
+
+		case rpc.InitialCmdSession, rpc.InitialCmdSessionV:
+			z.T(idApp, "InitialCmdSession: %v %v", mode,
+				conn.RemoteAddr())
+			version := rpc.LegacyProtocolVersion
+			if mode == rpc.InitialCmdSessionV {
+				var sv rpc.SessionV
+				_, err := z.unmarshal(conn, &sv)
+				if err != nil {
+					z.Error(idApp, "could not unmarshal "+
+						"SessionV: %v",
+						conn.RemoteAddr())
+					return
+				}
+				if sv.Version >= rpc.ProtocolVersion {
+					version = rpc.ProtocolVersion
+				}
+			}
+
 			// go full session
 			kx := new(session.KX)
 			kx.Conn = conn
-			kx.MaxMessageSize = uint(z.settings.MaxMsgSize)
+			kx.MaxMessageSize = uint(z.settings().MaxMsgSize)
 			kx.OurPublicKey = &z.id.Public.Key
 			kx.OurPrivateKey = &z.id.PrivateKey
 			err = kx.Respond()
@@ -674,6 +1047,7 @@ func (z *ZKS) preSession(conn net.Conn) {
 			if z.account.Disabled(remoteID) {
 				z.Warn(idApp, "disabled user identity: %v %x",
 					conn.RemoteAddr(), remoteID)
+				outcome = handshakeDisabled
 				err = z.unwelcome(kx, "administrator has "+
 					"disabled your account")
 				if err != nil {
@@ -684,24 +1058,41 @@ func (z *ZKS) preSession(conn net.Conn) {
 			}
 
 			if !z.account.Enabled(remoteID) {
+				outcome = handshakeUnknown
 				z.Warn(idApp, "unknown identity: %v %x",
 					conn.RemoteAddr(), remoteID)
 				return
 			}
 
+			if z.isDraining() {
+				err = z.unwelcome(kx, shutdownReason)
+				if err != nil {
+					z.Error(idApp, "unwelcome failed: %v %v",
+						conn.RemoteAddr(), err)
+				}
+				return
+			}
+
 			z.Info(idApp, "connection from %v identity %x",
 				conn.RemoteAddr(), remoteID)
 
 			// send welcome
-			err = z.welcome(kx)
+			err = z.welcome(kx, version)
 			if err != nil {
 				z.Error(idApp, "welcome failed: %v %v",
 					conn.RemoteAddr(),
 					err)
 			}
 
+			// handshake complete, the session enforces its own
+			// deadlines
+			inSession = true
+			z.preSessionLeave(conn.RemoteAddr())
+			z.metrics.handshake(handshakeSession)
+			conn.SetDeadline(time.Time{})
+
 			// at this point we are going to use tags
-			err = z.handleSession(kx)
+			err = z.handleSession(kx, version)
 			if err != nil {
 				z.Error(idApp, "handleSession failed: %v %v",
 					conn.RemoteAddr(),
@@ -741,7 +1132,7 @@ func (z *ZKS) socketHandler(c net.Conn) {
 		z.Dbg(idSock, "command: %v", sc)
 
 		je := json.NewEncoder(c) // prepare reply writer
-		var reply interface{}
+		var request, reply interface{}
 
 		// Read expected command
 		switch sc.Command {
@@ -757,14 +1148,17 @@ func (z *ZKS) socketHandler(c net.Conn) {
 			z.Dbg(idSock, "user disable %v", spew.Sdump(jud))
 
 			// write reply
+			request = jud
 			reply = z.handleIdentityDisable(jud)
 
-			// knock user offline
+			// knock all devices of user offline
 			z.Lock()
-			if sc, ok := z.sessions[jud.Identity]; ok {
-				z.Dbg(idSock, "user disconnected %s",
-					jud.Identity)
+			for device, sc := range z.sessions[jud.Identity] {
+				z.Dbg(idSock, "user disconnected %s %x",
+					jud.Identity, device)
 				sc.kx.Close()
+				z.auditDisconnect(socketapi.SCUserDisable,
+					jud.Identity, device)
 			}
 			z.Unlock()
 
@@ -780,13 +1174,226 @@ func (z *ZKS) socketHandler(c net.Conn) {
 			z.Dbg(idSock, "user enable %v", spew.Sdump(jue))
 
 			// write reply
+			request = jue
 			reply = z.handleIdentityEnable(jue)
 
+		case socketapi.SCSessionList:
+			var jsl socketapi.SocketCommandSessionList
+			err := jr.Decode(&jsl)
+			if err != nil {
+				// abort on any error
+				z.Dbg(idSock, "SocketCommandSessionList: %v",
+					err)
+				return
+			}
+			z.Dbg(idSock, "session list")
+
+			// write reply
+			request = jsl
+			reply = z.handleSessionList(jsl)
+
+		case socketapi.SCSessionKick:
+			var jsk socketapi.SocketCommandSessionKick
+			err := jr.Decode(&jsk)
+			if err != nil {
+				// abort on any error
+				z.Dbg(idSock, "SocketCommandSessionKick: %v",
+					err)
+				return
+			}
+			z.Dbg(idSock, "session kick %v", spew.Sdump(jsk))
+
+			// write reply
+			request = jsk
+			reply = z.handleSessionKick(jsk)
+
+		case socketapi.SCTokenCreate:
+			var jtc socketapi.SocketCommandTokenCreate
+			err := jr.Decode(&jtc)
+			if err != nil {
+				// abort on any error
+				z.Dbg(idSock, "SocketCommandTokenCreate: %v",
+					err)
+				return
+			}
+			z.Dbg(idSock, "token create %v", spew.Sdump(jtc))
+
+			// write reply
+			request = jtc
+			reply = z.handleTokenCreate(jtc)
+
+		case socketapi.SCTokenList:
+			var jtl socketapi.SocketCommandTokenList
+			err := jr.Decode(&jtl)
+			if err != nil {
+				// abort on any error
+				z.Dbg(idSock, "SocketCommandTokenList: %v",
+					err)
+				return
+			}
+			z.Dbg(idSock, "token list")
+
+			// write reply
+			request = jtl
+			reply = z.handleTokenList(jtl)
+
+		case socketapi.SCTokenRevoke:
+			var jtr socketapi.SocketCommandTokenRevoke
+			err := jr.Decode(&jtr)
+			if err != nil {
+				// abort on any error
+				z.Dbg(idSock, "SocketCommandTokenRevoke: %v",
+					err)
+				return
+			}
+			z.Dbg(idSock, "token revoke %v", spew.Sdump(jtr))
+
+			// write reply
+			request = jtr
+			reply = z.handleTokenRevoke(jtr)
+
+		case socketapi.SCUserPurge:
+			var jup socketapi.SocketCommandUserPurge
+			err := jr.Decode(&jup)
+			if err != nil {
+				// abort on any error
+				z.Dbg(idSock, "SocketCommandUserPurge: %v",
+					err)
+				return
+			}
+			z.Dbg(idSock, "user purge %v", spew.Sdump(jup))
+
+			// write reply
+			request = jup
+			reply = z.handleIdentityPurge(jup)
+
+		case socketapi.SCUserNick:
+			var jun socketapi.SocketCommandUserNick
+			err := jr.Decode(&jun)
+			if err != nil {
+				// abort on any error
+				z.Dbg(idSock, "SocketCommandUserNick: %v",
+					err)
+				return
+			}
+			z.Dbg(idSock, "user nick %v", spew.Sdump(jun))
+
+			// write reply
+			request = jun
+			reply = z.handleIdentityNick(jun)
+
+		case socketapi.SCDirectoryList:
+			var jdl socketapi.SocketCommandDirectoryList
+			err := jr.Decode(&jdl)
+			if err != nil {
+				// abort on any error
+				z.Dbg(idSock, "SocketCommandDirectoryList: %v",
+					err)
+				return
+			}
+			z.Dbg(idSock, "directory list %v", spew.Sdump(jdl))
+
+			// write reply
+			request = jdl
+			reply = z.handleDirectoryList(jdl)
+
+		case socketapi.SCDirectoryUnlist:
+			var jdu socketapi.SocketCommandDirectoryUnlist
+			err := jr.Decode(&jdu)
+			if err != nil {
+				// abort on any error
+				z.Dbg(idSock, "SocketCommandDirectoryUnlist: %v",
+					err)
+				return
+			}
+			z.Dbg(idSock, "directory unlist %v", spew.Sdump(jdu))
+
+			// write reply
+			request = jdu
+			reply = z.handleDirectoryUnlist(jdu)
+
+		case socketapi.SCNotice:
+			var jn socketapi.SocketCommandNotice
+			err := jr.Decode(&jn)
+			if err != nil {
+				// abort on any error
+				z.Dbg(idSock, "SocketCommandNotice: %v",
+					err)
+				return
+			}
+			z.Dbg(idSock, "notice %v", spew.Sdump(jn))
+
+			// write reply
+			request = jn
+			reply = z.handleNotice(jn)
+
+		case socketapi.SCReload:
+			var jrl socketapi.SocketCommandReload
+			err := jr.Decode(&jrl)
+			if err != nil {
+				// abort on any error
+				z.Dbg(idSock, "SocketCommandReload: %v",
+					err)
+				return
+			}
+			z.Dbg(idSock, "reload %v", spew.Sdump(jrl))
+
+			// write reply
+			request = jrl
+			reply = z.handleReload(jrl)
+
+		case socketapi.SCCertStage:
+			var jcs socketapi.SocketCommandCertStage
+			err := jr.Decode(&jcs)
+			if err != nil {
+				// abort on any error
+				z.Dbg(idSock, "SocketCommandCertStage: %v",
+					err)
+				return
+			}
+			z.Dbg(idSock, "cert stage %v", spew.Sdump(jcs))
+
+			// write reply
+			request = jcs
+			reply = z.handleCertStage(jcs)
+
+		case socketapi.SCCertRotate:
+			var jcr socketapi.SocketCommandCertRotate
+			err := jr.Decode(&jcr)
+			if err != nil {
+				// abort on any error
+				z.Dbg(idSock, "SocketCommandCertRotate: %v",
+					err)
+				return
+			}
+			z.Dbg(idSock, "cert rotate %v", spew.Sdump(jcr))
+
+			// write reply
+			request = jcr
+			reply = z.handleCertRotate(jcr)
+
+		case socketapi.SCBackup:
+			var jb socketapi.SocketCommandBackup
+			err := jr.Decode(&jb)
+			if err != nil {
+				// abort on any error
+				z.Dbg(idSock, "SocketCommandBackup: %v", err)
+				return
+			}
+			reply = z.handleBackup(jb)
+
+			// never record the passphrase
+			jb.Passphrase = ""
+			z.Dbg(idSock, "backup %v", spew.Sdump(jb))
+			request = jb
+
 		default:
 			z.Error(idSock, "invalid command: %v", sc.Command)
 			return
 		}
 
+		z.auditSocket(sc.Command, request, reply)
+
 		// write reply
 		z.Dbg(idSock, "reply:%v", spew.Sdump(reply))
 		err = je.Encode(reply)
@@ -800,7 +1407,7 @@ func (z *ZKS) socketHandler(c net.Conn) {
 func (z *ZKS) listenSocket() error {
 	var (
 		err      error
-		SockAddr = filepath.Join(z.settings.Root, socketapi.SocketFilename)
+		SockAddr = filepath.Join(z.settings().Root, socketapi.SocketFilename)
 	)
 	z.socket, err = net.Listen("unix", SockAddr)
 	if err != nil {
@@ -822,63 +1429,121 @@ func (z *ZKS) listenSocket() error {
 	return nil
 }
 
+// listen opens all configured listeners and accepts client connections on
+// them.
 func (z *ZKS) listen() error {
-	cert, err := tls.LoadX509KeyPair(filepath.Join(z.settings.Root,
-		tools.ZKSCertFilename),
-		filepath.Join(z.settings.Root, tools.ZKSKeyFilename))
-	if err != nil {
-		return fmt.Errorf("could not load certificates: %v", err)
-	}
-	config := tls.Config{
-		Certificates: []tls.Certificate{cert},
-		MinVersion:   tls.VersionTLS12,
+	config := &tls.Config{
+		GetCertificate: z.getCertificate,
+		MinVersion:     tls.VersionTLS12,
 		CipherSuites: []uint16{
 			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
 		},
 	}
-	l, err := net.Listen("tcp", z.settings.Listen)
-	if err != nil {
-		return fmt.Errorf("could not listen: %v", err)
-	}
-	z.Info(idApp, "Listening on %v", z.settings.Listen)
 
 	session.Init()
 
-	go func() {
-		for {
-			conn, err := l.Accept()
-			if err != nil {
-				z.Error(idApp, "Accept: %v", err)
-				continue
+	for _, l := range z.settings().Listen {
+		// a stale socket is left behind if the server crashed
+		if l.Network == "unix" {
+			fi, err := os.Stat(l.Address)
+			if err == nil && fi.Mode()&os.ModeSocket != 0 {
+				os.Remove(l.Address)
 			}
-			conn.(*net.TCPConn).SetKeepAlive(true)
-			go z.preSession(tls.Server(conn, &config))
 		}
-	}()
+		listener, err := net.Listen(l.Network, l.Address)
+		if err != nil {
+			return fmt.Errorf("could not listen on %v: %v", l, err)
+		}
+		z.Lock()
+		z.listeners = append(z.listeners, listener)
+		z.Unlock()
+		z.Info(idApp, "Listening on %v", l)
+
+		go z.accept(listener, l.Proxy, config)
+	}
 
 	return nil
 }
 
+// accept hands the connections of listener to the pre-session phase.  If
+// proxy is set every connection must start with a PROXY protocol header that
+// announces the address of the client.
+func (z *ZKS) accept(listener net.Listener, proxy bool, config *tls.Config) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if z.isDraining() {
+				return
+			}
+			z.Error(idApp, "Accept: %v", err)
+			continue
+		}
+		if tc, ok := conn.(*net.TCPConn); ok {
+			tc.SetKeepAlive(true)
+		}
+		if proxy {
+			go z.acceptProxy(conn, config)
+			continue
+		}
+		z.acceptConn(conn, config)
+	}
+}
+
+// acceptProxy reads the PROXY protocol header of conn before it is accounted
+// for, so that the pre-session limits apply to the address of the client
+// instead of the load balancer.
+func (z *ZKS) acceptProxy(conn net.Conn, config *tls.Config) {
+	if z.settings().PreSessionTimeout != 0 {
+		conn.SetDeadline(time.Now().Add(time.Duration(
+			z.settings().PreSessionTimeout) * time.Second))
+	}
+	pc, err := proxyproto.NewConn(conn)
+	if err != nil {
+		z.Warn(idApp, "refusing connection %v: %v", conn.RemoteAddr(),
+			err)
+		conn.Close()
+		return
+	}
+	z.Dbg(idApp, "proxied connection %v via %v", pc.RemoteAddr(),
+		conn.RemoteAddr())
+	z.acceptConn(pc, config)
+}
+
+// acceptConn starts the pre-session phase of conn unless it exceeds the
+// pre-session limits.
+func (z *ZKS) acceptConn(conn net.Conn, config *tls.Config) {
+	if !z.preSessionEnter(conn.RemoteAddr()) {
+		z.metrics.handshake(handshakeRefused)
+		z.Warn(idApp, "too many handshakes, refusing connection: %v",
+			conn.RemoteAddr())
+		conn.Close()
+		return
+	}
+	go z.preSession(tls.Server(conn, config))
+}
+
 func _main() error {
 	z := &ZKS{
-		sessions: make(map[string]*sessionContext),
+		sessions:        make(map[string]map[storage.DeviceID]*sessionContext),
+		preSessionConns: make(map[string]uint64),
 	}
 
 	// flags and settings
-	var err error
-	z.settings, err = ObtainSettings()
+	s, filename, err := ObtainSettings()
 	if err != nil {
 		return err
 	}
+	z.config.Store(s)
+	z.configFile = filename
 
 	// create paths
-	err = os.MkdirAll(z.settings.Root, 0700)
+	err = os.MkdirAll(z.settings().Root, 0700)
 	if err != nil {
 		return err
 	}
 
 	// handle logging
-	z.Debug, err = debug.New(z.settings.LogFile, z.settings.TimeFormat)
+	z.Debug, err = debug.New(z.settings().LogFile, z.settings().TimeFormat)
 	if err != nil {
 		return err
 	}
@@ -894,7 +1559,7 @@ func _main() error {
 		zkutil.Version(), rpc.ProtocolVersion)
 
 	// identity
-	id, err := ioutil.ReadFile(filepath.Join(z.settings.Root,
+	id, err := ioutil.ReadFile(filepath.Join(z.settings().Root,
 		tools.ZKSIdentityFilename))
 	if err != nil {
 		z.Info(idApp, "Creating a new identity")
@@ -906,7 +1571,7 @@ func _main() error {
 		if err != nil {
 			return err
 		}
-		err = ioutil.WriteFile(filepath.Join(z.settings.Root,
+		err = ioutil.WriteFile(filepath.Join(z.settings().Root,
 			tools.ZKSIdentityFilename), id, 0600)
 		if err != nil {
 			return err
@@ -917,10 +1582,28 @@ func _main() error {
 		return err
 	}
 
+	// identities this server succeeded
+	err = z.loadSuccessions()
+	if err != nil {
+		return err
+	}
+
+	// audit log
+	z.auditLog, err = audit.Open(z.settings().AuditLog, z.id,
+		tools.Predecessors(z.successions)...)
+	if err != nil {
+		return fmt.Errorf("could not open audit log: %v", err)
+	}
+	defer z.auditLog.Close()
+	if torn := z.auditLog.Torn(); torn != 0 {
+		z.Warn(idApp, "Removed incomplete last entry from audit log: "+
+			"%v bytes", torn)
+	}
+
 	// certs
-	cert, err := tls.LoadX509KeyPair(filepath.Join(z.settings.Root,
+	cert, err := tls.LoadX509KeyPair(filepath.Join(z.settings().Root,
 		tools.ZKSCertFilename),
-		filepath.Join(z.settings.Root, tools.ZKSKeyFilename))
+		filepath.Join(z.settings().Root, tools.ZKSKeyFilename))
 	if err != nil {
 		// create a new cert
 		valid := time.Date(2049, 12, 31, 23, 59, 59, 0, time.UTC)
@@ -931,12 +1614,12 @@ func _main() error {
 		}
 
 		// save on disk
-		err = ioutil.WriteFile(filepath.Join(z.settings.Root,
+		err = ioutil.WriteFile(filepath.Join(z.settings().Root,
 			tools.ZKSCertFilename), cp, 0600)
 		if err != nil {
 			return fmt.Errorf("could not save cert: %v", err)
 		}
-		err = ioutil.WriteFile(filepath.Join(z.settings.Root,
+		err = ioutil.WriteFile(filepath.Join(z.settings().Root,
 			tools.ZKSKeyFilename), kp, 0600)
 		if err != nil {
 			return fmt.Errorf("could not save key: %v", err)
@@ -948,23 +1631,33 @@ func _main() error {
 		}
 	}
 
+	next, err := z.loadNextCert()
+	if err != nil {
+		return fmt.Errorf("could not load staged cert: %v", err)
+	}
+	z.setCerts(cert, next)
+
 	z.Info(idApp, "Start of day")
-	z.Info(idApp, "Settings %v", spew.Sdump(z.settings))
+	z.Info(idApp, "Settings %v", spew.Sdump(z.settings()))
 	defer z.Info(idApp, "End of times")
 	z.Info(idApp, "Our outer fingerprint: %v", tools.FingerprintDER(cert))
 	z.Info(idApp, "Our inner fingerprint: %v", z.id.Public.Fingerprint())
+	if next != nil {
+		z.Info(idApp, "Staged outer fingerprint: %v",
+			tools.FingerprintDER(*next))
+	}
 
 	// debugging
-	if z.settings.Debug {
+	if z.settings().Debug {
 		z.Info(idApp, "Debug enabled")
 		z.EnableDebug()
-		if z.settings.Profiler != "" {
+		if z.settings().Profiler != "" {
 			z.Info(idApp, "Profiler enabled on http://%v/debug/pprof",
-				z.settings.Profiler)
-			go http.ListenAndServe(z.settings.Profiler, nil)
+				z.settings().Profiler)
+			go http.ListenAndServe(z.settings().Profiler, nil)
 		}
 
-		if z.settings.Trace {
+		if z.settings().Trace {
 			z.Info(idApp, "Trace enabled")
 			z.EnableTrace()
 		}
@@ -972,14 +1665,53 @@ func _main() error {
 
 	// launch account service
 	z.Info(idApp, "Account subsystem bringup started")
-	z.account, err = account.New(z.settings.Users)
+	z.store, err = storage.NewFilesystem(z.settings().Users,
+		z.settings().Root)
+	if err != nil {
+		return err
+	}
+	z.account, err = account.New(z.store)
 	if err != nil {
 		return err
 	}
+	for _, v := range z.account.Unindexed() {
+		z.Warn(idApp, "Skipping unreadable user %x: %v", v.Identity,
+			v.Err)
+	}
+	z.setAccountPolicy(z.settings())
+	go z.mailboxJanitor()
 	z.Info(idApp, "Account subsystem bringup complete")
 
+	// relay messages to and from peers
+	z.federation, err = z.newFederation()
+	if err != nil {
+		return fmt.Errorf("could not setup federation: %v", err)
+	}
+
+	// launch rendezvous pruner
+	z.rendezvousFailures = ratelimit.New(
+		z.settings().RendezvousPullFailures, time.Hour)
+	z.rendezvousFailuresGlobal = ratelimit.New(
+		z.settings().RendezvousPullFailuresGlobal, time.Hour)
+	go z.rendezvousPruner()
+
+	// per identity command limits
+	z.commandLimits = z.newCommandLimits()
+
+	// metrics
+	z.metrics = z.newMetrics()
+	if z.settings().Metrics != "" {
+		z.listenMetrics()
+	}
+
+	// account creation attempts per address and server wide
+	z.createLimit = ratelimit.New(z.settings().PreSessionCreateAccounts,
+		time.Hour)
+	z.createLimitTotal = ratelimit.New(
+		z.settings().PreSessionCreateAccountsGlobal, time.Hour)
+
 	// Setup unix domain socket
-	err = os.RemoveAll(filepath.Join(z.settings.Root,
+	err = os.RemoveAll(filepath.Join(z.settings().Root,
 		socketapi.SocketFilename))
 	if err != nil {
 		return err
@@ -995,17 +1727,25 @@ func _main() error {
 		return err
 	}
 
-	// wait for termination signals
+	// wait for termination signals, SIGHUP reloads the configuration
 	sigs := make(chan os.Signal, 1)
 	done := make(chan bool, 1)
-	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
 
 	go func() {
-		<-sigs
-		done <- true
+		for sig := range sigs {
+			if sig == syscall.SIGHUP {
+				z.reloadSignal()
+				continue
+			}
+			z.audit(audit.KindSignal, "shutdown", sig.String(), "ok")
+			done <- true
+			return
+		}
 	}()
 
 	<-done
+	z.shutdown()
 
 	return nil
 }